@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/xml"
 	"fmt"
+	"io/ioutil"
 	"strconv"
 )
 
@@ -16,9 +17,30 @@ type BrewController struct {
 	Equipment  []EquipmentConfig `xml:"equipment>equip"`
 	Sensors    []SensorConfig    `xml:"sensors>sensor"`
 	Actors     []ActorsConfig    `xml:"actors>actor"`
+	Users      []UserConfig      `xml:"users>user"`
+	Plugins    []PluginConfig    `xml:"plugins>plugin"`
 	Properties []PropertyConfig  `xml:"properties>property"`
 }
 
+// PluginConfig is an executable providing sensor and actor types.
+// The controller starts it and talks to it over stdin/stdout
+type PluginConfig struct {
+	XMLName xml.Name `xml:"plugin"`
+	Name    string   `xml:"name"`
+	Path    string   `xml:"path"`
+	Args    []string `xml:"args>arg"`
+}
+
+// UserConfig is a user allowed to access the web server.
+// Password is stored as bcrypt hash and Token as sha256 hash of the API token
+type UserConfig struct {
+	XMLName  xml.Name `xml:"user"`
+	Name     string   `xml:"name"`
+	Role     string   `xml:"role"`
+	Password string   `xml:"password,omitempty"`
+	Token    string   `xml:"token,omitempty"`
+}
+
 // EquipmentConfig is a kettle, mashtun, etc.
 // reads values from sensors and sets the actors
 type EquipmentConfig struct {
@@ -65,6 +87,28 @@ type PropertyConfig struct {
 	Value   string   `xml:",chardata"`
 }
 
+// LoadConfiguration reads configuration file
+func LoadConfiguration(fileName string) (*BrewController, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	brewController := new(BrewController)
+	if err := xml.Unmarshal(buf, brewController); err != nil {
+		return nil, err
+	}
+	return brewController, nil
+}
+
+// SaveConfiguration writes configuration file
+func SaveConfiguration(fileName string, brewController *BrewController) error {
+	buf, err := xml.MarshalIndent(brewController, "", "   ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, buf, 0600)
+}
+
 func DefaultEquipment(dummy bool) ([]EquipmentConfig, error) {
 	eq := []EquipmentConfig{}
 
@@ -139,15 +183,60 @@ func DefaultSensorConfig(adrs []uint64, dummy bool) ([]SensorConfig, error) {
 
 // DefaultConfiguration Creates a default configuration object
 func DefaultConfiguration(adrs []uint64, relayGPIO []string, ssrGPIO []string, dummy bool) (BrewController, error) {
-	brewController := BrewController{}
+	brewController := BrewController{Name: "brewbrat", Version: "1.0"}
 	var err error
 	brewController.Buzzers, err = DefaultBuzzerConfig(dummy)
 	brewController.Sensors, err = DefaultSensorConfig(adrs, dummy)
 	brewController.Actors, err = DefaultRelayConfig(relayGPIO, ssrGPIO, dummy)
 	brewController.Equipment, err = DefaultEquipment(dummy)
+	brewController.Properties, err = DefaultProperties()
 	return brewController, err
 }
 
+// DefaultProperties returns controller wide properties like MQTT broker settings
+func DefaultProperties() ([]PropertyConfig, error) {
+	return []PropertyConfig{
+		{Name: "MQTT Enabled", Type: "bool", Hidden: false, Value: "false", Comment: "Publish state and accept commands over MQTT", Choice: ""},
+		{Name: "MQTT Broker", Type: "string", Hidden: false, Value: "tcp://127.0.0.1:1883", Comment: "MQTT broker URL", Choice: ""},
+		{Name: "MQTT Client ID", Type: "string", Hidden: false, Value: "brewbrat", Comment: "MQTT client ID", Choice: ""},
+		{Name: "MQTT Username", Type: "string", Hidden: false, Value: "", Comment: "MQTT user name", Choice: ""},
+		{Name: "MQTT Password", Type: "string", Hidden: true, Value: "", Comment: "MQTT password", Choice: ""},
+		{Name: "MQTT Topic", Type: "string", Hidden: false, Value: "brewbrat", Comment: "Root of MQTT topic tree", Choice: ""},
+		{Name: "MQTT QoS", Type: "int", Hidden: false, Value: "0", Comment: "MQTT quality of service (0, 1 or 2)", Choice: "", Select: "0,1,2"},
+		{Name: "MQTT Retain", Type: "bool", Hidden: false, Value: "true", Comment: "Retain published state messages", Choice: ""},
+		{Name: "HA Discovery", Type: "bool", Hidden: false, Value: "false", Comment: "Publish Home Assistant MQTT discovery", Choice: ""},
+		{Name: "HA Discovery Prefix", Type: "string", Hidden: false, Value: "homeassistant", Comment: "Home Assistant discovery topic prefix", Choice: ""},
+		{Name: "Web Address", Type: "string", Hidden: false, Value: "0.0.0.0", Comment: "Address web server listens on", Choice: ""},
+		{Name: "Web Port", Type: "int", Hidden: false, Value: "8090", Comment: "Port web server listens on", Choice: ""},
+		{Name: "Web Assets", Type: "string", Hidden: false, Value: "", Comment: "Directory of web UI files. Empty uses files built into controller", Choice: ""},
+		{Name: "Web TLS Cert", Type: "string", Hidden: false, Value: "", Comment: "TLS certificate file. Serves https when cert and key are set", Choice: ""},
+		{Name: "Web TLS Key", Type: "string", Hidden: false, Value: "", Comment: "TLS private key file", Choice: ""},
+		{Name: "Web Authentication", Type: "bool", Hidden: false, Value: "true", Comment: "Require login or API token to use web server", Choice: ""},
+		{Name: "Web CORS Origins", Type: "string", Hidden: false, Value: "", Comment: "Comma separated origins allowed to call web API from other sites", Choice: ""},
+		{Name: "Log Console Format", Type: "string", Hidden: false, Value: "text", Comment: "Format of log on stdout: text, json or journal (systemd)", Choice: "", Select: "text,json,journal"},
+		{Name: "Log File", Type: "string", Hidden: false, Value: "", Comment: "Log file. Empty disables logging to file", Choice: ""},
+		{Name: "Log File Format", Type: "string", Hidden: false, Value: "text", Comment: "Format of log file: text or json", Choice: "", Select: "text,json"},
+		{Name: "Log File Level", Type: "string", Hidden: false, Value: "message", Comment: "Messages written to log file: all, message, warning or error", Choice: "", Select: "all,message,warning,error"},
+		{Name: "Log File Max Size", Type: "int", Hidden: false, Value: "10", Comment: "Log file is rotated when larger than this size in MB. 0 disables", Choice: ""},
+		{Name: "Log File Rotate Hours", Type: "int", Hidden: false, Value: "24", Comment: "Log file is rotated every number of hours. 0 disables", Choice: ""},
+		{Name: "Log File Keep", Type: "int", Hidden: false, Value: "7", Comment: "Number of rotated log files kept", Choice: ""},
+		{Name: "Log Buffer Size", Type: "int", Hidden: false, Value: "1000", Comment: "Number of log messages kept in memory for the web UI. 0 disables", Choice: ""},
+		{Name: "Log Syslog", Type: "bool", Hidden: false, Value: "false", Comment: "Send log to syslog", Choice: ""},
+		{Name: "Syslog Address", Type: "string", Hidden: false, Value: "", Comment: "Syslog server as udp://host:514 or tcp://host:514. Empty uses local syslog", Choice: ""},
+		{Name: "Syslog Tag", Type: "string", Hidden: false, Value: "brewbrat", Comment: "Syslog tag of messages", Choice: ""},
+		{Name: "Syslog Level", Type: "string", Hidden: false, Value: "message", Comment: "Messages sent to syslog: all, message, warning or error", Choice: "", Select: "all,message,warning,error"},
+		{Name: "Usage File", Type: "string", Hidden: false, Value: "usage.json", Comment: "File keeping switch cycles, on-time and energy of actors. Empty keeps them in memory", Choice: ""},
+		{Name: "Energy Price", Type: "float", Hidden: false, Value: "0", Comment: "Cost of one kWh used to show energy cost of actors", Choice: ""},
+		{Name: "Alarm History", Type: "int", Hidden: false, Value: "100", Comment: "Number of ended alarms kept in memory", Choice: ""},
+		{Name: "Alarm Buzzer", Type: "string", Hidden: false, Value: "Main Buzzer", Comment: "Buzzer sounding alarms. Empty disables", Choice: ""},
+		{Name: "Alarm Actor", Type: "string", Hidden: false, Value: "", Comment: "Actor switched on while an alarm is not acknowledged, e.g. a beacon. Empty disables", Choice: ""},
+		{Name: "Alarm Actor Severity", Type: "string", Hidden: false, Value: "warning", Comment: "Lowest severity of alarms switching Alarm Actor", Choice: "", Select: "info,warning,critical"},
+		{Name: "Alarm MQTT", Type: "bool", Hidden: false, Value: "true", Comment: "Publish alarms to MQTT topics <MQTT Topic>/alarm/<source>/<condition>", Choice: ""},
+		{Name: "Alarm Sensor Timeout", Type: "int", Hidden: false, Value: "30", Comment: "Seconds without a sensor reading that raise a sensor fault alarm. 0 disables", Choice: ""},
+		{Name: "Timer File", Type: "string", Hidden: false, Value: "timers.json", Comment: "File keeping timed actions of equipment. Empty keeps them in memory", Choice: ""},
+	}, nil
+}
+
 // DefaultRelayConfig is temp code to return initial relay devices for demo
 func DefaultRelayConfig(relayGPIO []string, ssrGPIO []string, dummy bool) ([]ActorsConfig, error) {
 	relayDefined := []ActorsConfig{}
@@ -1,12 +1,19 @@
 package control
 
 import (
-	"../config"
+	"fmt"
+	"strings"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
 	"periph.io/x/periph/conn/gpio"
-	"periph.io/x/periph/conn/gpio/gpioreg"
-	"periph.io/x/periph/host"
 )
 
+func init() {
+	mustRegister(KindActor, "SimpleRelay", func() IDevice { return new(SimpleRelay) }, "Relay on a GPIO pin. Active low unless Polarity is set")
+	mustRegister(KindActor, "SimpleSSR", func() IDevice { return new(SimpleSSR) }, "Solid state relay on a GPIO pin. Active high unless Polarity is set")
+	mustRegister(KindActor, "DummyRelay", func() IDevice { return new(DummyRelay) }, "Simulated relay without hardware")
+}
+
 type ActorDefinition struct {
 	Name       string
 	Type       string
@@ -20,6 +27,8 @@ type IActor interface {
 	SetPower(power int) error
 	GetState() DeviceState
 	GetPowerLevel() int
+	HasPowerControl() bool
+	GetWatts() float64
 }
 
 const (
@@ -27,22 +36,34 @@ const (
 	StateOn  = 1
 )
 
+// Polarity of GPIO actors is the pin level that turns the actor on
+const (
+	PolarityActiveHigh = "Active High"
+	PolarityActiveLow  = "Active Low"
+)
+
 type Actor struct {
 	Device
-	state DeviceState
-	power int
-	GPIO  string
-	Pin   gpio.PinIO
+	state        DeviceState
+	power        int
+	powerControl bool
+	watts        float64
+	GPIO         string
+	Pin          gpio.PinIO
 }
 
 func (act *Actor) Init(name string, logger *Logger, properties []Property) error {
+	act.DevKind = KindActor
 	act.Device.Init(name, logger, properties)
 
 	props := act.GetProperties()
+	act.powerControl = props.InitProperty("Power Control", "bool", false, "Actor accepts a power level 0-100").(bool)
+	act.watts = props.InitProperty("Watts", "float", 0.0, "Power used when on, e.g. heating element wattage. Used to count energy").(float64)
 	gpio, ok := props.GetProperty("GPIO")
 	if ok {
-		act.Pin = gpioreg.ByName(gpio.Value.(string))
-		act.LogDebug("Set '%s' to '%s'", gpio.Name, gpio.Value.(string))
+		act.GPIO = gpio.Value.(string)
+		act.Pin = act.hw.PinByName(act.GPIO)
+		act.LogDebug("Set '%s' to '%s'", gpio.Name, act.GPIO)
 	}
 	return nil
 }
@@ -50,11 +71,31 @@ func (act *Actor) Init(name string, logger *Logger, properties []Property) error
 func (sen *Actor) GetDefaultsConfig() ([]config.PropertyConfig, error) {
 	return []config.PropertyConfig{
 		{Name: "Name", Type: "string", Hidden: true, Value: "Relay 2", Comment: "relay Name", Choice: ""},
-		{Name: "GPIO", Type: "string", Hidden: false, Value: "P1_40", Comment: "GPIO by name", Choice: "", Select: "P1_36,P1_38,P1_40"},
+		{Name: "GPIO", Type: "string", Hidden: false, Value: "GPIO21", Comment: "GPIO by name", Choice: "", Select: gpioPins()},
+		{Name: "Power Control", Type: "bool", Hidden: false, Value: "false", Comment: "Actor accepts a power level 0-100", Choice: ""},
+		{Name: "Watts", Type: "float", Hidden: false, Value: "0", Comment: "Power used when on, e.g. heating element wattage. Used to count energy", Choice: ""},
 	}, nil
 
 }
 
+// gpioDefaultsConfig returns default properties of actors switching a GPIO pin
+func gpioDefaultsConfig(props []config.PropertyConfig, polarity string) []config.PropertyConfig {
+	return append(props,
+		config.PropertyConfig{Name: "Polarity", Type: "string", Hidden: false, Value: polarity, Comment: "Pin level that turns actor on", Choice: "", Select: PolarityActiveHigh + "," + PolarityActiveLow},
+		config.PropertyConfig{Name: "Default State", Type: "string", Hidden: false, Value: "Off", Comment: "State set when controller starts and stops", Choice: "", Select: "Off,On"},
+		config.PropertyConfig{Name: "Open Drain", Type: "bool", Hidden: false, Value: "false", Comment: "Release pin instead of driving it high", Choice: ""},
+	)
+}
+
+// gpioPins lists GPIO names of the Raspberry Pi header used for Select of GPIO properties
+func gpioPins() string {
+	pins := []string{}
+	for i := 2; i <= 27; i++ {
+		pins = append(pins, fmt.Sprintf("GPIO%d", i))
+	}
+	return strings.Join(pins, ",")
+}
+
 func (act *Actor) On() error {
 	return nil
 }
@@ -76,6 +117,16 @@ func (act *Actor) GetState() DeviceState {
 	return act.state
 }
 
+// HasPowerControl returns true if actor accepts a power level and not only On/Off
+func (act *Actor) HasPowerControl() bool {
+	return act.powerControl
+}
+
+// GetWatts returns power used when actor is on at full power
+func (act *Actor) GetWatts() float64 {
+	return act.watts
+}
+
 type DummyRelay struct {
 	Actor
 }
@@ -103,73 +154,125 @@ func (rel *DummyRelay) Off() error {
 	return nil
 }
 
-type SimpleRelay struct {
+// GPIOActor switches a GPIO pin. Polarity sets the pin level that turns it on.
+// With Open Drain the pin is only driven low and is released for high, leaving the level to the pull-up of the board
+type GPIOActor struct {
 	Actor
+	activeLow    bool
+	openDrain    bool
+	defaultState DeviceState
 }
 
-func (rel *SimpleRelay) OnStart() error {
-
-	if _, err := host.Init(); err != nil {
+// initGPIO initializes actor and checks its pin exists. polarity is the default of the Polarity property
+func (act *GPIOActor) initGPIO(name string, logger *Logger, properties []Property, polarity string) error {
+	if err := act.Actor.Init(name, logger, properties); err != nil {
 		return err
 	}
 
-	rel.Off()
+	props := act.GetProperties()
+	switch pol := props.InitProperty("Polarity", "string", polarity, "Pin level that turns actor on").(string); pol {
+	case PolarityActiveHigh:
+		act.activeLow = false
+	case PolarityActiveLow:
+		act.activeLow = true
+	default:
+		return fmt.Errorf("actor '%s' has unknown polarity '%s'", name, pol)
+	}
 
-	return nil
-}
+	switch state := props.InitProperty("Default State", "string", "Off", "State set when controller starts and stops").(string); state {
+	case "Off":
+		act.defaultState = StateOff
+	case "On":
+		act.defaultState = StateOn
+	default:
+		return fmt.Errorf("actor '%s' has unknown default state '%s'", name, state)
+	}
 
-func (rel *SimpleRelay) OnStop() error {
-	rel.Off()
+	act.openDrain = props.InitProperty("Open Drain", "bool", false, "Release pin instead of driving it high").(bool)
+
+	if act.GPIO == "" {
+		return fmt.Errorf("actor '%s' has no GPIO", name)
+	}
+	if act.Pin == nil {
+		return fmt.Errorf("actor '%s' uses unknown GPIO '%s'", name, act.GPIO)
+	}
 	return nil
 }
 
-func (rel *SimpleRelay) On() error {
+func (act *GPIOActor) OnStart() error {
 
-	err := rel.Pin.Out(gpio.Low)
-	if err != nil {
-		rel.LogMessage("cannot set value On: %s", err)
+	if err := act.hw.Init(); err != nil {
+		return err
 	}
-	rel.state = StateOn
-	return nil
-}
 
-func (rel *SimpleRelay) Off() error {
+	return act.setDefaultState()
+}
 
-	rel.Pin.Out(gpio.High)
-	rel.state = StateOff
-	return nil
+func (act *GPIOActor) OnStop() error {
+	return act.setDefaultState()
 }
 
-type SimpleSSR struct {
-	Actor
+// setDefaultState puts actor in the state of its Default State property
+func (act *GPIOActor) setDefaultState() error {
+	if act.defaultState == StateOn {
+		return act.On()
+	}
+	return act.Off()
 }
 
-func (rel *SimpleSSR) OnStart() error {
+func (act *GPIOActor) On() error {
+	if err := act.write(true); err != nil {
+		act.LogError("cannot turn %s on: %s", act.Name(), err)
+		return err
+	}
+	act.state = StateOn
+	return nil
+}
 
-	if _, err := host.Init(); err != nil {
+func (act *GPIOActor) Off() error {
+	if err := act.write(false); err != nil {
+		act.LogError("cannot turn %s off: %s", act.Name(), err)
 		return err
 	}
+	act.state = StateOff
+	return nil
+}
 
-	rel.Off()
+// write sets pin to the level that turns actor on or off
+func (act *GPIOActor) write(on bool) error {
+	level := gpio.Level(on != act.activeLow)
+	if act.openDrain && level == gpio.High {
+		return act.Pin.In(gpio.Float, gpio.NoEdge)
+	}
+	return act.Pin.Out(level)
+}
 
-	return nil
+// GetDefaultsConfig returns properties used by GPIO actors
+func (act *GPIOActor) GetDefaultsConfig() ([]config.PropertyConfig, error) {
+	props, _ := act.Actor.GetDefaultsConfig()
+	return gpioDefaultsConfig(props, PolarityActiveHigh), nil
 }
 
-func (rel *SimpleSSR) OnStop() error {
-	rel.Off()
-	return nil
+// SimpleRelay is a relay board input on a GPIO pin. Most boards turn the relay on when the pin is low
+type SimpleRelay struct {
+	GPIOActor
 }
 
-func (rel *SimpleSSR) On() error {
+func (rel *SimpleRelay) Init(name string, logger *Logger, properties []Property) error {
+	return rel.initGPIO(name, logger, properties, PolarityActiveLow)
+}
 
-	rel.Pin.Out(gpio.High)
-	rel.state = StateOn
-	return nil
+// GetDefaultsConfig returns properties used by SimpleRelay
+func (rel *SimpleRelay) GetDefaultsConfig() ([]config.PropertyConfig, error) {
+	props, _ := rel.Actor.GetDefaultsConfig()
+	return gpioDefaultsConfig(props, PolarityActiveLow), nil
 }
 
-func (rel *SimpleSSR) Off() error {
+// SimpleSSR is a solid state relay on a GPIO pin. The SSR is on when the pin is high
+type SimpleSSR struct {
+	GPIOActor
+}
 
-	rel.Pin.Out(gpio.Low)
-	rel.state = StateOff
-	return nil
+func (ssr *SimpleSSR) Init(name string, logger *Logger, properties []Property) error {
+	return ssr.initGPIO(name, logger, properties, PolarityActiveHigh)
 }
@@ -0,0 +1,162 @@
+package control
+
+import (
+	"testing"
+
+	"periph.io/x/periph/conn/gpio"
+)
+
+func gpioProperties(pin string) []Property {
+	return []Property{{Name: "GPIO", PropType: "string", Value: pin}}
+}
+
+func TestSimpleRelayPolarity(t *testing.T) {
+	hw := useFakeHardware(t)
+	rel := new(SimpleRelay)
+	rel.Init("Relay 1", testLogger(), gpioProperties("GPIO21"))
+	pin := hw.pins["GPIO21"]
+
+	if err := rel.OnStart(); err != nil {
+		t.Fatal(err)
+	}
+	if pin.Read() != gpio.High || rel.GetState() != StateOff {
+		t.Fatalf("after OnStart pin = %s, state = %d; want High and off", pin.Read(), rel.GetState())
+	}
+
+	tests := []struct {
+		name  string
+		fn    func() error
+		level gpio.Level
+		state DeviceState
+	}{
+		{"On", rel.On, gpio.Low, StateOn},
+		{"Off", rel.Off, gpio.High, StateOff},
+		{"On again", rel.On, gpio.Low, StateOn},
+	}
+	for _, test := range tests {
+		if err := test.fn(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if pin.Read() != test.level || rel.GetState() != test.state {
+			t.Errorf("%s: pin = %s, state = %d; want %s and %d", test.name, pin.Read(), rel.GetState(), test.level, test.state)
+		}
+	}
+
+	rel.OnStop()
+	if pin.Read() != gpio.High {
+		t.Errorf("relay is not off after OnStop")
+	}
+}
+
+func TestSimpleSSRSwitching(t *testing.T) {
+	hw := useFakeHardware(t)
+	ssr := new(SimpleSSR)
+	ssr.Init("SSR 1", testLogger(), gpioProperties("GPIO16"))
+	pin := hw.pins["GPIO16"]
+
+	if err := ssr.OnStart(); err != nil {
+		t.Fatal(err)
+	}
+	if pin.Read() != gpio.Low {
+		t.Fatalf("SSR is on after OnStart")
+	}
+	ssr.On()
+	if pin.Read() != gpio.High || ssr.GetState() != StateOn {
+		t.Errorf("On: pin = %s, state = %d", pin.Read(), ssr.GetState())
+	}
+	ssr.Off()
+	if pin.Read() != gpio.Low || ssr.GetState() != StateOff {
+		t.Errorf("Off: pin = %s, state = %d", pin.Read(), ssr.GetState())
+	}
+
+	// each call writes the pin once
+	want := []gpio.Level{gpio.Low, gpio.High, gpio.Low}
+	changes := pin.Changes()
+	if len(changes) != len(want) {
+		t.Fatalf("pin written %d times, want %d", len(changes), len(want))
+	}
+	for i, change := range changes {
+		if change.Level != want[i] {
+			t.Errorf("write %d = %s, want %s", i, change.Level, want[i])
+		}
+	}
+}
+
+func TestActorPowerControl(t *testing.T) {
+	useFakeHardware(t)
+	ssr := new(SimpleSSR)
+	ssr.Init("SSR 1", testLogger(), append(gpioProperties("GPIO16"), Property{Name: "Power Control", PropType: "bool", Value: true}))
+	if !ssr.HasPowerControl() {
+		t.Fatal("Power Control property not used")
+	}
+	ssr.SetPower(40)
+	if ssr.GetPowerLevel() != 40 {
+		t.Errorf("power = %d, want 40", ssr.GetPowerLevel())
+	}
+}
+
+func TestGPIOActorProperties(t *testing.T) {
+	tests := []struct {
+		name     string
+		actor    IActor
+		props    []Property
+		start    gpio.Level
+		on       gpio.Level
+		off      gpio.Level
+		released bool
+	}{
+		{"relay defaults", new(SimpleRelay), nil, gpio.High, gpio.Low, gpio.High, false},
+		{"active high relay", new(SimpleRelay), []Property{{Name: "Polarity", PropType: "string", Value: PolarityActiveHigh}}, gpio.Low, gpio.High, gpio.Low, false},
+		{"active low SSR", new(SimpleSSR), []Property{{Name: "Polarity", PropType: "string", Value: PolarityActiveLow}}, gpio.High, gpio.Low, gpio.High, false},
+		{"default on", new(SimpleSSR), []Property{{Name: "Default State", PropType: "string", Value: "On"}}, gpio.High, gpio.High, gpio.Low, false},
+		{"open drain relay", new(SimpleRelay), []Property{{Name: "Open Drain", PropType: "bool", Value: true}}, gpio.High, gpio.Low, gpio.High, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hw := useFakeHardware(t)
+			if err := test.actor.Init("Actor 1", testLogger(), append(gpioProperties("GPIO5"), test.props...)); err != nil {
+				t.Fatal(err)
+			}
+			pin := hw.pins["GPIO5"]
+			if err := test.actor.OnStart(); err != nil {
+				t.Fatal(err)
+			}
+			if pin.Read() != test.start {
+				t.Errorf("after OnStart pin = %s, want %s", pin.Read(), test.start)
+			}
+			test.actor.On()
+			if pin.Read() != test.on || test.actor.GetState() != StateOn {
+				t.Errorf("On: pin = %s, state = %d; want %s", pin.Read(), test.actor.GetState(), test.on)
+			}
+			test.actor.Off()
+			if pin.Read() != test.off || test.actor.GetState() != StateOff {
+				t.Errorf("Off: pin = %s, state = %d; want %s", pin.Read(), test.actor.GetState(), test.off)
+			}
+			changes := pin.Changes()
+			if last := changes[len(changes)-1]; last.Released != test.released {
+				t.Errorf("Off released pin = %t, want %t", last.Released, test.released)
+			}
+		})
+	}
+}
+
+func TestGPIOActorInitErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		props []Property
+	}{
+		{"no GPIO", nil},
+		{"unknown GPIO", gpioProperties("GPIO99")},
+		{"unknown polarity", append(gpioProperties("GPIO5"), Property{Name: "Polarity", PropType: "string", Value: "Sideways"})},
+		{"unknown default state", append(gpioProperties("GPIO5"), Property{Name: "Default State", PropType: "string", Value: "Maybe"})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useFakeHardware(t)
+			rel := new(SimpleRelay)
+			if err := rel.Init("Relay 1", testLogger(), test.props); err == nil {
+				t.Error("Init returned no error")
+			}
+		})
+	}
+}
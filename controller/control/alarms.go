@@ -0,0 +1,405 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// interlockDelay is how long the pump may be off while its policy wants it on before the interlock trips.
+// It allows for the pump being switched in the step before
+const interlockDelay = 15 * time.Second
+
+// alarmRepeat is how often an alarm sounds until acknowledged. Info alarms sound once
+var alarmRepeat = map[string]time.Duration{
+	api.SeverityInfo:     0,
+	api.SeverityWarning:  time.Minute,
+	api.SeverityCritical: 15 * time.Second,
+}
+
+// alarmSounds are the buzzer sounds played for each severity
+var alarmSounds = map[string]string{
+	api.SeverityInfo:     "Info",
+	api.SeverityWarning:  "Warning",
+	api.SeverityCritical: "Critical",
+}
+
+// severityRank orders severities, 0 for unknown severities
+func severityRank(severity string) int {
+	switch severity {
+	case api.SeverityInfo:
+		return 1
+	case api.SeverityWarning:
+		return 2
+	case api.SeverityCritical:
+		return 3
+	}
+	return 0
+}
+
+// equipmentAlarms watches the alarm conditions of equipment
+type equipmentAlarms struct {
+	// band is degrees from setpoint before out-of-band, 0 disables
+	band float64
+	// boilOver is the temperature the heater may not be on above, 0 disables
+	boilOver float64
+	// reached is true once temperature reached setpoint since setpoint changed or equipment became active
+	reached  bool
+	setpoint float64
+	// tripped is when the pump was first seen off while its policy wants it on
+	tripped time.Time
+	raised  map[string]bool
+}
+
+// initAlarms reads the alarm properties of equipment
+func (eq *Equipment) initAlarms() {
+	props := eq.GetProperties()
+	eq.alarms = equipmentAlarms{raised: make(map[string]bool)}
+	eq.alarms.band = props.InitProperty("Alarm Band", "float", 5.0, "Degrees from setpoint that raise an alarm once setpoint was reached. 0 disables").(float64)
+	eq.alarms.boilOver = props.InitProperty("Boil Over Temperature", "float", 0.0, "Temperature the heater on raises a boil-over alarm. 0 disables").(float64)
+}
+
+// alarmDefaultsConfig returns the alarm properties of equipment
+func alarmDefaultsConfig() []config.PropertyConfig {
+	return []config.PropertyConfig{
+		{Name: "Alarm Band", Type: "float", Hidden: false, Value: "5", Comment: "Degrees from setpoint that raise an alarm once setpoint was reached. 0 disables", Choice: ""},
+		{Name: "Boil Over Temperature", Type: "float", Hidden: false, Value: "0", Comment: "Temperature the heater on raises a boil-over alarm. 0 disables", Choice: ""},
+	}
+}
+
+// publishAlarm raises or clears alarm condition of equipment
+func (eq *Equipment) publishAlarm(condition string, severity string, message string, active bool) {
+	eq.bus.Publish(Topic(TopicAlarm, eq.Name()), AlarmEvent{Source: eq.Name(), Condition: condition, Severity: severity, Message: message, Active: active})
+}
+
+// setAlarm publishes alarm condition when it is raised or cleared
+func (eq *Equipment) setAlarm(condition string, severity string, active bool, message string) {
+	if eq.alarms.raised[condition] == active {
+		return
+	}
+	eq.alarms.raised[condition] = active
+	eq.publishAlarm(condition, severity, message, active)
+}
+
+// checkAlarms raises and clears the alarms of equipment at now. Temperature within margin below
+// setpoint counts as reaching it
+func (eq *Equipment) checkAlarms(now time.Time, margin float64) {
+	al := &eq.alarms
+	active := eq.GetState() == EqStateActive
+	temp := eq.Sensors[eq.tempSensor].Value
+	setpoint, _ := eq.GetSetpoint()
+
+	if !active || setpoint != al.setpoint {
+		al.reached = false
+		al.setpoint = setpoint
+	}
+	if active && !al.reached && temp >= setpoint-margin {
+		// step complete is an event, raised and cleared at once. It sounds until acknowledged
+		al.reached = true
+		message := fmt.Sprintf("reached setpoint %.1f", setpoint)
+		eq.publishAlarm(api.AlarmStepComplete, api.SeverityInfo, message, true)
+		eq.publishAlarm(api.AlarmStepComplete, api.SeverityInfo, message, false)
+	}
+
+	out := al.band > 0 && al.reached && math.Abs(temp-setpoint) > al.band
+	eq.setAlarm(api.AlarmOutOfBand, api.SeverityWarning, out,
+		fmt.Sprintf("temperature %.1f is more than %.1f from setpoint %.1f", temp, al.band, setpoint))
+
+	heaterOn := eq.Actors[eq.heater].State == StateOn
+	eq.setAlarm(api.AlarmBoilOver, api.SeverityCritical, al.boilOver > 0 && heaterOn && temp >= al.boilOver,
+		fmt.Sprintf("heater is on at %.1f, risk of boil-over", temp))
+
+	tripped := false
+	if active && eq.pumpPolicy != nil && eq.pumpPolicy.policy != PolicyNone && eq.pumpPolicy.wanted {
+		pump, ok := eq.Actors[eq.pump]
+		tripped = ok && pump.State != StateOn
+	}
+	if !tripped {
+		al.tripped = time.Time{}
+	} else if al.tripped.IsZero() {
+		al.tripped = now
+	}
+	eq.setAlarm(api.AlarmInterlock, api.SeverityCritical, tripped && now.Sub(al.tripped) >= interlockDelay,
+		"heater is blocked, pump is off while it should run")
+}
+
+// alarm is a current alarm and when it last sounded
+type alarm struct {
+	api.Alarm
+	lastSound time.Time
+}
+
+// Alarms keeps current alarms until they are both cleared and acknowledged, and a history of ended alarms.
+// Alarms are safe to use from several goroutines
+type Alarms struct {
+	mu      sync.Mutex
+	nextID  int
+	current []*alarm
+	history []api.Alarm
+	keep    int
+}
+
+// NewAlarms returns alarms keeping keep ended alarms in history
+func NewAlarms(keep int) *Alarms {
+	return &Alarms{nextID: 1, keep: keep}
+}
+
+func (a *Alarms) find(source string, condition string) *alarm {
+	for _, al := range a.current {
+		if al.Source == source && al.Condition == condition {
+			return al
+		}
+	}
+	return nil
+}
+
+// end moves al from current alarms to the start of history
+func (a *Alarms) end(al *alarm) {
+	for i, cur := range a.current {
+		if cur == al {
+			a.current = append(a.current[:i], a.current[i+1:]...)
+			break
+		}
+	}
+	a.history = append([]api.Alarm{al.Alarm}, a.history...)
+	if len(a.history) > a.keep {
+		a.history = a.history[:a.keep]
+	}
+}
+
+// Update raises or clears the alarm of ev at now. Returns the alarm and false when nothing changed.
+// A cleared alarm that is not acknowledged is raised again by the same condition
+func (a *Alarms) Update(ev AlarmEvent, now time.Time) (api.Alarm, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ms := toMillis(now)
+	cur := a.find(ev.Source, ev.Condition)
+	if ev.Active {
+		if cur != nil {
+			if cur.Active {
+				return cur.Alarm, false
+			}
+			// sound again at once
+			cur.Active, cur.Cleared, cur.Message, cur.lastSound = true, 0, ev.Message, time.Time{}
+			return cur.Alarm, true
+		}
+		al := &alarm{Alarm: api.Alarm{ID: a.nextID, Source: ev.Source, Condition: ev.Condition, Severity: ev.Severity,
+			Message: ev.Message, Active: true, Raised: ms}}
+		a.nextID++
+		a.current = append(a.current, al)
+		return al.Alarm, true
+	}
+
+	if cur == nil || !cur.Active {
+		return api.Alarm{}, false
+	}
+	cur.Active, cur.Cleared = false, ms
+	if cur.Acknowledged != 0 {
+		a.end(cur)
+	}
+	return cur.Alarm, true
+}
+
+// Acknowledge acknowledges current alarm id, or all current alarms when id is 0, and returns them.
+// Acknowledged alarms no longer sound and end when they are cleared
+func (a *Alarms) Acknowledge(id int, now time.Time) []api.Alarm {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	acked := []api.Alarm{}
+	for _, al := range append([]*alarm{}, a.current...) {
+		if (id != 0 && al.ID != id) || al.Acknowledged != 0 {
+			continue
+		}
+		al.Acknowledged = toMillis(now)
+		acked = append(acked, al.Alarm)
+		if !al.Active {
+			a.end(al)
+		}
+	}
+	return acked
+}
+
+// Due returns the alarms to sound at now, most severe first, and counts them as sounded.
+// Alarms sound when raised and repeat by severity until acknowledged
+func (a *Alarms) Due(now time.Time) []api.Alarm {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	due := []api.Alarm{}
+	for _, al := range a.current {
+		if al.Acknowledged != 0 {
+			continue
+		}
+		if repeat := alarmRepeat[al.Severity]; al.lastSound.IsZero() || (repeat > 0 && now.Sub(al.lastSound) >= repeat) {
+			al.Sounded++
+			al.lastSound = now
+			due = append(due, al.Alarm)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return severityRank(due[i].Severity) > severityRank(due[j].Severity) })
+	return due
+}
+
+// Unacknowledged returns true when a current alarm of at least severity is not acknowledged
+func (a *Alarms) Unacknowledged(severity string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, al := range a.current {
+		if al.Acknowledged == 0 && severityRank(al.Severity) >= severityRank(severity) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns current alarms, oldest first, and history
+func (a *Alarms) Get() api.Alarms {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alarms := api.Alarms{Current: []api.Alarm{}, History: append([]api.Alarm{}, a.history...)}
+	for _, al := range a.current {
+		alarms.Current = append(alarms.Current, al.Alarm)
+	}
+	return alarms
+}
+
+// alarmOutputs are where the controller sends alarms besides the log
+type alarmOutputs struct {
+	buzzer        string
+	actor         string
+	actorSeverity string
+	mqtt          bool
+	sensorTimeout time.Duration
+}
+
+// startAlarms reads the alarm outputs and starts handling alarms raised on the event bus
+func (ctrl *Control) startAlarms() {
+	props := &ctrl.props
+	keep := props.InitProperty("Alarm History", "int", int64(100), "Number of ended alarms kept in memory").(int64)
+	out := alarmOutputs{}
+	out.buzzer = props.InitProperty("Alarm Buzzer", "string", "Main Buzzer", "Buzzer sounding alarms. Empty disables").(string)
+	out.actor = props.InitProperty("Alarm Actor", "string", "", "Actor switched on while an alarm is not acknowledged, e.g. a beacon. Empty disables").(string)
+	out.actorSeverity = props.InitProperty("Alarm Actor Severity", "string", api.SeverityWarning, "Lowest severity of alarms switching Alarm Actor").(string)
+	out.mqtt = props.InitProperty("Alarm MQTT", "bool", true, "Publish alarms to MQTT topics <MQTT Topic>/alarm/<source>/<condition>").(bool)
+	timeout := props.InitProperty("Alarm Sensor Timeout", "int", int64(30), "Seconds without a sensor reading that raise a sensor fault alarm. 0 disables").(int64)
+	out.sensorTimeout = time.Duration(timeout) * time.Second
+
+	if _, ok := ctrl.buzzers[out.buzzer]; out.buzzer != "" && !ok {
+		ctrl.logger.LogWarning("Alarm Buzzer '%s' not found. Alarms are not sounded", out.buzzer)
+	}
+	if _, ok := ctrl.actors[out.actor]; out.actor != "" && !ok {
+		ctrl.logger.LogWarning("Alarm Actor '%s' not found", out.actor)
+	}
+	if severityRank(out.actorSeverity) == 0 {
+		ctrl.logger.LogWarning("Unknown Alarm Actor Severity '%s'. Using %s", out.actorSeverity, api.SeverityWarning)
+		out.actorSeverity = api.SeverityWarning
+	}
+	ctrl.alarmOut = out
+	ctrl.alarms = NewAlarms(int(keep))
+	go ctrl.handleAlarms(ctrl.bus.Subscribe("alarms", Topic(TopicAlarm, "#")), time.Now())
+}
+
+// handleAlarms keeps alarms raised and cleared by devices, raises sensor faults and sounds
+// alarms until they are acknowledged. Sensors are checked for readings from start
+func (ctrl *Control) handleAlarms(events *Subscription, start time.Time) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	faults := make(map[string]bool)
+	actorOn := false
+
+	for {
+		select {
+		case ev, ok := <-events.C:
+			if !ok {
+				return
+			}
+			if payload, ok := ev.Payload.(AlarmEvent); ok {
+				if al, changed := ctrl.alarms.Update(payload, ev.Time); changed {
+					ctrl.reportAlarm(al)
+				}
+			}
+		case now := <-t.C:
+			ctrl.checkSensors(now, start, faults)
+			ctrl.soundAlarms(now)
+			if out := ctrl.alarmOut; out.actor != "" {
+				if on := ctrl.alarms.Unacknowledged(out.actorSeverity); on != actorOn {
+					actorOn = on
+					cmd := ActorCommand{Name: out.actor, Source: "alarms", Cmd: ActorCmdOff}
+					if on {
+						cmd.Cmd = ActorCmdOn
+					}
+					ctrl.bus.Publish(Topic(TopicActorCommand, out.actor), cmd)
+				}
+			}
+		}
+	}
+}
+
+// checkSensors raises a sensor fault for sensors without a reading for "Alarm Sensor Timeout"
+// and clears it when readings return. faults are the sensors with a raised fault
+func (ctrl *Control) checkSensors(now time.Time, start time.Time, faults map[string]bool) {
+	timeout := ctrl.alarmOut.sensorTimeout
+	if timeout <= 0 {
+		return
+	}
+	for name := range ctrl.sensors {
+		ctrl.valuesMu.RLock()
+		last, ok := ctrl.sensorTimes[name]
+		ctrl.valuesMu.RUnlock()
+		if !ok {
+			last = start
+		}
+		fault := now.Sub(last) > timeout
+		if fault == faults[name] {
+			continue
+		}
+		faults[name] = fault
+		ctrl.bus.Publish(Topic(TopicAlarm, name), AlarmEvent{Source: name, Condition: api.AlarmSensorFault, Severity: api.SeverityCritical,
+			Message: fmt.Sprintf("no reading for %s", timeout), Active: fault})
+	}
+}
+
+// soundAlarms plays the sound of the most severe alarm due at now on the alarm buzzer
+func (ctrl *Control) soundAlarms(now time.Time) {
+	due := ctrl.alarms.Due(now)
+	if len(due) == 0 {
+		return
+	}
+	if buzzer, ok := ctrl.buzzers[ctrl.alarmOut.buzzer]; ok {
+		buzzer.PlaySound(alarmSounds[due[0].Severity])
+	}
+}
+
+// reportAlarm logs a raised, cleared or acknowledged alarm and publishes it to MQTT
+func (ctrl *Control) reportAlarm(al api.Alarm) {
+	switch {
+	case !al.Active && al.Acknowledged != 0:
+		ctrl.logger.LogMessage("Alarm %d %s of '%s' ended", al.ID, al.Condition, al.Source)
+	case al.Acknowledged != 0:
+		ctrl.logger.LogMessage("Alarm %d %s of '%s' acknowledged", al.ID, al.Condition, al.Source)
+	case !al.Active:
+		ctrl.logger.LogMessage("Alarm %d %s of '%s' cleared", al.ID, al.Condition, al.Source)
+	case al.Severity == api.SeverityCritical:
+		ctrl.logger.LogError("Alarm %d %s of '%s': %s", al.ID, al.Condition, al.Source, al.Message)
+	case al.Severity == api.SeverityWarning:
+		ctrl.logger.LogWarning("Alarm %d %s of '%s': %s", al.ID, al.Condition, al.Source, al.Message)
+	default:
+		ctrl.logger.LogMessage("Alarm %d %s of '%s': %s", al.ID, al.Condition, al.Source, al.Message)
+	}
+	if ctrl.alarmOut.mqtt && ctrl.mqtt.IsConnected() {
+		ctrl.mqtt.PublishAlarm(al)
+	}
+}
+
+// acknowledgeAlarms acknowledges alarm id, or all alarms when id is 0. Returns false when no alarm was acknowledged
+func (ctrl *Control) acknowledgeAlarms(id int, now time.Time) bool {
+	acked := ctrl.alarms.Acknowledge(id, now)
+	for _, al := range acked {
+		ctrl.reportAlarm(al)
+	}
+	return len(acked) > 0 || id == 0
+}
@@ -0,0 +1,204 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// raisedAlarms returns alarm events sent to alarms as "<condition> raised" or "<condition> cleared"
+func raisedAlarms(alarms *Subscription) []string {
+	raised := []string{}
+	for {
+		select {
+		case ev := <-alarms.C:
+			alarm := ev.Payload.(AlarmEvent)
+			state := "cleared"
+			if alarm.Active {
+				state = "raised"
+			}
+			raised = append(raised, alarm.Condition+" "+state)
+		case <-time.After(50 * time.Millisecond):
+			return raised
+		}
+	}
+}
+
+func TestAlarms(t *testing.T) {
+	alarms := NewAlarms(2)
+	now := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	band := AlarmEvent{Source: "HLT", Condition: api.AlarmOutOfBand, Severity: api.SeverityWarning, Message: "too hot", Active: true}
+
+	al, changed := alarms.Update(band, now)
+	if !changed || al.ID != 1 || !al.Active || al.Raised != toMillis(now) {
+		t.Fatalf("raised %+v, %t", al, changed)
+	}
+	if _, changed = alarms.Update(band, now); changed {
+		t.Error("alarm raised twice")
+	}
+
+	// warnings sound when raised and every minute until acknowledged
+	for _, step := range []struct {
+		after time.Duration
+		due   int
+	}{{0, 1}, {30 * time.Second, 0}, {time.Minute, 1}} {
+		if due := alarms.Due(now.Add(step.after)); len(due) != step.due {
+			t.Errorf("%d alarms due after %s, want %d", len(due), step.after, step.due)
+		}
+	}
+	if !alarms.Unacknowledged(api.SeverityWarning) || alarms.Unacknowledged(api.SeverityCritical) {
+		t.Error("unacknowledged warning not found by severity")
+	}
+
+	// cleared alarms stay until acknowledged and sound again when raised again
+	band.Active = false
+	alarms.Update(band, now.Add(2*time.Minute))
+	band.Active = true
+	if al, _ = alarms.Update(band, now.Add(3*time.Minute)); al.ID != 1 || !al.Active {
+		t.Errorf("raised again %+v, want alarm 1 active", al)
+	}
+	if due := alarms.Due(now.Add(3 * time.Minute)); len(due) != 1 || due[0].Sounded != 3 {
+		t.Errorf("due %+v, want alarm sounded the third time", due)
+	}
+
+	if acked := alarms.Acknowledge(1, now.Add(4*time.Minute)); len(acked) != 1 {
+		t.Fatalf("acknowledged %+v", acked)
+	}
+	if due := alarms.Due(now.Add(10 * time.Minute)); len(due) != 0 || alarms.Unacknowledged(api.SeverityInfo) {
+		t.Error("acknowledged alarm still sounds")
+	}
+	band.Active = false
+	alarms.Update(band, now.Add(5*time.Minute))
+	if got := alarms.Get(); len(got.Current) != 0 || len(got.History) != 1 || got.History[0].Cleared == 0 {
+		t.Errorf("alarms %+v, want acknowledged and cleared alarm in history", got)
+	}
+
+	// info alarms sound once. Critical alarms sound first
+	for i, source := range []string{"Kettle", "Mash Tun", "HLT"} {
+		alarms.Update(AlarmEvent{Source: source, Condition: api.AlarmStepComplete, Severity: api.SeverityInfo, Active: true}, now)
+		alarms.Update(AlarmEvent{Source: source, Condition: api.AlarmStepComplete, Severity: api.SeverityInfo}, now)
+		if i == 0 {
+			alarms.Update(AlarmEvent{Source: "Temp", Condition: api.AlarmSensorFault, Severity: api.SeverityCritical, Active: true}, now)
+		}
+	}
+	if due := alarms.Due(now); len(due) != 4 || due[0].Severity != api.SeverityCritical {
+		t.Errorf("due %+v, want critical alarm first", due)
+	}
+	if due := alarms.Due(now.Add(time.Hour)); len(due) != 1 || due[0].Condition != api.AlarmSensorFault {
+		t.Errorf("due %+v, want only the critical alarm repeated", due)
+	}
+
+	// acknowledging all ends cleared alarms. History keeps the newest 2
+	alarms.Acknowledge(0, now.Add(time.Hour))
+	if got := alarms.Get(); len(got.Current) != 1 || len(got.History) != 2 || got.History[0].Source != "HLT" {
+		t.Errorf("alarms %+v, want sensor fault current and 2 step complete alarms in history", got)
+	}
+}
+
+// newAlarmEquipment returns active equipment at setpoint 150 with its pump on all the time
+func newAlarmEquipment(t *testing.T, props []Property) *Equipment {
+	eq := newAutotuneEquipment(t, append([]Property{
+		{Name: "Pump", PropType: "string", Value: "Pump"},
+		{Name: "Pump Policy", PropType: "string", Value: PolicyAlwaysOn},
+	}, props...))
+	eq.AddActor("Pump")
+	return eq
+}
+
+func TestEquipmentAlarms(t *testing.T) {
+	eq := newAlarmEquipment(t, []Property{{Name: "Alarm Band", PropType: "float", Value: 3.0}, {Name: "Boil Over Temperature", PropType: "float", Value: 160.0}})
+	events := eq.bus.Subscribe("test", Topic(TopicAlarm, "#"))
+	defer events.Close()
+	now := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	setPump := func(on bool) {
+		state := DeviceState(StateOff)
+		if on {
+			state = StateOn
+		}
+		eq.handleEvent(Event{Topic: Topic(TopicActor, "Pump"), Payload: ActorEvent{Name: "Pump", State: state}})
+	}
+	eq.updatePolicies(now)
+	setPump(true)
+
+	// far below setpoint is not out of band before setpoint is reached
+	steps := []struct {
+		temp float64
+		want []string
+	}{
+		{140, nil},
+		{149.5, []string{"step-complete raised", "step-complete cleared"}},
+		{150, nil},
+		{154, []string{"out-of-band raised"}},
+		{151, []string{"out-of-band cleared"}},
+	}
+	for _, step := range steps {
+		setTemp(eq, step.temp)
+		eq.checkAlarms(now, 1)
+		if got := raisedAlarms(events); !equal(got, step.want) {
+			t.Errorf("at %.1f alarms %v, want %v", step.temp, got, step.want)
+		}
+	}
+
+	// a new setpoint completes a new step
+	eq.SetSetpoint(152)
+	eq.checkAlarms(now, 1)
+	if got := raisedAlarms(events); !equal(got, []string{"step-complete raised", "step-complete cleared"}) {
+		t.Errorf("new setpoint alarms %v", got)
+	}
+
+	eq.SetSetpoint(170)
+	setTemp(eq, 161)
+	eq.handleEvent(Event{Topic: Topic(TopicActor, "Heater"), Payload: ActorEvent{Name: "Heater", State: StateOn}})
+	eq.checkAlarms(now, 1)
+	if got := raisedAlarms(events); !equal(got, []string{"boil-over raised"}) {
+		t.Errorf("heater on above boil-over temperature alarms %v", got)
+	}
+
+	// pump switched off by hand trips the interlock after a while
+	setPump(false)
+	eq.checkAlarms(now, 1)
+	eq.checkAlarms(now.Add(interlockDelay-time.Second), 1)
+	if got := raisedAlarms(events); len(got) != 0 {
+		t.Errorf("alarms %v before interlock delay", got)
+	}
+	eq.checkAlarms(now.Add(interlockDelay), 1)
+	if got := raisedAlarms(events); !equal(got, []string{"interlock raised"}) {
+		t.Errorf("pump off alarms %v, want interlock", got)
+	}
+	setPump(true)
+	eq.checkAlarms(now.Add(interlockDelay+time.Second), 1)
+	if got := raisedAlarms(events); !equal(got, []string{"interlock cleared"}) {
+		t.Errorf("pump on alarms %v, want interlock cleared", got)
+	}
+}
+
+func TestSensorFault(t *testing.T) {
+	bus := NewEventBus(nil)
+	events := bus.Subscribe("test", Topic(TopicAlarm, "#"))
+	defer events.Close()
+	start := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	ctrl := &Control{
+		logger:      testLogger(),
+		bus:         bus,
+		sensors:     map[string]ISensor{"Temp": new(DummyTempSensor)},
+		sensorTimes: make(map[string]time.Time),
+		alarmOut:    alarmOutputs{sensorTimeout: 30 * time.Second},
+	}
+	faults := make(map[string]bool)
+
+	ctrl.checkSensors(start.Add(30*time.Second), start, faults)
+	if got := raisedAlarms(events); len(got) != 0 {
+		t.Errorf("alarms %v before timeout", got)
+	}
+	ctrl.checkSensors(start.Add(31*time.Second), start, faults)
+	ctrl.checkSensors(start.Add(40*time.Second), start, faults)
+	if got := raisedAlarms(events); !equal(got, []string{"sensor-fault raised"}) {
+		t.Errorf("sensor without reading alarms %v", got)
+	}
+	ctrl.sensorTimes["Temp"] = start.Add(45 * time.Second)
+	ctrl.checkSensors(start.Add(46*time.Second), start, faults)
+	if got := raisedAlarms(events); !equal(got, []string{"sensor-fault cleared"}) {
+		t.Errorf("sensor reading again alarms %v", got)
+	}
+}
@@ -0,0 +1,280 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// autotuneOutput is half the swing of heater power in percent. The relay experiment
+// switches the heater between 0 and 100% so PID gains are in percent power per degree
+const autotuneOutput = 50.0
+
+// autotune runs a relay (Åström–Hägglund) experiment. The heater goes on below setpoint minus
+// band and off above setpoint plus band. The temperature oscillates around the setpoint and the
+// amplitude and period of the oscillation give the ultimate gain and period of the process.
+type autotune struct {
+	mu      sync.Mutex
+	status  api.Autotune
+	started time.Time
+	timeout time.Duration
+	heating bool
+	// cooled is true once the heater went off. lastOn is when the heater last went on after that.
+	// A cycle is the time between two lastOn
+	cooled     bool
+	lastOn     time.Time
+	high, low  float64
+	amplitudes []float64
+	periods    []float64
+}
+
+// initAutotune reads auto-tune properties of equipment
+func (eq *Equipment) initAutotune() {
+	props := eq.GetProperties()
+	eq.autotune.status = api.Autotune{Equipment: eq.Name(), State: api.AutotuneIdle}
+	eq.autotune.status.Band = props.InitProperty("Autotune Band", "float", 0.5, "Degrees above and below setpoint where auto-tune switches heater").(float64)
+	eq.autotune.status.Wanted = int(props.InitProperty("Autotune Cycles", "int", int64(3), "Oscillations measured by auto-tune").(int64))
+	eq.autotune.timeout = minutes(props.InitProperty("Autotune Minutes", "float", 180.0, "Auto-tune fails when it does not finish in this many minutes").(float64))
+}
+
+// autotuneDefaultsConfig returns properties of PID gains and auto-tune
+func autotuneDefaultsConfig() []config.PropertyConfig {
+	return []config.PropertyConfig{
+		{Name: "PID Kp", Type: "float", Hidden: false, Value: "0", Comment: "Proportional gain in percent power per degree", Choice: ""},
+		{Name: "PID Ki", Type: "float", Hidden: false, Value: "0", Comment: "Integral gain in percent power per degree second", Choice: ""},
+		{Name: "PID Kd", Type: "float", Hidden: false, Value: "0", Comment: "Derivative gain in percent power seconds per degree", Choice: ""},
+		{Name: "Autotune Band", Type: "float", Hidden: false, Value: "0.5", Comment: "Degrees above and below setpoint where auto-tune switches heater", Choice: ""},
+		{Name: "Autotune Cycles", Type: "int", Hidden: false, Value: "3", Comment: "Oscillations measured by auto-tune", Choice: ""},
+		{Name: "Autotune Minutes", Type: "float", Hidden: false, Value: "180", Comment: "Auto-tune fails when it does not finish in this many minutes", Choice: ""},
+	}
+}
+
+// StartAutotune starts auto-tune around the current setpoint. With save the suggested gains are
+// written to the configuration when auto-tune is done. Equipment must be active
+func (eq *Equipment) StartAutotune(save bool) error {
+	if eq.GetState() != EqStateActive {
+		return fmt.Errorf("equipment '%s' is not active", eq.Name())
+	}
+	if eq.pumpPolicy != nil && eq.pumpPolicy.policy == PolicyInterval {
+		return fmt.Errorf("pump rests of Interval pump policy disturb auto-tune")
+	}
+	setpoint, _ := eq.GetSetpoint()
+
+	at := &eq.autotune
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.status.Band <= 0 || at.status.Wanted < 1 {
+		return fmt.Errorf("auto-tune needs a band above 0 and at least one cycle")
+	}
+	if at.status.State == api.AutotuneRunning {
+		return fmt.Errorf("auto-tune of '%s' is already running", eq.Name())
+	}
+	at.status = api.Autotune{
+		Equipment: eq.Name(),
+		State:     api.AutotuneRunning,
+		Setpoint:  setpoint,
+		Band:      at.status.Band,
+		Wanted:    at.status.Wanted,
+		Save:      save,
+	}
+	at.started = time.Now()
+	at.status.Started = at.started.UnixNano() / int64(time.Millisecond)
+	at.heating, at.cooled = false, false
+	at.lastOn = time.Time{}
+	at.amplitudes, at.periods = nil, nil
+	eq.LogMessage("Auto-tune started at setpoint %0.2f", at.status.Setpoint)
+	return nil
+}
+
+// StopAutotune stops a running auto-tune. Equipment goes back to its control mode
+func (eq *Equipment) StopAutotune() error {
+	at := &eq.autotune
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.status.State != api.AutotuneRunning {
+		return fmt.Errorf("auto-tune of '%s' is not running", eq.Name())
+	}
+	at.status.State = api.AutotuneStopped
+	eq.LogMessage("Auto-tune stopped")
+	return nil
+}
+
+// GetAutotune returns state and result of the last auto-tune
+func (eq *Equipment) GetAutotune() api.Autotune {
+	eq.autotune.mu.Lock()
+	defer eq.autotune.mu.Unlock()
+	return eq.autotune.status
+}
+
+// AutotuneSaved is called by the controller after it wrote the suggested gains to the configuration
+func (eq *Equipment) AutotuneSaved(err error) {
+	eq.autotune.mu.Lock()
+	defer eq.autotune.mu.Unlock()
+	if err != nil {
+		eq.autotune.status.Error = fmt.Sprintf("gains not saved: %s", err)
+		return
+	}
+	eq.autotune.status.Saved = true
+}
+
+// failAutotune ends a running auto-tune with reason
+func (eq *Equipment) failAutotune(reason string) {
+	at := &eq.autotune
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.status.State != api.AutotuneRunning {
+		return
+	}
+	at.status.State = api.AutotuneFailed
+	at.status.Error = reason
+	eq.LogWarning("Auto-tune failed: %s", reason)
+}
+
+// updateAutotune switches the heater while auto-tune runs and returns true. When auto-tune ended
+// the heater is turned off once and false is returned so equipment goes back to its control mode
+func (eq *Equipment) updateAutotune(now time.Time) bool {
+	at := &eq.autotune
+	at.mu.Lock()
+	running := at.status.State == api.AutotuneRunning
+	heating := at.heating
+	if !running {
+		at.heating = false
+	}
+	at.mu.Unlock()
+
+	if !running {
+		if heating {
+			eq.switchActor(eq.heater, false)
+		}
+		return false
+	}
+	eq.stepAutotune(now)
+	return true
+}
+
+// stepAutotune switches the heater around the setpoint and measures the oscillation at now
+func (eq *Equipment) stepAutotune(now time.Time) {
+	temp, ok := eq.Sensors[eq.tempSensor]
+	if !ok {
+		eq.failAutotune(fmt.Sprintf("no temperature sensor '%s'", eq.tempSensor))
+		return
+	}
+
+	at := &eq.autotune
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if now.Sub(at.started) > at.timeout {
+		at.status.State = api.AutotuneFailed
+		at.status.Error = fmt.Sprintf("temperature did not oscillate around %0.2f in %s", at.status.Setpoint, at.timeout)
+		eq.LogWarning("Auto-tune failed: %s", at.status.Error)
+		return
+	}
+
+	at.high = math.Max(at.high, temp.Value)
+	at.low = math.Min(at.low, temp.Value)
+	switch {
+	case !at.heating && temp.Value < at.status.Setpoint-at.status.Band:
+		at.heating = true
+		// heating up to the setpoint is not a cycle. Cycles start once the heater went off
+		if at.cooled {
+			if !at.lastOn.IsZero() {
+				at.amplitudes = append(at.amplitudes, (at.high-at.low)/2)
+				at.periods = append(at.periods, now.Sub(at.lastOn).Seconds())
+				at.status.Cycles = len(at.periods)
+			}
+			at.lastOn = now
+		}
+		at.high, at.low = temp.Value, temp.Value
+	case at.heating && temp.Value > at.status.Setpoint+at.status.Band:
+		at.heating = false
+		at.cooled = true
+	}
+
+	if at.status.Cycles >= at.status.Wanted {
+		if err := at.finish(); err != nil {
+			at.status.State = api.AutotuneFailed
+			at.status.Error = err.Error()
+			eq.LogWarning("Auto-tune failed: %s", at.status.Error)
+			return
+		}
+		eq.LogMessage("Auto-tune done. Amplitude %0.2f, period %0.0fs, Kp %0.3f, Ki %0.5f, Kd %0.3f",
+			at.status.Amplitude, at.status.Period, at.status.Kp, at.status.Ki, at.status.Kd)
+		if at.status.Save {
+			eq.bus.Publish(Topic(TopicAutotune, eq.Name()), AutotuneEvent{Name: eq.Name(), Kp: at.status.Kp, Ki: at.status.Ki, Kd: at.status.Kd})
+		}
+		return
+	}
+	if act, ok := eq.Actors[eq.heater]; ok && at.heating != (act.State == StateOn) {
+		eq.switchActor(eq.heater, at.heating)
+	}
+}
+
+// finish averages the measured cycles and computes Ziegler–Nichols PID gains.
+// Fails without changing the status when the oscillation gives no gains
+func (at *autotune) finish() error {
+	amplitude, period := average(at.amplitudes), average(at.periods)
+	// relay with hysteresis: the describing function uses the amplitude beyond the band
+	a := amplitude
+	if band := at.status.Band; a > band {
+		a = math.Sqrt(a*a - band*band)
+	}
+	if !(a > 0) || !(period > 0) {
+		return fmt.Errorf("oscillation with amplitude %0.2f and period %0.0fs gives no PID gains", amplitude, period)
+	}
+	ku := 4 * autotuneOutput / (math.Pi * a)
+
+	at.status.State = api.AutotuneDone
+	at.status.Amplitude = amplitude
+	at.status.Period = period
+	at.status.Kp = 0.6 * ku
+	at.status.Ki = 1.2 * ku / period
+	at.status.Kd = 0.075 * ku * period
+	return nil
+}
+
+func average(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// finiteGains returns true if no gain is infinite or NaN
+func finiteGains(gains ...float64) bool {
+	for _, gain := range gains {
+		if math.IsInf(gain, 0) || math.IsNaN(gain) {
+			return false
+		}
+	}
+	return true
+}
+
+// saveAutotune writes gains found by auto-tune to the equipment in the configuration file.
+// Gains that are not finite are never written
+func (ctrl *Control) saveAutotune(ev AutotuneEvent) {
+	eq, ok := ctrl.equipment[ev.Name]
+	if !ok {
+		return
+	}
+	var err error
+	if !finiteGains(ev.Kp, ev.Ki, ev.Kd) {
+		err = fmt.Errorf("gains Kp %g, Ki %g, Kd %g are not finite", ev.Kp, ev.Ki, ev.Kd)
+	} else {
+		err = ctrl.saveEquipmentProperties(ev.Name, []config.PropertyConfig{
+			{Name: "PID Kp", Type: "float", Value: fmt.Sprintf("%.4g", ev.Kp), Comment: "Proportional gain in percent power per degree"},
+			{Name: "PID Ki", Type: "float", Value: fmt.Sprintf("%.4g", ev.Ki), Comment: "Integral gain in percent power per degree second"},
+			{Name: "PID Kd", Type: "float", Value: fmt.Sprintf("%.4g", ev.Kd), Comment: "Derivative gain in percent power seconds per degree"},
+		})
+	}
+	if err != nil {
+		ctrl.logger.LogError("Auto-tune gains of '%s' not saved: %s", ev.Name, err)
+	} else {
+		ctrl.logger.LogMessage("Auto-tune gains of '%s' saved to '%s'", ev.Name, ctrl.configFileName)
+	}
+	eq.AutotuneSaved(err)
+}
@@ -0,0 +1,193 @@
+package control
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// newAutotuneEquipment returns active equipment at setpoint 150 with a heater and temperature sensor
+func newAutotuneEquipment(t *testing.T, props []Property) *Equipment {
+	props = append([]Property{
+		{Name: "Temperature Sensor", PropType: "string", Value: "Temp"},
+		{Name: "Heater", PropType: "string", Value: "Heater"},
+		{Name: "Pump", PropType: "string", Value: ""},
+		{Name: "Agitator", PropType: "string", Value: ""},
+	}, props...)
+	eq := new(Equipment)
+	eq.InitEquipment("Mash Tun", testLogger(), props, NewEventBus(nil))
+	eq.AddSensor("Temp")
+	eq.AddActor("Heater")
+	eq.SetSetpoint(150)
+	eq.State = EqStateActive
+	return eq
+}
+
+func setTemp(eq *Equipment, value float64) {
+	eq.handleEvent(Event{Topic: Topic(TopicSensor, "Temp"), Payload: SensorEvent{Name: "Temp", Value: value}})
+}
+
+// runPlant steps auto-tune every second for at most limit. Temperature rises 1°/min while the heater
+// is on and falls 0.5°/min while off, one minute after the heater switched
+func runPlant(eq *Equipment, start time.Time, temp float64, limit time.Duration) {
+	const delay = 60
+	heater := make([]bool, delay)
+	now := start
+	for now.Sub(start) < limit && eq.GetAutotune().State == api.AutotuneRunning {
+		setTemp(eq, temp)
+		eq.stepAutotune(now)
+		heater = append(heater[1:], eq.autotune.heating)
+		if heater[0] {
+			temp += 1.0 / 60
+		} else {
+			temp -= 0.5 / 60
+		}
+		now = now.Add(time.Second)
+	}
+}
+
+func TestAutotune(t *testing.T) {
+	eq := newAutotuneEquipment(t, nil)
+	saved := eq.bus.Subscribe("test", Topic(TopicAutotune, "#"))
+	defer saved.Close()
+
+	if err := eq.StartAutotune(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := eq.StartAutotune(true); err == nil {
+		t.Error("second start returned no error")
+	}
+	runPlant(eq, eq.autotune.started, 140, 2*time.Hour)
+
+	at := eq.GetAutotune()
+	if at.State != api.AutotuneDone || at.Cycles != 3 {
+		t.Fatalf("auto-tune %+v, want done after 3 cycles", at)
+	}
+	// peaks are 1° above and 0.5° below the band. Heater is on 2.5 minutes and off 5 minutes
+	if math.Abs(at.Amplitude-1.25) > 0.05 || math.Abs(at.Period-450) > 5 {
+		t.Errorf("amplitude %.3f, period %.1fs; want 1.25 and 450s", at.Amplitude, at.Period)
+	}
+	ku := 4 * autotuneOutput / (math.Pi * math.Sqrt(at.Amplitude*at.Amplitude-at.Band*at.Band))
+	if !near(at.Kp, 0.6*ku) || !near(at.Ki, 1.2*ku/at.Period) || !near(at.Kd, 0.075*ku*at.Period) {
+		t.Errorf("gains Kp %.3f, Ki %.5f, Kd %.3f do not match Ku %.3f", at.Kp, at.Ki, at.Kd, ku)
+	}
+
+	select {
+	case ev := <-saved.C:
+		if gains := ev.Payload.(AutotuneEvent); gains.Name != "Mash Tun" || gains.Kp != at.Kp {
+			t.Errorf("saved gains %+v, want %+v", gains, at)
+		}
+	case <-time.After(time.Second):
+		t.Error("gains not sent to be saved")
+	}
+	eq.AutotuneSaved(nil)
+	if !eq.GetAutotune().Saved {
+		t.Error("auto-tune not marked saved")
+	}
+}
+
+func TestAutotuneEnds(t *testing.T) {
+	eq := newAutotuneEquipment(t, []Property{{Name: "Autotune Minutes", PropType: "float", Value: 30.0}})
+	commands := eq.bus.Subscribe("test", Topic(TopicActorCommand, "#"))
+	defer commands.Close()
+
+	eq.State = EqStateIdle
+	if err := eq.StartAutotune(false); err == nil {
+		t.Fatal("auto-tune started on idle equipment")
+	}
+	eq.State = EqStateActive
+	if err := eq.StopAutotune(); err == nil {
+		t.Error("stop returned no error when auto-tune is not running")
+	}
+
+	// heater too weak to reach the setpoint
+	if err := eq.StartAutotune(false); err != nil {
+		t.Fatal(err)
+	}
+	setTemp(eq, 100)
+	if !eq.updateAutotune(eq.autotune.started) {
+		t.Fatal("auto-tune not running")
+	}
+	eq.updateAutotune(eq.autotune.started.Add(31 * time.Minute))
+	if at := eq.GetAutotune(); at.State != api.AutotuneFailed || at.Error == "" {
+		t.Fatalf("auto-tune %+v, want failed after timeout", at)
+	}
+	if eq.updateAutotune(time.Now()) {
+		t.Error("failed auto-tune still running")
+	}
+	if sent := sentCommands(commands); !equal(sent, []string{"Heater on", "Heater off"}) {
+		t.Errorf("sent %v, want heater on and off after failure", sent)
+	}
+
+	if err := eq.StartAutotune(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := eq.StopAutotune(); err != nil {
+		t.Fatal(err)
+	}
+	if at := eq.GetAutotune(); at.State != api.AutotuneStopped {
+		t.Errorf("state %s after stop, want stopped", at.State)
+	}
+}
+
+func TestAutotuneNeedsSteadyPump(t *testing.T) {
+	eq := newAutotuneEquipment(t, []Property{{Name: "Pump Policy", PropType: "string", Value: PolicyInterval}})
+	if err := eq.StartAutotune(false); err == nil {
+		t.Error("auto-tune started with Interval pump policy")
+	}
+}
+
+func TestAutotuneWithoutOscillation(t *testing.T) {
+	tests := []struct {
+		name       string
+		amplitudes []float64
+		periods    []float64
+	}{
+		{"no amplitude", []float64{0, 0}, []float64{300, 300}},
+		{"no period", []float64{1, 1}, []float64{0, 0}},
+		{"no cycles", nil, nil},
+	}
+	for _, test := range tests {
+		at := &autotune{status: api.Autotune{State: api.AutotuneRunning, Band: 0.5}, amplitudes: test.amplitudes, periods: test.periods}
+		if err := at.finish(); err == nil {
+			t.Errorf("%s: finished with gains Kp %v, Ki %v, Kd %v", test.name, at.status.Kp, at.status.Ki, at.status.Kd)
+		}
+		if at.status.State != api.AutotuneRunning || at.status.Kp != 0 {
+			t.Errorf("%s: status changed to %+v", test.name, at.status)
+		}
+	}
+
+	// equipment fails the auto-tune and does not send gains to be saved
+	eq := newAutotuneEquipment(t, nil)
+	saved := eq.bus.Subscribe("test", Topic(TopicAutotune, "#"))
+	defer saved.Close()
+	if err := eq.StartAutotune(true); err != nil {
+		t.Fatal(err)
+	}
+	eq.autotune.amplitudes, eq.autotune.periods = []float64{0, 0, 0}, []float64{0, 0, 0}
+	eq.autotune.status.Cycles = 3
+	setTemp(eq, 150)
+	eq.stepAutotune(eq.autotune.started.Add(time.Minute))
+	if at := eq.GetAutotune(); at.State != api.AutotuneFailed || at.Error == "" {
+		t.Errorf("auto-tune %+v, want failed", at)
+	}
+	select {
+	case ev := <-saved.C:
+		t.Errorf("sent gains %+v", ev.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSaveAutotuneNotFinite(t *testing.T) {
+	eq := new(SimpleRIMM)
+	eq.InitEquipment("Mash Tun", testLogger(), nil, NewEventBus(nil))
+	ctrl := &Control{logger: testLogger(), equipment: map[string]IEquipment{"Mash Tun": eq}}
+
+	// the configuration is not touched, the controller has none
+	ctrl.saveAutotune(AutotuneEvent{Name: "Mash Tun", Kp: math.Inf(1), Ki: 1, Kd: math.NaN()})
+	if at := eq.GetAutotune(); at.Saved || at.Error == "" {
+		t.Errorf("auto-tune %+v, want gains not saved", at)
+	}
+}
@@ -1,19 +1,32 @@
 package control
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"../config"
+	"github.com/gigatropolis/brewbrat/controller/config"
 	"periph.io/x/periph/conn/gpio"
-	"periph.io/x/periph/conn/gpio/gpioreg"
-	"periph.io/x/periph/host"
+	"periph.io/x/periph/conn/physic"
 )
 
-// SoundBit id piece of sound that has On and Off each Milliseconds
+func init() {
+	mustRegister(KindBuzzer, "ActiveBuzzer", func() IDevice { return new(ActiveBuzzer) }, "Active buzzer on a GPIO pin")
+	mustRegister(KindBuzzer, "PassiveBuzzer", func() IDevice { return new(PassiveBuzzer) }, "Passive buzzer on a PWM GPIO pin playing notes")
+	mustRegister(KindBuzzer, "DummyBuzzer", func() IDevice { return new(DummyBuzzer) }, "Simulated buzzer without hardware")
+}
+
+// soundQueueSize is the number of sounds waiting to play before PlaySound fails
+const soundQueueSize = 8
+
+// SoundBit id piece of sound that has On and Off each Milliseconds.
+// Freq is the note in Hz played by passive buzzers, 0 for the buzzer frequency
 type SoundBit struct {
 	Level int
 	On    int
 	Off   int
+	Freq  int
 }
 
 type IBuzzer interface {
@@ -29,40 +42,146 @@ type Buzzer struct {
 	Sounds map[string][]SoundBit
 	GPIO   string
 	Pin    gpio.PinIO
+
+	queue   chan []SoundBit
+	queueMu sync.Mutex
+	stopped bool
+	playing sync.WaitGroup
+	playMu  sync.Mutex
 }
 
 func (buz *Buzzer) Init(name string, logger *Logger, properties []Property) error {
+	buz.DevKind = KindBuzzer
 	buz.Device.Init(name, logger, properties)
 
 	props := buz.GetProperties()
 	buz.GPIO = props.InitProperty("GPIO", "string", "GPIO18", "GPIO used to control buzzer").(string)
-	buz.Pin = gpioreg.ByName(buz.GPIO)
+	buz.Pin = buz.hw.PinByName(buz.GPIO)
+	buz.initSounds()
+
+	if buz.GPIO == "" {
+		return fmt.Errorf("buzzer '%s' has no GPIO", name)
+	}
+	if buz.Pin == nil {
+		return fmt.Errorf("buzzer '%s' uses unknown GPIO '%s'", name, buz.GPIO)
+	}
 	buz.LogMessage("Set buzzer %s '%s'", name, buz.GPIO)
+	return nil
+}
+
+// initSounds loads the default sounds and every "Sound <name>" property of the buzzer.
+// Sounds that cannot be parsed are logged and left out
+func (buz *Buzzer) initSounds() {
+	props := buz.GetProperties()
+	for _, def := range defaultSounds {
+		props.InitProperty(soundPrefix+def.name, "string", def.sound, soundComment)
+	}
 
 	buz.Sounds = make(map[string][]SoundBit)
-	buz.Sounds["Main"] = []SoundBit{
-		{100, 200, 20},
-		{100, 200, 20},
-		{100, 200, 20},
+	for name, prop := range *props {
+		if !strings.HasPrefix(name, soundPrefix) {
+			continue
+		}
+		value, _ := prop.Value.(string)
+		bits, err := parseSound(value)
+		if err != nil {
+			buz.LogError("Sound '%s' not loaded: %s", name, err)
+			continue
+		}
+		buz.Sounds[strings.TrimPrefix(name, soundPrefix)] = bits
 	}
-	return nil
+}
+
+// queueSound queues sound name to be played by play once the sounds queued before have played.
+// The player goroutine starts with the first sound. Sounds are refused once the buzzer is stopped
+func (buz *Buzzer) queueSound(name string, play func([]SoundBit) error) error {
+	sound, ok := buz.Sounds[name]
+	if !ok {
+		return fmt.Errorf("unknown sound '%s'", name)
+	}
+
+	buz.queueMu.Lock()
+	defer buz.queueMu.Unlock()
+	if buz.stopped {
+		return fmt.Errorf("buzzer '%s' is stopped", buz.Name())
+	}
+	if buz.queue == nil {
+		buz.queue = make(chan []SoundBit, soundQueueSize)
+		go buz.player(buz.queue, play)
+	}
+
+	buz.playing.Add(1)
+	select {
+	case buz.queue <- sound:
+		return nil
+	default:
+		buz.playing.Done()
+		return fmt.Errorf("sound queue of '%s' is full", buz.Name())
+	}
+}
+
+// player plays the sounds of queue until it is closed. Sounds still queued when the buzzer
+// stops are dropped
+func (buz *Buzzer) player(queue chan []SoundBit, play func([]SoundBit) error) {
+	for bits := range queue {
+		if !buz.isStopped() {
+			if err := play(bits); err != nil {
+				buz.LogError("Unable to play sound: %s", err)
+			}
+		}
+		buz.playing.Done()
+	}
+}
+
+func (buz *Buzzer) isStopped() bool {
+	buz.queueMu.Lock()
+	defer buz.queueMu.Unlock()
+	return buz.stopped
+}
+
+// wait blocks until the queued sounds have played
+func (buz *Buzzer) wait() {
+	buz.playing.Wait()
 }
 
 func (buz *Buzzer) OnStart() error {
 
-	if _, err := host.Init(); err != nil {
+	if err := buz.hw.Init(); err != nil {
 		return err
 	}
 
+	buz.startQueue()
 	buz.Off()
 	return nil
 }
 
+// OnStop waits for the sound playing to end and turns the buzzer off
 func (buz *Buzzer) OnStop() error {
+	buz.stopQueue()
 	buz.Off()
 	return nil
 }
 
+// startQueue lets sounds be queued again after stopQueue
+func (buz *Buzzer) startQueue() {
+	buz.queueMu.Lock()
+	buz.stopped = false
+	buz.queueMu.Unlock()
+}
+
+// stopQueue refuses new sounds, drops the queued ones and waits for the sound playing to end
+func (buz *Buzzer) stopQueue() {
+	buz.queueMu.Lock()
+	buz.stopped = true
+	if buz.queue != nil {
+		close(buz.queue)
+		buz.queue = nil
+	}
+	buz.queueMu.Unlock()
+
+	buz.playing.Wait()
+}
+
 func (buz *Buzzer) On() error {
 
 	err := buz.Pin.Out(gpio.High)
@@ -83,28 +202,107 @@ type ActiveBuzzer struct {
 }
 
 func (buz *ActiveBuzzer) GetDefaultsConfig() ([]config.PropertyConfig, error) {
-	return []config.PropertyConfig{
+	return append([]config.PropertyConfig{
 		{Name: "Name", Type: "string", Hidden: true, Value: "Main Buzzer", Comment: "Buzzer Name", Choice: ""},
-		{Name: "GPIO", Type: "string", Hidden: false, Value: "GPIO18", Comment: "GPIO by name", Choice: "", Select: "GPIO18,GPIO22"},
-	}, nil
+		{Name: "GPIO", Type: "string", Hidden: false, Value: "GPIO18", Comment: "GPIO by name", Choice: "", Select: gpioPins()},
+	}, soundDefaultsConfig()...), nil
 
 }
 
+// PlaySound queues the sound and returns without waiting for it to play
 func (buz *ActiveBuzzer) PlaySound(name string) error {
+	return buz.queueSound(name, buz.PlaySoundBit)
+}
 
-	if sound, ok := buz.Sounds[name]; ok {
-		buz.PlaySoundBit(sound)
+// PlaySoundBit plays the sound bits at the buzzer's own tone and returns when done
+func (buz *ActiveBuzzer) PlaySoundBit(soundBits []SoundBit) error {
+	buz.playMu.Lock()
+	defer buz.playMu.Unlock()
+
+	buz.LogDebug("Play Sound")
+	for _, bit := range soundBits {
+		if bit.Level > 0 && bit.On > 0 {
+			buz.On()
+			time.Sleep(time.Duration(bit.On) * time.Millisecond)
+			buz.Off()
+		} else {
+			time.Sleep(time.Duration(bit.On) * time.Millisecond)
+		}
+		time.Sleep(time.Duration(bit.Off) * time.Millisecond)
 	}
 
+	buz.Off()
+
 	return nil
 }
 
-func (buz *ActiveBuzzer) PlaySoundBit(soundBits []SoundBit) error {
-	buz.LogMessage("Play Sound")
+// PassiveBuzzer is a buzzer without its own oscillator. It is driven by PWM so sounds play
+// each bit at its note frequency
+type PassiveBuzzer struct {
+	Buzzer
+	Frequency int
+}
+
+func (buz *PassiveBuzzer) Init(name string, logger *Logger, properties []Property) error {
+	if err := buz.Buzzer.Init(name, logger, properties); err != nil {
+		return err
+	}
+	props := buz.GetProperties()
+	buz.Frequency = int(props.InitProperty("Frequency", "int", int64(2000), "Hz of sounds without notes").(int64))
+	return nil
+}
+
+func (buz *PassiveBuzzer) GetDefaultsConfig() ([]config.PropertyConfig, error) {
+	return append([]config.PropertyConfig{
+		{Name: "Name", Type: "string", Hidden: true, Value: "Main Buzzer", Comment: "Buzzer Name", Choice: ""},
+		{Name: "GPIO", Type: "string", Hidden: false, Value: "GPIO18", Comment: "PWM GPIO by name", Choice: "", Select: "GPIO12,GPIO13,GPIO18,GPIO19"},
+		{Name: "Frequency", Type: "int", Hidden: false, Value: "2000", Comment: "Hz of sounds without notes", Choice: ""},
+	}, soundDefaultsConfig()...), nil
+}
+
+// On sounds the buzzer at its frequency
+func (buz *PassiveBuzzer) On() error {
+	if err := buz.tone(buz.Frequency, 100); err != nil {
+		buz.LogMessage("cannot set value On: %s", err)
+	}
+	return nil
+}
+
+// tone drives the pin at freq Hz. Level 100 is a square wave, lower levels shorten the pulse
+func (buz *PassiveBuzzer) tone(freq int, level int) error {
+	if level > 100 {
+		level = 100
+	}
+	duty := gpio.Duty(int64(gpio.DutyHalf) * int64(level) / 100)
+	return buz.Pin.PWM(duty, physic.Frequency(freq)*physic.Hertz)
+}
+
+// PlaySound queues the sound and returns without waiting for it to play
+func (buz *PassiveBuzzer) PlaySound(name string) error {
+	return buz.queueSound(name, buz.PlaySoundBit)
+}
+
+// PlaySoundBit plays each sound bit at its note and returns when done
+func (buz *PassiveBuzzer) PlaySoundBit(soundBits []SoundBit) error {
+	buz.playMu.Lock()
+	defer buz.playMu.Unlock()
+
+	buz.LogDebug("Play Sound")
 	for _, bit := range soundBits {
-		buz.On()
-		time.Sleep(time.Duration(bit.On) * time.Millisecond)
-		buz.Off()
+		if bit.Level > 0 && bit.On > 0 {
+			freq := bit.Freq
+			if freq <= 0 {
+				freq = buz.Frequency
+			}
+			if err := buz.tone(freq, bit.Level); err != nil {
+				buz.Off()
+				return err
+			}
+			time.Sleep(time.Duration(bit.On) * time.Millisecond)
+			buz.Off()
+		} else {
+			time.Sleep(time.Duration(bit.On) * time.Millisecond)
+		}
 		time.Sleep(time.Duration(bit.Off) * time.Millisecond)
 	}
 
@@ -120,22 +318,26 @@ type DummyBuzzer struct {
 func (buz *DummyBuzzer) Init(name string, logger *Logger, properties []Property) error {
 	properties = append(properties, CreateDummyProp())
 
+	buz.DevKind = KindBuzzer
 	buz.Device.Init(name, logger, properties)
+	buz.initSounds()
 	return nil
 }
 
 func (buz *DummyBuzzer) GetDefaultsConfig() ([]config.PropertyConfig, error) {
-	return []config.PropertyConfig{
+	return append([]config.PropertyConfig{
 		{Name: "Name", Type: "string", Hidden: true, Value: "Main Buzzer", Comment: "Buzzer Name", Choice: ""},
-	}, nil
+	}, soundDefaultsConfig()...), nil
 
 }
 
 func (buz *DummyBuzzer) OnStart() error {
+	buz.startQueue()
 	return nil
 }
 
 func (buz *DummyBuzzer) OnStop() error {
+	buz.stopQueue()
 	return nil
 }
 
@@ -148,10 +350,17 @@ func (buz *DummyBuzzer) Off() error {
 }
 
 func (buz *DummyBuzzer) PlaySound(name string) error {
-	return nil
+	buz.LogDebug("Play sound '%s'", name)
+	return buz.queueSound(name, buz.PlaySoundBit)
 }
 
+// PlaySoundBit takes as long as the sound would play
 func (buz *DummyBuzzer) PlaySoundBit(soundBits []SoundBit) error {
-	buz.LogMessage("Play Sound it")
+	buz.playMu.Lock()
+	defer buz.playMu.Unlock()
+
+	for _, bit := range soundBits {
+		time.Sleep(time.Duration(bit.On+bit.Off) * time.Millisecond)
+	}
 	return nil
 }
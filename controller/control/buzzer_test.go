@@ -0,0 +1,198 @@
+package control
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/physic"
+)
+
+func TestActiveBuzzerTiming(t *testing.T) {
+	hw := useFakeHardware(t)
+	buz := new(ActiveBuzzer)
+	buz.Init("Main Buzzer", testLogger(), gpioProperties("GPIO18"))
+	pin := hw.pins["GPIO18"]
+
+	bits := []SoundBit{{100, 60, 30, 0}, {100, 40, 20, 0}}
+	start := time.Now()
+	buz.PlaySoundBit(bits)
+	elapsed := time.Since(start)
+
+	// On and Off for each bit and a final Off
+	changes := pin.Changes()
+	want := []gpio.Level{gpio.High, gpio.Low, gpio.High, gpio.Low, gpio.Low}
+	if len(changes) != len(want) {
+		t.Fatalf("pin written %d times, want %d", len(changes), len(want))
+	}
+	for i, change := range changes {
+		if change.Level != want[i] {
+			t.Errorf("write %d = %s, want %s", i, change.Level, want[i])
+		}
+	}
+
+	const slack = 50 * time.Millisecond
+	check := func(what string, got time.Duration, ms int) {
+		want := time.Duration(ms) * time.Millisecond
+		if got < want || got > want+slack {
+			t.Errorf("%s lasted %s, want %s", what, got, want)
+		}
+	}
+	check("first beep", changes[1].Time.Sub(changes[0].Time), bits[0].On)
+	check("first pause", changes[2].Time.Sub(changes[1].Time), bits[0].Off)
+	check("second beep", changes[3].Time.Sub(changes[2].Time), bits[1].On)
+	check("sound", elapsed, 60+30+40+20)
+}
+
+func TestActiveBuzzerPlaySound(t *testing.T) {
+	hw := useFakeHardware(t)
+	buz := new(ActiveBuzzer)
+	buz.Init("Main Buzzer", testLogger(), gpioProperties("GPIO18"))
+	buz.Sounds["Short"] = []SoundBit{{100, 10, 10, 0}}
+	buz.Sounds["Long"] = []SoundBit{{100, 100, 0, 0}}
+	pin := hw.pins["GPIO18"]
+
+	if err := buz.PlaySound("Unknown"); err == nil {
+		t.Error("unknown sound played")
+	}
+	if n := len(pin.Changes()); n != 0 {
+		t.Fatalf("unknown sound wrote pin %d times", n)
+	}
+
+	// sounds play in the background one after the other
+	start := time.Now()
+	buz.PlaySound("Long")
+	buz.PlaySound("Short")
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("PlaySound blocked for %s", elapsed)
+	}
+	buz.wait()
+
+	changes := pin.Changes()
+	want := []gpio.Level{gpio.High, gpio.Low, gpio.Low, gpio.High, gpio.Low, gpio.Low}
+	if len(changes) != len(want) {
+		t.Fatalf("sounds wrote pin %d times, want %d", len(changes), len(want))
+	}
+	for i, change := range changes {
+		if change.Level != want[i] {
+			t.Errorf("write %d = %s, want %s", i, change.Level, want[i])
+		}
+	}
+	if changes[3].Time.Sub(changes[0].Time) < 100*time.Millisecond {
+		t.Error("second sound started before the first ended")
+	}
+	if pin.Read() != gpio.Low {
+		t.Errorf("buzzer is on after sound")
+	}
+}
+
+func TestBuzzerSounds(t *testing.T) {
+	useFakeHardware(t)
+	buz := new(ActiveBuzzer)
+	buz.Init("Main Buzzer", testLogger(), append(gpioProperties("GPIO18"),
+		Property{Name: "Sound Main", PropType: "string", Value: "100:50:10"},
+		Property{Name: "Sound Tune", PropType: "string", Value: "Tune:d=8,o=5,b=120:c,e,g"},
+		Property{Name: "Sound Broken", PropType: "string", Value: "100:50"},
+	))
+
+	if got := buz.Sounds["Main"]; !reflect.DeepEqual(got, []SoundBit{{100, 50, 10, 0}}) {
+		t.Errorf("configured Main sound %v", got)
+	}
+	if got := buz.Sounds["Tune"]; len(got) != 3 || got[2].Freq != 784 {
+		t.Errorf("RTTTL sound %v", got)
+	}
+	if _, ok := buz.Sounds["Broken"]; ok {
+		t.Error("broken sound loaded")
+	}
+	for _, def := range defaultSounds[1:] {
+		if _, ok := buz.Sounds[def.name]; !ok {
+			t.Errorf("default sound %s not loaded", def.name)
+		}
+	}
+}
+
+func TestPassiveBuzzer(t *testing.T) {
+	hw := useFakeHardware(t)
+	buz := new(PassiveBuzzer)
+	buz.Init("Main Buzzer", testLogger(), append(gpioProperties("GPIO18"),
+		Property{Name: "Frequency", PropType: "int", Value: int64(1000)},
+		Property{Name: "Sound Tune", PropType: "string", Value: "Tune:d=16,o=4,b=240:a,p,c5"},
+	))
+	buz.Sounds["Beep"] = []SoundBit{{50, 10, 0, 0}}
+	pin := hw.pins["GPIO18"]
+
+	buz.PlaySound("Tune")
+	buz.PlaySound("Beep")
+	buz.wait()
+
+	// a note and Off for each note, the pause only waits, Off at the end of each sound
+	tones := []struct {
+		freq physic.Frequency
+		duty gpio.Duty
+	}{{440, gpio.DutyHalf}, {0, 0}, {523, gpio.DutyHalf}, {0, 0}, {0, 0}, {1000, gpio.DutyHalf / 2}, {0, 0}, {0, 0}}
+	changes := pin.Changes()
+	if len(changes) != len(tones) {
+		t.Fatalf("sounds wrote pin %d times, want %d", len(changes), len(tones))
+	}
+	for i, tone := range tones {
+		if changes[i].Freq != tone.freq*physic.Hertz || changes[i].Duty != tone.duty {
+			t.Errorf("write %d = %s at duty %s, want %d Hz at %s", i, changes[i].Freq, changes[i].Duty, tone.freq, tone.duty)
+		}
+	}
+	if changes[2].Time.Sub(changes[0].Time) < 120*time.Millisecond {
+		t.Error("pause not played between notes")
+	}
+}
+
+func TestBuzzerUnknownGPIO(t *testing.T) {
+	useFakeHardware(t)
+	if err := new(ActiveBuzzer).Init("Main Buzzer", testLogger(), gpioProperties("GPIO99")); err == nil {
+		t.Error("buzzer on unknown GPIO initialized")
+	}
+	if err := new(PassiveBuzzer).Init("Main Buzzer", testLogger(), gpioProperties("")); err == nil {
+		t.Error("buzzer without GPIO initialized")
+	}
+}
+
+func TestBuzzerStop(t *testing.T) {
+	hw := useFakeHardware(t)
+	buz := new(ActiveBuzzer)
+	if err := buz.Init("Main Buzzer", testLogger(), gpioProperties("GPIO18")); err != nil {
+		t.Fatal(err)
+	}
+	buz.OnStart()
+	buz.Sounds["Long"] = []SoundBit{{100, 100, 0, 0}}
+	pin := hw.pins["GPIO18"]
+
+	buz.PlaySound("Long")
+	buz.PlaySound("Long")
+	waitFor(t, time.Second, "sound to start", func() bool { return pin.Read() == gpio.High })
+
+	// the playing sound ends before the pin goes low, the queued sound is dropped
+	start := time.Now()
+	buz.OnStop()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 150*time.Millisecond {
+		t.Errorf("OnStop returned after %s", elapsed)
+	}
+	changes := pin.Changes()
+	want := []gpio.Level{gpio.Low, gpio.High, gpio.Low, gpio.Low, gpio.Low}
+	if len(changes) != len(want) {
+		t.Fatalf("pin written %d times, want %d", len(changes), len(want))
+	}
+	for i, change := range changes {
+		if change.Level != want[i] {
+			t.Errorf("write %d = %s, want %s", i, change.Level, want[i])
+		}
+	}
+	if err := buz.PlaySound("Long"); err == nil {
+		t.Error("sound queued after OnStop")
+	}
+
+	// sounds play again after a restart
+	buz.OnStart()
+	if err := buz.PlaySound("Long"); err != nil {
+		t.Errorf("sound not queued after OnStart: %s", err)
+	}
+	buz.wait()
+}
@@ -1,15 +1,23 @@
 package control
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
-	"reflect"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"../config"
-	"../www/cmd/server"
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/mqtt"
+	"github.com/gigatropolis/brewbrat/controller/www"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+	"github.com/gigatropolis/brewbrat/controller/www/cmd/server"
 )
 
 const (
@@ -29,11 +37,8 @@ func (er *sErr) String() string {
 // SensorValues stores updated values from all registered sensors
 type SensorValues map[string]float64
 
-//RegDevices stores all device types that can be used.
-type RegDevices map[string]reflect.Type
-
 type Controller interface {
-	InitController(reg *RegDevices, log *Logger, sensors []string, fileName string, isDummyController bool)
+	InitController(reg *Registry, log *Logger, sensors []string, cmdMode int, fileName string, isDummyController bool) error
 	HandleWebMessage(msg server.ServerCommand)
 	OnHandleMessages()
 	Run()
@@ -41,7 +46,7 @@ type Controller interface {
 }
 
 type Control struct {
-	regDevices        *RegDevices
+	registry          *Registry
 	configuration     *config.BrewController
 	logger            *Logger
 	isDummyController bool
@@ -50,14 +55,26 @@ type Control struct {
 	sensors           map[string]ISensor
 	equipment         map[string]IEquipment
 	buzzers           map[string]IBuzzer
-
-	chnSensorValue chan SensorMessage
-	sensorValues   SensorValues
-	svrIn          server.SvrChanIn
-	svrOut         server.SvrChanOut
-	EqIn           chan EquipMessage
-	EqOut          chan EquipMessage
-	chnAlive       chan int
+	props             Properties
+	mqtt              *mqtt.Bridge
+	history           *History
+	usage             *Usage
+	timers            *Timers
+	alarms            *Alarms
+	alarmOut          alarmOutputs
+	logRing           *LogRing
+	plugins           []*Plugin
+	bus               *EventBus
+
+	overrides  map[string]actorOverride
+	overrideMu sync.Mutex
+
+	sensorValues SensorValues
+	sensorTimes  map[string]time.Time
+	valuesMu     sync.RWMutex
+	svrIn        server.SvrChanIn
+	svrOut       server.SvrChanOut
+	chnAlive     chan int
 }
 
 type CmdInfo struct {
@@ -70,25 +87,25 @@ type CmdInfo struct {
 	SSRs                      []string
 }
 
-func (ctrl *Control) InitController(reg *RegDevices, log *Logger, sensors []string, cmdMode int, fileName string, isDummyController bool) error {
-	ctrl.regDevices = reg
+func (ctrl *Control) InitController(reg *Registry, log *Logger, sensors []string, cmdMode int, fileName string, isDummyController bool) error {
+	ctrl.registry = reg
 	ctrl.logger = log
 	ctrl.isDummyController = isDummyController
 	ctrl.configFileName = fileName
 
-	ctrl.chnSensorValue = make(chan SensorMessage, 4)
+	ctrl.bus = NewEventBus(log)
 	ctrl.svrIn = make(server.SvrChanIn)
 	ctrl.svrOut = make(server.SvrChanOut)
-	ctrl.EqIn = make(chan EquipMessage, 4)
-	ctrl.EqOut = make(chan EquipMessage, 4)
 	ctrl.chnAlive = make(chan int)
 
 	ctrl.sensors = make(map[string]ISensor)
 	ctrl.actors = make(map[string]IActor)
+	ctrl.overrides = make(map[string]actorOverride)
 	ctrl.equipment = make(map[string]IEquipment)
 	ctrl.buzzers = make(map[string]IBuzzer)
 
 	ctrl.sensorValues = make(SensorValues)
+	ctrl.sensorTimes = make(map[string]time.Time)
 
 	var availableLinknetAddresses []uint64
 	if !ctrl.isDummyController {
@@ -117,29 +134,10 @@ func (ctrl *Control) InitController(reg *RegDevices, log *Logger, sensors []stri
 		ctrl.logger.LogMessage("fileName=%s", fileName)
 		if fileName == "default" {
 			ctrl.configFileName = "configuration.xml"
-			ctrl.SetDefaultConfiguration(availableLinknetAddresses, rels, ssrs)
-		} else {
-
-			ctrl.SetDefaultConfiguration(availableLinknetAddresses, rels, ssrs)
-
-			//var availableLinknetAddresses []uint64
-			//if !ctrl.isDummyController {
-			//	availableLinknetAddresses, _ = GetActiveNetlinkAddresses(ctrl.logger)
-			//}
-
-			//rels := []string{"GPIO21", "GPIO20"}
-			//ssrs := []string{"GPIO16"}
-			//defaultConfiguration, conErr := config.DefaultConfiguration(availableLinknetAddresses, rels, ssrs, ctrl.isDummyController)
-			//if conErr != nil {
-			//	ctrl.logger.LogMessage("Unable to create default configuration::%s", conErr.Error())
-			//}
-
-			//configFile, _ := xml.MarshalIndent(defaultConfiguration, "", "   ")
-			//fmt.Println(string(configFile))
-			//ioutil.WriteFile(ctrl.configFileName, configFile, 0644)
-			//ctrl.configuration = &defaultConfiguration
 		}
-
+		if err := ctrl.createConfiguration(sensors, availableLinknetAddresses, rels, ssrs); err != nil {
+			return err
+		}
 	} else {
 		//ctrl.SetDefaultConfiguration()
 		ctrl.logger.LogError("Unknown command mode (%d)", cmdMode)
@@ -164,38 +162,61 @@ func (ctrl *Control) SetDefaultConfiguration(availableLinknetAddresses []uint64,
 }
 
 func (ctrl *Control) InitializeConfiguration() {
+	ctrl.props = NewProperties()
+	ctrl.props.AddProperties(toProperties(ctrl.configuration.Properties))
+	ctrl.startLogSinks()
+	ctrl.startLogRing()
+	ctrl.startPlugins()
+
 	for _, sensor := range ctrl.configuration.Sensors {
-		if _, ok := (*ctrl.regDevices)[sensor.Type]; ok {
-			t1 := reflect.New((*ctrl.regDevices)[sensor.Type]).Interface().(ISensor)
-			t1.InitSensor(sensor.Name, ctrl.logger, toProperties(sensor.Properties), ctrl.chnSensorValue)
-			ctrl.sensors[sensor.Name] = t1
+		dev, err := ctrl.registry.New(KindSensor, sensor.Type)
+		if err != nil {
+			ctrl.logger.LogError("Sensor '%s' not created: %s", sensor.Name, err)
+			continue
 		}
+		t1 := dev.(ISensor)
+		t1.InitSensor(sensor.Name, ctrl.logger, toProperties(sensor.Properties), ctrl.bus)
+		ctrl.sensors[sensor.Name] = t1
 	}
 
 	for _, actor := range ctrl.configuration.Actors {
-		if _, ok := (*ctrl.regDevices)[actor.Type]; ok {
-			t1 := reflect.New((*ctrl.regDevices)[actor.Type]).Interface().(IActor)
-			t1.Init(actor.Name, ctrl.logger, toProperties(actor.Properties))
-			ctrl.actors[actor.Name] = t1
+		dev, err := ctrl.registry.New(KindActor, actor.Type)
+		if err != nil {
+			ctrl.logger.LogError("Actor '%s' not created: %s", actor.Name, err)
+			continue
 		}
+		t1 := dev.(IActor)
+		if err := t1.Init(actor.Name, ctrl.logger, toProperties(actor.Properties)); err != nil {
+			ctrl.logger.LogError("Actor '%s' not created: %s", actor.Name, err)
+			continue
+		}
+		ctrl.actors[actor.Name] = t1
 	}
+	ctrl.startUsage()
 
 	for _, eq := range ctrl.configuration.Equipment {
-
-		if _, ok := (*ctrl.regDevices)[eq.Type]; ok {
-			t1 := reflect.New((*ctrl.regDevices)[eq.Type]).Interface().(IEquipment)
-			t1.InitEquipment(eq.Name, ctrl.logger, toProperties(eq.Properties), ctrl.EqIn, ctrl.EqOut)
-			ctrl.equipment[eq.Name] = t1
+		dev, err := ctrl.registry.New(KindEquipment, eq.Type)
+		if err != nil {
+			ctrl.logger.LogError("Equipment '%s' not created: %s", eq.Name, err)
+			continue
 		}
+		t1 := dev.(IEquipment)
+		t1.InitEquipment(eq.Name, ctrl.logger, toProperties(eq.Properties), ctrl.bus)
+		ctrl.equipment[eq.Name] = t1
 	}
 
 	for _, buz := range ctrl.configuration.Buzzers {
-
-		if _, ok := (*ctrl.regDevices)[buz.Type]; ok {
-			t1 := reflect.New((*ctrl.regDevices)[buz.Type]).Interface().(IBuzzer)
-			t1.Init(buz.Name, ctrl.logger, toProperties(buz.Properties))
-			ctrl.buzzers[buz.Name] = t1
+		dev, err := ctrl.registry.New(KindBuzzer, buz.Type)
+		if err != nil {
+			ctrl.logger.LogError("Buzzer '%s' not created: %s", buz.Name, err)
+			continue
 		}
+		t1 := dev.(IBuzzer)
+		if err := t1.Init(buz.Name, ctrl.logger, toProperties(buz.Properties)); err != nil {
+			ctrl.logger.LogError("Buzzer '%s' not created: %s", buz.Name, err)
+			continue
+		}
+		ctrl.buzzers[buz.Name] = t1
 	}
 
 }
@@ -208,6 +229,7 @@ func (ctrl *Control) OnStart() {
 
 	for _, actor := range ctrl.actors {
 		actor.OnStart()
+		ctrl.actorChanged(actor)
 	}
 
 	for _, eq := range ctrl.equipment {
@@ -220,8 +242,31 @@ func (ctrl *Control) OnStart() {
 
 }
 
+// stopDevices calls OnStop() of all devices so actors are turned off, then stops plugin processes
+func (ctrl *Control) stopDevices() {
+	for _, eq := range ctrl.equipment {
+		eq.OnStop()
+	}
+	for _, actor := range ctrl.actors {
+		actor.OnStop()
+	}
+	ctrl.saveUsage()
+	for _, sensor := range ctrl.sensors {
+		sensor.OnStop()
+	}
+	for _, buzz := range ctrl.buzzers {
+		buzz.OnStop()
+	}
+	ctrl.stopPlugins()
+	ctrl.bus.Publish(Topic(TopicSession, "controller"), SessionEvent{Name: "controller", Event: SessionStopped})
+	ctrl.mqtt.Close()
+}
+
 func (ctrl *Control) Run() {
 
+	// subscribe before sensors publish their first reading
+	events := ctrl.bus.Subscribe("controller", Topic(TopicSensor, "#"), Topic(TopicActorCommand, "#"), Topic(TopicNotify, "#"))
+
 	for _, sensor := range ctrl.sensors {
 		go sensor.Run()
 	}
@@ -230,19 +275,227 @@ func (ctrl *Control) Run() {
 		go eq.Run()
 	}
 
-	ctrl.buzzers["Main Buzzer"].PlaySound("Main")
+	if buzzer, ok := ctrl.buzzers["Main Buzzer"]; ok {
+		buzzer.PlaySound("Main")
+	}
+
+	ctrl.startMQTT()
+	ctrl.startHistory()
+	ctrl.startTimers()
+	ctrl.startAlarms()
 
-	go ctrl.HandleDevices()
+	go ctrl.HandleDevices(events)
+	ctrl.bus.Publish(Topic(TopicSession, "controller"), SessionEvent{Name: "controller", Event: SessionStarted})
 
-	ctrl.logger.LogMessage("Web Server running at 127.0.0.1:8090")
-	go server.RunWebServer(ctrl.svrIn, ctrl.svrOut)
+	webOpts := ctrl.webOptions()
+	ctrl.logger.LogMessage("Web Server running at %s", webOpts.URL())
+	if webOpts.AssetDir != "" {
+		ctrl.logger.LogMessage("Web UI served from directory '%s'", webOpts.AssetDir)
+	}
+	go server.RunWebServer(ctrl.svrIn, ctrl.svrOut, webOpts)
 
 	go ctrl.HandleWebServer()
+	go ctrl.stopOnSignal()
 
 	<-ctrl.chnAlive
 
 }
 
+// stopOnSignal turns off actors and saves actor usage when the controller is interrupted or terminated
+func (ctrl *Control) stopOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	ctrl.logger.LogMessage("Stopping controller on signal '%s'", sig)
+	ctrl.stopDevices()
+	ctrl.logger.Sync()
+	os.Exit(0)
+}
+
+// SetProperty sets a controller property, overriding the value from configuration file.
+// Used for command line flags. Call after InitController()
+func (ctrl *Control) SetProperty(name string, propType string, value interface{}, comment string) {
+	ctrl.props.AddProperty(name, propType, value, comment)
+}
+
+// webOptions returns web server users and access settings from configuration
+func (ctrl *Control) webOptions() server.Options {
+	props := &ctrl.props
+	opts := server.Options{
+		Address:     props.InitProperty("Web Address", "string", "0.0.0.0", "Address web server listens on").(string),
+		Port:        int(props.InitProperty("Web Port", "int", int64(8090), "Port web server listens on").(int64)),
+		Assets:      www.Assets(),
+		AssetDir:    props.InitProperty("Web Assets", "string", "", "Directory of web UI files. Empty uses files built into controller").(string),
+		TLSCert:     props.InitProperty("Web TLS Cert", "string", "", "TLS certificate file. Serves https when cert and key are set").(string),
+		TLSKey:      props.InitProperty("Web TLS Key", "string", "", "TLS private key file").(string),
+		AuthEnabled: props.InitProperty("Web Authentication", "bool", true, "Require login or API token to use web server").(bool),
+	}
+
+	origins := props.InitProperty("Web CORS Origins", "string", "", "Comma separated origins allowed to call web API from other sites").(string)
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			opts.Origins = append(opts.Origins, origin)
+		}
+	}
+
+	for _, user := range ctrl.configuration.Users {
+		role := server.ParseRole(user.Role)
+		if role == server.RoleNone {
+			ctrl.logger.LogError("User '%s' has unknown role '%s'", user.Name, user.Role)
+			continue
+		}
+		opts.Users = append(opts.Users, server.User{Name: user.Name, Role: role, PasswordHash: user.Password, TokenHash: user.Token})
+	}
+
+	if !opts.AuthEnabled {
+		ctrl.logger.LogWarning("Web authentication is disabled. Anyone who can reach the web server can control devices")
+	} else if len(opts.Users) == 0 {
+		ctrl.logger.LogWarning("No web users configured. Add one with 'controller user -user <name> -role admin -password <password>'")
+	}
+	return opts
+}
+
+// startMQTT connects to MQTT broker if enabled in configuration properties.
+// Commands from the broker are sent on the same channel as the web server.
+func (ctrl *Control) startMQTT() {
+	props := &ctrl.props
+	if !props.InitProperty("MQTT Enabled", "bool", false, "Publish state and accept commands over MQTT").(bool) {
+		return
+	}
+
+	opts := mqtt.Options{
+		Broker:   props.InitProperty("MQTT Broker", "string", "tcp://127.0.0.1:1883", "MQTT broker URL").(string),
+		ClientID: props.InitProperty("MQTT Client ID", "string", "brewbrat", "MQTT client ID").(string),
+		Username: props.InitProperty("MQTT Username", "string", "", "MQTT user name").(string),
+		Password: props.InitProperty("MQTT Password", "string", "", "MQTT password").(string),
+		Topic:    props.InitProperty("MQTT Topic", "string", "brewbrat", "Root of MQTT topic tree").(string),
+		QoS:      byte(props.InitProperty("MQTT QoS", "int", int64(0), "MQTT quality of service (0, 1 or 2)").(int64)),
+		Retain:   props.InitProperty("MQTT Retain", "bool", true, "Retain published state messages").(bool),
+	}
+
+	bridge := mqtt.NewBridge(opts, ctrl.svrOut, ctrl.logger)
+	if err := bridge.Connect(); err != nil {
+		ctrl.logger.LogError("Unable to connect to MQTT broker '%s': %s", opts.Broker, err)
+		bridge.Close()
+		return
+	}
+	ctrl.mqtt = bridge
+	go ctrl.publishMQTT(ctrl.bus.Subscribe("mqtt", Topic(TopicSensor, "#"), Topic(TopicActor, "#"), Topic(TopicSetpoint, "#"), Topic(TopicEquipment, "#")))
+
+	for name, actor := range ctrl.actors {
+		mode, _ := ctrl.actorMode(name)
+		ctrl.mqtt.PublishActor(name, actor.GetState() == StateOn, actor.GetPowerLevel(), mode == api.ActorManual)
+	}
+	for name, eq := range ctrl.equipment {
+		if setpoint, err := eq.GetSetpoint(); err == nil {
+			ctrl.mqtt.PublishSetpoint(name, setpoint)
+		}
+		ctrl.mqtt.PublishMode(name, eq.GetState() == EqStateActive)
+	}
+
+	if props.InitProperty("HA Discovery", "bool", false, "Publish Home Assistant MQTT discovery").(bool) {
+		prefix := props.InitProperty("HA Discovery Prefix", "string", "homeassistant", "Home Assistant discovery topic prefix").(string)
+		ctrl.mqtt.PublishDiscovery(prefix, ctrl.inventory())
+	}
+}
+
+// publishMQTT sends sensor readings and changes of actors and equipment to the MQTT broker
+func (ctrl *Control) publishMQTT(events *Subscription) {
+	for ev := range events.C {
+		switch payload := ev.Payload.(type) {
+		case SensorEvent:
+			ctrl.mqtt.PublishSensor(payload.Name, payload.Value)
+		case ActorEvent:
+			ctrl.mqtt.PublishActor(payload.Name, payload.State == StateOn, payload.Power, payload.Manual)
+		case SetpointEvent:
+			ctrl.mqtt.PublishSetpoint(payload.Name, payload.Setpoint)
+		case EquipmentEvent:
+			ctrl.mqtt.PublishMode(payload.Name, payload.State == EqStateActive)
+		}
+	}
+}
+
+// startHistory creates the in-memory history of equipment temperatures used by web UI charts
+func (ctrl *Control) startHistory() {
+	props := &ctrl.props
+	interval := props.InitProperty("History Interval", "int", int64(5), "Seconds between samples of equipment history").(int64)
+	hours := props.InitProperty("History Hours", "int", int64(24), "Hours of equipment history kept in memory").(int64)
+	if interval < 1 {
+		interval = 1
+	}
+	ctrl.history = NewHistory(time.Duration(interval)*time.Second, time.Duration(hours)*time.Hour)
+}
+
+// recordHistory adds current temperature, setpoint and heater power of all equipment to history
+func (ctrl *Control) recordHistory(now time.Time) {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	for name, eq := range ctrl.equipment {
+		point := api.HistoryPoint{Time: ms, Active: eq.GetState() == EqStateActive}
+		ctrl.valuesMu.RLock()
+		point.Temperature, point.Valid = ctrl.sensorValues[eq.GetTemperatureSensor()]
+		ctrl.valuesMu.RUnlock()
+		point.Setpoint, _ = eq.GetSetpoint()
+		if heater, ok := ctrl.actors[eq.GetHeater()]; ok && heater.GetState() == StateOn {
+			point.Heater = 100
+			if heater.HasPowerControl() && heater.GetPowerLevel() > 0 {
+				point.Heater = heater.GetPowerLevel()
+			}
+		}
+		ctrl.history.Add(name, point)
+	}
+}
+
+// equipmentHistory returns recorded history of equipment for the range in query. See historyRange()
+func (ctrl *Control) equipmentHistory(name string, query string) (api.History, bool) {
+	eq, ok := ctrl.equipment[name]
+	if !ok || ctrl.history == nil {
+		return api.History{}, false
+	}
+	from, to, max := historyRange(query, time.Now())
+	hist := api.History{
+		Name:     name,
+		From:     from,
+		To:       to,
+		Interval: int(ctrl.history.Interval() / time.Second),
+		Points:   ctrl.history.Get(name, from, to, max),
+	}
+	if sensor, ok := ctrl.sensors[eq.GetTemperatureSensor()]; ok {
+		hist.Units = sensor.GetUnits()
+	}
+	if bands, ok := eq.(IHysteresis); ok {
+		hist.PowerOn, hist.PowerOff = bands.GetPowerBands()
+	}
+	return hist, true
+}
+
+// inventory lists all devices announced over MQTT discovery
+func (ctrl *Control) inventory() mqtt.Inventory {
+	inv := mqtt.Inventory{
+		Controller: ctrl.configuration.Name,
+		Version:    ctrl.configuration.Version,
+	}
+	for name, sensor := range ctrl.sensors {
+		inv.Sensors = append(inv.Sensors, mqtt.SensorInfo{Name: name, Units: sensor.GetUnits()})
+	}
+	for name, actor := range ctrl.actors {
+		inv.Actors = append(inv.Actors, mqtt.ActorInfo{Name: name, Power: actor.HasPowerControl()})
+	}
+	for name, eq := range ctrl.equipment {
+		info := mqtt.EquipmentInfo{Name: name, Sensor: eq.GetTemperatureSensor()}
+		if sensor, ok := ctrl.sensors[info.Sensor]; ok {
+			info.Units = sensor.GetUnits()
+		}
+		inv.Equipment = append(inv.Equipment, info)
+	}
+	return inv
+}
+
+// actorChanged publishes new state and mode of actor on the event bus
+func (ctrl *Control) actorChanged(actor IActor) {
+	mode, until := ctrl.actorMode(actor.Name())
+	ctrl.bus.Publish(Topic(TopicActor, actor.Name()), ActorEvent{Name: actor.Name(), State: actor.GetState(), Power: actor.GetPowerLevel(), Manual: mode == api.ActorManual, Until: until})
+}
+
 // HandleWebMessage recieves all messages coming from web UI and calls appropriate handlers
 func (ctrl *Control) HandleWebMessage(msg server.ServerCommand) {
 
@@ -252,11 +505,10 @@ func (ctrl *Control) HandleWebMessage(msg server.ServerCommand) {
 	case server.CmdSetRelay:
 		relay, ok := ctrl.actors[name]
 		if ok {
-			sVal := string(msg.Value)
-			if sVal == "ON" {
-				relay.On()
-			} else {
-				relay.Off()
+			if err := ctrl.setActorFromUser(relay, string(msg.Value)); err != nil {
+				ctrl.logger.LogWarning("Actor '%s' not set: %s", name, err)
+				msg.ChanReturn <- "bad"
+				break
 			}
 			state := relay.GetState()
 			if state == StateOn {
@@ -269,16 +521,28 @@ func (ctrl *Control) HandleWebMessage(msg server.ServerCommand) {
 		}
 	case server.CmdRelayOn:
 		if relay, ok := ctrl.actors[name]; ok {
-			relay.On()
+			ctrl.overrideActor(relay, 0, relay.On)
 		}
 		msg.ChanReturn <- "ack"
 	case server.CmdRelayOff:
 		if relay, ok := ctrl.actors[name]; ok {
-			relay.Off()
+			ctrl.overrideActor(relay, 0, relay.Off)
 		}
 		msg.ChanReturn <- "ack"
+	case server.CmdRelaySetPower:
+		relay, ok := ctrl.actors[name]
+		power, err := strconv.Atoi(string(msg.Value))
+		if !ok || err != nil || power < 0 || power > 100 {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		ctrl.overrideActor(relay, 0, func() error { return relay.SetPower(power) })
+		msg.ChanReturn <- fmt.Sprintf("%d", relay.GetPowerLevel())
 	case server.CmdGetSensorValue:
-		if sensor, ok := ctrl.sensorValues[name]; ok {
+		ctrl.valuesMu.RLock()
+		sensor, ok := ctrl.sensorValues[name]
+		ctrl.valuesMu.RUnlock()
+		if ok {
 			val := fmt.Sprintf("%.2f", sensor)
 			msg.ChanReturn <- val
 		} else {
@@ -309,26 +573,312 @@ func (ctrl *Control) HandleWebMessage(msg server.ServerCommand) {
 		} else {
 			msg.ChanReturn <- "bad"
 		}
+	case server.CmdSetSetpointValue:
+		eq, ok := ctrl.equipment[name]
+		setpoint, err := strconv.ParseFloat(string(msg.Value), 64)
+		if !ok || err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		ctrl.setSetpoint(name, eq, setpoint)
+		msg.ChanReturn <- fmt.Sprintf("%0.2f", setpoint)
+	case server.CmdSetEquipmentState:
+		eq, ok := ctrl.equipment[name]
+		if !ok {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		state := EqStateIdle
+		switch string(msg.Value) {
+		case mqtt.ModeHeat, "active", "ON", api.EquipmentActive:
+			state = EqStateActive
+		case mqtt.ModeOff, "idle", "OFF", api.EquipmentIdle:
+			state = EqStateIdle
+		default:
+			msg.ChanReturn <- "bad"
+			return
+		}
+		ctrl.setEquipmentState(name, eq, state)
+		msg.ChanReturn <- string(msg.Value)
+	case server.CmdGetStatus:
+		buf, err := json.Marshal(ctrl.status())
+		if err != nil {
+			ctrl.logger.LogError("Unable to create status: %s", err)
+			msg.ChanReturn <- "{}"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetUsage, server.CmdNewBatch:
+		if msg.Cmd == server.CmdNewBatch {
+			ctrl.usage.NewBatch(time.Now())
+			ctrl.logger.LogMessage("New batch of actor usage started")
+		}
+		buf, err := json.Marshal(ctrl.usage.Get(time.Now()))
+		if err != nil {
+			ctrl.logger.LogError("Unable to create usage: %s", err)
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetAutotune, server.CmdStartAutotune, server.CmdStopAutotune:
+		eq, ok := ctrl.equipment[name]
+		if !ok {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		var err error
+		switch msg.Cmd {
+		case server.CmdStartAutotune:
+			err = eq.StartAutotune(string(msg.Value) == "save")
+		case server.CmdStopAutotune:
+			err = eq.StopAutotune()
+		}
+		if err != nil {
+			ctrl.logger.LogWarning("Auto-tune command refused: %s", err)
+			msg.ChanReturn <- "error: " + err.Error()
+			break
+		}
+		buf, err := json.Marshal(eq.GetAutotune())
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetHeatUp:
+		if _, ok := ctrl.equipment[name]; !ok {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		var result interface{}
+		if steps := string(msg.Value); steps != "" {
+			eta, err := ctrl.scheduleETA(name, steps, time.Now())
+			if err != nil {
+				msg.ChanReturn <- "error: " + err.Error()
+				break
+			}
+			result = eta
+		} else {
+			heat, ok := ctrl.heatUp(name, time.Now())
+			if !ok {
+				msg.ChanReturn <- fmt.Sprintf("error: heating rate or temperature of '%s' is not known. Set its Volume or heat for a few minutes", name)
+				break
+			}
+			result = heat
+		}
+		buf, err := json.Marshal(result)
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetTimers:
+		buf, err := json.Marshal(ctrl.listTimers())
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdAddTimer:
+		req := api.TimerRequest{}
+		if err := json.Unmarshal(msg.Value, &req); err != nil {
+			msg.ChanReturn <- "error: timer is not valid JSON"
+			break
+		}
+		timer, err := ctrl.addTimer(req, time.Now())
+		if err != nil {
+			msg.ChanReturn <- "error: " + err.Error()
+			break
+		}
+		buf, err := json.Marshal(timer)
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdCancelTimer:
+		id, err := strconv.Atoi(name)
+		if err != nil || !ctrl.cancelTimer(id) {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- name
+	case server.CmdGetAlarms, server.CmdAckAlarm:
+		if msg.Cmd == server.CmdAckAlarm {
+			id, err := strconv.Atoi(name)
+			if err != nil || !ctrl.acknowledgeAlarms(id, time.Now()) {
+				msg.ChanReturn <- "bad"
+				break
+			}
+		}
+		buf, err := json.Marshal(ctrl.alarms.Get())
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetConfig:
+		buf, err := json.Marshal(ctrl.editorConfiguration())
+		if err != nil {
+			ctrl.logger.LogError("Unable to create configuration: %s", err)
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdSetConfig:
+		cfg := api.Configuration{}
+		result := api.ConfigResult{}
+		if err := json.Unmarshal(msg.Value, &cfg); err != nil {
+			result.Errors = []string{fmt.Sprintf("unable to read configuration: %s", err)}
+		} else {
+			result = ctrl.saveConfiguration(cfg)
+		}
+		buf, _ := json.Marshal(result)
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetHistory:
+		hist, ok := ctrl.equipmentHistory(name, string(msg.Value))
+		if !ok {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		buf, err := json.Marshal(hist)
+		if err != nil {
+			ctrl.logger.LogError("Unable to create history: %s", err)
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetLog:
+		if ctrl.logRing == nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		after, level, device, kind, max := logQuery(string(msg.Value))
+		buf, err := json.Marshal(ctrl.logRing.Get(after, level, device, kind, max))
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
+	case server.CmdGetLogLevels, server.CmdSetLogLevel:
+		if msg.Cmd == server.CmdSetLogLevel {
+			if err := ctrl.setLogLevel(string(msg.Value)); err != nil {
+				ctrl.logger.LogWarning("Log level not set: %s", err)
+				msg.ChanReturn <- "bad"
+				break
+			}
+		}
+		buf, err := json.Marshal(ctrl.logLevels())
+		if err != nil {
+			msg.ChanReturn <- "bad"
+			break
+		}
+		msg.ChanReturn <- string(buf)
 	default:
 		msg.ChanReturn <- "Unknown"
 	}
 }
 
+// setSetpoint changes setpoint of equipment and publishes it
+func (ctrl *Control) setSetpoint(name string, eq IEquipment, setpoint float64) {
+	eq.SetSetpoint(setpoint)
+	ctrl.bus.Publish(Topic(TopicSetpoint, name), SetpointEvent{Name: name, Setpoint: setpoint})
+}
+
+// setEquipmentState changes equipment to EqStateIdle or EqStateActive and publishes the new state
+func (ctrl *Control) setEquipmentState(name string, eq IEquipment, state int) {
+	eq.SetState(state)
+	ctrl.bus.Publish(Topic(TopicEquipment, name), EquipmentEvent{Name: name, State: eq.GetState()})
+}
+
+// status returns all configured devices with their current values
+func (ctrl *Control) status() api.Status {
+	status := api.Status{Name: ctrl.configuration.Name}
+
+	ctrl.valuesMu.RLock()
+	for _, conf := range ctrl.configuration.Sensors {
+		if sensor, ok := ctrl.sensors[conf.Name]; ok {
+			value, valid := ctrl.sensorValues[conf.Name]
+			status.Sensors = append(status.Sensors, api.Sensor{Name: conf.Name, Type: conf.Type, Units: sensor.GetUnits(), Value: value, Valid: valid})
+		}
+	}
+	ctrl.valuesMu.RUnlock()
+
+	for _, conf := range ctrl.configuration.Actors {
+		if actor, ok := ctrl.actors[conf.Name]; ok {
+			state := api.StateOff
+			if actor.GetState() == StateOn {
+				state = api.StateOn
+			}
+			info := api.Actor{Name: conf.Name, Type: conf.Type, State: state, Power: actor.GetPowerLevel(), PowerControl: actor.HasPowerControl()}
+			mode, until := ctrl.actorMode(conf.Name)
+			info.Mode = mode
+			if !until.IsZero() {
+				info.Until = until.UnixNano() / int64(time.Millisecond)
+			}
+			status.Actors = append(status.Actors, info)
+		}
+	}
+
+	for _, conf := range ctrl.configuration.Equipment {
+		eq, ok := ctrl.equipment[conf.Name]
+		if !ok {
+			continue
+		}
+		setpoint, _ := eq.GetSetpoint()
+		state := api.EquipmentIdle
+		if eq.GetState() == EqStateActive {
+			state = api.EquipmentActive
+		}
+		mode := "Historisis"
+		if eq.GetMode() == EqModePIDControl {
+			mode = "PID"
+		}
+		info := api.Equipment{
+			Name:     conf.Name,
+			Type:     conf.Type,
+			Sensor:   eq.GetTemperatureSensor(),
+			Heater:   eq.GetHeater(),
+			Pump:     eq.GetPump(),
+			Agitator: eq.GetAgitator(),
+			Setpoint: setpoint,
+			State:    state,
+			Mode:     mode,
+			Autotune: eq.GetAutotune().State,
+		}
+		if heat, ok := ctrl.heatUp(conf.Name, time.Now()); ok {
+			info.HeatUp = &heat
+		}
+		status.Equipment = append(status.Equipment, info)
+	}
+	if ctrl.alarms != nil {
+		status.Alarms = ctrl.alarms.Get().Current
+	}
+	return status
+}
+
 // OnHandleMessages called when HandleDevices() is idle to do any needed processing.
 func (ctrl *Control) OnHandleMessages() {
 	//ctrl.logger.LogDebug("(ctrl *Control) OnHandleMessages....")
 }
 
 // HandleWebServer recieves all incoming messages from web server
+// Gains found by auto-tune are saved here so the configuration is only changed by this goroutine.
+// Timed actions run here too so timers are only used by this goroutine.
 func (ctrl *Control) HandleWebServer() {
 	t := time.NewTicker(5000 * time.Millisecond)
 	tickCount := 0
+	autotune := ctrl.bus.Subscribe("autotune", Topic(TopicAutotune, "#"))
 	for true {
 		select {
 		case in := <-ctrl.svrOut:
 			//ctrl.logger.LogDebug("Got message")
 			ctrl.HandleWebMessage(in)
-		case <-t.C:
+		case ev := <-autotune.C:
+			if payload, ok := ev.Payload.(AutotuneEvent); ok {
+				ctrl.saveAutotune(payload)
+			}
+		case now := <-t.C:
+			ctrl.runTimers(now)
 			if tickCount > 10 {
 				ctrl.logger.LogDebug("tick")
 				tickCount = 0
@@ -338,67 +888,60 @@ func (ctrl *Control) HandleWebServer() {
 	}
 }
 
-// HandleDevices  listens on device channels like sensors and equipment to handle incomming messages.
-func (ctrl *Control) HandleDevices() {
+// HandleDevices receives sensor readings, actor commands and notifications from the event bus.
+// Actor changes are published back on the bus so equipment, MQTT and other subscribers see them.
+func (ctrl *Control) HandleDevices(events *Subscription) {
 	t := time.NewTicker(3000 * time.Millisecond)
-	//state := true
-	needUpdateSensors := false
-	needUpdateActors := false
-
-	for true {
-		needUpdateSensors = false
-		needUpdateActors = false
+	h := time.NewTicker(ctrl.history.Interval())
 
+	for {
 		select {
-		case resvMsg := <-ctrl.chnSensorValue:
-			//name := resvMsg.Name
-			//fmt.Println("Recieved from '%s': Value %.3f\n", name, resvMsg.Value)
-			ctrl.sensorValues[resvMsg.Name] = resvMsg.Value
-			needUpdateSensors = true
-		case eqMesg := <-ctrl.EqOut:
-			//fmt.Printf("Recieved from Equipment (%d) '%s' param(%s)\n", eqMesg.Cmd, eqMesg.DeviceName, eqMesg.StrParam1)
-			switch eqMesg.Cmd {
-			case CmdSendNotification:
-				sensor, ok := ctrl.sensors[eqMesg.DeviceName]
-				if ok {
-					sensor.SendNotification(eqMesg.StrParam1)
-				}
-			case CmdActorOn:
-				if relay, ok := ctrl.actors[eqMesg.DeviceName]; ok {
-					relay.On()
-					needUpdateActors = true
-				}
-			case CmdActorOff:
-				if relay, ok := ctrl.actors[eqMesg.DeviceName]; ok {
-					relay.Off()
-					needUpdateActors = true
+		case ev := <-events.C:
+			switch payload := ev.Payload.(type) {
+			case SensorEvent:
+				ctrl.valuesMu.Lock()
+				ctrl.sensorValues[payload.Name] = payload.Value
+				ctrl.sensorTimes[payload.Name] = ev.Time
+				ctrl.valuesMu.Unlock()
+			case ActorCommand:
+				ctrl.handleActorCommand(payload)
+			case NotifyEvent:
+				if sensor, ok := ctrl.sensors[payload.Name]; ok {
+					sensor.SendNotification(payload.Notification)
 				}
 			}
-		case <-t.C:
+		case now := <-t.C:
+			ctrl.expireOverrides(now)
 			ctrl.OnHandleMessages()
+		case now := <-h.C:
+			ctrl.recordHistory(now)
 		}
+	}
+}
 
-		if needUpdateActors || needUpdateSensors {
-			for _, eq := range ctrl.equipment {
-				sens := []SensValue{}
-				acts := []ActValue{}
-				if needUpdateSensors {
-					for name, senVal := range ctrl.sensorValues {
-						ctrl.logger.LogDebug("senVal '%s' %0.2f\n", name, senVal)
-						sens = append(sens, SensValue{Name: name, Value: senVal})
-					}
-				}
-				if needUpdateActors {
-					for _, act := range ctrl.actors {
-						acts = append(acts, ActValue{Name: act.Name(), State: act.GetState(), Power: act.GetPowerLevel()})
-					}
-
-				}
-				ctrl.EqIn <- EquipMessage{Name: eq.Name(), Cmd: CmdUpdateDevices, Sensors: sens, Actors: acts}
-			}
-		}
-
+// handleActorCommand switches actor as requested by equipment. Commands for manual actors are ignored
+func (ctrl *Control) handleActorCommand(cmd ActorCommand) {
+	relay, ok := ctrl.actors[cmd.Name]
+	if !ok {
+		ctrl.logger.LogWarning("'%s' sent command for unknown actor '%s'", cmd.Source, cmd.Name)
+		return
+	}
+	ctrl.overrideMu.Lock()
+	if _, manual := ctrl.overrides[cmd.Name]; manual {
+		ctrl.overrideMu.Unlock()
+		ctrl.logger.LogDebug("'%s' command for manual actor '%s' ignored", cmd.Source, cmd.Name)
+		return
+	}
+	switch cmd.Cmd {
+	case ActorCmdOn:
+		relay.On()
+	case ActorCmdOff:
+		relay.Off()
+	case ActorCmdPower:
+		relay.SetPower(cmd.Power)
 	}
+	ctrl.overrideMu.Unlock()
+	ctrl.actorChanged(relay)
 }
 
 func toProperties(propsConfig []config.PropertyConfig) []Property {
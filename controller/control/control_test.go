@@ -0,0 +1,130 @@
+package control
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"periph.io/x/periph/conn/gpio"
+)
+
+// testConfiguration is a mash tun heated by an SSR with a DS18B20 in the mash
+func testConfiguration() config.BrewController {
+	return config.BrewController{
+		Name: "test",
+		Sensors: []config.SensorConfig{{
+			Name: "Mash Temp",
+			Type: "TempSensor",
+			Properties: []config.PropertyConfig{
+				{Name: "Address", Type: "uint", Value: "216172825519340840"},
+				{Name: "Units", Type: "string", Value: "°C"},
+			},
+		}},
+		Actors: []config.ActorsConfig{
+			{Name: "Heater", Type: "SimpleSSR", Properties: []config.PropertyConfig{{Name: "GPIO", Type: "string", Value: "GPIO16"}}},
+			{Name: "Pump", Type: "SimpleRelay", Properties: []config.PropertyConfig{{Name: "GPIO", Type: "string", Value: "GPIO21"}}},
+		},
+		Equipment: []config.EquipmentConfig{{
+			Name: "Mash Tun",
+			Type: "SimpleRIMM",
+			Properties: []config.PropertyConfig{
+				{Name: "Temperature Sensor", Type: "string", Value: "Mash Temp"},
+				{Name: "Temperature Setpoint", Type: "float", Value: "65"},
+				{Name: "Power On", Type: "float", Value: "0.8"},
+				{Name: "Power Off", Type: "float", Value: "0.3"},
+				{Name: "Heater", Type: "string", Value: "Heater"},
+				{Name: "Pump", Type: "string", Value: "Pump"},
+				{Name: "Agitator", Type: "string", Value: ""},
+			},
+		}},
+		Properties: []config.PropertyConfig{
+			{Name: "Web Address", Type: "string", Value: "127.0.0.1"},
+			{Name: "Web Port", Type: "int", Value: "0"},
+			{Name: "Web Authentication", Type: "bool", Value: "false"},
+			{Name: "Usage File", Type: "string", Value: ""},
+		},
+	}
+}
+
+func TestHysteresisControl(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reads sensor through DS18B20 conversions")
+	}
+	hw := useFakeHardware(t)
+	hw.oneWire.Add(mashProbe, 60)
+
+	buf, err := xml.Marshal(testConfiguration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "configuration.xml")
+	if err := ioutil.WriteFile(fileName, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctrl := &Control{}
+	if err := ctrl.InitController(DefaultRegistry, testLogger(), nil, RunCmdMode, fileName, false); err != nil {
+		t.Fatal(err)
+	}
+	sensor, ok := ctrl.sensors["Mash Temp"].(*TempSensor)
+	if !ok {
+		t.Fatalf("sensor not created from configuration")
+	}
+	mash, ok := ctrl.equipment["Mash Tun"].(*SimpleRIMM)
+	if !ok {
+		t.Fatalf("equipment not created from configuration")
+	}
+	sensor.readInterval = 50 * time.Millisecond
+	mash.stepInterval = 50 * time.Millisecond
+
+	ctrl.OnStart()
+	actorEvents := ctrl.bus.Subscribe("test", Topic(TopicActor, "Heater"))
+	defer actorEvents.Close()
+	go ctrl.Run()
+
+	heater := hw.pins["GPIO16"]
+	heaterOn := func() bool { return heater.Read() == gpio.High }
+
+	// 60°C is more than "Power On" below setpoint
+	waitFor(t, 10*time.Second, "heater on", heaterOn)
+
+	// within the band the heater stays on
+	hw.oneWire.SetTemp(mashProbe, 64.5)
+	time.Sleep(2 * time.Second)
+	if !heaterOn() {
+		t.Fatal("heater turned off inside hysteresis band")
+	}
+
+	// less than "Power Off" below setpoint
+	hw.oneWire.SetTemp(mashProbe, 64.8)
+	waitFor(t, 10*time.Second, "heater off", func() bool { return !heaterOn() })
+
+	hw.oneWire.SetTemp(mashProbe, 64.5)
+	time.Sleep(2 * time.Second)
+	if heaterOn() {
+		t.Fatal("heater turned on inside hysteresis band")
+	}
+
+	hw.oneWire.SetTemp(mashProbe, 64)
+	waitFor(t, 10*time.Second, "heater on again", heaterOn)
+
+	// on, off and on again are published for the heater
+	states := []DeviceState{}
+	for len(states) < 3 {
+		select {
+		case ev := <-actorEvents.C:
+			states = append(states, ev.Payload.(ActorEvent).State)
+		case <-time.After(time.Second):
+			t.Fatalf("heater events %v, want on, off and on", states)
+		}
+	}
+	if states[0] != StateOn || states[1] != StateOff || states[2] != StateOn {
+		t.Errorf("heater events %v, want on, off and on", states)
+	}
+	if pump := hw.pins["GPIO21"]; pump.Read() != gpio.High {
+		t.Error("pump relay is on")
+	}
+}
@@ -1,7 +1,7 @@
 package control
 
 import (
-	"../config"
+	"github.com/gigatropolis/brewbrat/controller/config"
 )
 
 type IDevice interface {
@@ -12,6 +12,7 @@ type IDevice interface {
 	String() string
 	IsDummyDevice() bool
 	SendNotification(notify string) error
+	Kind() string
 	GetDefaultsConfig() ([]config.PropertyConfig, error)
 	LogMessage(pattern string, args ...interface{}) error
 	LogWarning(pattern string, args ...interface{}) error
@@ -30,14 +31,17 @@ type DeviceDefinition struct {
 
 type Device struct {
 	logger  *Logger
+	hw      Hardware
 	Props   Properties
 	DevName string
+	DevKind string
 	isDummy bool
 }
 
 // Init called when device first being created before OnStart()
 func (dev *Device) Init(name string, logger *Logger, properties []Property) error {
 	dev.logger = logger
+	dev.hw = hardware
 	dev.Props = NewProperties()
 	dev.Props.AddProperties(properties)
 	dev.DevName = name
@@ -64,6 +68,11 @@ func (dev *Device) Name() string {
 	return dev.DevName
 }
 
+// Kind is device kind (KindSensor, KindActor, ...) set before Init() by the base device type
+func (dev *Device) Kind() string {
+	return dev.DevKind
+}
+
 // Name is device name used to identify device
 func (dev *Device) String() string {
 	return dev.Name()
@@ -87,24 +96,24 @@ func (dev *Device) SendNotification(notify string) error {
 
 // LogMessage is convenience wrapper for logger
 func (dev *Device) LogMessage(pattern string, args ...interface{}) error {
-	dev.logger.LogMessage(pattern, args...)
+	dev.logger.log(LogLevelMessage, dev.Name(), dev.Kind(), pattern, args)
 	return nil
 }
 
 // LogWarning is convenience wrapper for logger
 func (dev *Device) LogWarning(pattern string, args ...interface{}) error {
-	dev.logger.LogWarning(pattern, args...)
+	dev.logger.log(LogLevelWarning, dev.Name(), dev.Kind(), pattern, args)
 	return nil
 }
 
 // LogError is convenience wrapper for logger
 func (dev *Device) LogError(pattern string, args ...interface{}) error {
-	dev.logger.LogError(pattern, args...)
+	dev.logger.log(LogLevelError, dev.Name(), dev.Kind(), pattern, args)
 	return nil
 }
 
 // LogDebug is convenience wrapper for logger
 func (dev *Device) LogDebug(pattern string, args ...interface{}) error {
-	dev.logger.LogDebug(pattern, args...)
+	dev.logger.log(LogLevelDebug, dev.Name(), dev.Kind(), pattern, args)
 	return nil
 }
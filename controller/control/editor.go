@@ -0,0 +1,392 @@
+package control
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// typeDefaults returns kind and default properties of a registered device type
+func (ctrl *Control) typeDefaults(devType string) (string, []config.PropertyConfig, bool) {
+	t, ok := ctrl.registry.Lookup(devType)
+	if !ok {
+		return "", nil, false
+	}
+	return t.Kind, t.Properties, true
+}
+
+// deviceTypes lists all registered device types sorted by kind and type
+func (ctrl *Control) deviceTypes() []api.DeviceType {
+	types := []api.DeviceType{}
+	for _, t := range ctrl.registry.Types() {
+		devType := api.DeviceType{Class: t.Kind, Type: t.Name, Description: t.Description}
+		for _, prop := range t.Properties {
+			if prop.Name != "Name" {
+				devType.Properties = append(devType.Properties, toAPIProperty(prop))
+			}
+		}
+		types = append(types, devType)
+	}
+	return types
+}
+
+func toAPIProperty(prop config.PropertyConfig) api.Property {
+	p := api.Property{Name: prop.Name, Type: prop.Type, Hidden: prop.Hidden, Comment: prop.Comment, Value: prop.Value}
+	if prop.Select != "" {
+		p.Select = strings.Split(prop.Select, ",")
+	}
+	return p
+}
+
+// editorDevice merges configured property values with the properties of the device type.
+// Properties only found in configuration are kept after the type properties.
+func (ctrl *Control) editorDevice(name string, devType string, configured []config.PropertyConfig) api.DeviceConfig {
+	dev := api.DeviceConfig{Name: name, Type: devType, Properties: []api.Property{}}
+	values := make(map[string]config.PropertyConfig)
+	for _, prop := range configured {
+		values[prop.Name] = prop
+	}
+
+	used := map[string]bool{"Name": true}
+	_, defaults, _ := ctrl.typeDefaults(devType)
+	for _, prop := range defaults {
+		if used[prop.Name] {
+			continue
+		}
+		used[prop.Name] = true
+		p := toAPIProperty(prop)
+		if value, ok := values[prop.Name]; ok {
+			p.Value = value.Value
+		}
+		dev.Properties = append(dev.Properties, p)
+	}
+	for _, prop := range configured {
+		if !used[prop.Name] {
+			used[prop.Name] = true
+			dev.Properties = append(dev.Properties, toAPIProperty(prop))
+		}
+	}
+	return dev
+}
+
+// editorConfiguration returns configured devices and registered types for the web configuration editor
+func (ctrl *Control) editorConfiguration() api.Configuration {
+	cfg := api.Configuration{Types: ctrl.deviceTypes()}
+	for _, dev := range ctrl.configuration.Sensors {
+		cfg.Sensors = append(cfg.Sensors, ctrl.editorDevice(dev.Name, dev.Type, dev.Properties))
+	}
+	for _, dev := range ctrl.configuration.Actors {
+		cfg.Actors = append(cfg.Actors, ctrl.editorDevice(dev.Name, dev.Type, dev.Properties))
+	}
+	for _, dev := range ctrl.configuration.Equipment {
+		cfg.Equipment = append(cfg.Equipment, ctrl.editorDevice(dev.Name, dev.Type, dev.Properties))
+	}
+	for _, dev := range ctrl.configuration.Buzzers {
+		cfg.Buzzers = append(cfg.Buzzers, ctrl.editorDevice(dev.Name, dev.Type, dev.Properties))
+	}
+	return cfg
+}
+
+// validateConfiguration checks names, types and property values of edited configuration.
+// Returns a message for each problem found.
+func (ctrl *Control) validateConfiguration(cfg api.Configuration) []string {
+	errs := []string{}
+	names := map[string][]string{}
+	for _, dev := range cfg.Sensors {
+		names[api.SelectSensors] = append(names[api.SelectSensors], dev.Name)
+	}
+	for _, dev := range cfg.Actors {
+		names[api.SelectActors] = append(names[api.SelectActors], dev.Name)
+	}
+
+	check := func(class string, devices []api.DeviceConfig) {
+		seen := make(map[string]bool)
+		for i, dev := range devices {
+			label := fmt.Sprintf("%s %d", class, i+1)
+			if strings.TrimSpace(dev.Name) == "" {
+				errs = append(errs, fmt.Sprintf("%s: name is missing", label))
+			} else if seen[dev.Name] {
+				errs = append(errs, fmt.Sprintf("%s '%s': name is used more than once", class, dev.Name))
+			} else {
+				label = fmt.Sprintf("%s '%s'", class, dev.Name)
+			}
+			seen[dev.Name] = true
+
+			devClass, _, ok := ctrl.typeDefaults(dev.Type)
+			if !ok || devClass != class {
+				errs = append(errs, fmt.Sprintf("%s: unknown %s type '%s'", label, class, dev.Type))
+			}
+			for _, prop := range dev.Properties {
+				if err := validateProperty(prop, names); err != "" {
+					errs = append(errs, fmt.Sprintf("%s: %s", label, err))
+				}
+			}
+		}
+	}
+	check(api.ClassSensor, cfg.Sensors)
+	check(api.ClassActor, cfg.Actors)
+	check(api.ClassEquipment, cfg.Equipment)
+	check(api.ClassBuzzer, cfg.Buzzers)
+	return errs
+}
+
+// validateProperty returns a message when value does not match property type or select list
+func validateProperty(prop api.Property, names map[string][]string) string {
+	var err error
+	switch prop.Type {
+	case "int":
+		_, err = strconv.ParseInt(prop.Value, 10, 64)
+	case "uint":
+		_, err = strconv.ParseUint(prop.Value, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(prop.Value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(prop.Value)
+	}
+	if err != nil {
+		return fmt.Sprintf("'%s' is not a valid %s value for '%s'", prop.Value, prop.Type, prop.Name)
+	}
+
+	if len(prop.Select) == 0 {
+		return ""
+	}
+	choices := []string{}
+	for _, choice := range prop.Select {
+		if list, ok := names[choice]; ok {
+			choices = append(choices, list...)
+			if choice == api.SelectActors {
+				choices = append(choices, "")
+			}
+			continue
+		}
+		choices = append(choices, choice)
+	}
+	for _, choice := range choices {
+		if prop.Value == choice {
+			return ""
+		}
+	}
+	return fmt.Sprintf("'%s' is not one of the choices for '%s'", prop.Value, prop.Name)
+}
+
+// toPropertyConfigs converts edited properties back to configuration. "Name" is always the device name.
+func (ctrl *Control) toPropertyConfigs(dev api.DeviceConfig) []config.PropertyConfig {
+	props := []config.PropertyConfig{}
+	if _, defaults, ok := ctrl.typeDefaults(dev.Type); ok {
+		for _, prop := range defaults {
+			if prop.Name == "Name" {
+				props = append(props, config.PropertyConfig{Name: "Name", Type: "string", Hidden: prop.Hidden, Value: dev.Name, Comment: prop.Comment, Choice: ""})
+				break
+			}
+		}
+	}
+	for _, prop := range dev.Properties {
+		if prop.Name == "Name" {
+			continue
+		}
+		props = append(props, config.PropertyConfig{
+			Name:    prop.Name,
+			Type:    prop.Type,
+			Hidden:  prop.Hidden,
+			Comment: prop.Comment,
+			Choice:  "",
+			Select:  strings.Join(prop.Select, ","),
+			Value:   prop.Value,
+		})
+	}
+	return props
+}
+
+// saveConfiguration validates edited devices and writes them to the configuration file.
+// Controller properties and users are kept. The previous file is saved with extension ".bak"
+func (ctrl *Control) saveConfiguration(cfg api.Configuration) api.ConfigResult {
+	if errs := ctrl.validateConfiguration(cfg); len(errs) > 0 {
+		return api.ConfigResult{Errors: errs}
+	}
+
+	brewController := *ctrl.configuration
+	ctrl.setDevices(&brewController, cfg)
+
+	if err := ctrl.writeConfiguration(&brewController); err != nil {
+		return api.ConfigResult{Errors: []string{fmt.Sprintf("unable to save configuration file: %s", err)}}
+	}
+	ctrl.logger.LogMessage("Configuration saved to '%s'", ctrl.configFileName)
+
+	result := api.ConfigResult{Saved: true, Restart: canRestart}
+	if canRestart {
+		go ctrl.restart()
+	} else {
+		ctrl.logger.LogWarning("Restart controller to use new configuration")
+	}
+	return result
+}
+
+// setDevices replaces the devices of brewController with the edited devices
+func (ctrl *Control) setDevices(brewController *config.BrewController, cfg api.Configuration) {
+	brewController.Sensors = []config.SensorConfig{}
+	for _, dev := range cfg.Sensors {
+		brewController.Sensors = append(brewController.Sensors, config.SensorConfig{Name: dev.Name, Type: dev.Type, Properties: ctrl.toPropertyConfigs(dev)})
+	}
+	brewController.Actors = []config.ActorsConfig{}
+	for _, dev := range cfg.Actors {
+		brewController.Actors = append(brewController.Actors, config.ActorsConfig{Name: dev.Name, Type: dev.Type, Properties: ctrl.toPropertyConfigs(dev)})
+	}
+	brewController.Equipment = []config.EquipmentConfig{}
+	for _, dev := range cfg.Equipment {
+		brewController.Equipment = append(brewController.Equipment, config.EquipmentConfig{Name: dev.Name, Type: dev.Type, Properties: ctrl.toPropertyConfigs(dev)})
+	}
+	brewController.Buzzers = []config.BuzzerConfig{}
+	for _, dev := range cfg.Buzzers {
+		brewController.Buzzers = append(brewController.Buzzers, config.BuzzerConfig{Name: dev.Name, Type: dev.Type, Properties: ctrl.toPropertyConfigs(dev)})
+	}
+}
+
+// writeConfiguration saves brewController to the configuration file and uses it as the current configuration.
+// The previous file is saved with extension ".bak"
+func (ctrl *Control) writeConfiguration(brewController *config.BrewController) error {
+	if buf, err := ioutil.ReadFile(ctrl.configFileName); err == nil {
+		if err := ioutil.WriteFile(ctrl.configFileName+".bak", buf, 0600); err != nil {
+			ctrl.logger.LogWarning("Unable to save backup of configuration file '%s': %s", ctrl.configFileName, err)
+		}
+	}
+	if err := config.SaveConfiguration(ctrl.configFileName, brewController); err != nil {
+		return err
+	}
+	ctrl.configuration = brewController
+	return nil
+}
+
+// saveEquipmentProperties sets properties of equipment name in the configuration file without a restart.
+// Properties not yet configured are added
+func (ctrl *Control) saveEquipmentProperties(name string, props []config.PropertyConfig) error {
+	brewController := *ctrl.configuration
+	brewController.Equipment = append([]config.EquipmentConfig{}, ctrl.configuration.Equipment...)
+	for i, eq := range brewController.Equipment {
+		if eq.Name != name {
+			continue
+		}
+		configured := append([]config.PropertyConfig{}, eq.Properties...)
+		index := make(map[string]int)
+		for j, prop := range configured {
+			index[prop.Name] = j
+		}
+		for _, prop := range props {
+			if j, ok := index[prop.Name]; ok {
+				configured[j].Value = prop.Value
+			} else {
+				configured = append(configured, prop)
+			}
+		}
+		brewController.Equipment[i].Properties = configured
+		return ctrl.writeConfiguration(&brewController)
+	}
+	return fmt.Errorf("equipment '%s' is not configured", name)
+}
+
+// newDeviceConfig returns the properties of a new device of devType from the defaults of its type.
+// "Name" is the device name and values replace the defaults of their properties
+func (ctrl *Control) newDeviceConfig(name string, devType string, values map[string]string) []config.PropertyConfig {
+	dev := ctrl.editorDevice(name, devType, nil)
+	for i, prop := range dev.Properties {
+		if value, ok := values[prop.Name]; ok {
+			dev.Properties[i].Value = value
+		}
+	}
+	return ctrl.toPropertyConfigs(dev)
+}
+
+// configSensors returns a temperature sensor for each "<name>[:<address>]" given to the config command.
+// Sensors without address get the next 1-Wire address found that is not given to another sensor,
+// or are dummy sensors in dummy mode
+func (ctrl *Control) configSensors(specs []string, addresses []uint64) ([]config.SensorConfig, error) {
+	used := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, spec := range specs {
+		if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+			used[parts[1]] = true
+		}
+	}
+	free := []string{}
+	for _, adr := range addresses {
+		if s := strconv.FormatUint(adr, 10); !used[s] {
+			free = append(free, s)
+		}
+	}
+
+	sensors := []config.SensorConfig{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if name == "" || names[name] {
+			return nil, fmt.Errorf("sensor '%s' needs a unique name", spec)
+		}
+		names[name] = true
+
+		devType, values := "TempSensor", map[string]string{}
+		switch {
+		case len(parts) == 2:
+			if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("sensor '%s' has no valid 1-Wire address", spec)
+			}
+			values["Address"] = parts[1]
+		case ctrl.isDummyController:
+			devType = "DummyTempSensor"
+		case len(free) > 0:
+			values["Address"] = free[0]
+			free = free[1:]
+		default:
+			return nil, fmt.Errorf("no 1-Wire address left for sensor '%s'", name)
+		}
+		sensors = append(sensors, config.SensorConfig{Name: name, Type: devType, Properties: ctrl.newDeviceConfig(name, devType, values)})
+	}
+	return sensors, nil
+}
+
+// createConfiguration writes a new configuration file for the config command. Sensors are created from
+// specs, or from the 1-Wire addresses found when there are none. Every device gets all properties of its type
+func (ctrl *Control) createConfiguration(specs []string, addresses []uint64, rels []string, ssrs []string) error {
+	brewController, err := config.DefaultConfiguration(addresses, rels, ssrs, ctrl.isDummyController)
+	if err != nil {
+		return err
+	}
+	if len(specs) > 0 {
+		if brewController.Sensors, err = ctrl.configSensors(specs, addresses); err != nil {
+			return err
+		}
+	}
+	ctrl.configuration = &brewController
+
+	cfg := ctrl.editorConfiguration()
+	if len(brewController.Sensors) > 0 {
+		for _, eq := range cfg.Equipment {
+			for i, prop := range eq.Properties {
+				if prop.Name == "Temperature Sensor" && !hasSensor(brewController.Sensors, prop.Value) {
+					eq.Properties[i].Value = brewController.Sensors[0].Name
+				}
+			}
+		}
+	}
+	for _, msg := range ctrl.validateConfiguration(cfg) {
+		ctrl.logger.LogWarning("New configuration: %s", msg)
+	}
+
+	ctrl.setDevices(&brewController, cfg)
+	if err := config.SaveConfiguration(ctrl.configFileName, &brewController); err != nil {
+		return err
+	}
+	ctrl.logger.LogMessage("Configuration saved to '%s'", ctrl.configFileName)
+	return nil
+}
+
+func hasSensor(sensors []config.SensorConfig, name string) bool {
+	for _, sensor := range sensors {
+		if sensor.Name == name {
+			return true
+		}
+	}
+	return false
+}
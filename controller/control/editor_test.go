@@ -0,0 +1,67 @@
+package control
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+)
+
+func propertyValue(props []config.PropertyConfig, name string) string {
+	for _, prop := range props {
+		if prop.Name == name {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+func TestConfigSensors(t *testing.T) {
+	ctrl := &Control{registry: DefaultRegistry, logger: testLogger()}
+	sensors, err := ctrl.configSensors([]string{"HLT Temp", "Mash Temp:22", "Kettle Temp"}, []uint64{11, 22, 33})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, address string }{{"HLT Temp", "11"}, {"Mash Temp", "22"}, {"Kettle Temp", "33"}}
+	for i, sensor := range sensors {
+		if sensor.Name != want[i].name || sensor.Type != "TempSensor" || propertyValue(sensor.Properties, "Address") != want[i].address {
+			t.Errorf("sensor %d = %+v, want %s at %s", i, sensor, want[i].name, want[i].address)
+		}
+		if propertyValue(sensor.Properties, "Name") != sensor.Name || propertyValue(sensor.Properties, "Units") != "°F" {
+			t.Errorf("sensor %s properties %+v not from type defaults", sensor.Name, sensor.Properties)
+		}
+	}
+
+	for _, specs := range [][]string{{"A", "B"}, {"A:x"}, {"A", "A:1"}, {":1"}} {
+		if _, err := ctrl.configSensors(specs, []uint64{1}); err == nil {
+			t.Errorf("sensors %v created", specs)
+		}
+	}
+}
+
+func TestCreateConfiguration(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "configuration.xml")
+	ctrl := &Control{registry: DefaultRegistry, logger: testLogger(), isDummyController: true, configFileName: fileName}
+	if err := ctrl.createConfiguration([]string{"HLT Temp", "Mash Temp"}, nil, []string{"GPIO21"}, []string{"GPIO16"}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := config.LoadConfiguration(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Sensors) != 2 || saved.Sensors[0].Type != "DummyTempSensor" || saved.Sensors[1].Name != "Mash Temp" {
+		t.Errorf("sensors %+v", saved.Sensors)
+	}
+	// equipment uses the first sensor and gets every property of its type
+	eq := saved.Equipment[0]
+	if got := propertyValue(eq.Properties, "Temperature Sensor"); got != "HLT Temp" {
+		t.Errorf("equipment sensor %q, want HLT Temp", got)
+	}
+	if got := propertyValue(eq.Properties, "Alarm Band"); got == "" {
+		t.Errorf("equipment properties %+v miss type defaults", eq.Properties)
+	}
+	if got := propertyValue(saved.Buzzers[0].Properties, "Sound Main"); got == "" {
+		t.Errorf("buzzer properties %+v miss type defaults", saved.Buzzers[0].Properties)
+	}
+}
@@ -1,23 +1,17 @@
 package control
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
-	"../config"
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
 )
 
-// Equipment messages
-const (
-	CmdUpdateDevices = iota + 1
-	CmdUpdateSensor
-	CmdChangeState
-	CmdActorOn
-	CmdActorOff
-	CmdActorChange
-	CmdSendNotification
-	CmdSetSetpoint
-	CmdGetSetpoint
-)
+func init() {
+	mustRegister(KindEquipment, "SimpleRIMM", func() IDevice { return new(SimpleRIMM) }, "RIMS mash tun heated by hysteresis control with pump and agitator")
+}
 
 const (
 	EqStateIdle = iota + 1
@@ -34,60 +28,81 @@ type SensValue struct {
 	Value float64
 }
 type ActValue struct {
-	Name  string
-	State DeviceState
-	Power int
-}
-
-type EquipMessage struct {
-	Name       string
-	DeviceName string
-	Cmd        int
-	FltParam1  float64
-	FltParam2  float64
-	IntParam1  int64
-	IntParam2  int64
-	StrParam1  string
-	StrParam2  string
-	Sensors    []SensValue
-	Actors     []ActValue
+	Name   string
+	State  DeviceState
+	Power  int
+	Manual bool
 }
 
 type IEquipment interface {
 	IDevice
-	InitEquipment(name string, logger *Logger, properties []Property, in <-chan EquipMessage, out chan<- EquipMessage) error
+	InitEquipment(name string, logger *Logger, properties []Property, bus *EventBus) error
 	AddSensor(name string) error
 	AddActor(name string) error
 	GetSetpoint() (float64, error)
 	SetSetpoint(value float64) error
+	GetState() int
+	SetState(state int) error
+	GetMode() int
+	GetTemperatureSensor() string
+	GetHeater() string
+	GetPump() string
+	GetAgitator() string
+	StartAutotune(save bool) error
+	StopAutotune() error
+	GetAutotune() api.Autotune
+	AutotuneSaved(err error)
+	HeatRate(watts float64, units string) float64
 	Run() error
 	NextStep() error
 }
 
+// IHysteresis is implemented by equipment switching the heater on and off
+// at "Power On" and "Power Off" degrees below the setpoint
+type IHysteresis interface {
+	GetPowerBands() (powerOn float64, powerOff float64)
+}
+
+// Equipment is run by Run() in its own go routine. The controller changes State and Setpoint
+// from its web and timer go routines, so they are read and written with the getters and setters
 type Equipment struct {
 	Device
-	State    int
-	Mode     int
-	Setpoint float64
-	pump     string
-	agitator string
-	heater   string
-	Sensors  map[string]SensValue
-	Actors   map[string]ActValue
-	in       <-chan EquipMessage
-	out      chan<- EquipMessage
-}
-
-// InitEquipment does that
-func (eq *Equipment) InitEquipment(name string, logger *Logger, properties []Property, in <-chan EquipMessage, out chan<- EquipMessage) error {
+	stateMu      sync.RWMutex
+	State        int
+	Mode         int
+	Setpoint     float64
+	tempSensor   string
+	pump         string
+	agitator     string
+	heater       string
+	Sensors      map[string]SensValue
+	Actors       map[string]ActValue
+	bus          *EventBus
+	events       *Subscription
+	stepInterval time.Duration
+
+	pumpPolicy     *actorPolicy
+	agitatorPolicy *actorPolicy
+	autotune       autotune
+	alarms         equipmentAlarms
+	// liters of water heated and percent of heater power heating it, used to estimate heat-up time
+	liters     float64
+	efficiency float64
+}
+
+// InitEquipment reads properties and subscribes to events of the sensors and actors added later
+func (eq *Equipment) InitEquipment(name string, logger *Logger, properties []Property, bus *EventBus) error {
+	eq.DevKind = KindEquipment
 	eq.Device.Init(name, logger, properties)
-	eq.in = in
-	eq.out = out
+	eq.bus = bus
+	eq.events = bus.Subscribe(name)
+	eq.stepInterval = 4 * time.Second
 	eq.Sensors = make(map[string]SensValue)
 	eq.Actors = make(map[string]ActValue)
 
 	props := eq.GetProperties()
 	mode := props.InitProperty("Control Mode", "string", "Historisis", "Control mode for equipment").(string)
+	eq.tempSensor = props.InitProperty("Temperature Sensor", "string", "Temp Sensor 1", "Name of Temperature Sensor").(string)
 	eq.pump = props.InitProperty("Pump", "string", "Dummy Relay 1", "Sensor controlled by pump").(string)
 	eq.agitator = props.InitProperty("Agitator", "string", "Dummy Relay 2", "Sensor controlled by agitator").(string)
 	eq.heater = props.InitProperty("Heater", "string", "Dummy Relay 3", "Sensor controlled by heater").(string)
@@ -100,20 +115,26 @@ func (eq *Equipment) InitEquipment(name string, logger *Logger, properties []Pro
 	default:
 		eq.Mode = EqModeHistorisis
 	}
+	eq.initPolicies()
+	eq.initAutotune()
+	eq.initHeatUp()
+	eq.initAlarms()
 	//eq.LogDebug("InitEquipment %d", eq.Mode)
 
 	return nil
 }
 
 func (eq *Equipment) GetDefaultsConfig() ([]config.PropertyConfig, error) {
-	return []config.PropertyConfig{
-		{Name: "Temperature Sensor", Type: "string", Hidden: false, Value: "Dummy Temp 1", Comment: "Sensor Name", Choice: ""},
-		{Name: "Units", Type: "string", Hidden: false, Value: "°F", Comment: "Units for Sensor", Choice: ""},
-		{Name: "Pump", Type: "string", Hidden: false, Value: "Relay 1", Comment: "Units for Sensor", Choice: ""},
-		{Name: "Circulator", Type: "string", Hidden: false, Value: "Relay 2", Comment: "Units for Sensor", Choice: ""},
-		{Name: "Heater", Type: "string", Hidden: false, Value: "SSR 1", Comment: "Units for Sensor", Choice: ""},
-	}, nil
-
+	props := []config.PropertyConfig{
+		{Name: "Temperature Sensor", Type: "string", Hidden: false, Value: "Temp Sensor 1", Comment: "Name of Temperature Sensor", Choice: "", Select: api.SelectSensors},
+		{Name: "Control Mode", Type: "string", Hidden: false, Value: "Historisis", Comment: "Control mode for equipment", Choice: "", Select: "Historisis,PID"},
+		{Name: "Pump", Type: "string", Hidden: false, Value: "Relay 1", Comment: "Name of actor used to control Pump", Choice: "", Select: api.SelectActors},
+		{Name: "Agitator", Type: "string", Hidden: false, Value: "Relay 2", Comment: "Name of actor used to for agitation", Choice: "", Select: api.SelectActors},
+		{Name: "Heater", Type: "string", Hidden: false, Value: "SSR 1", Comment: "Name of actor used to control Heater", Choice: "", Select: api.SelectActors},
+	}
+	props = append(props, heatUpDefaultsConfig()...)
+	props = append(props, alarmDefaultsConfig()...)
+	return append(props, autotuneDefaultsConfig()...), nil
 }
 
 func (eq *Equipment) isValidState(state int64) bool {
@@ -124,46 +145,98 @@ func (eq *Equipment) isValidState(state int64) bool {
 	return true
 }
 
+// AddSensor subscribes to readings of sensor name
 func (eq *Equipment) AddSensor(name string) error {
 	eq.LogMessage("eq.AddSensor %s", name)
 	eq.Sensors[name] = SensValue{Name: name}
+	eq.events.Add(Topic(TopicSensor, name))
 	return nil
 }
+
+// AddActor subscribes to state changes of actor name
 func (eq *Equipment) AddActor(name string) error {
 	eq.LogMessage("eq.AddActor %s", name)
 	eq.Actors[name] = ActValue{Name: name}
+	eq.events.Add(Topic(TopicActor, name))
 	return nil
 }
 
-func (eq *Equipment) getActorControl(name string) string {
-	if name == "Relay 1" || name == "Dummy Relay 1" {
-		return "Temp Sensor 1"
-	} else if name == "Relay 2" {
-		return "Temp Sensor 2"
-	} else if name == "Relay 3" {
-		return "Temp Sensor 1"
+// switchActor asks controller to turn actor on or off
+func (eq *Equipment) switchActor(name string, on bool) {
+	if a, ok := eq.Actors[name]; ok && a.Manual {
+		return
 	}
-
-	return "Relay 1"
+	cmd := ActorCommand{Name: name, Source: eq.Name(), Cmd: ActorCmdOff}
+	if on {
+		cmd.Cmd = ActorCmdOn
+	}
+	eq.bus.Publish(Topic(TopicActorCommand, name), cmd)
 }
 
 func (eq *Equipment) GetSetpoint() (float64, error) {
+	eq.stateMu.RLock()
+	defer eq.stateMu.RUnlock()
 	return eq.Setpoint, nil
 }
 
 func (eq *Equipment) SetSetpoint(value float64) error {
+	eq.stateMu.Lock()
 	eq.Setpoint = value
+	eq.stateMu.Unlock()
 	return nil
 }
 
+// GetState returns EqStateIdle or EqStateActive
+func (eq *Equipment) GetState() int {
+	eq.stateMu.RLock()
+	defer eq.stateMu.RUnlock()
+	return eq.State
+}
+
+// SetState changes equipment to EqStateIdle or EqStateActive
+func (eq *Equipment) SetState(state int) error {
+	if !eq.isValidState(int64(state)) {
+		return fmt.Errorf("invalid equipment state %d", state)
+	}
+	eq.stateMu.Lock()
+	eq.State = state
+	eq.stateMu.Unlock()
+	return nil
+}
+
+// GetMode returns EqModeHistorisis or EqModePIDControl
+func (eq *Equipment) GetMode() int {
+	return eq.Mode
+}
+
+// GetTemperatureSensor returns name of sensor used to control temperature
+func (eq *Equipment) GetTemperatureSensor() string {
+	return eq.tempSensor
+}
+
+// GetHeater returns name of actor used to heat
+func (eq *Equipment) GetHeater() string {
+	return eq.heater
+}
+
+// GetPump returns name of actor used to pump
+func (eq *Equipment) GetPump() string {
+	return eq.pump
+}
+
+// GetAgitator returns name of actor used for agitation
+func (eq *Equipment) GetAgitator() string {
+	return eq.agitator
+}
+
 func (eq *Equipment) readMessages() error {
 	var err error = nil
-	tWait := time.NewTimer(time.Millisecond * 4000)
+	tWait := time.NewTimer(eq.stepInterval)
 	readMessages := true
 	for readMessages {
 		select {
-		case inMessage := <-eq.in:
-			eq.handleMessage(inMessage)
+		case ev := <-eq.events.C:
+			eq.handleEvent(ev)
 		case <-tWait.C:
 			readMessages = false
 		}
@@ -171,43 +244,30 @@ func (eq *Equipment) readMessages() error {
 	return err
 }
 
-func (eq *Equipment) handleMessage(message EquipMessage) error {
-	//eq.LogDebug("eq.handleMessage %d", message.Cmd)
-	switch message.Cmd {
-	case CmdUpdateDevices:
-		for _, sensor := range message.Sensors {
-			//eq.LogDebug("start CmdUpdateDevices: eq.handleMessage %s", sensor.Name)
-			s, ok := eq.Sensors[sensor.Name]
-			if ok {
-				//eq.LogDebug("sensor.Name: eq.handleMessage %s", sensor.Name)
-				s.Value = sensor.Value
-				eq.Sensors[sensor.Name] = s
-			}
+func (eq *Equipment) handleEvent(ev Event) error {
+	switch payload := ev.Payload.(type) {
+	case SensorEvent:
+		if s, ok := eq.Sensors[payload.Name]; ok {
+			s.Value = payload.Value
+			eq.Sensors[payload.Name] = s
 		}
-		for _, actor := range message.Actors {
-			//eq.LogDebug("start CmdUpdateDevices::eq.handleMessage '%s'", actor.Name)
-			a, ok := eq.Actors[actor.Name]
-			if ok {
-				if a.State != actor.State && eq.IsDummyDevice() {
-					//eq.LogDebug("start CmdUpdateDevices: eq.handleMessage '%s' Handled", actor.Name)
-					cmd := "OFF"
-					if actor.State == StateOn {
-						cmd = "ON"
-					}
-					//eq.LogDebug("Actor out %s", actor.Name)
-					name := eq.getActorControl(actor.Name)
-
-					eq.out <- EquipMessage{DeviceName: name, Cmd: CmdSendNotification, StrParam1: cmd}
-				}
-				a.State = actor.State
-				a.Power = actor.Power
-				eq.Actors[actor.Name] = a
-			}
+	case ActorEvent:
+		a, ok := eq.Actors[payload.Name]
+		if !ok {
+			break
 		}
-	case CmdChangeState:
-		if eq.isValidState(message.IntParam1) {
-			eq.State = int(message.IntParam1)
+		if a.State != payload.State && eq.IsDummyDevice() && payload.Name == eq.heater {
+			// dummy temperature sensor follows the heater
+			cmd := "OFF"
+			if payload.State == StateOn {
+				cmd = "ON"
+			}
+			eq.bus.Publish(Topic(TopicNotify, eq.tempSensor), NotifyEvent{Name: eq.tempSensor, Source: eq.Name(), Notification: cmd})
 		}
+		a.State = payload.State
+		a.Power = payload.Power
+		a.Manual = payload.Manual
+		eq.Actors[payload.Name] = a
 	}
 	return nil
 }
@@ -215,8 +275,7 @@ func (eq *Equipment) handleMessage(message EquipMessage) error {
 // OnStart called once when device first started up. Called after Init()
 func (eq *Equipment) OnStart() error {
 
-	eq.State = EqStateActive
-	return nil
+	return eq.SetState(EqStateActive)
 }
 
 type SimpleRIMM struct {
@@ -229,16 +288,16 @@ type SimpleRIMM struct {
 	AgitatorName  string
 }
 
-func (rim *SimpleRIMM) InitEquipment(name string, logger *Logger, properties []Property, in <-chan EquipMessage, out chan<- EquipMessage) error {
-	rim.Equipment.InitEquipment(name, logger, properties, in, out)
+func (rim *SimpleRIMM) InitEquipment(name string, logger *Logger, properties []Property, bus *EventBus) error {
+	rim.Equipment.InitEquipment(name, logger, properties, bus)
 
 	props := rim.GetProperties()
 	rim.TempProbeName = props.InitProperty("Temperature Sensor", "string", "Temp Sensor 1", "Name of Temperature Sensor").(string)
 	rim.SetSetpoint(props.InitProperty("Temperature Setpoint", "float", 135.5, "Equipment setpoint").(float64))
 	rim.PowerOn = props.InitProperty("Power On", "float", 0.8, "Power goes on if temperature drops below this value").(float64)
 	rim.PowerOff = props.InitProperty("Power Off", "float", 0.3, "Power goes Off if temperature goes above this value").(float64)
-	rim.HeaterName = props.InitProperty("Pump", "string", "Relay 1", "Name of actor used to control Heater").(string)
-	rim.PumpName = props.InitProperty("Heater", "string", "Relay 2", "Name of actor used to control Pump").(string)
+	rim.HeaterName = props.InitProperty("Heater", "string", "Relay 2", "Name of actor used to control Heater").(string)
+	rim.PumpName = props.InitProperty("Pump", "string", "Relay 1", "Name of actor used to control Pump").(string)
 	rim.AgitatorName = props.InitProperty("Agitator", "string", "Relay 3", "Name of actor used to for agitation").(string)
 
 	rim.AddSensor(rim.TempProbeName)
@@ -248,6 +307,22 @@ func (rim *SimpleRIMM) InitEquipment(name string, logger *Logger, properties []P
 	return nil
 }
 
+// GetDefaultsConfig returns properties used by SimpleRIMM
+func (rim *SimpleRIMM) GetDefaultsConfig() ([]config.PropertyConfig, error) {
+	props, _ := rim.Equipment.GetDefaultsConfig()
+	props = append(props,
+		config.PropertyConfig{Name: "Temperature Setpoint", Type: "float", Hidden: false, Value: "135.5", Comment: "Equipment setpoint", Choice: ""},
+		config.PropertyConfig{Name: "Power On", Type: "float", Hidden: false, Value: "0.8", Comment: "Power goes on if temperature drops below this value", Choice: ""},
+		config.PropertyConfig{Name: "Power Off", Type: "float", Hidden: false, Value: "0.3", Comment: "Power goes Off if temperature goes above this value", Choice: ""},
+	)
+	return append(props, policyDefaultsConfig(PolicyAlwaysOn)...), nil
+}
+
+// GetPowerBands returns degrees below setpoint where heater goes on and off
+func (rim *SimpleRIMM) GetPowerBands() (float64, float64) {
+	return rim.PowerOn, rim.PowerOff
+}
+
 // Run will handle reading in channel and setting values for sensors and actors
 func (rim *SimpleRIMM) Run() error {
 
@@ -262,16 +337,32 @@ func (rim *SimpleRIMM) Run() error {
 func (rim *SimpleRIMM) NextStep() error {
 	//rim.LogDebug("rim.NextStep")
 
-	switch rim.State {
+	rim.updatePolicies(time.Now())
+	switch rim.GetState() {
 	case EqStateActive:
 		rim.updateActors()
+	default:
+		rim.failAutotune("equipment is not active")
+		rim.updateAutotune(time.Now())
 	}
+	rim.checkAlarms(time.Now(), rim.PowerOn)
 	return nil
 }
 
 func (rim *SimpleRIMM) updateActors() error {
 	//rim.LogDebug("rim.updateActors")
 
+	if !rim.heaterAllowed() {
+		if rim.Actors[rim.HeaterName].State == StateOn {
+			rim.LogMessage("Heater off while pump is not running")
+			rim.switchActor(rim.HeaterName, false)
+		}
+		return nil
+	}
+	if rim.updateAutotune(time.Now()) {
+		return nil
+	}
+
 	var err error = nil
 	switch rim.Mode {
 	case EqModeHistorisis:
@@ -300,14 +391,14 @@ func (rim *SimpleRIMM) updateHistorisis() error {
 	if temp.Value > (setpoint - rim.PowerOff) {
 		if act, ok := rim.Actors[rim.HeaterName]; ok {
 			if act.State != StateOff {
-				rim.out <- EquipMessage{DeviceName: rim.HeaterName, Cmd: CmdActorOff}
+				rim.switchActor(rim.HeaterName, false)
 			}
 		}
 	}
 	if temp.Value < (setpoint - rim.PowerOn) {
 		if act, ok := rim.Actors[rim.HeaterName]; ok {
 			if act.State != StateOn {
-				rim.out <- EquipMessage{DeviceName: rim.HeaterName, Cmd: CmdActorOn}
+				rim.switchActor(rim.HeaterName, true)
 			}
 		}
 	}
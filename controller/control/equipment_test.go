@@ -0,0 +1,54 @@
+package control
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestEquipmentConcurrentChanges changes state, setpoint and auto-tune the way web commands and
+// timers do while the equipment steps. Run with -race
+func TestEquipmentConcurrentChanges(t *testing.T) {
+	rim := new(SimpleRIMM)
+	rim.InitEquipment("Mash Tun", testLogger(), []Property{
+		{Name: "Temperature Sensor", PropType: "string", Value: "Temp"},
+		{Name: "Heater", PropType: "string", Value: "Heater"},
+		{Name: "Pump", PropType: "string", Value: "Pump"},
+		{Name: "Pump Policy", PropType: "string", Value: PolicyAlwaysOn},
+	}, NewEventBus(nil))
+	rim.OnStart()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			rim.handleEvent(Event{Topic: Topic(TopicSensor, "Temp"), Payload: SensorEvent{Name: "Temp", Value: float64(100 + i%60)}})
+			rim.NextStep()
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		state := EqStateActive
+		if i%3 == 0 {
+			state = EqStateIdle
+		}
+		rim.SetState(state)
+		rim.SetSetpoint(float64(140 + i%20))
+		if i%10 == 0 {
+			rim.StartAutotune(false)
+		}
+		if i%10 == 5 {
+			rim.StopAutotune()
+		}
+		rim.GetAutotune()
+	}
+	wg.Wait()
+
+	rim.SetSetpoint(152)
+	if setpoint, _ := rim.GetSetpoint(); setpoint != 152 {
+		t.Errorf("setpoint %v, want 152", setpoint)
+	}
+	if err := rim.SetState(7); err == nil || rim.GetState() != EqStateActive {
+		t.Errorf("invalid state accepted: %v, state %d", err, rim.GetState())
+	}
+}
@@ -0,0 +1,238 @@
+package control
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event topics. Topics are "<prefix>/<device name>", for example "sensor/Temp Sensor 1"
+const (
+	TopicSensor       = "sensor"        // SensorEvent, a new sensor reading
+	TopicActor        = "actor"         // ActorEvent, actor state or power level changed
+	TopicActorCommand = "command/actor" // ActorCommand, request to switch an actor
+	TopicSetpoint     = "setpoint"      // SetpointEvent, equipment setpoint changed
+	TopicEquipment    = "equipment"     // EquipmentEvent, equipment state changed
+	TopicNotify       = "notify"        // NotifyEvent, notification for a device
+	TopicAlarm        = "alarm"         // AlarmEvent, raised or cleared by a device
+	TopicAutotune     = "autotune"      // AutotuneEvent, equipment auto-tune found PID gains to save
+	TopicSession      = "session"       // SessionEvent, controller started or stopped
+)
+
+const eventQueueSize = 1000
+
+// Topic returns topic of device name under prefix
+func Topic(prefix string, name string) string {
+	return prefix + "/" + name
+}
+
+// Event is published on the bus to all subscriptions matching Topic
+type Event struct {
+	Topic   string
+	Time    time.Time
+	Payload interface{}
+}
+
+// SensorEvent is a sensor reading
+type SensorEvent struct {
+	Name  string
+	Value float64
+}
+
+// ActorEvent is the new state of an actor
+type ActorEvent struct {
+	Name  string
+	State DeviceState
+	Power int
+	// Manual is true while the user overrides the actor. Equipment leaves manual actors alone
+	Manual bool
+	// Until is when a manual override ends. Zero if it does not expire
+	Until time.Time
+}
+
+// Actor commands
+const (
+	ActorCmdOn = iota + 1
+	ActorCmdOff
+	ActorCmdPower
+)
+
+// ActorCommand asks the controller to switch an actor. Source is the device sending the command
+type ActorCommand struct {
+	Name   string
+	Source string
+	Cmd    int
+	Power  int
+}
+
+// SetpointEvent is a new equipment setpoint
+type SetpointEvent struct {
+	Name     string
+	Setpoint float64
+}
+
+// EquipmentEvent is a new equipment state, EqStateIdle or EqStateActive
+type EquipmentEvent struct {
+	Name  string
+	State int
+}
+
+// NotifyEvent is passed to SendNotification() of device Name
+type NotifyEvent struct {
+	Name         string
+	Source       string
+	Notification string
+}
+
+// AlarmEvent raises or clears alarm Condition of device Source, one of the api.Alarm conditions.
+// Active is false when the alarm is cleared. Severity is api.SeverityInfo, SeverityWarning or SeverityCritical
+type AlarmEvent struct {
+	Source    string
+	Condition string
+	Severity  string
+	Message   string
+	Active    bool
+}
+
+// AutotuneEvent are PID gains found by auto-tune of equipment Name, to be saved in the configuration
+type AutotuneEvent struct {
+	Name       string
+	Kp, Ki, Kd float64
+}
+
+// Session events
+const (
+	SessionStarted = "started"
+	SessionStopped = "stopped"
+)
+
+// SessionEvent is a change of the controller session
+type SessionEvent struct {
+	Name  string
+	Event string
+}
+
+// EventBus sends published events to every subscription with a matching topic filter.
+// Each subscription has its own queue so subscribers never take events from each other
+// and a slow subscriber does not block publishers.
+type EventBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	logger *Logger
+}
+
+// NewEventBus returns a bus without subscriptions. logger may be nil
+func NewEventBus(logger *Logger) *EventBus {
+	return &EventBus{subs: make(map[*Subscription]struct{}), logger: logger}
+}
+
+// Subscription receives events of its topic filters on C until Close()
+type Subscription struct {
+	C       <-chan Event
+	name    string
+	filters []string
+	bus     *EventBus
+	in      chan Event
+}
+
+// Subscribe returns subscription for topics matching filters.
+// A filter is a topic, "+" matches one level and a trailing "#" matches all remaining levels,
+// for example "sensor/#" or "actor/Relay 1". name identifies the subscriber in log messages
+func (bus *EventBus) Subscribe(name string, filters ...string) *Subscription {
+	out := make(chan Event)
+	sub := &Subscription{C: out, name: name, filters: filters, bus: bus, in: make(chan Event, 16)}
+	go sub.queue(out)
+
+	bus.mu.Lock()
+	bus.subs[sub] = struct{}{}
+	bus.mu.Unlock()
+	return sub
+}
+
+// Publish sends payload to all subscriptions matching topic
+func (bus *EventBus) Publish(topic string, payload interface{}) {
+	ev := Event{Topic: topic, Time: time.Now(), Payload: payload}
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	for sub := range bus.subs {
+		if sub.matches(topic) {
+			sub.in <- ev
+		}
+	}
+}
+
+// Add adds topic filters to subscription
+func (sub *Subscription) Add(filters ...string) {
+	sub.bus.mu.Lock()
+	sub.filters = append(sub.filters, filters...)
+	sub.bus.mu.Unlock()
+}
+
+// Close ends subscription. C is closed after queued events are dropped
+func (sub *Subscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	if _, ok := sub.bus.subs[sub]; ok {
+		delete(sub.bus.subs, sub)
+		close(sub.in)
+	}
+}
+
+func (sub *Subscription) matches(topic string) bool {
+	for _, filter := range sub.filters {
+		if topicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue moves events from in to out, keeping up to eventQueueSize events while the subscriber is busy.
+// The oldest events are dropped when the queue is full
+func (sub *Subscription) queue(out chan<- Event) {
+	queue := []Event{}
+	dropped := 0
+	for {
+		var send chan<- Event
+		var next Event
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+		select {
+		case ev, ok := <-sub.in:
+			if !ok {
+				close(out)
+				return
+			}
+			if len(queue) >= eventQueueSize {
+				queue = queue[1:]
+				if dropped++; dropped == 1 && sub.bus.logger != nil {
+					sub.bus.logger.LogWarning("Subscriber '%s' is not reading events. Dropping oldest events", sub.name)
+				}
+			}
+			queue = append(queue, ev)
+		case send <- next:
+			queue = queue[1:]
+			dropped = 0
+		}
+	}
+}
+
+// topicMatch returns true if topic matches filter. See Subscribe()
+func topicMatch(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
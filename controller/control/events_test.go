@@ -0,0 +1,130 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensor/Temp Sensor 1", "sensor/Temp Sensor 1", true},
+		{"sensor/Temp Sensor 1", "sensor/Temp Sensor 2", false},
+		{"sensor/+", "sensor/Temp", true},
+		{"sensor/+", "actor/Temp", false},
+		{"sensor/+", "sensor", false},
+		{"sensor/+", "sensor/Temp/extra", false},
+		{"+/Heater", "actor/Heater", true},
+		{"command/+/Heater", "command/actor/Heater", true},
+		{"sensor/#", "sensor/Temp", true},
+		{"sensor/#", "sensor/Temp/extra", true},
+		{"sensor/#", "actor/Temp", false},
+		{"#", "alarm/HLT", true},
+		{"command/actor", "command/actor/Heater", false},
+	}
+	for _, test := range tests {
+		if got := topicMatch(test.filter, test.topic); got != test.want {
+			t.Errorf("topicMatch(%q, %q) = %t, want %t", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+// receive returns the events on sub until none arrive for 50ms
+func receive(sub *Subscription) []Event {
+	events := []Event{}
+	for {
+		select {
+		case ev := <-sub.C:
+			events = append(events, ev)
+		case <-time.After(50 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+func TestEventBusSubscribers(t *testing.T) {
+	bus := NewEventBus(nil)
+	hlt := bus.Subscribe("HLT", Topic(TopicSensor, "Temp"), Topic(TopicActorCommand, "+"))
+	boil := bus.Subscribe("Boil", Topic(TopicSensor, "Temp"))
+	actors := bus.Subscribe("Actors", Topic(TopicActor, "#"))
+	defer hlt.Close()
+	defer boil.Close()
+	defer actors.Close()
+
+	// both equipment get the same reading, nobody takes it from the other
+	bus.Publish(Topic(TopicSensor, "Temp"), SensorEvent{Name: "Temp", Value: 152})
+	bus.Publish(Topic(TopicSensor, "Other"), SensorEvent{Name: "Other", Value: 60})
+	bus.Publish(Topic(TopicActorCommand, "Heater"), ActorCommand{Name: "Heater", Cmd: ActorCmdOn})
+
+	for _, sub := range []*Subscription{hlt, boil} {
+		events := receive(sub)
+		if len(events) == 0 {
+			t.Errorf("%s received no events", sub.name)
+			continue
+		}
+		if ev, ok := events[0].Payload.(SensorEvent); !ok || ev.Name != "Temp" || ev.Value != 152 {
+			t.Errorf("%s received %+v, want Temp reading", sub.name, events[0])
+		}
+		if sub == boil && len(events) != 1 {
+			t.Errorf("Boil received %d events, want 1", len(events))
+		}
+		if sub == hlt && (len(events) != 2 || events[1].Topic != "command/actor/Heater") {
+			t.Errorf("HLT received %+v, want reading and actor command", events)
+		}
+	}
+	if events := receive(actors); len(events) != 0 {
+		t.Errorf("Actors received %+v", events)
+	}
+
+	// subscriptions added later match too
+	actors.Add(Topic(TopicSensor, "Other"))
+	bus.Publish(Topic(TopicSensor, "Other"), SensorEvent{Name: "Other", Value: 61})
+	if events := receive(actors); len(events) != 1 {
+		t.Errorf("Actors received %d events after Add, want 1", len(events))
+	}
+
+	// closed subscriptions get nothing and C is closed
+	boil.Close()
+	bus.Publish(Topic(TopicSensor, "Temp"), SensorEvent{Name: "Temp", Value: 153})
+	if ev, ok := <-boil.C; ok {
+		t.Errorf("closed subscription received %+v", ev)
+	}
+	if events := receive(hlt); len(events) != 1 {
+		t.Errorf("HLT received %d events after Boil closed, want 1", len(events))
+	}
+}
+
+func TestEventBusDropsOldest(t *testing.T) {
+	bus := NewEventBus(nil)
+	sub := bus.Subscribe("Slow", "sensor/#")
+	defer sub.Close()
+
+	const extra = 25
+	for i := 0; i < eventQueueSize+extra; i++ {
+		bus.Publish(Topic(TopicSensor, "Temp"), SensorEvent{Name: "Temp", Value: float64(i)})
+	}
+	// let the queue take every event before reading
+	for len(sub.in) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	events := receive(sub)
+	if len(events) != eventQueueSize {
+		t.Fatalf("received %d events, want %d", len(events), eventQueueSize)
+	}
+	for i, ev := range events {
+		if want := float64(i + extra); ev.Payload.(SensorEvent).Value != want {
+			t.Fatalf("event %d is reading %v, want %v", i, ev.Payload.(SensorEvent).Value, want)
+		}
+	}
+
+	// the queue keeps delivering once the subscriber reads again
+	bus.Publish(Topic(TopicSensor, "Temp"), SensorEvent{Name: "Temp", Value: -1})
+	if events := receive(sub); len(events) != 1 || events[0].Payload.(SensorEvent).Value != -1 {
+		t.Errorf("received %+v after catching up", events)
+	}
+}
@@ -0,0 +1,51 @@
+package control
+
+import (
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpioreg"
+	"periph.io/x/periph/conn/onewire"
+	"periph.io/x/periph/experimental/host/netlink"
+	"periph.io/x/periph/host"
+)
+
+// Hardware gives devices access to GPIO pins and the 1-Wire bus.
+// The default uses the periph host drivers of the Raspberry Pi; tests replace it with fakes
+type Hardware interface {
+	// Init initializes host drivers. Called by devices before they use pins or buses
+	Init() error
+	// PinByName returns GPIO pin called name, e.g. "GPIO21", or nil if there is none
+	PinByName(name string) gpio.PinIO
+	// OpenOneWire opens the 1-Wire bus of DS18B20 sensors
+	OpenOneWire() (OneWireBus, error)
+}
+
+// OneWireBus is a 1-Wire bus that is closed when the device using it stops
+type OneWireBus interface {
+	onewire.Bus
+	Close() error
+}
+
+// periphHardware uses periph host drivers and the 1-Wire netlink bus
+type periphHardware struct{}
+
+func (periphHardware) Init() error {
+	_, err := host.Init()
+	return err
+}
+
+func (periphHardware) PinByName(name string) gpio.PinIO {
+	return gpioreg.ByName(name)
+}
+
+func (periphHardware) OpenOneWire() (OneWireBus, error) {
+	return netlink.New(001)
+}
+
+var hardware Hardware = periphHardware{}
+
+// SetHardware replaces hardware of devices initialized afterwards and returns the previous hardware
+func SetHardware(hw Hardware) Hardware {
+	prev := hardware
+	hardware = hw
+	return prev
+}
@@ -0,0 +1,222 @@
+package control
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpiotest"
+	"periph.io/x/periph/conn/onewire"
+	"periph.io/x/periph/conn/physic"
+)
+
+// pinChange is a level written to a fake pin. Released pins are inputs pulled high by the board.
+// PWM output is recorded as High with its duty and frequency
+type pinChange struct {
+	Level    gpio.Level
+	Released bool
+	Duty     gpio.Duty
+	Freq     physic.Frequency
+	Time     time.Time
+}
+
+// fakePin is a gpiotest pin that records every level written with Out() and every release with In()
+type fakePin struct {
+	*gpiotest.Pin
+	mu      sync.Mutex
+	changes []pinChange
+}
+
+func newFakePin(name string, num int) *fakePin {
+	return &fakePin{Pin: &gpiotest.Pin{N: name, Num: num}}
+}
+
+func (p *fakePin) Out(l gpio.Level) error {
+	p.mu.Lock()
+	p.changes = append(p.changes, pinChange{Level: l, Time: time.Now()})
+	p.mu.Unlock()
+	return p.Pin.Out(l)
+}
+
+func (p *fakePin) PWM(duty gpio.Duty, f physic.Frequency) error {
+	p.mu.Lock()
+	p.changes = append(p.changes, pinChange{Level: gpio.High, Duty: duty, Freq: f, Time: time.Now()})
+	p.mu.Unlock()
+	return p.Pin.PWM(duty, f)
+}
+
+func (p *fakePin) In(pull gpio.Pull, edge gpio.Edge) error {
+	p.mu.Lock()
+	p.changes = append(p.changes, pinChange{Level: gpio.High, Released: true, Time: time.Now()})
+	p.mu.Unlock()
+	return p.Pin.In(gpio.PullUp, edge)
+}
+
+// Changes returns copy of the levels written
+func (p *fakePin) Changes() []pinChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]pinChange(nil), p.changes...)
+}
+
+// fakeDS18B20 is a DS18B20 on the fake 1-Wire bus
+type fakeDS18B20 struct {
+	celsius float64
+	config  byte
+}
+
+// scratchpad returns the 9 bytes read with command 0xbe
+func (dev *fakeDS18B20) scratchpad() []byte {
+	raw := int16(math.Round(dev.celsius * 16))
+	spad := []byte{byte(raw), byte(uint16(raw) >> 8), 0x4b, 0x46, dev.config, 0xff, 0x0c, 0x10, 0}
+	spad[8] = onewire.CalcCRC(spad[:8])
+	return spad
+}
+
+// fakeOneWire is a 1-Wire bus with DS18B20 sensors. It answers the commands used by periph's ds18b20 driver
+type fakeOneWire struct {
+	mu      sync.Mutex
+	devices map[onewire.Address]*fakeDS18B20
+	order   []onewire.Address
+}
+
+func newFakeOneWire() *fakeOneWire {
+	return &fakeOneWire{devices: make(map[onewire.Address]*fakeDS18B20)}
+}
+
+// Add puts a sensor at celsius on the bus
+func (bus *fakeOneWire) Add(addr onewire.Address, celsius float64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.devices[addr] = &fakeDS18B20{celsius: celsius, config: 0x1f}
+	bus.order = append(bus.order, addr)
+}
+
+// SetTemp changes temperature of sensor addr
+func (bus *fakeOneWire) SetTemp(addr onewire.Address, celsius float64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.devices[addr].celsius = celsius
+}
+
+func (bus *fakeOneWire) String() string {
+	return "fakeOneWire"
+}
+
+func (bus *fakeOneWire) Tx(w, r []byte, power onewire.Pullup) error {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for i := range r {
+		r[i] = 0xff
+	}
+	if len(w) == 2 && w[0] == 0xcc && w[1] == 0x44 {
+		// skip ROM, convert all
+		return nil
+	}
+	if len(w) < 10 || w[0] != 0x55 {
+		return errors.New("unexpected 1-wire command")
+	}
+	dev, ok := bus.devices[onewire.Address(binary.LittleEndian.Uint64(w[1:9]))]
+	if !ok {
+		// nobody answers, the bus stays high
+		return nil
+	}
+	switch w[9] {
+	case 0xbe:
+		copy(r, dev.scratchpad())
+	case 0x4e:
+		if len(w) >= 13 {
+			dev.config = w[12]
+		}
+	}
+	return nil
+}
+
+func (bus *fakeOneWire) Search(alarmOnly bool) ([]onewire.Address, error) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if alarmOnly {
+		return nil, nil
+	}
+	return append([]onewire.Address(nil), bus.order...), nil
+}
+
+// Close does nothing, the bus is shared by all sensors of a test
+func (bus *fakeOneWire) Close() error {
+	return nil
+}
+
+// fakeHardware has pins GPIO2 to GPIO27 and one 1-Wire bus
+type fakeHardware struct {
+	pins    map[string]*fakePin
+	oneWire *fakeOneWire
+}
+
+func (hw *fakeHardware) Init() error {
+	return nil
+}
+
+func (hw *fakeHardware) PinByName(name string) gpio.PinIO {
+	if pin, ok := hw.pins[name]; ok {
+		return pin
+	}
+	return nil
+}
+
+func (hw *fakeHardware) OpenOneWire() (OneWireBus, error) {
+	return hw.oneWire, nil
+}
+
+// useFakeHardware makes devices initialized by the test use fake hardware
+func useFakeHardware(t *testing.T) *fakeHardware {
+	hw := &fakeHardware{pins: make(map[string]*fakePin), oneWire: newFakeOneWire()}
+	for i := 2; i <= 27; i++ {
+		name := "GPIO" + strconv.Itoa(i)
+		hw.pins[name] = newFakePin(name, i)
+	}
+	prev := SetHardware(hw)
+	t.Cleanup(func() { SetHardware(prev) })
+	return hw
+}
+
+// testLogger returns a logger without sinks
+func testLogger() *Logger {
+	logger := &Logger{}
+	logger.Init()
+	return logger
+}
+
+// waitFor polls cond until it is true or timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFakeOneWireScratchpad(t *testing.T) {
+	bus := newFakeOneWire()
+	bus.Add(0x28000001, 65.5)
+	spad := make([]byte, 9)
+	w := make([]byte, 9)
+	w[0] = 0x55
+	binary.LittleEndian.PutUint64(w[1:], 0x28000001)
+	if err := bus.Tx(append(w, 0xbe), spad, onewire.WeakPullup); err != nil {
+		t.Fatal(err)
+	}
+	if !onewire.CheckCRC(spad) {
+		t.Fatalf("bad CRC of scratchpad %x", spad)
+	}
+	if raw := int16(spad[0]) | int16(spad[1])<<8; raw != 65.5*16 {
+		t.Errorf("raw temperature = %d, want %d", raw, int(65.5*16))
+	}
+}
@@ -0,0 +1,248 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// Units of equipment "Volume"
+const (
+	VolumeGallons = "Gallons"
+	VolumeLiters  = "Liters"
+)
+
+const (
+	// litersPerGallon converts US gallons
+	litersPerGallon = 3.78541
+	// waterHeatCapacity is joules to heat one liter of water by 1°C
+	waterHeatCapacity = 4186.0
+	// heatRateWindow is the history searched for the latest run of the heater
+	heatRateWindow = time.Hour
+	// heatRateMinRun is the shortest run of the heater used to measure heating rate
+	heatRateMinRun = 2 * time.Minute
+)
+
+// initHeatUp reads volume and heating efficiency used to estimate heat-up time without history
+func (eq *Equipment) initHeatUp() {
+	props := eq.GetProperties()
+	volume := props.InitProperty("Volume", "float", 0.0, "Volume of water heated. 0 estimates heat-up time from history only").(float64)
+	units := props.InitProperty("Volume Units", "string", VolumeGallons, "Units of Volume").(string)
+	eq.efficiency = props.InitProperty("Heating Efficiency", "float", 80.0, "Percent of heater power that heats the water").(float64)
+
+	switch units {
+	case VolumeGallons:
+		eq.liters = volume * litersPerGallon
+	case VolumeLiters:
+		eq.liters = volume
+	default:
+		eq.LogError("Unknown Volume Units '%s'. Heat-up time is estimated from history only", units)
+	}
+}
+
+// heatUpDefaultsConfig returns properties used to estimate heat-up time
+func heatUpDefaultsConfig() []config.PropertyConfig {
+	return []config.PropertyConfig{
+		{Name: "Volume", Type: "float", Hidden: false, Value: "0", Comment: "Volume of water heated. 0 estimates heat-up time from history only", Choice: ""},
+		{Name: "Volume Units", Type: "string", Hidden: false, Value: VolumeGallons, Comment: "Units of Volume", Choice: "", Select: VolumeGallons + "," + VolumeLiters},
+		{Name: "Heating Efficiency", Type: "float", Hidden: false, Value: "80", Comment: "Percent of heater power that heats the water", Choice: ""},
+	}
+}
+
+// HeatRate returns degrees per second a heater of watts raises the water of equipment, in units °F or °C.
+// Returns 0 when volume or watts are not known
+func (eq *Equipment) HeatRate(watts float64, units string) float64 {
+	if eq.liters <= 0 || watts <= 0 {
+		return 0
+	}
+	rate := watts * eq.efficiency / 100 / (eq.liters * waterHeatCapacity)
+	if u, _ := api.TemperatureUnits(units); u == api.UnitsFahrenheit {
+		rate *= 1.8
+	}
+	return rate
+}
+
+func heating(p api.HistoryPoint) bool {
+	return p.Valid && p.Active && p.Heater > 0
+}
+
+// observedHeatRate returns degrees per second at full heater power measured over the latest run of
+// samples with the heater on that lasted at least minRun
+func observedHeatRate(points []api.HistoryPoint, minRun time.Duration) (float64, bool) {
+	end := len(points)
+	for end > 0 {
+		for end > 0 && !heating(points[end-1]) {
+			end--
+		}
+		start := end
+		for start > 0 && heating(points[start-1]) {
+			start--
+		}
+		if run := points[start:end]; len(run) >= 3 && run[len(run)-1].Time-run[0].Time >= minRun.Milliseconds() {
+			if rate := heatingSlope(run); rate > 0 {
+				return rate, true
+			}
+		}
+		end = start
+	}
+	return 0, false
+}
+
+// heatingSlope returns least squares slope of temperature in degrees per second divided by average heater power
+func heatingSlope(run []api.HistoryPoint) float64 {
+	n := float64(len(run))
+	var sumT, sumY, sumTT, sumTY, power float64
+	for _, p := range run {
+		t := float64(p.Time-run[0].Time) / 1000
+		sumT += t
+		sumY += p.Temperature
+		sumTT += t * t
+		sumTY += t * p.Temperature
+		power += float64(p.Heater)
+	}
+	div := n*sumTT - sumT*sumT
+	if div == 0 {
+		return 0
+	}
+	return (n*sumTY - sumT*sumY) / div / (power / n / 100)
+}
+
+// durationText returns seconds as "23 min" or "1 h 5 min", rounded up to a minute
+func durationText(seconds float64) string {
+	minutes := int(math.Ceil(seconds / 60))
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	return fmt.Sprintf("%d h %d min", minutes/60, minutes%60)
+}
+
+// heatRate returns degrees per second of equipment at full heater power and its source,
+// observed from history when the heater ran recently, otherwise from heater watts and volume
+func (ctrl *Control) heatRate(name string, eq IEquipment, now time.Time) (float64, string, bool) {
+	if ctrl.history != nil {
+		to := now.UnixNano() / int64(time.Millisecond)
+		points := ctrl.history.Get(name, to-heatRateWindow.Milliseconds(), to, 0)
+		if rate, ok := observedHeatRate(points, heatRateMinRun); ok {
+			return rate, api.HeatRateObserved, true
+		}
+	}
+	heater, ok := ctrl.actors[eq.GetHeater()]
+	sensor, ok2 := ctrl.sensors[eq.GetTemperatureSensor()]
+	if !ok || !ok2 {
+		return 0, "", false
+	}
+	if rate := eq.HeatRate(heater.GetWatts(), sensor.GetUnits()); rate > 0 {
+		return rate, api.HeatRateModel, true
+	}
+	return 0, "", false
+}
+
+// temperature returns the latest reading of the temperature sensor of equipment
+func (ctrl *Control) temperature(eq IEquipment) (float64, bool) {
+	ctrl.valuesMu.RLock()
+	defer ctrl.valuesMu.RUnlock()
+	temp, ok := ctrl.sensorValues[eq.GetTemperatureSensor()]
+	return temp, ok
+}
+
+// heatUp returns the estimated time for equipment name to reach its setpoint from now.
+// Hysteresis equipment is at setpoint inside its "Power On" band and heats until "Power Off"
+func (ctrl *Control) heatUp(name string, now time.Time) (api.HeatUp, bool) {
+	eq, ok := ctrl.equipment[name]
+	if !ok {
+		return api.HeatUp{}, false
+	}
+	setpoint, _ := eq.GetSetpoint()
+	return ctrl.heatUpTo(name, setpoint, now)
+}
+
+// heatUpTo returns the estimated time for equipment name to reach setpoint from now
+func (ctrl *Control) heatUpTo(name string, setpoint float64, now time.Time) (api.HeatUp, bool) {
+	eq, ok := ctrl.equipment[name]
+	if !ok {
+		return api.HeatUp{}, false
+	}
+	temp, ok := ctrl.temperature(eq)
+	if !ok {
+		return api.HeatUp{}, false
+	}
+	rate, source, ok := ctrl.heatRate(name, eq, now)
+	if !ok {
+		return api.HeatUp{}, false
+	}
+
+	reached, target := setpoint, setpoint
+	if hyst, ok := eq.(IHysteresis); ok {
+		powerOn, powerOff := hyst.GetPowerBands()
+		reached, target = setpoint-powerOn, setpoint-powerOff
+	}
+	heat := api.HeatUp{Temperature: temp, Setpoint: setpoint, Rate: rate * 60, Source: source, Text: "at setpoint"}
+	if temp < reached {
+		heat.Seconds = math.Max(0, target-temp) / rate
+		heat.Text = "ready in " + durationText(heat.Seconds)
+	}
+	heat.Ready = now.Add(time.Duration(heat.Seconds*float64(time.Second))).UnixNano() / int64(time.Millisecond)
+	return heat, true
+}
+
+// parseSteps reads a mash schedule "<temperature>:<minutes>,..." such as "152:60,168:10"
+func parseSteps(steps string) ([]api.ScheduleStep, error) {
+	schedule := []api.ScheduleStep{}
+	for _, step := range strings.Split(steps, ",") {
+		parts := strings.Split(strings.TrimSpace(step), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("step '%s' is not <temperature>:<minutes>", step)
+		}
+		temp, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("step '%s' has no valid temperature", step)
+		}
+		minutes, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || minutes < 0 {
+			return nil, fmt.Errorf("step '%s' has no valid minutes", step)
+		}
+		schedule = append(schedule, api.ScheduleStep{Temperature: temp, Minutes: minutes})
+	}
+	return schedule, nil
+}
+
+// scheduleETA estimates when each step of mash schedule steps starts and ends when started now.
+// Steps cooler than the step before are assumed to start at once
+func (ctrl *Control) scheduleETA(name string, steps string, now time.Time) (api.ScheduleETA, error) {
+	schedule, err := parseSteps(steps)
+	if err != nil {
+		return api.ScheduleETA{}, err
+	}
+	eq, ok := ctrl.equipment[name]
+	if !ok {
+		return api.ScheduleETA{}, fmt.Errorf("unknown equipment '%s'", name)
+	}
+	temp, ok := ctrl.temperature(eq)
+	if !ok {
+		return api.ScheduleETA{}, fmt.Errorf("no temperature of '%s'", name)
+	}
+	rate, source, ok := ctrl.heatRate(name, eq, now)
+	if !ok {
+		return api.ScheduleETA{}, fmt.Errorf("heating rate of '%s' is not known. Set its Volume or heat for a few minutes", name)
+	}
+
+	eta := api.ScheduleETA{Temperature: temp, Rate: rate * 60, Source: source, Steps: schedule}
+	current := temp
+	for i := range eta.Steps {
+		step := &eta.Steps[i]
+		step.HeatSeconds = math.Max(0, step.Temperature-current) / rate
+		eta.Seconds += step.HeatSeconds
+		step.Start = now.Add(time.Duration(eta.Seconds*float64(time.Second))).UnixNano() / int64(time.Millisecond)
+		eta.Seconds += step.Minutes * 60
+		step.End = now.Add(time.Duration(eta.Seconds*float64(time.Second))).UnixNano() / int64(time.Millisecond)
+		current = step.Temperature
+	}
+	eta.Done = eta.Steps[len(eta.Steps)-1].End
+	eta.Text = "schedule done in " + durationText(eta.Seconds)
+	return eta, nil
+}
@@ -0,0 +1,181 @@
+package control
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// heatingRun returns samples every 5 seconds for minutes starting at temp, rising rate degrees a minute at power
+func heatingRun(start time.Time, minutes int, temp float64, rate float64, power int) []api.HistoryPoint {
+	points := []api.HistoryPoint{}
+	for i := 0; i <= minutes*12; i++ {
+		points = append(points, api.HistoryPoint{
+			Time:        start.Add(time.Duration(i)*5*time.Second).UnixNano() / int64(time.Millisecond),
+			Temperature: temp + rate*float64(i)/12,
+			Valid:       true,
+			Active:      true,
+			Heater:      power,
+		})
+	}
+	return points
+}
+
+func TestHeatRateUnits(t *testing.T) {
+	eq := &Equipment{liters: 20, efficiency: 100}
+	celsius := eq.HeatRate(5000, "°C")
+	if !near(celsius, 5000/(20*waterHeatCapacity)) {
+		t.Errorf("HeatRate in °C = %.4f", celsius)
+	}
+	for _, units := range []string{"°F", "F", "f", " °f "} {
+		if rate := eq.HeatRate(5000, units); !near(rate, celsius*1.8) {
+			t.Errorf("HeatRate in %q = %.4f, want %.4f", units, rate, celsius*1.8)
+		}
+	}
+	for _, units := range []string{"C", "c"} {
+		if rate := eq.HeatRate(5000, units); !near(rate, celsius) {
+			t.Errorf("HeatRate in %q = %.4f, want %.4f", units, rate, celsius)
+		}
+	}
+
+	// sensors report the units in one form
+	sen := new(DummyTempSensor)
+	sen.InitSensor("Temp", testLogger(), []Property{{Name: "Units", PropType: "string", Value: "F"}}, NewEventBus(nil))
+	if units := sen.GetUnits(); units != api.UnitsFahrenheit {
+		t.Errorf("sensor units %q, want °F", units)
+	}
+}
+
+func TestObservedHeatRate(t *testing.T) {
+	start := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	// heater runs 10 minutes, is off and then runs a minute
+	cycling := heatingRun(start, 10, 60, 3, 100)
+	cycling = append(cycling, api.HistoryPoint{Time: start.Add(15*time.Minute).UnixNano() / int64(time.Millisecond), Temperature: 88, Valid: true, Active: true})
+	cycling = append(cycling, heatingRun(start.Add(20*time.Minute), 1, 90, 1, 100)...)
+
+	tests := []struct {
+		name   string
+		points []api.HistoryPoint
+		want   float64 // degrees per minute
+		ok     bool
+	}{
+		{"no samples", nil, 0, false},
+		{"full power", heatingRun(start, 10, 60, 2, 100), 2, true},
+		{"half power", heatingRun(start, 10, 60, 1, 50), 2, true},
+		{"run too short", heatingRun(start, 1, 60, 2, 100), 0, false},
+		// latest run is too short so the run before is used
+		{"latest run", cycling, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rate, ok := observedHeatRate(test.points, heatRateMinRun)
+			if ok != test.ok || !near(rate*60, test.want) {
+				t.Errorf("observedHeatRate() = %.3f°/min, %t; want %.3f, %t", rate*60, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+// newHeatUpControl returns controller with a 10 gallon HLT at 60°F heated by a 5500 W element.
+// The HLT heats to its setpoint of 168 and is at setpoint from 167
+func newHeatUpControl(t *testing.T) *Control {
+	eq := new(SimpleRIMM)
+	eq.InitEquipment("HLT", testLogger(), []Property{
+		{Name: "Temperature Sensor", PropType: "string", Value: "Temp"},
+		{Name: "Heater", PropType: "string", Value: "Element"},
+		{Name: "Volume", PropType: "float", Value: 10.0},
+		{Name: "Temperature Setpoint", PropType: "float", Value: 168.0},
+		{Name: "Power On", PropType: "float", Value: 1.0},
+		{Name: "Power Off", PropType: "float", Value: 0.0},
+	}, NewEventBus(nil))
+
+	heater := new(DummyRelay)
+	if err := heater.Init("Element", testLogger(), []Property{{Name: "Watts", PropType: "float", Value: 5500.0}}); err != nil {
+		t.Fatal(err)
+	}
+	sensor := new(DummyTempSensor)
+	sensor.InitSensor("Temp", testLogger(), []Property{{Name: "Units", PropType: "string", Value: "°F"}}, eq.bus)
+
+	return &Control{
+		logger:       testLogger(),
+		equipment:    map[string]IEquipment{"HLT": eq},
+		actors:       map[string]IActor{"Element": heater},
+		sensors:      map[string]ISensor{"Temp": sensor},
+		sensorValues: SensorValues{"Temp": 60},
+	}
+}
+
+func TestDurationText(t *testing.T) {
+	for seconds, want := range map[float64]string{1: "1 min", 60: "1 min", 61: "2 min", 3540: "59 min", 3600: "1 h 0 min", 5460: "1 h 31 min"} {
+		if got := durationText(seconds); got != want {
+			t.Errorf("durationText(%.0f) = %q, want %q", seconds, got, want)
+		}
+	}
+}
+
+func TestHeatUp(t *testing.T) {
+	ctrl := newHeatUpControl(t)
+	now := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+	// 4400 W heats 37.85 l of water 0.0278°C or 0.05°F a second
+	model := 5500 * 0.8 / (10 * litersPerGallon * waterHeatCapacity) * 1.8
+	heat, ok := ctrl.heatUp("HLT", now)
+	if !ok || heat.Source != api.HeatRateModel || !near(heat.Rate, model*60) {
+		t.Fatalf("heatUp() = %+v, %t; want model rate %.3f°/min", heat, ok, model*60)
+	}
+	if want := 108 / model; !near(heat.Seconds, want) || heat.Text != "ready in 37 min" {
+		t.Errorf("heat-up %.0fs %q, want %.0fs", heat.Seconds, heat.Text, want)
+	}
+	if heat.Ready != now.Add(time.Duration(heat.Seconds*float64(time.Second))).UnixNano()/int64(time.Millisecond) {
+		t.Errorf("ready at %d", heat.Ready)
+	}
+
+	// history of the heater running is used before the model
+	ctrl.history = NewHistory(5*time.Second, time.Hour)
+	for _, p := range heatingRun(now.Add(-10*time.Minute), 10, 40, 2, 100) {
+		ctrl.history.Add("HLT", p)
+	}
+	heat, _ = ctrl.heatUp("HLT", now)
+	if heat.Source != api.HeatRateObserved || !near(heat.Rate, 2) || !near(heat.Seconds, 54*60) {
+		t.Errorf("heatUp() = %+v, want observed 2°/min", heat)
+	}
+
+	ctrl.sensorValues["Temp"] = 167.5
+	if heat, _ = ctrl.heatUp("HLT", now); heat.Seconds != 0 || heat.Text != "at setpoint" {
+		t.Errorf("heatUp() at setpoint = %+v", heat)
+	}
+}
+
+func TestScheduleETA(t *testing.T) {
+	ctrl := newHeatUpControl(t)
+	ctrl.history = NewHistory(5*time.Second, time.Hour)
+	now := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	for _, p := range heatingRun(now.Add(-10*time.Minute), 10, 40, 2, 100) {
+		ctrl.history.Add("HLT", p)
+	}
+	ctrl.sensorValues["Temp"] = 140
+
+	// heat 12° in 6 min, rest 60, cooler step starts at once, heat 20° in 10 min, rest 10
+	eta, err := ctrl.scheduleETA("HLT", "152:60, 148:5,168:10", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minutes := func(ms int64) float64 { return float64(ms-now.UnixNano()/int64(time.Millisecond)) / 60000 }
+	want := []struct{ start, end float64 }{{6, 66}, {66, 71}, {81, 91}}
+	for i, step := range eta.Steps {
+		if math.Abs(minutes(step.Start)-want[i].start) > 0.01 || math.Abs(minutes(step.End)-want[i].end) > 0.01 {
+			t.Errorf("step %d from %.2f to %.2f min, want %.0f to %.0f", i+1, minutes(step.Start), minutes(step.End), want[i].start, want[i].end)
+		}
+	}
+	if !near(eta.Seconds, 91*60) || eta.Done != eta.Steps[2].End || eta.Text != "schedule done in "+durationText(eta.Seconds) {
+		t.Errorf("schedule %.0fs done %d %q", eta.Seconds, eta.Done, eta.Text)
+	}
+
+	for _, steps := range []string{"", "152", "hot:60", "152:-5"} {
+		if _, err := ctrl.scheduleETA("HLT", steps, now); err == nil {
+			t.Errorf("steps %q returned no error", steps)
+		}
+	}
+}
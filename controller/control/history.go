@@ -0,0 +1,96 @@
+package control
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// History keeps recent samples of every equipment in memory so the web UI
+// can chart temperature against setpoint and heater power.
+type History struct {
+	mu       sync.RWMutex
+	interval time.Duration
+	length   time.Duration
+	points   map[string][]api.HistoryPoint
+}
+
+// NewHistory creates a history that is sampled every interval and keeps samples for length
+func NewHistory(interval time.Duration, length time.Duration) *History {
+	return &History{
+		interval: interval,
+		length:   length,
+		points:   make(map[string][]api.HistoryPoint),
+	}
+}
+
+// Interval returns time between samples
+func (h *History) Interval() time.Duration {
+	return h.interval
+}
+
+// Add appends sample of equipment and drops samples older than history length
+func (h *History) Add(name string, point api.HistoryPoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	points := append(h.points[name], point)
+	oldest := point.Time - h.length.Milliseconds()
+	drop := sort.Search(len(points), func(i int) bool { return points[i].Time >= oldest })
+	if drop > 0 {
+		points = append([]api.HistoryPoint(nil), points[drop:]...)
+	}
+	h.points[name] = points
+}
+
+// Get returns samples of equipment between from and to (Unix time in milliseconds).
+// When there are more than max samples, every n'th sample is returned.
+func (h *History) Get(name string, from int64, to int64, max int) []api.HistoryPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	points := h.points[name]
+	start := sort.Search(len(points), func(i int) bool { return points[i].Time >= from })
+	end := sort.Search(len(points), func(i int) bool { return points[i].Time > to })
+	if start >= end {
+		return []api.HistoryPoint{}
+	}
+	points = points[start:end]
+
+	step := 1
+	if max > 0 && len(points) > max {
+		step = (len(points) + max - 1) / max
+	}
+	result := make([]api.HistoryPoint, 0, len(points)/step+1)
+	for i := 0; i < len(points); i += step {
+		result = append(result, points[i])
+	}
+	return result
+}
+
+// historyRange reads "minutes" or "from" and "to" (Unix time in milliseconds) and "max" from query.
+// Default is the last 30 minutes and at most 1000 samples.
+func historyRange(query string, now time.Time) (from int64, to int64, max int) {
+	values, _ := url.ParseQuery(query)
+	to = now.UnixNano() / int64(time.Millisecond)
+	from = to - 30*time.Minute.Milliseconds()
+	max = 1000
+
+	if minutes, err := strconv.ParseInt(values.Get("minutes"), 10, 64); err == nil && minutes > 0 {
+		from = to - minutes*time.Minute.Milliseconds()
+	}
+	if value, err := strconv.ParseInt(values.Get("from"), 10, 64); err == nil {
+		from = value
+	}
+	if value, err := strconv.ParseInt(values.Get("to"), 10, 64); err == nil {
+		to = value
+	}
+	if value, err := strconv.Atoi(values.Get("max")); err == nil && value > 0 {
+		max = value
+	}
+	return from, to, max
+}
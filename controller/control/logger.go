@@ -3,8 +3,9 @@ package control
 import (
 	"fmt"
 	"io"
-	"log"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,43 +26,95 @@ const (
 	LogLevelAll
 )
 
-type logArg struct {
-	level   uint64
-	pattern string
-	args    []interface{}
+// logPrefix is written before messages of each level by text sinks
+var logPrefix = map[uint64]string{
+	LogLevelDebug:   "DEBUG",
+	LogLevelMessage: "MSG",
+	LogLevelWarning: "WARN",
+	LogLevelPass:    "PASS",
+	LogLevelFail:    "FAIL",
+	LogLevelError:   "ERROR",
+}
+
+// Kinds of message sources that are not devices. Devices use their kind, e.g. KindSensor
+const (
+	LogKindController = "controller"
+	LogKindPlugin     = "plugin"
+)
+
+// LogEntry is one message sent to log sinks. Device and Kind are the source of the message,
+// Device is empty for controller messages.
+// Prefix is empty for messages sent with Printf(), which are written unchanged by text sinks
+type LogEntry struct {
+	Time    time.Time
+	Level   uint64
+	Prefix  string
+	Device  string
+	Kind    string
+	Message string
+}
+
+// LogSink writes log entries. Each sink is called from its own go routine
+type LogSink interface {
+	WriteEntry(entry LogEntry) error
+	Close() error
 }
 
 type logStream struct {
-	ChnLogInput chan logArg
+	ChnLogInput chan LogEntry
 	level       uint64
-	logger      *log.Logger
+	sink        LogSink
+	done        chan struct{}
 }
 
 func (log *logStream) Start() {
 
-	log.ChnLogInput = make(chan logArg, LOG_QUEUE_SIZE)
+	log.ChnLogInput = make(chan LogEntry, LOG_QUEUE_SIZE)
+	log.done = make(chan struct{})
 
 	go func() {
-		for message := range log.ChnLogInput {
-			log.logger.Printf(message.pattern, message.args...)
+		for entry := range log.ChnLogInput {
+			log.sink.WriteEntry(entry)
 		}
+		log.sink.Close()
+		close(log.done)
 	}()
 
 }
 
+// accepts returns true if sink writes messages of level
+func (log *logStream) accepts(level uint64) bool {
+	if log.level&LogLevelAll != 0 || log.level&level != 0 {
+		return true
+	}
+	return log.level&LogLevelResults != 0 && level&(LogLevelPass|LogLevelFail) != 0
+}
+
 func (log *logStream) sync() {
 	for len(log.ChnLogInput) > 0 {
 		time.Sleep(time.Millisecond * LOG_SYNC_DELAY)
 	}
 }
 
+// stop closes sink after queued entries are written
+func (log *logStream) stop() {
+	close(log.ChnLogInput)
+	<-log.done
+}
+
+// Logger sends messages to log sinks. Messages below the minimum level of their
+// device, the kind of the device or the default level are dropped before they reach any sink.
 type Logger struct {
-	chnInput    chan logArg
-	loggers     map[string]logStream
-	debugMode   bool
-	initialized bool
-	faulted     bool
-	END         string
+	chnInput     chan LogEntry
+	mu           sync.Mutex
+	loggers      map[string]*logStream
+	levelsMu     sync.RWMutex
+	defaultLevel string
+	deviceLevels map[string]string
+	kindLevels   map[string]string
+	initialized  bool
+	faulted      bool
+	END          string
 }
 
 // Init method will automatically be called before logger is used but user can call if desired.
@@ -75,47 +128,35 @@ func (clog *Logger) Init() {
 			panic(r)
 		}
 	}()
-	clog.loggers = make(map[string]logStream)
-	clog.chnInput = make(chan logArg, LOG_QUEUE_SIZE)
-	clog.debugMode = false
-	if runtime.GOOS == "linux" {
-		clog.END = "\n"
-	} else {
-		clog.END = "\r\n"
-	}
+	clog.loggers = make(map[string]*logStream)
+	clog.chnInput = make(chan LogEntry, LOG_QUEUE_SIZE)
+	clog.defaultLevel = "message"
+	clog.deviceLevels = make(map[string]string)
+	clog.kindLevels = make(map[string]string)
+	clog.END = lineEnd()
 	clog.initialized = true
 
 	go func() {
 		for message := range clog.chnInput {
+			clog.mu.Lock()
 			for _, logger := range clog.loggers {
-
-				if ((message.level & LogLevelDebug) != 0) &&
-					((logger.level&(LogLevelMessage|LogLevelAll) != 0) && clog.debugMode) {
-					logger.ChnLogInput <- message
-					continue
-				}
-
-				if (logger.level & LogLevelAll) != 0 {
-					logger.ChnLogInput <- message
-					continue
-				}
-
-				if ((logger.level & LogLevelResults) != 0) &&
-					(message.level&(LogLevelPass|LogLevelFail) != 0) {
+				if logger.accepts(message.Level) {
 					logger.ChnLogInput <- message
-					continue
-				}
-
-				logLevel := uint64(message.level & logger.level)
-				if logLevel != 0 {
-					logger.ChnLogInput <- message
-					continue
 				}
 			}
+			clog.mu.Unlock()
 		}
 	}()
 }
 
+// lineEnd returns line ending of messages written by text sinks
+func lineEnd() string {
+	if runtime.GOOS == "linux" {
+		return "\n"
+	}
+	return "\r\n"
+}
+
 func (clog *Logger) ready() bool {
 	if clog.initialized {
 		return true
@@ -127,20 +168,156 @@ func (clog *Logger) ready() bool {
 	return clog.initialized
 }
 
+// Add writes messages of level to stream as text. Does nothing if a stream called name exists
 func (clog *Logger) Add(name string, level uint64, stream io.Writer) {
+	clog.mu.Lock()
+	_, ok := clog.loggers[name]
+	clog.mu.Unlock()
+	if !ok {
+		clog.SetSink(name, level, NewTextSink(stream))
+	}
+}
+
+// SetSink writes messages of level to sink. A sink already called name is closed and replaced
+func (clog *Logger) SetSink(name string, level uint64, sink LogSink) {
+	if !clog.ready() {
+		return
+	}
+	stream := &logStream{level: level, sink: sink}
+	stream.Start()
+	clog.mu.Lock()
+	old, ok := clog.loggers[name]
+	clog.loggers[name] = stream
+	clog.mu.Unlock()
+	if ok {
+		old.stop()
+	}
+}
+
+// Remove closes sink called name
+func (clog *Logger) Remove(name string) {
 	if !clog.ready() {
 		return
 	}
-	if _, ok := clog.loggers[name]; !ok {
-		stream := logStream{level: level, logger: log.New(stream, "", log.Ldate|log.Ltime|log.Lmicroseconds)}
-		stream.Start()
-		clog.loggers[name] = stream
+	clog.mu.Lock()
+	old, ok := clog.loggers[name]
+	delete(clog.loggers, name)
+	clog.mu.Unlock()
+	if ok {
+		old.stop()
 	}
 }
 
+// Printf sends message to sinks of level without a prefix
 func (clog *Logger) Printf(level uint64, value string, args ...interface{}) {
-	arg := logArg{level, value, args}
-	clog.chnInput <- arg
+	clog.chnInput <- LogEntry{Time: time.Now(), Level: level, Message: fmt.Sprintf(value, args...)}
+}
+
+// log sends message of device of kind to sinks of level. device is empty for controller messages
+func (clog *Logger) log(level uint64, device string, kind string, msg string, args []interface{}) {
+	if !clog.ready() {
+		return
+	}
+	if logSeverity[LevelName(level)] < logSeverity[clog.minLevel(device, kind)] {
+		return
+	}
+	clog.chnInput <- LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Prefix:  logPrefix[level],
+		Device:  device,
+		Kind:    kind,
+		Message: fmt.Sprintf(msg, args...),
+	}
+}
+
+// minLevel returns level set for device, else for kind, else the default level
+func (clog *Logger) minLevel(device string, kind string) string {
+	clog.levelsMu.RLock()
+	defer clog.levelsMu.RUnlock()
+	if level, ok := clog.deviceLevels[device]; ok && device != "" {
+		return level
+	}
+	if level, ok := clog.kindLevels[kind]; ok {
+		return level
+	}
+	return clog.defaultLevel
+}
+
+// checkMinLevel returns lower case level if it is debug, message, warning or error
+func checkMinLevel(level string) (string, error) {
+	level = strings.ToLower(level)
+	switch level {
+	case "debug", "message", "warning", "error":
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown log level '%s'", level)
+}
+
+// SetDefaultLevel sets minimum level (debug, message, warning or error) of messages
+// from devices and kinds without their own level
+func (clog *Logger) SetDefaultLevel(level string) error {
+	if !clog.ready() {
+		return nil
+	}
+	level, err := checkMinLevel(level)
+	if err != nil {
+		return err
+	}
+	clog.levelsMu.Lock()
+	clog.defaultLevel = level
+	clog.levelsMu.Unlock()
+	return nil
+}
+
+// SetDeviceLevel sets minimum level of messages from device. Empty level removes it
+func (clog *Logger) SetDeviceLevel(device string, level string) error {
+	if !clog.ready() {
+		return nil
+	}
+	return clog.setLevel(clog.deviceLevels, device, level)
+}
+
+// SetKindLevel sets minimum level of messages from devices of kind, e.g. KindSensor
+// or LogKindPlugin. Empty level removes it
+func (clog *Logger) SetKindLevel(kind string, level string) error {
+	if !clog.ready() {
+		return nil
+	}
+	return clog.setLevel(clog.kindLevels, kind, level)
+}
+
+func (clog *Logger) setLevel(levels map[string]string, name string, level string) error {
+	clog.levelsMu.Lock()
+	defer clog.levelsMu.Unlock()
+	if level == "" {
+		delete(levels, name)
+		return nil
+	}
+	level, err := checkMinLevel(level)
+	if err != nil {
+		return err
+	}
+	levels[name] = level
+	return nil
+}
+
+// Levels returns default level and copies of the levels set for devices and kinds
+func (clog *Logger) Levels() (defaultLevel string, devices map[string]string, kinds map[string]string) {
+	if !clog.ready() {
+		return "", nil, nil
+	}
+	clog.levelsMu.RLock()
+	defer clog.levelsMu.RUnlock()
+	devices = make(map[string]string, len(clog.deviceLevels))
+	for name, level := range clog.deviceLevels {
+		devices[name] = level
+	}
+	kinds = make(map[string]string, len(clog.kindLevels))
+	for name, level := range clog.kindLevels {
+		kinds[name] = level
+	}
+	return clog.defaultLevel, devices, kinds
 }
 
 // Sync will block until all messages have been sent to all log streams
@@ -152,55 +329,51 @@ func (clog *Logger) Sync() {
 	for len(clog.chnInput) > 0 {
 		time.Sleep(time.Millisecond * LOG_SYNC_DELAY)
 	}
+	clog.mu.Lock()
+	defer clog.mu.Unlock()
 	for _, logger := range clog.loggers {
 		logger.sync()
 	}
 }
+
+// SetDebug sets default level to debug when mode is true, else to message
 func (clog *Logger) SetDebug(mode bool) {
-	if clog.ready() {
-		clog.debugMode = mode
+	if mode {
+		clog.SetDefaultLevel("debug")
+	} else {
+		clog.SetDefaultLevel("message")
 	}
 }
 
 func (clog *Logger) IsDebugSet() bool {
-
-	return clog.debugMode
+	if !clog.ready() {
+		return false
+	}
+	clog.levelsMu.RLock()
+	defer clog.levelsMu.RUnlock()
+	return clog.defaultLevel == "debug"
 }
 
 func (clog *Logger) LogError(errMsg string, args ...interface{}) {
-	if clog.ready() {
-		clog.Printf(LogLevelError, fmt.Sprintf("ERROR::%s%s", errMsg, clog.END), args...)
-	}
+	clog.log(LogLevelError, "", LogKindController, errMsg, args)
 }
 
 func (clog *Logger) LogDebug(DebugMsg string, args ...interface{}) {
-	if clog.ready() {
-		if clog.debugMode {
-			clog.Printf(LogLevelDebug, fmt.Sprintf("DEBUG::%s%s", DebugMsg, clog.END), args...)
-		}
-	}
+	clog.log(LogLevelDebug, "", LogKindController, DebugMsg, args)
 }
 
 func (clog *Logger) LogWarning(warnMsg string, args ...interface{}) {
-	if clog.ready() {
-		clog.Printf(LogLevelWarning, fmt.Sprintf("ERROR::%s%s", warnMsg, clog.END), args...)
-	}
+	clog.log(LogLevelWarning, "", LogKindController, warnMsg, args)
 }
 
 func (clog *Logger) LogPass(passMsg string, args ...interface{}) {
-	if clog.ready() {
-		clog.Printf(LogLevelPass, fmt.Sprintf("PASS::%s%s", passMsg, clog.END), args...)
-	}
+	clog.log(LogLevelPass, "", LogKindController, passMsg, args)
 }
 
 func (clog *Logger) LogFail(failMsg string, args ...interface{}) {
-	if clog.ready() {
-		clog.Printf(LogLevelFail, fmt.Sprintf("FAIL::%s%s", failMsg, clog.END), args...)
-	}
+	clog.log(LogLevelFail, "", LogKindController, failMsg, args)
 }
 
 func (clog *Logger) LogMessage(msg string, args ...interface{}) {
-	if clog.ready() {
-		clog.Printf(LogLevelMessage, fmt.Sprintf("MSG::%s%s", msg, clog.END), args...)
-	}
+	clog.log(LogLevelMessage, "", LogKindController, msg, args)
 }
@@ -0,0 +1,166 @@
+package control
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink keeps written entries for tests
+type memorySink struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (sink *memorySink) WriteEntry(entry LogEntry) error {
+	sink.mu.Lock()
+	sink.entries = append(sink.entries, entry)
+	sink.mu.Unlock()
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	return nil
+}
+
+func (sink *memorySink) messages() []string {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	messages := []string{}
+	for _, entry := range sink.entries {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+func TestMinLevel(t *testing.T) {
+	tests := []struct {
+		name         string
+		defaultLevel string
+		kindLevel    string
+		deviceLevel  string
+		want         string
+	}{
+		{"default", "warning", "", "", "warning"},
+		{"kind over default", "warning", "debug", "", "debug"},
+		{"device over kind", "warning", "debug", "error", "error"},
+		{"device over default", "message", "", "debug", "debug"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := testLogger()
+			if err := logger.SetDefaultLevel(test.defaultLevel); err != nil {
+				t.Fatal(err)
+			}
+			if err := logger.SetKindLevel(KindSensor, test.kindLevel); err != nil {
+				t.Fatal(err)
+			}
+			if err := logger.SetDeviceLevel("Temp", test.deviceLevel); err != nil {
+				t.Fatal(err)
+			}
+			if got := logger.minLevel("Temp", KindSensor); got != test.want {
+				t.Errorf("level of Temp = %s, want %s", got, test.want)
+			}
+			// other devices of the kind and other kinds are not changed by the device level
+			wantKind := test.defaultLevel
+			if test.kindLevel != "" {
+				wantKind = test.kindLevel
+			}
+			if got := logger.minLevel("Other", KindSensor); got != wantKind {
+				t.Errorf("level of other sensor = %s, want %s", got, wantKind)
+			}
+			if got := logger.minLevel("Pump", KindActor); got != test.defaultLevel {
+				t.Errorf("level of actor = %s, want %s", got, test.defaultLevel)
+			}
+			// controller messages have no device and never match a device level
+			if got := logger.minLevel("", LogKindController); got != test.defaultLevel {
+				t.Errorf("level of controller = %s, want %s", got, test.defaultLevel)
+			}
+		})
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	logger := testLogger()
+	if err := logger.SetDeviceLevel("Temp", "Verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if err := logger.SetDefaultLevel("WARNING"); err != nil || logger.minLevel("", "") != "warning" {
+		t.Errorf("default level %s, %v", logger.minLevel("", ""), err)
+	}
+	logger.SetDeviceLevel("Temp", "debug")
+	logger.SetKindLevel(KindActor, "error")
+
+	def, devices, kinds := logger.Levels()
+	if def != "warning" || devices["Temp"] != "debug" || kinds[KindActor] != "error" {
+		t.Errorf("Levels() = %s %v %v", def, devices, kinds)
+	}
+	devices["Temp"] = "error"
+	if logger.minLevel("Temp", KindSensor) != "debug" {
+		t.Error("Levels() returned the logger's map")
+	}
+
+	// empty level removes the device level
+	logger.SetDeviceLevel("Temp", "")
+	if got := logger.minLevel("Temp", KindSensor); got != "warning" {
+		t.Errorf("level after removing device level = %s", got)
+	}
+	logger.SetDebug(true)
+	if !logger.IsDebugSet() || logger.minLevel("", "") != "debug" {
+		t.Error("SetDebug(true) did not set default level debug")
+	}
+}
+
+func TestLoggerFiltersLevels(t *testing.T) {
+	logger := testLogger()
+	sink := &memorySink{}
+	logger.SetSink("memory", LogLevelAll, sink)
+	logger.SetKindLevel(KindSensor, "warning")
+	logger.SetDeviceLevel("Temp", "debug")
+
+	logger.log(LogLevelDebug, "Temp", KindSensor, "temp debug", nil)
+	logger.log(LogLevelMessage, "Other", KindSensor, "other message", nil)
+	logger.log(LogLevelWarning, "Other", KindSensor, "other warning", nil)
+	logger.LogDebug("controller debug")
+	logger.LogMessage("controller %s", "message")
+	waitFor(t, time.Second, "log entries", func() bool { return len(sink.messages()) >= 3 })
+
+	want := []string{"temp debug", "other warning", "controller message"}
+	got := sink.messages()
+	if len(got) != len(want) {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("logged %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSinkAccepts(t *testing.T) {
+	message, _ := LogLevelByName("message")
+	warning, _ := LogLevelByName("warning")
+	tests := []struct {
+		sink  uint64
+		level uint64
+		want  bool
+	}{
+		{LogLevelAll, LogLevelDebug, true},
+		{message, LogLevelDebug, false},
+		{message, LogLevelMessage, true},
+		{message, LogLevelPass, true},
+		{message, LogLevelFail, true},
+		{warning, LogLevelMessage, false},
+		{warning, LogLevelPass, false},
+		{warning, LogLevelFail, true},
+		{warning, LogLevelError, true},
+		{LogLevelResults, LogLevelPass, true},
+		{LogLevelResults, LogLevelError, false},
+	}
+	for _, test := range tests {
+		stream := &logStream{level: test.sink}
+		if got := stream.accepts(test.level); got != test.want {
+			t.Errorf("sink %b accepts %s = %t, want %t", test.sink, LevelName(test.level), got, test.want)
+		}
+	}
+}
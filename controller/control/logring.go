@@ -0,0 +1,121 @@
+package control
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// logSeverity orders message levels for the level filter of the log ring
+var logSeverity = map[string]int{
+	"debug":   0,
+	"message": 1,
+	"pass":    1,
+	"warning": 2,
+	"fail":    3,
+	"error":   3,
+}
+
+// LogRing is a log sink keeping the newest entries in memory so the web UI can show the log
+type LogRing struct {
+	mu      sync.RWMutex
+	entries []api.LogEntry
+	next    int
+	full    bool
+	lastID  uint64
+}
+
+// NewLogRing returns a log ring keeping the last size entries
+func NewLogRing(size int) *LogRing {
+	return &LogRing{entries: make([]api.LogEntry, size)}
+}
+
+// WriteEntry adds entry and drops the oldest entry when the ring is full
+func (ring *LogRing) WriteEntry(entry LogEntry) error {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	ring.lastID++
+	ring.entries[ring.next] = api.LogEntry{
+		ID:      ring.lastID,
+		Time:    entry.Time.UnixNano() / 1e6,
+		Level:   LevelName(entry.Level),
+		Device:  entry.Device,
+		Kind:    entry.Kind,
+		Message: strings.TrimRight(entry.Message, "\r\n"),
+	}
+	ring.next++
+	if ring.next == len(ring.entries) {
+		ring.next = 0
+		ring.full = true
+	}
+	return nil
+}
+
+// Close does nothing. Entries stay readable after the sink is removed from the logger
+func (ring *LogRing) Close() error {
+	return nil
+}
+
+// Get returns the newest max entries after ID after with at least severity of level
+// ("debug", "message", "warning" or "error") from device of kind. Empty level, device or kind match all entries.
+// Last is the ID of the newest entry in the ring, matching or not. after newer than Last
+// is from before a restart of the controller and returns entries from the start of the ring.
+func (ring *LogRing) Get(after uint64, level string, device string, kind string, max int) api.Log {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	if after > ring.lastID {
+		// IDs start again when the controller restarts
+		after = 0
+	}
+	minSeverity := logSeverity[strings.ToLower(level)]
+	start, count := 0, ring.next
+	if ring.full {
+		start, count = ring.next, len(ring.entries)
+	}
+	entries := []api.LogEntry{}
+	for i := 0; i < count; i++ {
+		entry := ring.entries[(start+i)%len(ring.entries)]
+		if entry.ID <= after || logSeverity[entry.Level] < minSeverity {
+			continue
+		}
+		if (device != "" && entry.Device != device) || (kind != "" && entry.Kind != kind) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if max > 0 && len(entries) > max {
+		entries = entries[len(entries)-max:]
+	}
+	return api.Log{Entries: entries, Last: ring.lastID}
+}
+
+// logQuery reads "after", "level", "device", "kind" and "max" from query of the /log route.
+// Default is the last 200 entries of all levels and devices
+func logQuery(query string) (after uint64, level string, device string, kind string, max int) {
+	values, _ := url.ParseQuery(query)
+	max = 200
+	if value, err := strconv.ParseUint(values.Get("after"), 10, 64); err == nil {
+		after = value
+	}
+	if value, err := strconv.Atoi(values.Get("max")); err == nil && value > 0 {
+		max = value
+	}
+	return after, values.Get("level"), values.Get("device"), values.Get("kind"), max
+}
+
+// startLogRing keeps the last "Log Buffer Size" log messages for the web UI
+func (ctrl *Control) startLogRing() {
+	size := ctrl.props.InitProperty("Log Buffer Size", "int", int64(1000), "Number of log messages kept in memory for the web UI. 0 disables").(int64)
+	if size <= 0 {
+		ctrl.logger.Remove("memory")
+		ctrl.logRing = nil
+		return
+	}
+	ctrl.logRing = NewLogRing(int(size))
+	ctrl.logger.SetSink("memory", LogLevelAll, ctrl.logRing)
+}
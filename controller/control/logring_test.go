@@ -0,0 +1,100 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+// ringMessages writes entries to ring and returns the messages of the entries Get() returns
+func ringMessages(entries []LogEntry, ring *LogRing, after uint64, level string, device string, kind string, max int) []string {
+	for _, entry := range entries {
+		ring.WriteEntry(entry)
+	}
+	messages := []string{}
+	for _, entry := range ring.Get(after, level, device, kind, max).Entries {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+func TestLogRingFilter(t *testing.T) {
+	entries := []LogEntry{
+		{Level: LogLevelDebug, Device: "HLT", Kind: KindEquipment, Message: "hlt debug"},
+		{Level: LogLevelMessage, Device: "HLT", Kind: KindEquipment, Message: "hlt message"},
+		{Level: LogLevelWarning, Device: "Temp", Kind: KindSensor, Message: "temp warning"},
+		{Level: LogLevelPass, Kind: LogKindController, Message: "pass"},
+		{Level: LogLevelFail, Kind: LogKindController, Message: "fail"},
+		{Level: LogLevelError, Device: "HLT", Kind: KindEquipment, Message: "hlt error\n"},
+	}
+	tests := []struct {
+		name   string
+		level  string
+		device string
+		kind   string
+		max    int
+		want   []string
+	}{
+		{"all", "", "", "", 0, []string{"hlt debug", "hlt message", "temp warning", "pass", "fail", "hlt error"}},
+		{"debug", "debug", "", "", 0, []string{"hlt debug", "hlt message", "temp warning", "pass", "fail", "hlt error"}},
+		{"message", "Message", "", "", 0, []string{"hlt message", "temp warning", "pass", "fail", "hlt error"}},
+		{"warning", "warning", "", "", 0, []string{"temp warning", "fail", "hlt error"}},
+		{"error", "error", "", "", 0, []string{"fail", "hlt error"}},
+		{"device", "", "HLT", "", 0, []string{"hlt debug", "hlt message", "hlt error"}},
+		{"device and level", "warning", "HLT", "", 0, []string{"hlt error"}},
+		{"kind", "", "", LogKindController, 0, []string{"pass", "fail"}},
+		{"max", "", "", "", 2, []string{"fail", "hlt error"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ringMessages(entries, NewLogRing(10), 0, test.level, test.device, test.kind, test.max)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogRingWrap(t *testing.T) {
+	ring := NewLogRing(3)
+	now := time.Now()
+	for _, msg := range []string{"1", "2", "3", "4", "5"} {
+		ring.WriteEntry(LogEntry{Time: now, Level: LogLevelMessage, Message: msg})
+	}
+
+	// the oldest entries are dropped and IDs keep counting
+	log := ring.Get(0, "", "", "", 0)
+	if log.Last != 5 || len(log.Entries) != 3 || log.Entries[0].Message != "3" || log.Entries[2].ID != 5 {
+		t.Errorf("ring has %+v", log)
+	}
+	if log.Entries[0].Time != now.UnixNano()/1e6 || log.Entries[0].Level != "message" {
+		t.Errorf("entry %+v", log.Entries[0])
+	}
+
+	// entries after ID
+	if log := ring.Get(4, "", "", "", 0); len(log.Entries) != 1 || log.Entries[0].Message != "5" {
+		t.Errorf("after 4: %+v", log.Entries)
+	}
+	if log := ring.Get(5, "", "", "", 0); len(log.Entries) != 0 || log.Last != 5 {
+		t.Errorf("after 5: %+v", log)
+	}
+	// an ID from before a restart of the controller returns the whole ring
+	if log := ring.Get(100, "", "", "", 0); len(log.Entries) != 3 {
+		t.Errorf("after 100: %+v", log.Entries)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	after, level, device, kind, max := logQuery("after=12&level=warning&device=HLT%2FBoil&kind=equipment&max=50")
+	if after != 12 || level != "warning" || device != "HLT/Boil" || kind != "equipment" || max != 50 {
+		t.Errorf("logQuery = %d %q %q %q %d", after, level, device, kind, max)
+	}
+	after, level, device, kind, max = logQuery("max=-1&after=x")
+	if after != 0 || level != "" || device != "" || kind != "" || max != 200 {
+		t.Errorf("default logQuery = %d %q %q %q %d", after, level, device, kind, max)
+	}
+}
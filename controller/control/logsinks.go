@@ -0,0 +1,422 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// Log formats of the "Log Console Format" and "Log File Format" properties
+const (
+	LogFormatText    = "text"
+	LogFormatJSON    = "json"
+	LogFormatJournal = "journal"
+)
+
+// logLevels maps names used in "... Level" properties to the level of a log sink
+var logLevels = map[string]uint64{
+	"all":     LogLevelAll,
+	"message": LogLevelMessage | LogLevelWarning | LogLevelError | LogLevelResults,
+	"warning": LogLevelWarning | LogLevelError | LogLevelFail,
+	"error":   LogLevelError | LogLevelFail,
+}
+
+// LogLevelByName returns sink level for "all", "message", "warning" or "error"
+func LogLevelByName(name string) (uint64, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s'", name)
+	}
+	return level, nil
+}
+
+// LevelName returns lower case name of a single message level, used by JSON and syslog sinks
+func LevelName(level uint64) string {
+	switch level {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelWarning:
+		return "warning"
+	case LogLevelPass:
+		return "pass"
+	case LogLevelFail:
+		return "fail"
+	case LogLevelError:
+		return "error"
+	}
+	return "message"
+}
+
+// textSink writes entries the way log.Logger does: "2021/03/04 05:06:07.123456 MSG::message"
+type textSink struct {
+	logger *log.Logger
+	end    string
+	closer io.Closer
+}
+
+// NewTextSink writes entries to w as text lines. w is not closed by the sink
+func NewTextSink(w io.Writer) LogSink {
+	return newTextSink(w, nil)
+}
+
+func newTextSink(w io.Writer, closer io.Closer) LogSink {
+	return &textSink{logger: log.New(w, "", log.Ldate|log.Ltime|log.Lmicroseconds), end: lineEnd(), closer: closer}
+}
+
+func (sink *textSink) WriteEntry(entry LogEntry) error {
+	if entry.Prefix == "" {
+		return sink.logger.Output(2, entry.Message)
+	}
+	return sink.logger.Output(2, entry.Prefix+"::"+entry.Message+sink.end)
+}
+
+func (sink *textSink) Close() error {
+	if sink.closer != nil {
+		return sink.closer.Close()
+	}
+	return nil
+}
+
+// jsonEntry is one line written by the JSON sink
+type jsonEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Device  string `json:"device,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message"`
+}
+
+type jsonSink struct {
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewJSONSink writes each entry to w as a JSON object on its own line
+// with fields time (RFC 3339), level, device, kind and message. w is not closed by the sink
+func NewJSONSink(w io.Writer) LogSink {
+	return newJSONSink(w, nil)
+}
+
+func newJSONSink(w io.Writer, closer io.Closer) LogSink {
+	return &jsonSink{enc: json.NewEncoder(w), closer: closer}
+}
+
+func (sink *jsonSink) WriteEntry(entry LogEntry) error {
+	return sink.enc.Encode(jsonEntry{
+		Time:    entry.Time.Format(time.RFC3339Nano),
+		Level:   LevelName(entry.Level),
+		Device:  entry.Device,
+		Kind:    entry.Kind,
+		Message: strings.TrimRight(entry.Message, "\r\n"),
+	})
+}
+
+func (sink *jsonSink) Close() error {
+	if sink.closer != nil {
+		return sink.closer.Close()
+	}
+	return nil
+}
+
+// syslogPriority returns syslog severity of level
+func syslogPriority(level uint64) int {
+	switch level {
+	case LogLevelDebug:
+		return 7
+	case LogLevelWarning:
+		return 4
+	case LogLevelFail, LogLevelError:
+		return 3
+	}
+	return 6
+}
+
+type journalSink struct {
+	w io.Writer
+}
+
+// NewJournalSink writes entries with the "<priority>" prefix read by systemd-journald
+// from the output of a service, so messages get the right priority in the journal
+func NewJournalSink(w io.Writer) LogSink {
+	return &journalSink{w: w}
+}
+
+func (sink *journalSink) WriteEntry(entry LogEntry) error {
+	msg := strings.TrimRight(entry.Message, "\r\n")
+	if entry.Device != "" {
+		msg = entry.Device + ": " + msg
+	}
+	_, err := fmt.Fprintf(sink.w, "<%d>%s\n", syslogPriority(entry.Level), msg)
+	return err
+}
+
+func (sink *journalSink) Close() error {
+	return nil
+}
+
+// RotatingFile is a log file that is renamed to "<path>.<date>-<time>" when it grows over maxSize bytes
+// or when a new period of interval starts (periods start at local midnight for 24 hours).
+// Only the newest maxBackups renamed files are kept. maxSize or interval of 0 disable that rotation
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	period     time.Time
+}
+
+// NewRotatingFile opens log file path for appending
+func NewRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// periodStart returns start of the rotation period containing t in local time
+func periodStart(t time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return time.Time{}
+	}
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(interval).Add(-shift)
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	// a file written in an earlier period is rotated at the next write
+	rf.period = periodStart(time.Now(), rf.interval)
+	if rf.size > 0 {
+		rf.period = periodStart(info.ModTime(), rf.interval)
+	}
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	if rf.size > 0 && ((rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize) ||
+		(rf.interval > 0 && !periodStart(now, rf.interval).Equal(rf.period))) {
+		if err := rf.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames current file and opens a new one
+func (rf *RotatingFile) rotate(now time.Time) error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+	stamp := rf.path + "." + now.Format("20060102-150405")
+	backup := stamp
+	// files rotated in the same second are numbered after the newest so names still sort by age
+	if taken, _ := filepath.Glob(stamp + "*"); len(taken) > 0 {
+		sort.Strings(taken)
+		n := 0
+		fmt.Sscanf(strings.TrimPrefix(taken[len(taken)-1], stamp), "-%d", &n)
+		backup = fmt.Sprintf("%s-%03d", stamp, n+1)
+	}
+	if err := os.Rename(rf.path, backup); err != nil {
+		return err
+	}
+	rf.removeOldBackups()
+	return rf.open()
+}
+
+// removeOldBackups deletes renamed files except the newest maxBackups
+func (rf *RotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(rf.path + ".[0-9]*")
+	if err != nil || len(backups) <= rf.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(name)
+	}
+}
+
+// Close closes log file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// NewFileSink writes entries in format text or json to a rotating log file
+func NewFileSink(format string, file *RotatingFile) (LogSink, error) {
+	switch format {
+	case LogFormatText:
+		return newTextSink(file, file), nil
+	case LogFormatJSON:
+		return newJSONSink(file, file), nil
+	}
+	return nil, fmt.Errorf("unknown log file format '%s'", format)
+}
+
+// NewConsoleSink writes entries to w in format text, json or journal
+func NewConsoleSink(format string, w io.Writer) (LogSink, error) {
+	switch format {
+	case LogFormatText:
+		return NewTextSink(w), nil
+	case LogFormatJSON:
+		return NewJSONSink(w), nil
+	case LogFormatJournal:
+		return NewJournalSink(w), nil
+	}
+	return nil, fmt.Errorf("unknown console log format '%s'", format)
+}
+
+// startLogSinks replaces console output and adds file and syslog sinks configured in controller properties
+func (ctrl *Control) startLogSinks() {
+	props := &ctrl.props
+
+	console := props.InitProperty("Log Console Format", "string", LogFormatText, "Format of log on stdout: text, json or journal (systemd)").(string)
+	if console != LogFormatText {
+		if sink, err := NewConsoleSink(console, os.Stdout); err != nil {
+			ctrl.logger.LogError("%s", err)
+		} else {
+			ctrl.logger.SetSink("default", LogLevelAll, sink)
+		}
+	}
+
+	if path := props.InitProperty("Log File", "string", "", "Log file. Empty disables logging to file").(string); path != "" {
+		format := props.InitProperty("Log File Format", "string", LogFormatText, "Format of log file: text or json").(string)
+		levelName := props.InitProperty("Log File Level", "string", "message", "Messages written to log file: all, message, warning or error").(string)
+		maxSize := props.InitProperty("Log File Max Size", "int", int64(10), "Log file is rotated when larger than this size in MB. 0 disables").(int64)
+		hours := props.InitProperty("Log File Rotate Hours", "int", int64(24), "Log file is rotated every number of hours. 0 disables").(int64)
+		keep := props.InitProperty("Log File Keep", "int", int64(7), "Number of rotated log files kept").(int64)
+
+		err := func() error {
+			level, err := LogLevelByName(levelName)
+			if err != nil {
+				return err
+			}
+			file, err := NewRotatingFile(path, maxSize*1024*1024, time.Duration(hours)*time.Hour, int(keep))
+			if err != nil {
+				return err
+			}
+			sink, err := NewFileSink(format, file)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			ctrl.logger.SetSink("file", level, sink)
+			return nil
+		}()
+		if err != nil {
+			ctrl.logger.LogError("Unable to log to file '%s': %s", path, err)
+		}
+	}
+
+	if props.InitProperty("Log Syslog", "bool", false, "Send log to syslog").(bool) {
+		address := props.InitProperty("Syslog Address", "string", "", "Syslog server as udp://host:514 or tcp://host:514. Empty uses local syslog").(string)
+		tag := props.InitProperty("Syslog Tag", "string", "brewbrat", "Syslog tag of messages").(string)
+		levelName := props.InitProperty("Syslog Level", "string", "message", "Messages sent to syslog: all, message, warning or error").(string)
+
+		level, err := LogLevelByName(levelName)
+		var sink LogSink
+		if err == nil {
+			network := ""
+			if i := strings.Index(address, "://"); i >= 0 {
+				network, address = address[:i], address[i+3:]
+			}
+			sink, err = NewSyslogSink(network, address, tag)
+		}
+		if err != nil {
+			ctrl.logger.LogError("Unable to log to syslog: %s", err)
+		} else {
+			ctrl.logger.SetSink("syslog", level, sink)
+		}
+	}
+}
+
+// logLevels returns minimum log levels of the /loglevel route
+func (ctrl *Control) logLevels() api.LogLevels {
+	levels := api.LogLevels{}
+	levels.Default, levels.Devices, levels.Kinds = ctrl.logger.Levels()
+	return levels
+}
+
+// setLogLevel sets minimum log level from query "level=<debug|message|warning|error>"
+// with "device=<name>" or "kind=<kind>". Without device and kind the default level is set.
+// Level "default" removes the level of device or kind
+func (ctrl *Control) setLogLevel(query string) error {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	level := values.Get("level")
+	if level == "default" {
+		level = ""
+	}
+	if device := values.Get("device"); device != "" {
+		if !ctrl.hasLogSource(device) {
+			return fmt.Errorf("unknown device '%s'", device)
+		}
+		return ctrl.logger.SetDeviceLevel(device, level)
+	}
+	if kind := values.Get("kind"); kind != "" {
+		switch kind {
+		case KindSensor, KindActor, KindEquipment, KindBuzzer, LogKindPlugin, LogKindController:
+			return ctrl.logger.SetKindLevel(kind, level)
+		}
+		return fmt.Errorf("unknown kind '%s'", kind)
+	}
+	return ctrl.logger.SetDefaultLevel(level)
+}
+
+// hasLogSource returns true if name is a configured device or plugin
+func (ctrl *Control) hasLogSource(name string) bool {
+	_, sensor := ctrl.sensors[name]
+	_, actor := ctrl.actors[name]
+	_, eq := ctrl.equipment[name]
+	_, buz := ctrl.buzzers[name]
+	if sensor || actor || eq || buz {
+		return true
+	}
+	for _, p := range ctrl.plugins {
+		if p.Name() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONSink(&buf)
+	now := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	sink.WriteEntry(LogEntry{Time: now, Level: LogLevelWarning, Prefix: "WARN", Device: "HLT", Kind: KindEquipment, Message: "Too hot\n"})
+	sink.WriteEntry(LogEntry{Time: now, Level: LogLevelMessage, Prefix: "MSG", Kind: LogKindController, Message: "Started"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want 2: %q", len(lines), buf.String())
+	}
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"time": "2024-03-04T05:06:07Z", "level": "warning", "device": "HLT", "kind": "equipment", "message": "Too hot"}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %q, want %q", key, entry[key], value)
+		}
+	}
+	if len(entry) != len(want) {
+		t.Errorf("entry has fields %v", entry)
+	}
+
+	entry = nil
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry["device"]; ok || entry["level"] != "message" {
+		t.Errorf("controller entry %v", entry)
+	}
+}
+
+func TestJournalSink(t *testing.T) {
+	tests := []struct {
+		level  uint64
+		device string
+		want   string
+	}{
+		{LogLevelDebug, "", "<7>hello\n"},
+		{LogLevelMessage, "Pump", "<6>Pump: hello\n"},
+		{LogLevelPass, "", "<6>hello\n"},
+		{LogLevelWarning, "", "<4>hello\n"},
+		{LogLevelFail, "", "<3>hello\n"},
+		{LogLevelError, "HLT", "<3>HLT: hello\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		NewJournalSink(&buf).WriteEntry(LogEntry{Level: test.level, Device: test.device, Message: "hello\r\n"})
+		if buf.String() != test.want {
+			t.Errorf("level %s wrote %q, want %q", LevelName(test.level), buf.String(), test.want)
+		}
+	}
+}
+
+func TestTextSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewTextSink(&buf)
+	sink.WriteEntry(LogEntry{Level: LogLevelError, Prefix: "ERROR", Message: "failed"})
+	sink.WriteEntry(LogEntry{Level: LogLevelMessage, Message: "printf\n"})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " ERROR::failed") || !strings.HasSuffix(lines[1], " printf") {
+		t.Errorf("text sink wrote %q", buf.String())
+	}
+}
+
+func TestLogLevelByName(t *testing.T) {
+	level, err := LogLevelByName("Warning")
+	if err != nil || level&LogLevelWarning == 0 || level&LogLevelMessage != 0 {
+		t.Errorf("warning level %b, %v", level, err)
+	}
+	if _, err := LogLevelByName("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if _, err := NewConsoleSink("xml", os.Stdout); err == nil {
+		t.Error("unknown console format accepted")
+	}
+	if _, err := NewFileSink(LogFormatJournal, nil); err == nil {
+		t.Error("journal format accepted for file")
+	}
+}
+
+// readBackups returns contents of the rotated files of path, oldest first
+func readBackups(t *testing.T, path string) []string {
+	t.Helper()
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	contents := []string{}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brewbrat.log")
+	rf, err := NewRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	lines := []string{}
+	for i := 1; i <= 5; i++ {
+		line := strings.Repeat(string(rune('0'+i)), 59) + "\n"
+		lines = append(lines, line)
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every write after the first is over 100 bytes, only the newest two rotated files are kept
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != lines[4] {
+		t.Errorf("log file has %q, want last line", data)
+	}
+	backups := readBackups(t, path)
+	if len(backups) != 2 || backups[0] != lines[2] || backups[1] != lines[3] {
+		t.Errorf("rotated files %q, want lines 3 and 4", backups)
+	}
+
+	// lines fitting in the size are appended
+	rf.Write([]byte("a\n"))
+	if data, _ := os.ReadFile(path); string(data) != lines[4]+"a\n" {
+		t.Errorf("log file has %q after short line", data)
+	}
+}
+
+func TestRotatingFilePeriod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brewbrat.log")
+	if err := os.WriteFile(path, []byte("yesterday\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-25 * time.Hour)
+	if err := os.Chtimes(path, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file written in an earlier period is rotated at the first write
+	rf, err := NewRotatingFile(path, 0, 24*time.Hour, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("today\n"))
+	rf.Write([]byte("still today\n"))
+	rf.Close()
+
+	if data, _ := os.ReadFile(path); string(data) != "today\nstill today\n" {
+		t.Errorf("log file has %q", data)
+	}
+	if backups := readBackups(t, path); len(backups) != 1 || backups[0] != "yesterday\n" {
+		t.Errorf("rotated files %q", backups)
+	}
+	if _, err := rf.Write([]byte("closed\n")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	t1 := time.Date(2024, 3, 4, 0, 30, 0, 0, loc)
+	if got := periodStart(t1, 24*time.Hour); !got.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, loc)) {
+		t.Errorf("day period of %s starts %s, want local midnight", t1, got)
+	}
+	if got := periodStart(t1, 6*time.Hour); !got.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, loc)) {
+		t.Errorf("6 hour period of %s starts %s", t1, got)
+	}
+	t2 := time.Date(2024, 3, 4, 13, 0, 0, 0, loc)
+	if got := periodStart(t2, 6*time.Hour); !got.Equal(time.Date(2024, 3, 4, 12, 0, 0, 0, loc)) {
+		t.Errorf("6 hour period of %s starts %s", t2, got)
+	}
+	if got := periodStart(t2, 0); !got.IsZero() {
+		t.Errorf("period without interval starts %s", got)
+	}
+}
@@ -0,0 +1,105 @@
+package control
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// actorOverride is a manual actor. Until is zero when the override does not expire
+type actorOverride struct {
+	Until time.Time
+}
+
+// actorMode returns api.ActorAuto for actors switched by their equipment or api.ActorManual
+// for actors switched only by the user, and the time a manual override expires
+func (ctrl *Control) actorMode(name string) (string, time.Time) {
+	ctrl.overrideMu.Lock()
+	defer ctrl.overrideMu.Unlock()
+	if over, ok := ctrl.overrides[name]; ok {
+		return api.ActorManual, over.Until
+	}
+	return api.ActorAuto, time.Time{}
+}
+
+// overrideActor runs switch fn for the user and puts actor in manual mode.
+// duration 0 keeps actor manual until it is returned to automatic
+func (ctrl *Control) overrideActor(actor IActor, duration time.Duration, fn func() error) error {
+	ctrl.overrideMu.Lock()
+	over := actorOverride{}
+	if duration > 0 {
+		over.Until = time.Now().Add(duration)
+	}
+	if _, ok := ctrl.overrides[actor.Name()]; !ok {
+		ctrl.logger.LogMessage("Actor '%s' set to manual", actor.Name())
+	}
+	ctrl.overrides[actor.Name()] = over
+	err := fn()
+	ctrl.overrideMu.Unlock()
+
+	ctrl.actorChanged(actor)
+	return err
+}
+
+// releaseActor returns actor to automatic mode. Its equipment switches it again on the next step
+func (ctrl *Control) releaseActor(actor IActor) {
+	ctrl.overrideMu.Lock()
+	_, ok := ctrl.overrides[actor.Name()]
+	delete(ctrl.overrides, actor.Name())
+	ctrl.overrideMu.Unlock()
+
+	if ok {
+		ctrl.logger.LogMessage("Actor '%s' set to automatic", actor.Name())
+		ctrl.actorChanged(actor)
+	}
+}
+
+// expireOverrides returns actors with an override that ended before now to automatic mode
+func (ctrl *Control) expireOverrides(now time.Time) {
+	expired := []string{}
+	ctrl.overrideMu.Lock()
+	for name, over := range ctrl.overrides {
+		if !over.Until.IsZero() && !now.Before(over.Until) {
+			expired = append(expired, name)
+		}
+	}
+	ctrl.overrideMu.Unlock()
+
+	for _, name := range expired {
+		if actor, ok := ctrl.actors[name]; ok {
+			ctrl.releaseActor(actor)
+		}
+	}
+}
+
+// setActorFromUser handles ON, OFF and AUTO from the web UI and MQTT. ON and OFF can be followed
+// by ":<minutes>" to return the actor to automatic mode after that many minutes, e.g. "OFF:10"
+func (ctrl *Control) setActorFromUser(actor IActor, value string) error {
+	cmd, minutes := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		cmd, minutes = value[:i], value[i+1:]
+	}
+
+	var duration time.Duration
+	if minutes != "" {
+		m, err := strconv.ParseFloat(minutes, 64)
+		if err != nil || m < 0 {
+			return fmt.Errorf("invalid override minutes '%s'", minutes)
+		}
+		duration = time.Duration(m * float64(time.Minute))
+	}
+
+	switch cmd {
+	case "ON":
+		return ctrl.overrideActor(actor, duration, actor.On)
+	case "OFF":
+		return ctrl.overrideActor(actor, duration, actor.Off)
+	case "AUTO":
+		ctrl.releaseActor(actor)
+		return nil
+	}
+	return fmt.Errorf("unknown actor command '%s'", cmd)
+}
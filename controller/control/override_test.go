@@ -0,0 +1,124 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// newOverrideControl returns controller with a dummy heater, without configuration or web server
+func newOverrideControl(t *testing.T) (*Control, IActor) {
+	heater := new(DummyRelay)
+	if err := heater.Init("Heater", testLogger(), nil); err != nil {
+		t.Fatal(err)
+	}
+	ctrl := &Control{
+		logger:    testLogger(),
+		bus:       NewEventBus(nil),
+		actors:    map[string]IActor{"Heater": heater},
+		overrides: make(map[string]actorOverride),
+	}
+	return ctrl, heater
+}
+
+func TestManualOverride(t *testing.T) {
+	ctrl, heater := newOverrideControl(t)
+	events := ctrl.bus.Subscribe("test", Topic(TopicActor, "Heater"))
+	defer events.Close()
+
+	if err := ctrl.setActorFromUser(heater, "OFF:10"); err != nil {
+		t.Fatal(err)
+	}
+	mode, until := ctrl.actorMode("Heater")
+	if mode != api.ActorManual || time.Until(until) < 9*time.Minute {
+		t.Fatalf("mode = %s until %s, want manual for 10 minutes", mode, until)
+	}
+	ev := (<-events.C).Payload.(ActorEvent)
+	if !ev.Manual || ev.Until != until {
+		t.Errorf("actor event %+v is not manual until %s", ev, until)
+	}
+
+	// equipment can not switch a manual actor
+	ctrl.handleActorCommand(ActorCommand{Name: "Heater", Source: "Mash Tun", Cmd: ActorCmdOn})
+	if heater.GetState() != StateOff {
+		t.Fatal("equipment switched manual actor on")
+	}
+
+	ctrl.expireOverrides(time.Now().Add(5 * time.Minute))
+	if mode, _ := ctrl.actorMode("Heater"); mode != api.ActorManual {
+		t.Fatal("override expired early")
+	}
+	ctrl.expireOverrides(until)
+	if mode, _ := ctrl.actorMode("Heater"); mode != api.ActorAuto {
+		t.Fatal("override did not expire")
+	}
+	if ev := (<-events.C).Payload.(ActorEvent); ev.Manual {
+		t.Errorf("actor event %+v after override expired is manual", ev)
+	}
+
+	ctrl.handleActorCommand(ActorCommand{Name: "Heater", Source: "Mash Tun", Cmd: ActorCmdOn})
+	if heater.GetState() != StateOn {
+		t.Error("equipment can not switch actor after override expired")
+	}
+}
+
+func TestManualOverrideCommands(t *testing.T) {
+	ctrl, heater := newOverrideControl(t)
+
+	if err := ctrl.setActorFromUser(heater, "ON"); err != nil {
+		t.Fatal(err)
+	}
+	mode, until := ctrl.actorMode("Heater")
+	if mode != api.ActorManual || !until.IsZero() || heater.GetState() != StateOn {
+		t.Fatalf("ON: mode = %s until %s, state %d; want manual without end and on", mode, until, heater.GetState())
+	}
+	ctrl.expireOverrides(time.Now().Add(24 * time.Hour))
+	if mode, _ := ctrl.actorMode("Heater"); mode != api.ActorManual {
+		t.Fatal("override without end expired")
+	}
+
+	if err := ctrl.setActorFromUser(heater, "AUTO"); err != nil {
+		t.Fatal(err)
+	}
+	if mode, _ := ctrl.actorMode("Heater"); mode != api.ActorAuto {
+		t.Fatal("AUTO did not return actor to automatic")
+	}
+	if heater.GetState() != StateOn {
+		t.Error("AUTO switched actor")
+	}
+
+	for _, value := range []string{"TOGGLE", "OFF:soon", "OFF:-5"} {
+		if err := ctrl.setActorFromUser(heater, value); err == nil {
+			t.Errorf("%s returned no error", value)
+		}
+	}
+	if mode, _ := ctrl.actorMode("Heater"); mode != api.ActorAuto {
+		t.Error("invalid command made actor manual")
+	}
+}
+
+func TestEquipmentSkipsManualActor(t *testing.T) {
+	bus := NewEventBus(nil)
+	commands := bus.Subscribe("test", Topic(TopicActorCommand, "#"))
+	defer commands.Close()
+
+	eq := new(Equipment)
+	eq.InitEquipment("Mash Tun", testLogger(), nil, bus)
+	eq.AddActor("Heater")
+	eq.handleEvent(Event{Topic: Topic(TopicActor, "Heater"), Payload: ActorEvent{Name: "Heater", State: StateOff, Manual: true}})
+	eq.switchActor("Heater", true)
+
+	eq.handleEvent(Event{Topic: Topic(TopicActor, "Heater"), Payload: ActorEvent{Name: "Heater", State: StateOff}})
+	eq.switchActor("Heater", true)
+
+	ev := <-commands.C
+	if cmd := ev.Payload.(ActorCommand); cmd.Cmd != ActorCmdOn {
+		t.Fatalf("command %+v, want on", cmd)
+	}
+	select {
+	case ev := <-commands.C:
+		t.Errorf("command %+v sent for manual actor", ev.Payload)
+	default:
+	}
+}
@@ -0,0 +1,588 @@
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/plugin"
+)
+
+// Timing of plugin supervision. Variables so tests can run plugins faster
+var (
+	pluginCallTimeout  = 10 * time.Second
+	pluginHealthPeriod = 10 * time.Second
+	pluginMinBackoff   = time.Second
+	pluginMaxBackoff   = time.Minute
+)
+
+var errPluginNotRunning = errors.New("plugin is not running")
+
+// pluginConn joins the pipes to stdin and stdout of a plugin process
+type pluginConn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (conn pluginConn) Close() error {
+	conn.WriteCloser.Close()
+	return conn.ReadCloser.Close()
+}
+
+// pluginDevice is a device created in a plugin process. Kept to create it again after a restart
+// with the same state. power is -1 until SetPower() is called
+type pluginDevice struct {
+	args    plugin.InitArgs
+	started bool
+	on      bool
+	power   int
+}
+
+// Plugin runs a plugin executable and restarts it when it exits or fails the health check.
+// Devices of the plugin are registered as types of kind sensor or actor, see startPlugins().
+// Only supervise() reads exited and starts the process again, and it does not once stopped is set
+type Plugin struct {
+	name   string
+	path   string
+	args   []string
+	logger *Logger
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	client  *rpc.Client
+	devices []*pluginDevice
+	stopped bool
+	exited  chan error
+	stop    chan struct{}
+	done    chan struct{} // closed when supervise() returns
+}
+
+// NewPlugin returns plugin for configuration. Call Start() to run it
+func NewPlugin(cfg config.PluginConfig, logger *Logger) *Plugin {
+	name := cfg.Name
+	if name == "" {
+		name = cfg.Path
+	}
+	return &Plugin{
+		name:   name,
+		path:   cfg.Path,
+		args:   cfg.Args,
+		logger: logger,
+		exited: make(chan error, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Name of plugin from configuration
+func (p *Plugin) Name() string {
+	return p.name
+}
+
+// Start runs plugin process and reads its device types. The process is supervised until Stop()
+func (p *Plugin) Start() ([]plugin.TypeInfo, error) {
+	p.mu.Lock()
+	err := p.startProcess()
+	p.mu.Unlock()
+	if err != nil {
+		close(p.done)
+		return nil, err
+	}
+	reply := plugin.DescribeReply{}
+	if err := p.call("Describe", plugin.Empty{}, &reply); err != nil {
+		p.kill()
+		<-p.exited
+		close(p.done)
+		return nil, fmt.Errorf("no device types: %s", err)
+	}
+	go p.supervise()
+	return reply.Types, nil
+}
+
+// startProcess starts the plugin executable with an RPC client on its stdin and stdout.
+// Must be called with p.mu locked
+func (p *Plugin) startProcess() error {
+	cmd := exec.Command(p.path, p.args...)
+	inRead, inWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	outRead, outWrite, err := os.Pipe()
+	if err != nil {
+		inRead.Close()
+		inWrite.Close()
+		return err
+	}
+	cmd.Stdin = inRead
+	cmd.Stdout = outWrite
+	stderr, err := cmd.StderrPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	inRead.Close()
+	outWrite.Close()
+	if err != nil {
+		inWrite.Close()
+		outRead.Close()
+		return err
+	}
+
+	go p.logOutput(stderr)
+	client := jsonrpc.NewClient(pluginConn{outRead, inWrite})
+	p.cmd = cmd
+	p.client = client
+
+	go func() {
+		err := cmd.Wait()
+		client.Close()
+		p.mu.Lock()
+		if p.client == client {
+			p.client = nil
+		}
+		p.mu.Unlock()
+		p.exited <- err
+	}()
+	p.logMessage("Plugin '%s' started (pid %d)", p.name, cmd.Process.Pid)
+	return nil
+}
+
+// logOutput copies stderr of plugin to the log
+func (p *Plugin) logOutput(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		p.logMessage("%s", scanner.Text())
+	}
+}
+
+// logMessage logs message with the plugin as source
+func (p *Plugin) logMessage(msg string, args ...interface{}) {
+	p.logger.log(LogLevelMessage, p.name, LogKindPlugin, msg, args)
+}
+
+// logError logs error with the plugin as source
+func (p *Plugin) logError(msg string, args ...interface{}) {
+	p.logger.log(LogLevelError, p.name, LogKindPlugin, msg, args)
+}
+
+// call calls method of plugin service. Fails when the plugin does not answer within pluginCallTimeout
+func (p *Plugin) call(method string, args interface{}, reply interface{}) error {
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+	if client == nil {
+		return errPluginNotRunning
+	}
+	call := client.Go(plugin.ServiceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(pluginCallTimeout):
+		return fmt.Errorf("plugin '%s' did not answer %s", p.name, method)
+	}
+}
+
+// kill ends the plugin process. supervise() starts it again unless plugin is stopped
+func (p *Plugin) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// supervise checks health of the plugin and restarts it when the process exits.
+// Returns after the process exited once the plugin is stopped
+func (p *Plugin) supervise() {
+	defer close(p.done)
+	health := time.NewTicker(pluginHealthPeriod)
+	defer health.Stop()
+	backoff := pluginMinBackoff
+	for {
+		select {
+		case <-p.stop:
+			p.waitExit()
+			return
+		case err := <-p.exited:
+			if p.isStopped() {
+				return
+			}
+			p.logError("Plugin '%s' exited: %v", p.name, err)
+			if !p.restart(&backoff) {
+				return
+			}
+		case <-health.C:
+			reply := plugin.HealthReply{}
+			if err := p.call("Health", plugin.Empty{}, &reply); err != nil {
+				p.logError("Plugin '%s' failed health check: %s", p.name, err)
+				p.kill()
+				<-p.exited
+				if p.isStopped() || !p.restart(&backoff) {
+					return
+				}
+				// skip tick queued while waiting for the plugin
+				select {
+				case <-health.C:
+				default:
+				}
+				continue
+			}
+			backoff = pluginMinBackoff
+		}
+	}
+}
+
+// waitExit waits for the process to exit after Stop() closed its stdin. It is killed after a second
+func (p *Plugin) waitExit() {
+	select {
+	case <-p.exited:
+	case <-time.After(time.Second):
+		p.kill()
+		<-p.exited
+	}
+}
+
+// restart starts the plugin process again and creates all devices again.
+// The wait before each attempt doubles up to pluginMaxBackoff until a health check passes.
+// Returns false when plugin was stopped. No process is started after Stop()
+func (p *Plugin) restart(backoff *time.Duration) bool {
+	for {
+		p.logMessage("Restarting plugin '%s' in %s", p.name, *backoff)
+		select {
+		case <-p.stop:
+			return false
+		case <-time.After(*backoff):
+		}
+		if *backoff *= 2; *backoff > pluginMaxBackoff {
+			*backoff = pluginMaxBackoff
+		}
+		p.mu.Lock()
+		if p.stopped {
+			p.mu.Unlock()
+			return false
+		}
+		err := p.startProcess()
+		p.mu.Unlock()
+		if err == nil {
+			break
+		}
+		p.logError("Plugin '%s' not started: %s", p.name, err)
+	}
+
+	p.mu.Lock()
+	devices := []pluginDevice{}
+	for _, dev := range p.devices {
+		devices = append(devices, *dev)
+	}
+	p.mu.Unlock()
+	for _, dev := range devices {
+		if err := p.call("Init", dev.args, &plugin.Empty{}); err != nil {
+			p.logError("Plugin device '%s' not created again: %s", dev.args.Name, err)
+			continue
+		}
+		if !dev.started {
+			continue
+		}
+		args := plugin.DeviceArgs{Name: dev.args.Name}
+		if err := p.call("OnStart", args, &plugin.Empty{}); err != nil {
+			p.logError("Plugin device '%s' not started again: %s", dev.args.Name, err)
+			continue
+		}
+		if dev.power >= 0 {
+			p.call("SetPower", plugin.PowerArgs{Name: dev.args.Name, Power: dev.power}, &plugin.Empty{})
+		}
+		if dev.on {
+			p.call("On", args, &plugin.Empty{})
+		}
+	}
+	return true
+}
+
+func (p *Plugin) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+// Stop ends supervision and the plugin process and waits for both.
+// The plugin gets a second to exit after stdin is closed before it is killed
+func (p *Plugin) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.stop)
+	client := p.client
+	p.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+	<-p.done
+	p.logMessage("Plugin '%s' stopped", p.name)
+}
+
+// initDevice creates device in plugin and remembers it for restarts
+func (p *Plugin) initDevice(typeName string, name string, properties []Property) (*pluginDevice, error) {
+	values := make(map[string]string)
+	for _, prop := range properties {
+		values[prop.Name] = fmt.Sprint(prop.Value)
+	}
+	dev := &pluginDevice{args: plugin.InitArgs{Type: typeName, Name: name, Properties: values}, power: -1}
+	p.mu.Lock()
+	p.devices = append(p.devices, dev)
+	p.mu.Unlock()
+	return dev, p.call("Init", dev.args, &plugin.Empty{})
+}
+
+func (p *Plugin) deviceCall(dev *pluginDevice, method string) error {
+	if dev == nil {
+		return errPluginNotRunning
+	}
+	return p.call(method, plugin.DeviceArgs{Name: dev.args.Name}, &plugin.Empty{})
+}
+
+func (p *Plugin) setStarted(dev *pluginDevice, started bool) {
+	p.mu.Lock()
+	dev.started = started
+	p.mu.Unlock()
+}
+
+// setOn remembers state of actor to restore it after a restart
+func (p *Plugin) setOn(dev *pluginDevice, on bool) {
+	p.mu.Lock()
+	dev.on = on
+	p.mu.Unlock()
+}
+
+// setPower remembers power level of actor to restore it after a restart
+func (p *Plugin) setPower(dev *pluginDevice, power int) {
+	p.mu.Lock()
+	dev.power = power
+	p.mu.Unlock()
+}
+
+// pluginDefaults converts properties of a plugin device type to the configuration defaults
+func pluginDefaults(name string, props []plugin.Property) []config.PropertyConfig {
+	defaults := []config.PropertyConfig{
+		{Name: "Name", Type: "string", Hidden: true, Value: name, Comment: "Device Name", Choice: ""},
+	}
+	for _, prop := range props {
+		defaults = append(defaults, config.PropertyConfig{
+			Name:    prop.Name,
+			Type:    prop.Type,
+			Hidden:  prop.Hidden,
+			Value:   prop.Value,
+			Comment: prop.Comment,
+			Choice:  "",
+			Select:  prop.Select,
+		})
+	}
+	return defaults
+}
+
+// withDefaults adds default properties of the plugin device type missing from configured properties
+func withDefaults(properties []Property, defaults []config.PropertyConfig) []Property {
+	configured := make(map[string]bool)
+	for _, prop := range properties {
+		configured[prop.Name] = true
+	}
+	for _, def := range defaults {
+		if !configured[def.Name] {
+			properties = append(properties, toProperty(def))
+		}
+	}
+	return properties
+}
+
+// PluginSensor is a sensor implemented by a plugin process
+type PluginSensor struct {
+	Sensor
+	plugin   *Plugin
+	typeName string
+	defaults []config.PropertyConfig
+	dev      *pluginDevice
+}
+
+func (sen *PluginSensor) GetDefaultsConfig() ([]config.PropertyConfig, error) {
+	return sen.defaults, nil
+}
+
+// InitSensor creates the sensor in the plugin
+func (sen *PluginSensor) InitSensor(name string, logger *Logger, properties []Property, bus *EventBus) error {
+	properties = withDefaults(properties, sen.defaults)
+	sen.Sensor.InitSensor(name, logger, properties, bus)
+	dev, err := sen.plugin.initDevice(sen.typeName, name, properties)
+	sen.dev = dev
+	if err != nil {
+		sen.LogError("Plugin sensor '%s' not created: %s", name, err)
+	}
+	return err
+}
+
+func (sen *PluginSensor) OnStart() error {
+	sen.plugin.setStarted(sen.dev, true)
+	err := sen.plugin.deviceCall(sen.dev, "OnStart")
+	if err != nil {
+		sen.LogError("Plugin sensor '%s' not started: %s", sen.Name(), err)
+	}
+	return err
+}
+
+func (sen *PluginSensor) OnStop() error {
+	sen.plugin.setStarted(sen.dev, false)
+	return sen.plugin.deviceCall(sen.dev, "OnStop")
+}
+
+func (sen *PluginSensor) OnRead() (float64, error) {
+	reply := plugin.ReadReply{}
+	err := sen.plugin.call("OnRead", plugin.DeviceArgs{Name: sen.Name()}, &reply)
+	return reply.Value, err
+}
+
+// Run reads the sensor every 3 seconds. Unlike built in sensors it keeps
+// running when a read fails, as the plugin may be restarting
+func (sen *PluginSensor) Run() error {
+	sen.LogMessage("Start Run %s", sen.Name())
+	failed := false
+	for {
+		value, err := sen.OnRead()
+		if err != nil {
+			if !failed {
+				sen.LogWarning("can't read plugin sensor '%s': %s", sen.Name(), err)
+			}
+			failed = true
+		} else {
+			failed = false
+			sen.SetValue(value)
+		}
+		time.Sleep(time.Second * 3)
+	}
+}
+
+// PluginActor is an actor implemented by a plugin process
+type PluginActor struct {
+	Actor
+	plugin   *Plugin
+	typeName string
+	defaults []config.PropertyConfig
+	dev      *pluginDevice
+}
+
+func (act *PluginActor) GetDefaultsConfig() ([]config.PropertyConfig, error) {
+	return act.defaults, nil
+}
+
+// Init creates the actor in the plugin
+func (act *PluginActor) Init(name string, logger *Logger, properties []Property) error {
+	properties = withDefaults(properties, act.defaults)
+	act.Actor.Init(name, logger, properties)
+	dev, err := act.plugin.initDevice(act.typeName, name, properties)
+	act.dev = dev
+	if err != nil {
+		act.LogError("Plugin actor '%s' not created: %s", name, err)
+	}
+	return err
+}
+
+func (act *PluginActor) OnStart() error {
+	act.plugin.setStarted(act.dev, true)
+	err := act.plugin.deviceCall(act.dev, "OnStart")
+	if err != nil {
+		act.LogError("Plugin actor '%s' not started: %s", act.Name(), err)
+	}
+	return err
+}
+
+func (act *PluginActor) OnStop() error {
+	act.plugin.setStarted(act.dev, false)
+	return act.plugin.deviceCall(act.dev, "OnStop")
+}
+
+func (act *PluginActor) On() error {
+	if err := act.plugin.deviceCall(act.dev, "On"); err != nil {
+		act.LogError("Plugin actor '%s' not turned on: %s", act.Name(), err)
+		return err
+	}
+	act.state = StateOn
+	act.plugin.setOn(act.dev, true)
+	return nil
+}
+
+func (act *PluginActor) Off() error {
+	if err := act.plugin.deviceCall(act.dev, "Off"); err != nil {
+		act.LogError("Plugin actor '%s' not turned off: %s", act.Name(), err)
+		return err
+	}
+	act.state = StateOff
+	act.plugin.setOn(act.dev, false)
+	return nil
+}
+
+func (act *PluginActor) SetPower(power int) error {
+	if err := act.plugin.call("SetPower", plugin.PowerArgs{Name: act.Name(), Power: power}, &plugin.Empty{}); err != nil {
+		act.LogError("Plugin actor '%s' power not set: %s", act.Name(), err)
+		return err
+	}
+	act.power = power
+	act.plugin.setPower(act.dev, power)
+	return nil
+}
+
+// registerPluginTypes adds device types of plugin to reg
+func registerPluginTypes(reg *Registry, p *Plugin, types []plugin.TypeInfo) []error {
+	errs := []error{}
+	for _, t := range types {
+		t := t
+		defaults := pluginDefaults(t.Type, t.Properties)
+		description := fmt.Sprintf("%s (plugin %s)", t.Description, p.Name())
+		var factory DeviceFactory
+		switch t.Kind {
+		case plugin.KindSensor:
+			factory = func() IDevice { return &PluginSensor{plugin: p, typeName: t.Type, defaults: defaults} }
+		case plugin.KindActor:
+			factory = func() IDevice { return &PluginActor{plugin: p, typeName: t.Type, defaults: defaults} }
+		default:
+			errs = append(errs, fmt.Errorf("device type '%s' of plugin '%s' has unsupported kind '%s'", t.Type, p.Name(), t.Kind))
+			continue
+		}
+		if err := reg.Register(t.Kind, t.Type, factory, description); err != nil {
+			errs = append(errs, fmt.Errorf("plugin '%s': %s", p.Name(), err))
+		}
+	}
+	return errs
+}
+
+// startPlugins starts all configured plugins and registers their device types.
+// Must be called before devices are created
+func (ctrl *Control) startPlugins() {
+	for _, cfg := range ctrl.configuration.Plugins {
+		p := NewPlugin(cfg, ctrl.logger)
+		types, err := p.Start()
+		if err != nil {
+			ctrl.logger.LogError("Plugin '%s' not started: %s", p.Name(), err)
+			continue
+		}
+		for _, err := range registerPluginTypes(ctrl.registry, p, types) {
+			ctrl.logger.LogError("%s", err)
+		}
+		ctrl.plugins = append(ctrl.plugins, p)
+	}
+}
+
+// stopPlugins stops all plugin processes. Call after devices are stopped
+func (ctrl *Control) stopPlugins() {
+	for _, p := range ctrl.plugins {
+		p.Stop()
+	}
+	ctrl.plugins = nil
+}
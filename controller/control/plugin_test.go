@@ -0,0 +1,312 @@
+//go:build !windows
+
+package control
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/plugin"
+)
+
+// testPluginEnv makes the test binary run as the test plugin, see TestMain
+const testPluginEnv = "BREWBRAT_TEST_PLUGIN"
+
+// TestMain serves the test plugin types when the test binary is started as a plugin
+func TestMain(m *testing.M) {
+	if os.Getenv(testPluginEnv) == "1" {
+		plugin.Serve(testPluginTypes...)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testRelay is the state of the "TestRelay" actor in the plugin process
+var testRelay struct {
+	sync.Mutex
+	on    bool
+	power int
+}
+
+// testState is a sensor reading "Offset" plus the relay power plus 1000 while the relay is on,
+// so tests see the calls reaching the plugin process
+type testState struct {
+	offset float64
+}
+
+func (sen *testState) Init(name string, properties map[string]string) error {
+	offset, err := strconv.ParseFloat(properties["Offset"], 64)
+	sen.offset = offset
+	return err
+}
+
+func (sen *testState) OnStart() error { return nil }
+func (sen *testState) OnStop() error  { return nil }
+
+func (sen *testState) OnRead() (float64, error) {
+	testRelay.Lock()
+	defer testRelay.Unlock()
+	value := sen.offset + float64(testRelay.power)
+	if testRelay.on {
+		value += 1000
+	}
+	return value, nil
+}
+
+type testRelayActor struct{}
+
+func (act *testRelayActor) Init(name string, properties map[string]string) error { return nil }
+func (act *testRelayActor) OnStart() error                                       { return act.Off() }
+func (act *testRelayActor) OnStop() error                                        { return nil }
+
+func (act *testRelayActor) On() error {
+	testRelay.Lock()
+	testRelay.on = true
+	testRelay.Unlock()
+	return nil
+}
+
+func (act *testRelayActor) Off() error {
+	testRelay.Lock()
+	testRelay.on = false
+	testRelay.Unlock()
+	return nil
+}
+
+func (act *testRelayActor) SetPower(power int) error {
+	testRelay.Lock()
+	testRelay.power = power
+	testRelay.Unlock()
+	return nil
+}
+
+var testPluginTypes = []plugin.Type{
+	{
+		TypeInfo: plugin.TypeInfo{Kind: plugin.KindSensor, Type: "TestState", Description: "Relay state",
+			Properties: []plugin.Property{{Name: "Offset", Type: "float", Value: "0.5"}}},
+		New: func() interface{} { return new(testState) },
+	},
+	{
+		TypeInfo: plugin.TypeInfo{Kind: plugin.KindActor, Type: "TestRelay", Description: "Relay"},
+		New:      func() interface{} { return new(testRelayActor) },
+	},
+}
+
+// fastPluginTiming shortens supervision times for the test
+func fastPluginTiming(t *testing.T) {
+	call, health, min, max := pluginCallTimeout, pluginHealthPeriod, pluginMinBackoff, pluginMaxBackoff
+	pluginCallTimeout, pluginHealthPeriod, pluginMinBackoff, pluginMaxBackoff = 200*time.Millisecond, time.Hour, 10*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() {
+		pluginCallTimeout, pluginHealthPeriod, pluginMinBackoff, pluginMaxBackoff = call, health, min, max
+	})
+}
+
+// testPlugin is the test binary running as plugin with a started sensor and relay
+type testPlugin struct {
+	*Plugin
+	ring   *LogRing
+	sensor *PluginSensor
+	relay  *PluginActor
+}
+
+// startTestPlugin starts the test plugin and creates a sensor and relay of its types
+func startTestPlugin(t *testing.T) *testPlugin {
+	t.Setenv(testPluginEnv, "1")
+	logger := testLogger()
+	ring := NewLogRing(100)
+	logger.SetSink("memory", LogLevelAll, ring)
+
+	p := NewPlugin(config.PluginConfig{Name: "test", Path: os.Args[0], Args: []string{"-test.run=^$"}}, logger)
+	types, err := p.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+
+	reg := NewRegistry()
+	if errs := registerPluginTypes(reg, p, types); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	sen, err := reg.New(KindSensor, "TestState")
+	if err != nil {
+		t.Fatal(err)
+	}
+	act, err := reg.New(KindActor, "TestRelay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testPlugin{Plugin: p, ring: ring, sensor: sen.(*PluginSensor), relay: act.(*PluginActor)}
+	if err := tp.sensor.InitSensor("State", logger, nil, NewEventBus(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.relay.Init("Relay", logger, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.sensor.OnStart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.relay.OnStart(); err != nil {
+		t.Fatal(err)
+	}
+	return tp
+}
+
+func (p *testPlugin) pid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmd.Process.Pid
+}
+
+// read returns the reading of the test sensor, -1 if it fails
+func (p *testPlugin) read() float64 {
+	value, err := p.sensor.OnRead()
+	if err != nil {
+		return -1
+	}
+	return value
+}
+
+// logged returns true if the plugin logged a message containing text
+func (p *testPlugin) logged(text string) bool {
+	for _, entry := range p.ring.Get(0, "", p.Name(), "", 0).Entries {
+		if strings.Contains(entry.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPluginDevices(t *testing.T) {
+	fastPluginTiming(t)
+	p := startTestPlugin(t)
+
+	// the default "Offset" of the type is passed to the plugin
+	if value := p.read(); value != 0.5 {
+		t.Errorf("sensor read %v, want 0.5", value)
+	}
+	if err := p.relay.SetPower(40); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.relay.On(); err != nil {
+		t.Fatal(err)
+	}
+	if value := p.read(); value != 1040.5 {
+		t.Errorf("sensor read %v with relay on at 40%%, want 1040.5", value)
+	}
+	if p.relay.GetState() != StateOn || p.relay.GetPowerLevel() != 40 {
+		t.Errorf("relay state %v power %d", p.relay.GetState(), p.relay.GetPowerLevel())
+	}
+	if err := p.relay.Off(); err != nil {
+		t.Fatal(err)
+	}
+	if value := p.read(); value != 40.5 {
+		t.Errorf("sensor read %v with relay off, want 40.5", value)
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	fastPluginTiming(t)
+	p := startTestPlugin(t)
+	p.relay.SetPower(60)
+	p.relay.On()
+
+	pid := p.pid()
+	p.kill()
+	waitFor(t, 5*time.Second, "plugin restart", func() bool { return p.pid() != pid })
+
+	// devices are created again with their state
+	waitFor(t, 5*time.Second, "relay state restored", func() bool { return p.read() == 1060.5 })
+	if !p.logged("exited") {
+		t.Error("exit not logged")
+	}
+}
+
+func TestPluginBackoff(t *testing.T) {
+	fastPluginTiming(t)
+	p := startTestPlugin(t)
+
+	p.mu.Lock()
+	path := p.path
+	p.path = path + ".missing"
+	p.mu.Unlock()
+	p.kill()
+
+	// the wait doubles after each failed start up to pluginMaxBackoff
+	waits := []string{"in 10ms", "in 20ms", "in 40ms"}
+	waitFor(t, 5*time.Second, "restart attempts", func() bool {
+		n := 0
+		for _, entry := range p.ring.Get(0, "", p.Name(), "", 0).Entries {
+			if strings.Contains(entry.Message, "Restarting") {
+				if n < len(waits) && !strings.HasSuffix(entry.Message, waits[n]) {
+					t.Fatalf("attempt %d: %q, want wait %s", n+1, entry.Message, waits[n])
+				}
+				if n >= len(waits) && !strings.HasSuffix(entry.Message, "in 40ms") {
+					t.Fatalf("attempt %d: %q, want wait of at most 40ms", n+1, entry.Message)
+				}
+				n++
+			}
+		}
+		return n >= 5
+	})
+
+	p.mu.Lock()
+	p.path = path
+	p.mu.Unlock()
+	waitFor(t, 5*time.Second, "plugin restart", func() bool { return p.read() == 0.5 })
+}
+
+func TestPluginHealthCheck(t *testing.T) {
+	fastPluginTiming(t)
+	pluginHealthPeriod = 50 * time.Millisecond
+	p := startTestPlugin(t)
+
+	// a plugin that stops answering is killed and started again
+	pid := p.pid()
+	if err := syscall.Kill(pid, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "plugin restart", func() bool { return p.pid() != pid })
+	if !p.logged("failed health check") {
+		t.Error("failed health check not logged")
+	}
+	waitFor(t, 5*time.Second, "sensor read", func() bool { return p.read() == 0.5 })
+}
+
+func TestPluginStop(t *testing.T) {
+	fastPluginTiming(t)
+	p := startTestPlugin(t)
+
+	p.Stop()
+	p.mu.Lock()
+	state := p.cmd.ProcessState
+	p.mu.Unlock()
+	if state == nil {
+		t.Fatal("plugin process running after Stop")
+	}
+	if _, err := p.sensor.OnRead(); err != errPluginNotRunning {
+		t.Errorf("read after Stop: %v", err)
+	}
+	p.Stop()
+}
+
+func TestPluginStopWhileRestarting(t *testing.T) {
+	fastPluginTiming(t)
+	pluginMinBackoff = 100 * time.Millisecond
+	p := startTestPlugin(t)
+
+	// Stop during the wait before the restart ends supervision without a new process
+	pid := p.pid()
+	p.kill()
+	waitFor(t, 5*time.Second, "restart wait", func() bool { return p.logged("Restarting") })
+	p.Stop()
+	time.Sleep(3 * pluginMinBackoff)
+	if p.pid() != pid {
+		t.Error("plugin started again after Stop")
+	}
+}
@@ -0,0 +1,156 @@
+package control
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+)
+
+// Policies of pump and agitator. Equipment switches the actor only while it is active and
+// switches it off once when it becomes inactive. Inactive equipment leaves the actor alone
+const (
+	PolicyNone       = "None"        // equipment never switches actor
+	PolicyAlwaysOn   = "Always On"   // actor is on while equipment is active
+	PolicyInterval   = "Interval"    // actor cycles on and off. Off periods of a pump are pump rests
+	PolicyWithHeater = "With Heater" // actor is on while the heater is on, e.g. agitator starts on heat
+)
+
+// actorPolicy switches the pump or agitator of equipment
+type actorPolicy struct {
+	policy string
+	on     time.Duration
+	off    time.Duration
+	// phaseOn is true in the on part of an interval that started at phaseStart
+	phaseOn    bool
+	phaseStart time.Time
+	// wanted is true when the policy last wanted the actor on
+	wanted bool
+	// active is true while the equipment is active and the policy switches the actor
+	active bool
+}
+
+// newActorPolicy reads "<role> Policy" and the interval times "<role> <onName>" and "<role> <offName>" in minutes
+func newActorPolicy(props *Properties, role string, policies []string, onName string, onMinutes float64, offName string, offMinutes float64) (*actorPolicy, error) {
+	pol := &actorPolicy{}
+	pol.policy = props.InitProperty(role+" Policy", "string", PolicyNone, "How equipment switches "+role).(string)
+	pol.on = minutes(props.InitProperty(role+" "+onName, "float", onMinutes, "Minutes on of Interval policy").(float64))
+	pol.off = minutes(props.InitProperty(role+" "+offName, "float", offMinutes, "Minutes off of Interval policy").(float64))
+
+	for _, p := range policies {
+		if p == pol.policy {
+			if pol.policy == PolicyInterval && (pol.on <= 0 || pol.off <= 0) {
+				pol.policy = PolicyNone
+				return pol, fmt.Errorf("%s Interval policy needs minutes on and off", role)
+			}
+			return pol, nil
+		}
+	}
+	unknown := pol.policy
+	pol.policy = PolicyNone
+	return pol, fmt.Errorf("unknown %s Policy '%s'", role, unknown)
+}
+
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
+
+// want returns true when actor should be on at now
+func (pol *actorPolicy) want(now time.Time, active bool, heaterOn bool) bool {
+	if !active {
+		pol.phaseStart = time.Time{}
+		return false
+	}
+	switch pol.policy {
+	case PolicyAlwaysOn:
+		return true
+	case PolicyWithHeater:
+		return heaterOn
+	case PolicyInterval:
+		if pol.phaseStart.IsZero() {
+			pol.phaseOn, pol.phaseStart = true, now
+		}
+		length := pol.off
+		if pol.phaseOn {
+			length = pol.on
+		}
+		for now.Sub(pol.phaseStart) >= length {
+			pol.phaseOn = !pol.phaseOn
+			pol.phaseStart = pol.phaseStart.Add(length)
+			length = pol.off
+			if pol.phaseOn {
+				length = pol.on
+			}
+		}
+		return pol.phaseOn
+	}
+	return false
+}
+
+// initPolicies reads the pump and agitator policies
+func (eq *Equipment) initPolicies() {
+	props := eq.GetProperties()
+	var err error
+	eq.pumpPolicy, err = newActorPolicy(props, "Pump", []string{PolicyNone, PolicyAlwaysOn, PolicyInterval}, "On Minutes", 10, "Rest Minutes", 2)
+	if err != nil {
+		eq.LogError("%s. Pump is not switched by equipment", err)
+	}
+	eq.agitatorPolicy, err = newActorPolicy(props, "Agitator", []string{PolicyNone, PolicyAlwaysOn, PolicyInterval, PolicyWithHeater}, "On Minutes", 1, "Off Minutes", 4)
+	if err != nil {
+		eq.LogError("%s. Agitator is not switched by equipment", err)
+	}
+}
+
+// policyDefaultsConfig returns properties of the pump and agitator policies. pump is the default pump policy
+func policyDefaultsConfig(pump string) []config.PropertyConfig {
+	return []config.PropertyConfig{
+		{Name: "Pump Policy", Type: "string", Hidden: false, Value: pump, Comment: "How equipment switches Pump", Choice: "", Select: PolicyNone + "," + PolicyAlwaysOn + "," + PolicyInterval},
+		{Name: "Pump On Minutes", Type: "float", Hidden: false, Value: "10", Comment: "Minutes on of Interval policy", Choice: ""},
+		{Name: "Pump Rest Minutes", Type: "float", Hidden: false, Value: "2", Comment: "Minutes off of Interval policy. Heater stays off while pump rests", Choice: ""},
+		{Name: "Agitator Policy", Type: "string", Hidden: false, Value: PolicyNone, Comment: "How equipment switches Agitator", Choice: "", Select: PolicyNone + "," + PolicyAlwaysOn + "," + PolicyInterval + "," + PolicyWithHeater},
+		{Name: "Agitator On Minutes", Type: "float", Hidden: false, Value: "1", Comment: "Minutes on of Interval policy", Choice: ""},
+		{Name: "Agitator Off Minutes", Type: "float", Hidden: false, Value: "4", Comment: "Minutes off of Interval policy", Choice: ""},
+	}
+}
+
+// updatePolicies switches pump and agitator as their policies want at now
+func (eq *Equipment) updatePolicies(now time.Time) {
+	active := eq.GetState() == EqStateActive
+	heaterOn := eq.Actors[eq.heater].State == StateOn
+
+	for _, p := range []struct {
+		name string
+		pol  *actorPolicy
+	}{{eq.pump, eq.pumpPolicy}, {eq.agitator, eq.agitatorPolicy}} {
+		if p.name == "" || p.pol == nil || p.pol.policy == PolicyNone {
+			continue
+		}
+		act, ok := eq.Actors[p.name]
+		if !ok {
+			continue
+		}
+		on := p.pol.want(now, active, heaterOn)
+		p.pol.wanted = on
+		if !active {
+			// switched off when the equipment stops, then it can be switched by hand
+			if p.pol.active && act.State == StateOn {
+				eq.switchActor(p.name, false)
+			}
+			p.pol.active = false
+			continue
+		}
+		p.pol.active = true
+		if on != (act.State == StateOn) {
+			eq.switchActor(p.name, on)
+		}
+	}
+}
+
+// heaterAllowed is false while the pump policy has the pump off, so a RIMS element never heats without flow
+func (eq *Equipment) heaterAllowed() bool {
+	if eq.pump == "" || eq.pumpPolicy == nil || eq.pumpPolicy.policy == PolicyNone {
+		return true
+	}
+	pump, ok := eq.Actors[eq.pump]
+	return ok && pump.State == StateOn
+}
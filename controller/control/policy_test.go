@@ -0,0 +1,198 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIntervalPolicy(t *testing.T) {
+	pol := &actorPolicy{policy: PolicyInterval, on: 10 * time.Minute, off: 2 * time.Minute}
+	start := time.Now()
+
+	tests := []struct {
+		after  time.Duration
+		active bool
+		want   bool
+	}{
+		{0, true, true},
+		{9 * time.Minute, true, true},
+		{10 * time.Minute, true, false}, // pump rest
+		{11 * time.Minute, true, false},
+		{12 * time.Minute, true, true},
+		{23 * time.Minute, true, false}, // second rest, steps in between missed
+		{26 * time.Minute, false, false},
+		{27 * time.Minute, true, true}, // interval starts again
+	}
+	for _, test := range tests {
+		if got := pol.want(start.Add(test.after), test.active, false); got != test.want {
+			t.Errorf("after %s active %t: want() = %t, expected %t", test.after, test.active, got, test.want)
+		}
+	}
+}
+
+func TestNewActorPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		props   []Property
+		want    string
+		wantErr bool
+	}{
+		{"default", nil, PolicyNone, false},
+		{"always on", []Property{{Name: "Pump Policy", PropType: "string", Value: PolicyAlwaysOn}}, PolicyAlwaysOn, false},
+		{"unknown", []Property{{Name: "Pump Policy", PropType: "string", Value: "Sometimes"}}, PolicyNone, true},
+		{"not for pump", []Property{{Name: "Pump Policy", PropType: "string", Value: PolicyWithHeater}}, PolicyNone, true},
+		{"no rest", []Property{{Name: "Pump Policy", PropType: "string", Value: PolicyInterval}, {Name: "Pump Rest Minutes", PropType: "float", Value: 0.0}}, PolicyNone, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			props := NewProperties()
+			props.AddProperties(test.props)
+			pol, err := newActorPolicy(&props, "Pump", []string{PolicyNone, PolicyAlwaysOn, PolicyInterval}, "On Minutes", 10, "Rest Minutes", 2)
+			if (err != nil) != test.wantErr {
+				t.Errorf("err = %v, want error %t", err, test.wantErr)
+			}
+			if pol.policy != test.want {
+				t.Errorf("policy = %s, want %s", pol.policy, test.want)
+			}
+		})
+	}
+}
+
+// newPolicyEquipment returns equipment with pump, agitator and heater and the actor commands it sends
+func newPolicyEquipment(t *testing.T, props []Property) (*Equipment, *Subscription) {
+	bus := NewEventBus(nil)
+	commands := bus.Subscribe("test", Topic(TopicActorCommand, "#"))
+	t.Cleanup(commands.Close)
+
+	props = append([]Property{
+		{Name: "Pump", PropType: "string", Value: "Pump"},
+		{Name: "Agitator", PropType: "string", Value: "Agitator"},
+		{Name: "Heater", PropType: "string", Value: "Heater"},
+	}, props...)
+	eq := new(Equipment)
+	eq.InitEquipment("Mash Tun", testLogger(), props, bus)
+	for _, name := range []string{"Pump", "Agitator", "Heater"} {
+		eq.AddActor(name)
+	}
+	return eq, commands
+}
+
+// setActor tells equipment that actor name is on or off
+func setActor(eq *Equipment, name string, on bool) {
+	state := DeviceState(StateOff)
+	if on {
+		state = StateOn
+	}
+	eq.handleEvent(Event{Topic: Topic(TopicActor, name), Payload: ActorEvent{Name: name, State: state}})
+}
+
+// sentCommands returns actor commands published since the last call as "<name> on|off"
+func sentCommands(commands *Subscription) []string {
+	sent := []string{}
+	for {
+		select {
+		case ev := <-commands.C:
+			cmd := ev.Payload.(ActorCommand)
+			state := "off"
+			if cmd.Cmd == ActorCmdOn {
+				state = "on"
+			}
+			sent = append(sent, cmd.Name+" "+state)
+		case <-time.After(50 * time.Millisecond):
+			return sent
+		}
+	}
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEquipmentPolicies(t *testing.T) {
+	eq, commands := newPolicyEquipment(t, []Property{
+		{Name: "Pump Policy", PropType: "string", Value: PolicyAlwaysOn},
+		{Name: "Agitator Policy", PropType: "string", Value: PolicyWithHeater},
+	})
+	now := time.Now()
+
+	eq.State = EqStateIdle
+	eq.updatePolicies(now)
+	if sent := sentCommands(commands); len(sent) != 0 {
+		t.Fatalf("idle equipment sent %v", sent)
+	}
+	if eq.heaterAllowed() {
+		t.Error("heater allowed before pump runs")
+	}
+
+	eq.State = EqStateActive
+	eq.updatePolicies(now)
+	if sent := sentCommands(commands); !equal(sent, []string{"Pump on"}) {
+		t.Fatalf("active equipment sent %v, want pump on", sent)
+	}
+	setActor(eq, "Pump", true)
+	if !eq.heaterAllowed() {
+		t.Error("heater not allowed while pump runs")
+	}
+
+	// agitator starts with the heater
+	setActor(eq, "Heater", true)
+	eq.updatePolicies(now)
+	if sent := sentCommands(commands); !equal(sent, []string{"Agitator on"}) {
+		t.Fatalf("heater on sent %v, want agitator on", sent)
+	}
+	setActor(eq, "Agitator", true)
+	setActor(eq, "Heater", false)
+	eq.updatePolicies(now)
+	if sent := sentCommands(commands); !equal(sent, []string{"Agitator off"}) {
+		t.Fatalf("heater off sent %v, want agitator off", sent)
+	}
+	setActor(eq, "Agitator", false)
+
+	// manual pump is left alone
+	eq.handleEvent(Event{Topic: Topic(TopicActor, "Pump"), Payload: ActorEvent{Name: "Pump", State: StateOff, Manual: true}})
+	eq.updatePolicies(now)
+	if sent := sentCommands(commands); len(sent) != 0 {
+		t.Fatalf("manual pump switched: %v", sent)
+	}
+	if eq.heaterAllowed() {
+		t.Error("heater allowed while manual pump is off")
+	}
+	setActor(eq, "Pump", true)
+
+	eq.State = EqStateIdle
+	eq.updatePolicies(now)
+	if sent := sentCommands(commands); !equal(sent, []string{"Pump off"}) {
+		t.Fatalf("idle equipment sent %v, want pump off", sent)
+	}
+	setActor(eq, "Pump", false)
+
+	// pump switched on by hand stays on while equipment is idle
+	setActor(eq, "Pump", true)
+	setActor(eq, "Heater", true)
+	for i := 0; i < 3; i++ {
+		eq.updatePolicies(now.Add(time.Duration(i) * time.Second))
+	}
+	if sent := sentCommands(commands); len(sent) != 0 {
+		t.Fatalf("idle equipment switched actors %v", sent)
+	}
+}
+
+func TestEquipmentWithoutPolicies(t *testing.T) {
+	eq, commands := newPolicyEquipment(t, nil)
+	eq.State = EqStateActive
+	eq.updatePolicies(time.Now())
+	if sent := sentCommands(commands); len(sent) != 0 {
+		t.Fatalf("equipment without policies sent %v", sent)
+	}
+	if !eq.heaterAllowed() {
+		t.Error("heater needs pump without pump policy")
+	}
+}
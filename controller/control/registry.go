@@ -0,0 +1,148 @@
+package control
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// Kinds of devices accepted by Register
+const (
+	KindSensor    = api.ClassSensor
+	KindActor     = api.ClassActor
+	KindEquipment = api.ClassEquipment
+	KindBuzzer    = api.ClassBuzzer
+)
+
+// DeviceFactory returns a new uninitialized device of a registered type
+type DeviceFactory func() IDevice
+
+// DeviceType describes a registered device type.
+// Properties are the defaults returned by the device's GetDefaultsConfig()
+type DeviceType struct {
+	Kind        string
+	Name        string
+	Description string
+	Factory     DeviceFactory
+	Properties  []config.PropertyConfig
+}
+
+// Registry stores all device types that can be used in the configuration
+type Registry struct {
+	mu    sync.RWMutex
+	types map[string]*DeviceType
+}
+
+// DefaultRegistry holds the built in device types and all types added with Register()
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{types: make(map[string]*DeviceType)}
+}
+
+// Register adds device type to DefaultRegistry. See Registry.Register()
+func Register(kind string, typeName string, factory DeviceFactory, description string) error {
+	return DefaultRegistry.Register(kind, typeName, factory, description)
+}
+
+// mustRegister registers a built in device type. Panics on error as the type is broken
+func mustRegister(kind string, typeName string, factory DeviceFactory, description string) {
+	if err := Register(kind, typeName, factory, description); err != nil {
+		panic(err)
+	}
+}
+
+// isKind returns true when device implements the interface of kind
+func isKind(kind string, dev IDevice) bool {
+	switch kind {
+	case KindSensor:
+		_, ok := dev.(ISensor)
+		return ok
+	case KindActor:
+		_, ok := dev.(IActor)
+		return ok
+	case KindEquipment:
+		_, ok := dev.(IEquipment)
+		return ok
+	case KindBuzzer:
+		_, ok := dev.(IBuzzer)
+		return ok
+	}
+	return false
+}
+
+// Register adds device type typeName of kind sensor, actor, equipment or buzzer.
+// factory must return a device implementing the interface of kind (ISensor, IActor, IEquipment or IBuzzer).
+// The default properties of the type are read from GetDefaultsConfig()
+func (reg *Registry) Register(kind string, typeName string, factory DeviceFactory, description string) error {
+	switch kind {
+	case KindSensor, KindActor, KindEquipment, KindBuzzer:
+	default:
+		return fmt.Errorf("device type '%s' has unknown kind '%s'", typeName, kind)
+	}
+	if typeName == "" {
+		return fmt.Errorf("device type of kind '%s' has no name", kind)
+	}
+	if factory == nil {
+		return fmt.Errorf("device type '%s' has no factory", typeName)
+	}
+
+	dev := factory()
+	if dev == nil || !isKind(kind, dev) {
+		return fmt.Errorf("device type '%s' is not a %s", typeName, kind)
+	}
+	props, err := dev.GetDefaultsConfig()
+	if err != nil {
+		return fmt.Errorf("device type '%s' has no default properties: %s", typeName, err)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.types[typeName]; ok {
+		return fmt.Errorf("device type '%s' is already registered", typeName)
+	}
+	reg.types[typeName] = &DeviceType{Kind: kind, Name: typeName, Description: description, Factory: factory, Properties: props}
+	return nil
+}
+
+// Lookup returns registered device type
+func (reg *Registry) Lookup(typeName string) (*DeviceType, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	devType, ok := reg.types[typeName]
+	return devType, ok
+}
+
+// Types returns all registered device types sorted by kind and name
+func (reg *Registry) Types() []*DeviceType {
+	reg.mu.RLock()
+	types := make([]*DeviceType, 0, len(reg.types))
+	for _, devType := range reg.types {
+		types = append(types, devType)
+	}
+	reg.mu.RUnlock()
+
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Kind != types[j].Kind {
+			return types[i].Kind < types[j].Kind
+		}
+		return types[i].Name < types[j].Name
+	})
+	return types
+}
+
+// New creates a device of typeName. Returns error when type is unknown or not of kind
+func (reg *Registry) New(kind string, typeName string) (IDevice, error) {
+	devType, ok := reg.Lookup(typeName)
+	if !ok {
+		return nil, fmt.Errorf("unknown device type '%s'", typeName)
+	}
+	if devType.Kind != kind {
+		return nil, fmt.Errorf("device type '%s' is a %s not a %s", typeName, devType.Kind, kind)
+	}
+	return devType.Factory(), nil
+}
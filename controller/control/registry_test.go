@@ -0,0 +1,92 @@
+package control
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	relay := func() IDevice { return new(DummyRelay) }
+	tests := []struct {
+		name     string
+		kind     string
+		typeName string
+		factory  DeviceFactory
+		wantErr  string
+	}{
+		{"valid", KindActor, "TestRelay", relay, ""},
+		{"unknown kind", "valve", "TestValve", relay, "unknown kind 'valve'"},
+		{"empty name", KindActor, "", relay, "has no name"},
+		{"nil factory", KindActor, "TestNil", nil, "has no factory"},
+		{"factory returns nil", KindActor, "TestNilDevice", func() IDevice { return nil }, "is not a actor"},
+		{"wrong kind", KindSensor, "TestNotSensor", relay, "is not a sensor"},
+		{"duplicate", KindActor, "TestRelay", relay, "already registered"},
+	}
+	reg := NewRegistry()
+	for _, test := range tests {
+		err := reg.Register(test.kind, test.typeName, test.factory, "Test device")
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+
+	if types := reg.Types(); len(types) != 1 || types[0].Name != "TestRelay" {
+		t.Fatalf("registered types %+v, want only TestRelay", types)
+	}
+	devType, ok := reg.Lookup("TestRelay")
+	if !ok || devType.Kind != KindActor || devType.Description != "Test device" || len(devType.Properties) == 0 {
+		t.Errorf("TestRelay is %+v, %t", devType, ok)
+	}
+}
+
+func TestRegistryNew(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.Register(KindActor, "TestRelay", func() IDevice { return new(DummyRelay) }, "Test device"); err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := reg.New(KindActor, "TestRelay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.(*DummyRelay); !ok {
+		t.Errorf("New returned %T", dev)
+	}
+	if other, _ := reg.New(KindActor, "TestRelay"); other == dev {
+		t.Error("New returned the same device twice")
+	}
+
+	if _, err := reg.New(KindActor, "Unknown"); err == nil || !strings.Contains(err.Error(), "unknown device type") {
+		t.Errorf("New of unknown type: %v", err)
+	}
+	if _, err := reg.New(KindSensor, "TestRelay"); err == nil || !strings.Contains(err.Error(), "is a actor not a sensor") {
+		t.Errorf("New of wrong kind: %v", err)
+	}
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	kinds := map[string]string{
+		"SimpleRelay":     KindActor,
+		"DummyRelay":      KindActor,
+		"TempSensor":      KindSensor,
+		"DummyTempSensor": KindSensor,
+		"SimpleRIMM":      KindEquipment,
+		"ActiveBuzzer":    KindBuzzer,
+	}
+	for name, kind := range kinds {
+		if devType, ok := DefaultRegistry.Lookup(name); !ok || devType.Kind != kind {
+			t.Errorf("built in type %s: %+v, %t", name, devType, ok)
+		}
+	}
+
+	types := DefaultRegistry.Types()
+	for i := 1; i < len(types); i++ {
+		prev, cur := types[i-1], types[i]
+		if prev.Kind > cur.Kind || (prev.Kind == cur.Kind && prev.Name > cur.Name) {
+			t.Errorf("types not sorted: %s/%s before %s/%s", prev.Kind, prev.Name, cur.Kind, cur.Name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package control
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// canRestart is true when controller can replace itself with a new process to load configuration
+const canRestart = true
+
+// replaced by tests
+var (
+	executable  = os.Executable
+	execProcess = syscall.Exec
+	exit        = os.Exit
+)
+
+// restart turns off all actors and starts the controller again with the same arguments.
+// The controller keeps running when its executable is not found. Once devices are stopped
+// it exits with an error if it cannot start again, so the service manager restarts it
+func (ctrl *Control) restart() {
+	time.Sleep(time.Second)
+	exe, err := executable()
+	if err != nil {
+		ctrl.logger.LogError("Unable to restart controller, restart it to use new configuration: %s", err)
+		return
+	}
+
+	ctrl.logger.LogMessage("Restarting controller to use new configuration")
+	ctrl.stopDevices()
+	ctrl.logger.Sync()
+	err = execProcess(exe, os.Args, os.Environ())
+	ctrl.logger.LogError("Unable to restart controller: %s", err)
+	ctrl.logger.Sync()
+	exit(1)
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package control
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// stubRestart replaces process functions used by restart. Returns the exit code, -1 when restart did not exit
+func stubRestart(t *testing.T, exeErr error, execErr error) *int {
+	code := -1
+	oldExecutable, oldExec, oldExit := executable, execProcess, exit
+	t.Cleanup(func() { executable, execProcess, exit = oldExecutable, oldExec, oldExit })
+	executable = func() (string, error) { return "/usr/bin/controller", exeErr }
+	execProcess = func(string, []string, []string) error { return execErr }
+	exit = func(c int) { code = c }
+	return &code
+}
+
+func TestRestartFailure(t *testing.T) {
+	tests := []struct {
+		exeErr  error
+		execErr error
+		stopped bool
+		code    int
+	}{
+		{errors.New("no executable"), nil, false, -1},
+		{nil, errors.New("exec format error"), true, 1},
+	}
+	for _, test := range tests {
+		code := stubRestart(t, test.exeErr, test.execErr)
+		ctrl := &Control{logger: testLogger(), bus: NewEventBus(nil)}
+		session := ctrl.bus.Subscribe("test", Topic(TopicSession, "#"))
+
+		ctrl.restart()
+		stopped := false
+		select {
+		case <-session.C:
+			stopped = true
+		case <-time.After(50 * time.Millisecond):
+		}
+		session.Close()
+		if stopped != test.stopped || *code != test.code {
+			t.Errorf("executable %v, exec %v: stopped %t exit %d, want stopped %t exit %d",
+				test.exeErr, test.execErr, stopped, *code, test.stopped, test.code)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package control
+
+// canRestart is false because Windows can not replace the running process
+const canRestart = false
+
+func (ctrl *Control) restart() {
+}
@@ -1,31 +1,32 @@
 package control
 
 import (
+	"errors"
+	"fmt"
 	"time"
 	//"periph.io/x/periph/conn/physic"
 
-	"../config"
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
 	"periph.io/x/periph/conn/onewire"
 	"periph.io/x/periph/devices/ds18b20"
-	"periph.io/x/periph/experimental/host/netlink"
-	"periph.io/x/periph/host"
 )
 
+func init() {
+	mustRegister(KindSensor, "TempSensor", func() IDevice { return new(TempSensor) }, "1-Wire DS18B20 temperature sensor")
+	mustRegister(KindSensor, "DummyTempSensor", func() IDevice { return new(DummyTempSensor) }, "Simulated temperature sensor that heats up while equipment heater is on")
+}
+
 type SensorDefinition struct {
 	Name       string
 	Type       string
 	Properties []Property
 }
 
-type SensorMessage struct {
-	Name  string
-	Value float64
-}
-
 // ISensor defines a Sensor
 type ISensor interface {
 	IDevice
-	InitSensor(name string, logger *Logger, properties []Property, cnval chan<- SensorMessage) error
+	InitSensor(name string, logger *Logger, properties []Property, bus *EventBus) error
 	GetUnits() string
 	OnRead() (float64, error)
 	SetValue(float64) error
@@ -40,17 +41,20 @@ type ISensor interface {
 //	}
 type Sensor struct {
 	Device
-	chnValue chan<- SensorMessage
-	Unit     string
+	bus          *EventBus
+	readInterval time.Duration
+	Unit         string
 }
 
-// InitSensor called once at sensor creation before OnStart()
-func (sen *Sensor) InitSensor(name string, logger *Logger, properties []Property, cnval chan<- SensorMessage) error {
+// InitSensor called once at sensor creation before OnStart(). Readings are published on bus
+func (sen *Sensor) InitSensor(name string, logger *Logger, properties []Property, bus *EventBus) error {
+	sen.DevKind = KindSensor
 	sen.Device.Init(name, logger, properties)
 	sen.LogMessage("Init Sensor...")
-	sen.chnValue = cnval
+	sen.bus = bus
+	sen.readInterval = 3 * time.Second
 	props := sen.GetProperties()
-	sen.Unit = props.InitProperty("Units", "string", "°C", "Units for temperature sensor (default is Celsius)").(string)
+	sen.Unit, _ = api.TemperatureUnits(props.InitProperty("Units", "string", "°C", "Units for temperature sensor (default is Celsius)").(string))
 	return nil
 }
 
@@ -62,12 +66,9 @@ func (sen *Sensor) OnRead() (float64, error) {
 	return 99.99, nil
 }
 
+// SetValue publishes a sensor reading on topic "sensor/<name>"
 func (sen *Sensor) SetValue(value float64) error {
-
-	select {
-	case sen.chnValue <- SensorMessage{Name: sen.Name(), Value: value}:
-	case <-time.After(time.Millisecond * 5000):
-	}
+	sen.bus.Publish(Topic(TopicSensor, sen.Name()), SensorEvent{Name: sen.Name(), Value: value})
 	return nil
 }
 
@@ -90,7 +91,7 @@ func (sen *Sensor) startRun(fRead func() (float64, error)) error {
 			}
 			//sen.LogMessage("Sensor value = %.3f%s", value, sen.GetUnits())
 		}
-		time.Sleep(time.Second * 3)
+		time.Sleep(sen.readInterval)
 	}
 	return nil
 }
@@ -100,7 +101,7 @@ func (sen *Sensor) startRun(fRead func() (float64, error)) error {
 // each temp sensor will have unique UINT64 Address
 type TempSensor struct {
 	Sensor
-	oneBus     *netlink.OneWire
+	oneBus     OneWireBus
 	Addresses  []onewire.Address
 	Address    string
 	RealDevice *ds18b20.Dev
@@ -110,25 +111,27 @@ func (sen *TempSensor) GetDefaultsConfig() ([]config.PropertyConfig, error) {
 	return []config.PropertyConfig{
 		{Name: "Name", Type: "string", Hidden: true, Value: "temp Sensor 1", Comment: "Sensor Name", Choice: ""},
 		{Name: "Address", Type: "uint", Hidden: false, Value: "7205759448148251176", Comment: "1-Wire sensor address", Choice: ""},
-		{Name: "Units", Type: "string", Hidden: false, Value: "°F", Comment: "Units for Sensor", Choice: ""},
+		{Name: "Units", Type: "string", Hidden: false, Value: "°F", Comment: "Units for Sensor", Choice: "", Select: "°F,°C"},
 	}, nil
 
 }
 
 // InitSensor must initialize 1-wire host and call base init
-func (sen *TempSensor) InitSensor(name string, logger *Logger, properties []Property, cnval chan<- SensorMessage) error {
-	sen.Sensor.InitSensor(name, logger, properties, cnval)
+func (sen *TempSensor) InitSensor(name string, logger *Logger, properties []Property, bus *EventBus) error {
+	sen.Sensor.InitSensor(name, logger, properties, bus)
 	sen.LogMessage("init TempSensor...")
 
-	if _, err := host.Init(); err != nil {
+	if err := sen.hw.Init(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// OnStart finds sensor with the configured "Address" on the 1-Wire bus.
+// The first sensor on the bus is used when no address is configured
 func (sen *TempSensor) OnStart() error {
 	// get 1wire bus
-	oneBus, erBus := netlink.New(001)
+	oneBus, erBus := sen.hw.OpenOneWire()
 	if erBus != nil {
 		sen.LogMessage("Failed to open bus: %v", erBus)
 		return erBus
@@ -142,34 +145,35 @@ func (sen *TempSensor) OnStart() error {
 		return erAddr
 	}
 
+	var address onewire.Address
 	props := sen.GetProperties()
-	address, ok := props.GetProperty("Address")
-	sen.LogMessage("%s = %d", sen.Name(), address.Value.(uint64))
-	if !ok {
-		sen.LogMessage("Address Property Not found")
-		address.Value = addr[0]
+	if prop, ok := props.GetProperty("Address"); ok {
+		value, _ := prop.Value.(uint64)
+		address = onewire.Address(value)
+	} else if len(addr) > 0 {
+		sen.LogMessage("Address Property Not found. Using first sensor on bus")
+		address = addr[0]
 	}
+	sen.LogMessage("%s = %d", sen.Name(), uint64(address))
 
 	found := false
 	for indx, adrName := range addr {
-		sen.LogMessage("address(%d)=%d\n", indx, adrName)
-		if address.Value.(uint64) == uint64(adrName) {
-			address.Value = onewire.Address(adrName)
+		sen.LogMessage("address(%d)=%d", indx, adrName)
+		if address == adrName {
 			found = true
 			break
 		}
 	}
 
 	if !found {
-		sen.LogMessage("Addess not found for device %s", address)
-		return nil // TODO need error codes
+		sen.LogError("Address %d not found on 1-wire bus", uint64(address))
+		return fmt.Errorf("1-wire address %d of sensor '%s' not found", uint64(address), sen.Name())
 	}
 
 	sen.Addresses = append(sen.Addresses, addr...)
 
-	//fmt.Printf("address2=%d", addr[2])
 	// init ds18b20
-	sensor, erSensor := ds18b20.New(oneBus, address.Value.(onewire.Address), 12)
+	sensor, erSensor := ds18b20.New(oneBus, address, 12)
 
 	if erSensor != nil {
 		sen.LogMessage("Failed to get ds18b20 Sensor: %v", erSensor)
@@ -180,16 +184,24 @@ func (sen *TempSensor) OnStart() error {
 }
 
 func (sen *TempSensor) OnStop() error {
-	sen.oneBus.Close()
+	if sen.oneBus != nil {
+		sen.oneBus.Close()
+	}
 	return nil
 }
 
 // OnRead called in default loop of Run() method.
 // Use this method to return get returned from sensor
 func (sen *TempSensor) OnRead() (float64, error) {
+	if sen.RealDevice == nil {
+		return 0, errors.New("sensor is not started")
+	}
 
 	ds18b20.ConvertAll(sen.oneBus, 12)
-	temp, _ := sen.RealDevice.LastTemp()
+	temp, err := sen.RealDevice.LastTemp()
+	if err != nil {
+		return 0, err
+	}
 
 	//fmt.Printf("%s %.4f°F\n", temp, temp.Fahrenheit())
 	//time.Sleep(5 * time.Second)
@@ -224,8 +236,8 @@ type DummyTempSensor struct {
 }
 
 // InitSensor must initialize 1-wire host and call base init
-func (sen *DummyTempSensor) InitSensor(name string, logger *Logger, properties []Property, cnval chan<- SensorMessage) error {
-	sen.Sensor.InitSensor(name, logger, properties, cnval)
+func (sen *DummyTempSensor) InitSensor(name string, logger *Logger, properties []Property, bus *EventBus) error {
+	sen.Sensor.InitSensor(name, logger, properties, bus)
 	sen.LogMessage("init DummyTempSensor (%s)...", sen.GetUnits())
 	return nil
 }
@@ -233,7 +245,7 @@ func (sen *DummyTempSensor) InitSensor(name string, logger *Logger, properties [
 func (sen *DummyTempSensor) GetDefaultsConfig() ([]config.PropertyConfig, error) {
 	return []config.PropertyConfig{
 		{Name: "Name", Type: "string", Hidden: false, Value: "Dummy Temp 1", Comment: "Sensor Name", Choice: ""},
-		{Name: "Units", Type: "string", Hidden: false, Value: "°F", Comment: "Units for Sensor", Choice: ""},
+		{Name: "Units", Type: "string", Hidden: false, Value: "°F", Comment: "Units for Sensor", Choice: "", Select: "°F,°C"},
 	}, nil
 
 }
@@ -311,11 +323,11 @@ func GetActiveNetlinkAddresses(logger *Logger) ([]uint64, error) {
 
 	addresses := []uint64{}
 
-	if _, err := host.Init(); err != nil {
+	if err := hardware.Init(); err != nil {
 		return nil, err
 	}
 
-	oneBus, erBus := netlink.New(001)
+	oneBus, erBus := hardware.OpenOneWire()
 	if erBus != nil {
 		logger.LogMessage("Failed to open bus: %v", erBus)
 		return addresses, erBus
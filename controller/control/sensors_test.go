@@ -0,0 +1,91 @@
+package control
+
+import (
+	"math"
+	"testing"
+
+	"periph.io/x/periph/conn/onewire"
+)
+
+const (
+	mashProbe   = onewire.Address(0x0300000a1b2c3d28)
+	spargeProbe = onewire.Address(0x0400000a1b2c3d28)
+)
+
+func newTempSensor(t *testing.T, properties []Property) *TempSensor {
+	sen := new(TempSensor)
+	if err := sen.InitSensor("Temp Sensor 1", testLogger(), properties, NewEventBus(nil)); err != nil {
+		t.Fatal(err)
+	}
+	return sen
+}
+
+func TestTempSensorAddressMatching(t *testing.T) {
+	hw := useFakeHardware(t)
+	hw.oneWire.Add(mashProbe, 20)
+	hw.oneWire.Add(spargeProbe, 76.5)
+
+	tests := []struct {
+		name    string
+		props   []Property
+		want    float64
+		wantErr bool
+	}{
+		{"second sensor", []Property{{Name: "Address", PropType: "uint", Value: uint64(spargeProbe)}}, 76.5, false},
+		{"first sensor", []Property{{Name: "Address", PropType: "uint", Value: uint64(mashProbe)}}, 20, false},
+		{"fahrenheit", []Property{{Name: "Address", PropType: "uint", Value: uint64(spargeProbe)}, {Name: "Units", PropType: "string", Value: "°F"}}, 169.7, false},
+		{"no address uses first sensor", nil, 20, false},
+		{"unknown address", []Property{{Name: "Address", PropType: "uint", Value: uint64(0x0500000a1b2c3d28)}}, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sen := newTempSensor(t, test.props)
+			err := sen.OnStart()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("OnStart found a sensor that is not on the bus")
+				}
+				if _, err := sen.OnRead(); err == nil {
+					t.Error("OnRead of sensor not started returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := sen.OnRead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(value-test.want) > 0.1 {
+				t.Errorf("OnRead() = %.2f, want %.2f", value, test.want)
+			}
+			if len(sen.Addresses) != 2 {
+				t.Errorf("found %d addresses, want 2", len(sen.Addresses))
+			}
+			sen.OnStop()
+		})
+	}
+}
+
+func TestTempSensorPublishesReadings(t *testing.T) {
+	hw := useFakeHardware(t)
+	hw.oneWire.Add(mashProbe, 66)
+
+	sen := newTempSensor(t, []Property{{Name: "Address", PropType: "uint", Value: uint64(mashProbe)}})
+	sub := sen.bus.Subscribe("test", Topic(TopicSensor, "#"))
+	defer sub.Close()
+	if err := sen.OnStart(); err != nil {
+		t.Fatal(err)
+	}
+	go sen.Run()
+
+	ev := <-sub.C
+	reading, ok := ev.Payload.(SensorEvent)
+	if !ok || ev.Topic != "sensor/Temp Sensor 1" {
+		t.Fatalf("got %s %#v, want sensor reading", ev.Topic, ev.Payload)
+	}
+	if math.Abs(reading.Value-66) > 0.1 {
+		t.Errorf("reading = %.2f, want 66", reading.Value)
+	}
+}
@@ -0,0 +1,185 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gigatropolis/brewbrat/controller/config"
+)
+
+// soundPrefix starts the names of buzzer properties defining sounds, e.g. "Sound Main"
+const soundPrefix = "Sound "
+
+// defaultSounds are the sounds of every buzzer unless the configuration changes them.
+// "Main" plays when the controller starts, the others are the alarm sounds of each severity
+var defaultSounds = []struct {
+	name  string
+	sound string
+}{
+	{"Main", "100:200:20,100:200:20,100:200:20"},
+	{"Info", "100:150:0"},
+	{"Warning", "100:300:200,100:300:0"},
+	{"Critical", "100:100:100,100:100:100,100:100:100,100:100:100,100:100:0"},
+}
+
+const soundComment = "Sound as <level>:<on ms>:<off ms>[:<Hz>],... or an RTTTL ringtone"
+
+// soundDefaultsConfig returns the default sound properties of buzzers
+func soundDefaultsConfig() []config.PropertyConfig {
+	props := []config.PropertyConfig{}
+	for _, def := range defaultSounds {
+		props = append(props, config.PropertyConfig{Name: soundPrefix + def.name, Type: "string", Hidden: false, Value: def.sound, Comment: soundComment, Choice: ""})
+	}
+	return props
+}
+
+// parseSound reads a sound as RTTTL when it has the form "<name>:<defaults>:<notes>",
+// otherwise as sound bits "<level>:<on ms>:<off ms>[:<Hz>],..."
+func parseSound(sound string) ([]SoundBit, error) {
+	if parts := strings.SplitN(sound, ":", 3); len(parts) == 3 && (parts[1] == "" || strings.Contains(parts[1], "=")) {
+		return ParseRTTTL(sound)
+	}
+	return parseSoundBits(sound)
+}
+
+// parseSoundBits reads sound bits "<level>:<on ms>:<off ms>[:<Hz>]" separated by commas
+func parseSoundBits(sound string) ([]SoundBit, error) {
+	bits := []SoundBit{}
+	for _, text := range strings.Split(sound, ",") {
+		parts := strings.Split(strings.TrimSpace(text), ":")
+		if len(parts) != 3 && len(parts) != 4 {
+			return nil, fmt.Errorf("sound bit '%s' is not <level>:<on ms>:<off ms>[:<Hz>]", text)
+		}
+		values := []int{}
+		for _, part := range parts {
+			value, err := strconv.Atoi(part)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("sound bit '%s' has no valid number '%s'", text, part)
+			}
+			values = append(values, value)
+		}
+		bit := SoundBit{Level: values[0], On: values[1], Off: values[2]}
+		if len(values) == 4 {
+			bit.Freq = values[3]
+		}
+		bits = append(bits, bit)
+	}
+	return bits, nil
+}
+
+// rtttlSemitones are the semitones of RTTTL notes above C. "h" is the German name of b
+var rtttlSemitones = map[byte]int{'c': 0, 'd': 2, 'e': 4, 'f': 5, 'g': 7, 'a': 9, 'b': 11, 'h': 11}
+
+func validNoteDuration(d int) bool {
+	return d == 1 || d == 2 || d == 4 || d == 8 || d == 16 || d == 32
+}
+
+// noteFrequency returns Hz of note semitones above C in octave, A4 being 440 Hz
+func noteFrequency(semitone int, octave int) int {
+	return int(math.Round(440 * math.Pow(2, float64(semitone-9)/12+float64(octave-4))))
+}
+
+// ParseRTTTL reads a ringtone in RTTTL, such as "Beep:d=4,o=5,b=120:c,8e,g.,p,2c6", into sound bits.
+// Notes sound 90% of their length so repeated notes are heard separately; pauses are silent bits
+func ParseRTTTL(ringtone string) ([]SoundBit, error) {
+	parts := strings.SplitN(ringtone, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("ringtone is not <name>:<defaults>:<notes>")
+	}
+
+	duration, octave, bpm := 4, 6, 63
+	for _, def := range strings.Split(parts[1], ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		kv := strings.SplitN(def, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("default '%s' is not <d|o|b>=<value>", def)
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("default '%s' has no valid number", def)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "d":
+			duration = value
+		case "o":
+			octave = value
+		case "b":
+			bpm = value
+		default:
+			return nil, fmt.Errorf("unknown default '%s'", def)
+		}
+	}
+	if !validNoteDuration(duration) || octave < 1 || octave > 8 || bpm <= 0 {
+		return nil, fmt.Errorf("defaults '%s' are not valid", parts[1])
+	}
+
+	whole := 4 * 60000 / float64(bpm)
+	bits := []SoundBit{}
+	for _, text := range strings.Split(parts[2], ",") {
+		note := strings.ToLower(strings.TrimSpace(text))
+		if note == "" {
+			continue
+		}
+		i := 0
+		for i < len(note) && note[i] >= '0' && note[i] <= '9' {
+			i++
+		}
+		d := duration
+		if i > 0 {
+			d, _ = strconv.Atoi(note[:i])
+			if !validNoteDuration(d) {
+				return nil, fmt.Errorf("note '%s' has no valid duration", text)
+			}
+		}
+		if i == len(note) {
+			return nil, fmt.Errorf("note '%s' has no note name", text)
+		}
+		pause := note[i] == 'p'
+		semitone, ok := rtttlSemitones[note[i]]
+		if !ok && !pause {
+			return nil, fmt.Errorf("note '%s' has unknown note name", text)
+		}
+		i++
+		if i < len(note) && note[i] == '#' {
+			semitone++
+			i++
+		}
+		dotted := false
+		if i < len(note) && note[i] == '.' {
+			dotted = true
+			i++
+		}
+		o := octave
+		if i < len(note) && note[i] >= '1' && note[i] <= '8' {
+			o = int(note[i] - '0')
+			i++
+		}
+		if i < len(note) && note[i] == '.' {
+			dotted = true
+			i++
+		}
+		if i != len(note) {
+			return nil, fmt.Errorf("note '%s' is not valid", text)
+		}
+
+		ms := whole / float64(d)
+		if dotted {
+			ms *= 1.5
+		}
+		if pause {
+			bits = append(bits, SoundBit{Level: 0, On: 0, Off: int(math.Round(ms))})
+			continue
+		}
+		on := int(math.Round(ms * 0.9))
+		bits = append(bits, SoundBit{Level: 100, On: on, Off: int(math.Round(ms)) - on, Freq: noteFrequency(semitone, o)})
+	}
+	if len(bits) == 0 {
+		return nil, fmt.Errorf("ringtone has no notes")
+	}
+	return bits, nil
+}
@@ -0,0 +1,55 @@
+package control
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRTTTL(t *testing.T) {
+	// a whole note lasts 2s at 120 beats per minute
+	bits, err := ParseRTTTL("Test:d=4,o=5,b=120:c,8e6.,p,a#,2H")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SoundBit{
+		{100, 450, 50, 523},
+		{100, 338, 37, 1319},
+		{0, 0, 500, 0},
+		{100, 450, 50, 932},
+		{100, 900, 100, 988},
+	}
+	if !reflect.DeepEqual(bits, want) {
+		t.Errorf("ParseRTTTL = %v, want %v", bits, want)
+	}
+
+	// RTTTL defaults are d=4, o=6, b=63
+	if bits, err := ParseRTTTL("A::a"); err != nil || len(bits) != 1 || bits[0].Freq != 1760 || bits[0].On+bits[0].Off != 952 {
+		t.Errorf("ParseRTTTL with defaults = %v, %v", bits, err)
+	}
+
+	for _, ringtone := range []string{"beep", "x:d=3:c", "x:q=1:c", "x:b=0:c", "x::z", "x::3c", "x::c9x", "x::"} {
+		if bits, err := ParseRTTTL(ringtone); err == nil {
+			t.Errorf("ParseRTTTL(%q) = %v", ringtone, bits)
+		}
+	}
+}
+
+func TestParseSound(t *testing.T) {
+	tests := []struct {
+		sound string
+		want  []SoundBit
+	}{
+		{"100:200:20", []SoundBit{{100, 200, 20, 0}}},
+		{"100:200:20, 50:10:0:880", []SoundBit{{100, 200, 20, 0}, {50, 10, 0, 880}}},
+		{"Beep:b=240:a4", []SoundBit{{100, 225, 25, 440}}},
+		{"100:200", nil},
+		{"100:-1:0", nil},
+		{"a:b:c", nil},
+	}
+	for _, test := range tests {
+		bits, err := parseSound(test.sound)
+		if (err == nil) != (test.want != nil) || !reflect.DeepEqual(bits, test.want) {
+			t.Errorf("parseSound(%q) = %v, %v; want %v", test.sound, bits, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+
+package control
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink sends entries to syslog server address over network ("udp" or "tcp").
+// Empty network and address use the local syslog daemon
+func NewSyslogSink(network string, address string, tag string) (LogSink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (sink *syslogSink) WriteEntry(entry LogEntry) error {
+	msg := strings.TrimRight(entry.Message, "\r\n")
+	if entry.Device != "" {
+		msg = entry.Device + ": " + msg
+	}
+	switch syslogPriority(entry.Level) {
+	case 7:
+		return sink.writer.Debug(msg)
+	case 4:
+		return sink.writer.Warning(msg)
+	case 3:
+		return sink.writer.Err(msg)
+	}
+	return sink.writer.Info(msg)
+}
+
+func (sink *syslogSink) Close() error {
+	return sink.writer.Close()
+}
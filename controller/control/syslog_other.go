@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package control
+
+import "errors"
+
+// NewSyslogSink is not available on Windows and Plan 9
+func NewSyslogSink(network string, address string, tag string) (LogSink, error) {
+	return nil, errors.New("syslog is not supported on this system")
+}
@@ -0,0 +1,56 @@
+//go:build !windows && !plan9
+
+package control
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("udp", conn.LocalAddr().String(), "brewtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// priority is facility daemon (3) * 8 + severity of level
+	tests := []struct {
+		level  uint64
+		device string
+		want   string
+	}{
+		{LogLevelDebug, "", "<31>"},
+		{LogLevelMessage, "Pump", "<30>"},
+		{LogLevelWarning, "", "<28>"},
+		{LogLevelFail, "", "<27>"},
+		{LogLevelError, "HLT", "<27>"},
+	}
+	buf := make([]byte, 1024)
+	for _, test := range tests {
+		if err := sink.WriteEntry(LogEntry{Level: test.level, Device: test.device, Message: "hello\n"}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(buf[:n])
+		wantMsg := "hello"
+		if test.device != "" {
+			wantMsg = test.device + ": hello"
+		}
+		if !strings.HasPrefix(msg, test.want) || !strings.Contains(msg, "brewtest[") || !strings.HasSuffix(strings.TrimSpace(msg), wantMsg) {
+			t.Errorf("level %s sent %q, want priority %s and %q", LevelName(test.level), msg, test.want, wantMsg)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+const (
+	// timerLate is how late an action at a fixed time still runs, e.g. when the controller was down
+	timerLate = 15 * time.Minute
+	// timerKeep is how long actions that ran or were missed are listed
+	timerKeep = 24 * time.Hour
+	// readyByMargin lengthens the heat-up estimate so ready-by actions start a little early
+	readyByMargin = 1.1
+)
+
+// timerFile is the JSON timer file
+type timerFile struct {
+	NextID int         `json:"nextId"`
+	Timers []api.Timer `json:"timers"`
+}
+
+// Timers are the timed actions of the controller kept in a file.
+// Timers are only used by the HandleWebServer goroutine
+type Timers struct {
+	fileName string
+	file     timerFile
+}
+
+// NewTimers returns the timers saved in fileName. Timers are kept in memory only when fileName is empty
+func NewTimers(fileName string) (*Timers, error) {
+	timers := &Timers{fileName: fileName, file: timerFile{NextID: 1}}
+	if fileName == "" {
+		return timers, nil
+	}
+	buf, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return timers, nil
+	}
+	if err != nil {
+		return timers, err
+	}
+	file := timerFile{}
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return timers, err
+	}
+	if file.NextID < 1 {
+		file.NextID = 1
+	}
+	timers.file = file
+	return timers, nil
+}
+
+// save writes all timers to the timer file
+func (t *Timers) save() error {
+	if t.fileName == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(t.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write a new file and rename it so a crash never leaves a partly written file
+	tmp := t.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.fileName)
+}
+
+// add appends timer with a new ID and returns it
+func (t *Timers) add(timer api.Timer) api.Timer {
+	timer.ID = t.file.NextID
+	t.file.NextID++
+	t.file.Timers = append(t.file.Timers, timer)
+	return timer
+}
+
+// remove deletes timer id. Returns false when there is no such timer
+func (t *Timers) remove(id int) bool {
+	for i, timer := range t.file.Timers {
+		if timer.ID == id {
+			t.file.Timers = append(t.file.Timers[:i], t.file.Timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimerTime reads a time of day "06:00" as its next occurrence after now, or a time in RFC 3339
+func parseTimerTime(value string, now time.Time) (time.Time, error) {
+	if clock, err := time.ParseInLocation("15:04", value, now.Location()); err == nil {
+		at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time '%s' is not HH:MM or RFC 3339", value)
+	}
+	if !at.After(now) {
+		return time.Time{}, fmt.Errorf("time '%s' is in the past", value)
+	}
+	return at, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// startTimers reads timed actions from the "Timer File". Call after OnStart() as equipment that a
+// pending timer activates is put back in Idle
+func (ctrl *Control) startTimers() {
+	fileName := ctrl.props.InitProperty("Timer File", "string", "timers.json", "File keeping timed actions of equipment. Empty keeps them in memory").(string)
+	timers, err := NewTimers(fileName)
+	if err != nil {
+		ctrl.logger.LogError("Unable to read timer file '%s': %s", fileName, err)
+	}
+	ctrl.timers = timers
+	for _, timer := range timers.file.Timers {
+		ctrl.holdForTimer(timer)
+	}
+}
+
+// holdForTimer puts equipment in Idle until its pending timer activates it.
+// Equipment is active once started, so it would heat long before the timer without this
+func (ctrl *Control) holdForTimer(timer api.Timer) {
+	eq, ok := ctrl.equipment[timer.Equipment]
+	if !ok || timer.Status != api.TimerPending || timer.State != api.EquipmentActive || eq.GetState() == EqStateIdle {
+		return
+	}
+	ctrl.setEquipmentState(timer.Equipment, eq, EqStateIdle)
+	ctrl.logger.LogMessage("'%s' is idle until timer %d activates it", timer.Equipment, timer.ID)
+}
+
+// saveTimers writes timers to the timer file and logs errors
+func (ctrl *Control) saveTimers() {
+	if err := ctrl.timers.save(); err != nil {
+		ctrl.logger.LogError("Unable to save timer file: %s", err)
+	}
+}
+
+// addTimer checks request and adds it as a pending timed action.
+// Ready-by actions need a known heating rate of the equipment
+func (ctrl *Control) addTimer(req api.TimerRequest, now time.Time) (api.Timer, error) {
+	eq, ok := ctrl.equipment[req.Equipment]
+	if !ok {
+		return api.Timer{}, fmt.Errorf("unknown equipment '%s'", req.Equipment)
+	}
+	timer := api.Timer{Equipment: req.Equipment, Setpoint: req.Setpoint, State: req.State, Status: api.TimerPending}
+	switch req.State {
+	case "":
+		timer.State = api.EquipmentActive
+	case api.EquipmentActive, api.EquipmentIdle:
+	default:
+		return api.Timer{}, fmt.Errorf("state '%s' is not %s or %s", req.State, api.EquipmentActive, api.EquipmentIdle)
+	}
+
+	switch {
+	case req.At != "" && req.ReadyBy != "":
+		return api.Timer{}, fmt.Errorf("set either at or readyBy")
+	case req.At != "":
+		at, err := parseTimerTime(req.At, now)
+		if err != nil {
+			return api.Timer{}, err
+		}
+		timer.At = toMillis(at)
+		timer.Start = timer.At
+	case req.ReadyBy != "":
+		readyBy, err := parseTimerTime(req.ReadyBy, now)
+		if err != nil {
+			return api.Timer{}, err
+		}
+		if timer.State != api.EquipmentActive {
+			return api.Timer{}, fmt.Errorf("ready-by needs state %s", api.EquipmentActive)
+		}
+		rate, _, ok := ctrl.heatRate(req.Equipment, eq, now)
+		if !ok {
+			return api.Timer{}, fmt.Errorf("heating rate of '%s' is not known. Set its Volume or heat for a few minutes", req.Equipment)
+		}
+		timer.ReadyBy = toMillis(readyBy)
+		timer.Rate = rate * 60
+		timer.Start = ctrl.timerStart(timer, now)
+	default:
+		return api.Timer{}, fmt.Errorf("at or readyBy is missing")
+	}
+
+	timer = ctrl.timers.add(timer)
+	ctrl.saveTimers()
+	ctrl.logger.LogMessage("Timer %d of '%s' added, starts %s", timer.ID, timer.Equipment, time.Unix(0, timer.Start*int64(time.Millisecond)).Format("Mon 15:04"))
+	ctrl.holdForTimer(timer)
+	return timer, nil
+}
+
+// cancelTimer removes timer id. Returns false when there is no such timer
+func (ctrl *Control) cancelTimer(id int) bool {
+	if !ctrl.timers.remove(id) {
+		return false
+	}
+	ctrl.saveTimers()
+	ctrl.logger.LogMessage("Timer %d cancelled", id)
+	return true
+}
+
+// listTimers returns all timers by start time
+func (ctrl *Control) listTimers() []api.Timer {
+	timers := append([]api.Timer{}, ctrl.timers.file.Timers...)
+	sort.SliceStable(timers, func(i, j int) bool { return timers[i].Start < timers[j].Start })
+	return timers
+}
+
+// timerSetpoint returns the setpoint equipment has once timer ran
+func (ctrl *Control) timerSetpoint(timer api.Timer) float64 {
+	if timer.Setpoint != nil {
+		return *timer.Setpoint
+	}
+	setpoint, _ := ctrl.equipment[timer.Equipment].GetSetpoint()
+	return setpoint
+}
+
+// timerStart returns Unix time in ms timer should run. Ready-by timers start the estimated heat-up time
+// before ready-by, using the rate saved with the timer when the current rate is not known.
+// Without a temperature they start at once so the equipment is not late
+func (ctrl *Control) timerStart(timer api.Timer, now time.Time) int64 {
+	if timer.ReadyBy == 0 {
+		return timer.At
+	}
+	setpoint := ctrl.timerSetpoint(timer)
+	seconds := 0.0
+	if heat, ok := ctrl.heatUpTo(timer.Equipment, setpoint, now); ok {
+		seconds = heat.Seconds
+	} else if temp, ok := ctrl.temperature(ctrl.equipment[timer.Equipment]); ok && timer.Rate > 0 {
+		seconds = math.Max(0, setpoint-temp) / (timer.Rate / 60)
+	} else {
+		return toMillis(now)
+	}
+	return timer.ReadyBy - int64(seconds*readyByMargin*1000)
+}
+
+// runTimers runs pending timers that are due at now. Timers due longer than timerLate ago, or after
+// their ready-by time, are missed. Timers that ran are removed after timerKeep
+func (ctrl *Control) runTimers(now time.Time) {
+	if ctrl.timers == nil {
+		return
+	}
+	ms := toMillis(now)
+	changed := false
+	kept := ctrl.timers.file.Timers[:0]
+	for _, timer := range ctrl.timers.file.Timers {
+		if timer.Status != api.TimerPending {
+			if ms-timer.Start < timerKeep.Milliseconds() {
+				kept = append(kept, timer)
+			} else {
+				changed = true
+			}
+			continue
+		}
+		eq, ok := ctrl.equipment[timer.Equipment]
+		if !ok {
+			timer.Status = api.TimerFailed
+			timer.Message = fmt.Sprintf("unknown equipment '%s'", timer.Equipment)
+			ctrl.logger.LogWarning("Timer %d failed: %s", timer.ID, timer.Message)
+			kept = append(kept, timer)
+			changed = true
+			continue
+		}
+		timer.Start = ctrl.timerStart(timer, now)
+		switch {
+		case ms < timer.Start:
+		case timer.ReadyBy == 0 && ms-timer.Start > timerLate.Milliseconds(),
+			timer.ReadyBy != 0 && ms > timer.ReadyBy:
+			timer.Status = api.TimerMissed
+			timer.Message = "controller was not running"
+			ctrl.logger.LogWarning("Timer %d of '%s' missed", timer.ID, timer.Equipment)
+			changed = true
+		default:
+			ctrl.runTimer(&timer, eq, now)
+			changed = true
+		}
+		kept = append(kept, timer)
+	}
+	ctrl.timers.file.Timers = kept
+	if changed {
+		ctrl.saveTimers()
+	}
+}
+
+// runTimer sets setpoint and state of equipment eq from timer
+func (ctrl *Control) runTimer(timer *api.Timer, eq IEquipment, now time.Time) {
+	if timer.Setpoint != nil {
+		ctrl.setSetpoint(timer.Equipment, eq, *timer.Setpoint)
+	}
+	state := EqStateActive
+	if timer.State == api.EquipmentIdle {
+		state = EqStateIdle
+	}
+	ctrl.setEquipmentState(timer.Equipment, eq, state)
+	timer.Status = api.TimerDone
+	timer.Run = toMillis(now)
+	timer.Start = timer.Run
+	ctrl.logger.LogMessage("Timer %d set '%s' to %s at %.1f", timer.ID, timer.Equipment, timer.State, ctrl.timerSetpoint(*timer))
+}
@@ -0,0 +1,194 @@
+package control
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+func TestParseTimerTime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 6, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"07:00", time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), true},
+		{"06:00", time.Date(2026, 10, 20, 6, 0, 0, 0, time.UTC), true},
+		{"06:30", time.Date(2026, 10, 20, 6, 30, 0, 0, time.UTC), true},
+		{"2026-10-21T05:00:00Z", time.Date(2026, 10, 21, 5, 0, 0, 0, time.UTC), true},
+		{"2026-10-18T05:00:00Z", time.Time{}, false},
+		{"soon", time.Time{}, false},
+	}
+	for _, test := range tests {
+		at, err := parseTimerTime(test.value, now)
+		if (err == nil) != test.ok || !at.Equal(test.want) {
+			t.Errorf("parseTimerTime(%q) = %s, %v; want %s", test.value, at, err, test.want)
+		}
+	}
+}
+
+// newTimerControl returns the heat-up controller with timers kept in a file of a temporary directory
+func newTimerControl(t *testing.T) *Control {
+	ctrl := newHeatUpControl(t)
+	ctrl.bus = NewEventBus(nil)
+	timers, err := NewTimers(filepath.Join(t.TempDir(), "timers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl.timers = timers
+	return ctrl
+}
+
+func TestTimerAt(t *testing.T) {
+	ctrl := newTimerControl(t)
+	eq := ctrl.equipment["HLT"]
+	now := time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC)
+	setpoint := 160.0
+
+	timer, err := ctrl.addTimer(api.TimerRequest{Equipment: "HLT", Setpoint: &setpoint, At: "06:00"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timer.ID != 1 || timer.State != api.EquipmentActive || timer.Status != api.TimerPending {
+		t.Errorf("added timer %+v", timer)
+	}
+
+	// timers are read back from the timer file
+	saved, err := NewTimers(ctrl.timers.fileName)
+	if err != nil || len(saved.file.Timers) != 1 || saved.file.NextID != 2 {
+		t.Fatalf("timer file has %+v, %v", saved.file, err)
+	}
+
+	ctrl.runTimers(now.Add(59 * time.Minute))
+	if eq.GetState() == EqStateActive {
+		t.Fatal("equipment active before timer is due")
+	}
+	ctrl.runTimers(now.Add(time.Hour))
+	if got, _ := eq.GetSetpoint(); eq.GetState() != EqStateActive || got != 160 {
+		t.Errorf("equipment state %d at %.1f after timer ran", eq.GetState(), got)
+	}
+	if timers := ctrl.listTimers(); timers[0].Status != api.TimerDone || timers[0].Run == 0 {
+		t.Errorf("timer %+v, want done", timers[0])
+	}
+
+	// timers that ran are listed for a day
+	ctrl.runTimers(now.Add(25 * time.Hour))
+	if timers := ctrl.listTimers(); len(timers) != 0 {
+		t.Errorf("timers %+v kept after a day", timers)
+	}
+}
+
+func TestTimerHoldsStartedEquipment(t *testing.T) {
+	ctrl := newTimerControl(t)
+	eq := ctrl.equipment["HLT"]
+	now := time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC)
+
+	// equipment is active once started and goes idle until the timer activates it
+	eq.OnStart()
+	if _, err := ctrl.addTimer(api.TimerRequest{Equipment: "HLT", At: "06:00"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if eq.GetState() != EqStateIdle {
+		t.Fatalf("equipment state %d after activate timer added, want idle", eq.GetState())
+	}
+
+	// after a restart the pending timer holds the equipment again
+	restarted := newHeatUpControl(t)
+	restarted.bus = NewEventBus(nil)
+	restarted.props = NewProperties()
+	restarted.props.AddProperty("Timer File", "string", ctrl.timers.fileName, "")
+	eq = restarted.equipment["HLT"]
+	eq.OnStart()
+	restarted.startTimers()
+	if eq.GetState() != EqStateIdle {
+		t.Fatalf("equipment state %d after restart with pending timer, want idle", eq.GetState())
+	}
+	restarted.runTimers(now.Add(time.Hour))
+	if eq.GetState() != EqStateActive {
+		t.Errorf("equipment state %d after timer ran, want active", eq.GetState())
+	}
+
+	// equipment without pending activate timers stays active
+	eq.OnStart()
+	restarted.startTimers()
+	if eq.GetState() != EqStateActive {
+		t.Errorf("equipment state %d without pending timers, want active", eq.GetState())
+	}
+}
+
+func TestTimerMissedAndCancelled(t *testing.T) {
+	ctrl := newTimerControl(t)
+	now := time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC)
+
+	if _, err := ctrl.addTimer(api.TimerRequest{Equipment: "HLT", At: "06:00"}, now); err != nil {
+		t.Fatal(err)
+	}
+	cancel, err := ctrl.addTimer(api.TimerRequest{Equipment: "HLT", State: api.EquipmentIdle, At: "07:00"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ctrl.cancelTimer(cancel.ID) || ctrl.cancelTimer(cancel.ID) {
+		t.Error("timer not cancelled once")
+	}
+
+	// controller was not running at 06:00
+	ctrl.runTimers(now.Add(time.Hour + timerLate + time.Minute))
+	if timers := ctrl.listTimers(); len(timers) != 1 || timers[0].Status != api.TimerMissed {
+		t.Errorf("timers %+v, want one missed", timers)
+	}
+	if ctrl.equipment["HLT"].GetState() == EqStateActive {
+		t.Error("missed timer activated equipment")
+	}
+
+	for _, req := range []api.TimerRequest{
+		{Equipment: "Kettle", At: "06:00"},
+		{Equipment: "HLT"},
+		{Equipment: "HLT", At: "06:00", ReadyBy: "07:00"},
+		{Equipment: "HLT", At: "06:00", State: "Boil"},
+		{Equipment: "HLT", ReadyBy: "07:00", State: api.EquipmentIdle},
+	} {
+		if _, err := ctrl.addTimer(req, now); err == nil {
+			t.Errorf("timer %+v added", req)
+		}
+	}
+}
+
+func TestTimerReadyBy(t *testing.T) {
+	ctrl := newTimerControl(t)
+	eq := ctrl.equipment["HLT"]
+	now := time.Date(2026, 10, 19, 5, 0, 0, 0, time.UTC)
+	readyBy := now.Add(2 * time.Hour)
+
+	// 37 minutes to heat from 60 to 168 at the model rate, plus the margin
+	timer, err := ctrl.addTimer(api.TimerRequest{Equipment: "HLT", ReadyBy: "07:00"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heat, _ := ctrl.heatUpTo("HLT", 168, now)
+	want := toMillis(readyBy) - int64(heat.Seconds*readyByMargin*1000)
+	if timer.Start != want || timer.ReadyBy != toMillis(readyBy) || !near(timer.Rate, heat.Rate) {
+		t.Errorf("timer %+v, want start %d", timer, want)
+	}
+
+	// warmer water starts later
+	ctrl.sensorValues["Temp"] = 150
+	ctrl.runTimers(now.Add(time.Hour))
+	if timers := ctrl.listTimers(); timers[0].Start <= want || eq.GetState() == EqStateActive {
+		t.Errorf("timer %+v started at 150°", timers[0])
+	}
+
+	// the saved rate is used without a temperature sensor reading of the current rate
+	delete(ctrl.actors, "Element")
+	start := time.Unix(0, ctrl.timerStart(timer, now)*int64(time.Millisecond))
+	if minutes := readyBy.Sub(start).Minutes(); !near(minutes, 18/timer.Rate*readyByMargin) {
+		t.Errorf("start %.1f min before ready-by from saved rate", minutes)
+	}
+
+	ctrl.runTimers(readyBy.Add(-time.Minute))
+	if eq.GetState() != EqStateActive {
+		t.Error("equipment not active before ready-by")
+	}
+}
@@ -0,0 +1,363 @@
+package control
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+const (
+	// usageBucket is the time of each bucket of on-time used for duty cycles
+	usageBucket = time.Minute
+	// usageBuckets covers the longest duty cycle window
+	usageBuckets = 24 * 60
+	// usageSaveInterval is time between saves of the usage file while actors switch
+	usageSaveInterval = time.Minute
+)
+
+// usageWindows are the duty cycle windows of api.ActorUsage
+var usageWindows = []struct {
+	Name   string
+	Length time.Duration
+}{
+	{"10m", 10 * time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// usageCounters are saved in the usage file
+type usageCounters struct {
+	Cycles    int64   `json:"cycles"`
+	OnSeconds float64 `json:"onSeconds"`
+	KWh       float64 `json:"kWh"`
+}
+
+// add counts d on at watts
+func (c *usageCounters) add(d time.Duration, watts float64) {
+	c.OnSeconds += d.Seconds()
+	c.KWh += watts * d.Hours() / 1000
+}
+
+func (c usageCounters) api(price float64) api.UsageCounters {
+	return api.UsageCounters{Cycles: c.Cycles, OnTime: c.OnSeconds, Energy: c.KWh, Cost: c.KWh * price}
+}
+
+// usageActor is the saved usage of one actor
+type usageActor struct {
+	Total usageCounters `json:"total"`
+	Batch usageCounters `json:"batch"`
+}
+
+// usageFile is the JSON usage file
+type usageFile struct {
+	Since      time.Time              `json:"since"`
+	BatchStart time.Time              `json:"batchStart"`
+	Actors     map[string]*usageActor `json:"actors"`
+}
+
+// actorUsage is the saved usage of an actor and its state since the last update
+type actorUsage struct {
+	*usageActor
+	watts        float64
+	powerControl bool
+	on           bool
+	power        int
+	last         time.Time
+	// buckets are seconds on in each minute. minutes is the minute of each bucket
+	buckets [usageBuckets]float64
+	minutes [usageBuckets]int64
+}
+
+// accrue adds the time since the last update when actor is on
+func (act *actorUsage) accrue(now time.Time) {
+	if act.on && now.After(act.last) {
+		watts := act.watts
+		if act.powerControl {
+			watts = watts * float64(act.power) / 100
+		}
+		d := now.Sub(act.last)
+		act.Total.add(d, watts)
+		act.Batch.add(d, watts)
+		act.addBuckets(act.last, now)
+	}
+	act.last = now
+}
+
+// addBuckets spreads on-time between from and to over the minute buckets
+func (act *actorUsage) addBuckets(from time.Time, to time.Time) {
+	for from.Before(to) {
+		minute := from.Truncate(usageBucket)
+		end := minute.Add(usageBucket)
+		if end.After(to) {
+			end = to
+		}
+		i, m := bucketOf(minute)
+		if act.minutes[i] != m {
+			act.minutes[i] = m
+			act.buckets[i] = 0
+		}
+		act.buckets[i] += end.Sub(from).Seconds()
+		from = end
+	}
+}
+
+// duty returns percent of time on in the window before now, not counting time before start
+func (act *actorUsage) duty(now time.Time, window time.Duration, start time.Time) float64 {
+	from := now.Add(-window)
+	if from.Before(start) {
+		from = start
+	}
+	length := now.Sub(from).Seconds()
+	if length <= 0 {
+		return 0
+	}
+
+	on := 0.0
+	_, first := bucketOf(from)
+	_, last := bucketOf(now)
+	for m := first; m <= last; m++ {
+		if i := int(m % usageBuckets); act.minutes[i] == m {
+			on += act.buckets[i]
+		}
+	}
+	// the first bucket starts before the window. Count its on-time as if it was at the end of the bucket
+	if i := int(first % usageBuckets); act.minutes[i] == first {
+		before := from.Sub(from.Truncate(usageBucket)).Seconds()
+		on -= math.Max(0, act.buckets[i]-(usageBucket.Seconds()-before))
+	}
+	return math.Min(100, on/length*100)
+}
+
+func bucketOf(t time.Time) (int, int64) {
+	m := t.Unix() / int64(usageBucket/time.Second)
+	return int(m % usageBuckets), m
+}
+
+// Usage counts switch cycles, time on and energy of actors from their events on the bus.
+// Counters are kept in a JSON file so they continue after a restart; duty cycles are only kept in memory.
+type Usage struct {
+	mu       sync.Mutex
+	fileName string
+	price    float64
+	started  time.Time
+	file     usageFile
+	actors   map[string]*actorUsage
+	dirty    bool
+}
+
+// NewUsage reads counters from fileName. Empty fileName keeps counters in memory only.
+// price is the cost of one kWh. A missing file starts counting at now
+func NewUsage(fileName string, price float64, now time.Time) (*Usage, error) {
+	u := &Usage{
+		fileName: fileName,
+		price:    price,
+		started:  now,
+		file:     usageFile{Since: now, BatchStart: now, Actors: make(map[string]*usageActor)},
+		actors:   make(map[string]*actorUsage),
+	}
+	if fileName == "" {
+		return u, nil
+	}
+	file, err := readUsageFile(fileName)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return u, err
+	}
+	u.file = file
+	return u, nil
+}
+
+func readUsageFile(fileName string) (usageFile, error) {
+	file := usageFile{}
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return file, err
+	}
+	if err := json.Unmarshal(buf, &file); err != nil {
+		return file, err
+	}
+	if file.Actors == nil {
+		file.Actors = make(map[string]*usageActor)
+	}
+	return file, nil
+}
+
+// AddActor tracks actor that uses watts when on. Power control actors use watts times their power level
+func (u *Usage) AddActor(name string, watts float64, powerControl bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	saved, ok := u.file.Actors[name]
+	if !ok {
+		saved = &usageActor{}
+		u.file.Actors[name] = saved
+	}
+	u.actors[name] = &actorUsage{usageActor: saved, watts: watts, powerControl: powerControl, last: u.started}
+}
+
+// Update counts actor event published at t
+func (u *Usage) Update(ev ActorEvent, t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	act, ok := u.actors[ev.Name]
+	if !ok {
+		return
+	}
+	act.accrue(t)
+	on := ev.State == StateOn
+	if on && !act.on {
+		act.Total.Cycles++
+		act.Batch.Cycles++
+	}
+	act.on = on
+	act.power = ev.Power
+	u.dirty = true
+}
+
+// NewBatch starts counting a new batch
+func (u *Usage) NewBatch(now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, act := range u.actors {
+		act.accrue(now)
+	}
+	for _, saved := range u.file.Actors {
+		saved.Batch = usageCounters{}
+	}
+	u.file.BatchStart = now
+	u.dirty = true
+}
+
+// Get returns counters and duty cycles of all actors at now
+func (u *Usage) Get(now time.Time) api.Usage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, act := range u.actors {
+		act.accrue(now)
+	}
+
+	usage := usageToAPI(u.file, u.price)
+	for i, info := range usage.Actors {
+		act, ok := u.actors[info.Name]
+		if !ok {
+			continue
+		}
+		usage.Actors[i].Watts = act.watts
+		usage.Actors[i].Duty = make(map[string]float64)
+		for _, window := range usageWindows {
+			usage.Actors[i].Duty[window.Name] = act.duty(now, window.Length, u.started)
+		}
+	}
+	return usage
+}
+
+// usageToAPI returns the counters of file sorted by actor name
+func usageToAPI(file usageFile, price float64) api.Usage {
+	usage := api.Usage{
+		Since:      file.Since.UnixNano() / int64(time.Millisecond),
+		BatchStart: file.BatchStart.UnixNano() / int64(time.Millisecond),
+		Price:      price,
+		Actors:     []api.ActorUsage{},
+	}
+	for name, saved := range file.Actors {
+		usage.Actors = append(usage.Actors, api.ActorUsage{Name: name, Total: saved.Total.api(price), Batch: saved.Batch.api(price)})
+	}
+	sort.Slice(usage.Actors, func(i, j int) bool { return usage.Actors[i].Name < usage.Actors[j].Name })
+	return usage
+}
+
+// Save writes counters at now to the usage file if they changed since the last save
+func (u *Usage) Save(now time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.fileName == "" {
+		return nil
+	}
+	changed := u.dirty
+	for _, act := range u.actors {
+		changed = changed || act.on
+		act.accrue(now)
+	}
+	if !changed {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(u.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write a new file and rename it so a crash never leaves a partly written file
+	tmp := u.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, u.fileName); err != nil {
+		return err
+	}
+	u.dirty = false
+	return nil
+}
+
+// ReadUsage returns the counters saved in usage file fileName without duty cycles
+func ReadUsage(fileName string, price float64) (api.Usage, error) {
+	file, err := readUsageFile(fileName)
+	if err != nil {
+		return api.Usage{}, err
+	}
+	return usageToAPI(file, price), nil
+}
+
+// startUsage tracks usage of all actors in the "Usage File"
+func (ctrl *Control) startUsage() {
+	props := &ctrl.props
+	fileName := props.InitProperty("Usage File", "string", "usage.json", "File keeping switch cycles, on-time and energy of actors. Empty keeps them in memory").(string)
+	price := props.InitProperty("Energy Price", "float", 0.0, "Cost of one kWh used to show energy cost of actors").(float64)
+
+	usage, err := NewUsage(fileName, price, time.Now())
+	if err != nil {
+		ctrl.logger.LogError("Unable to read usage file '%s': %s", fileName, err)
+	}
+	for name, actor := range ctrl.actors {
+		usage.AddActor(name, actor.GetWatts(), actor.HasPowerControl())
+	}
+	ctrl.usage = usage
+	go ctrl.trackUsage(ctrl.bus.Subscribe("usage", Topic(TopicActor, "#")))
+}
+
+// trackUsage counts actor events and saves the usage file every usageSaveInterval
+func (ctrl *Control) trackUsage(events *Subscription) {
+	t := time.NewTicker(usageSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case ev, ok := <-events.C:
+			if !ok {
+				return
+			}
+			if payload, ok := ev.Payload.(ActorEvent); ok {
+				ctrl.usage.Update(payload, ev.Time)
+			}
+		case now := <-t.C:
+			if err := ctrl.usage.Save(now); err != nil {
+				ctrl.logger.LogError("Unable to save usage file: %s", err)
+			}
+		}
+	}
+}
+
+// saveUsage saves usage when controller stops
+func (ctrl *Control) saveUsage() {
+	if ctrl.usage == nil {
+		return
+	}
+	if err := ctrl.usage.Save(time.Now()); err != nil {
+		ctrl.logger.LogError("Unable to save usage file: %s", err)
+	}
+}
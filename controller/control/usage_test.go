@@ -0,0 +1,143 @@
+package control
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// usageStart is on a minute so duty cycle buckets are easy to follow
+var usageStart = time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+func switchAt(u *Usage, name string, on bool, power int, after time.Duration) {
+	state := DeviceState(StateOff)
+	if on {
+		state = StateOn
+	}
+	u.Update(ActorEvent{Name: name, State: state, Power: power}, usageStart.Add(after))
+}
+
+func near(got float64, want float64) bool {
+	return math.Abs(got-want) < 0.001
+}
+
+func TestUsageCounters(t *testing.T) {
+	u, err := NewUsage("", 0.25, usageStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.AddActor("Heater", 2000, false)
+	u.AddActor("Pump", 0, false)
+
+	// heater on for 10 of the first 30 minutes, in two cycles
+	switchAt(u, "Heater", false, 0, 0)
+	switchAt(u, "Heater", true, 0, 5*time.Minute)
+	switchAt(u, "Heater", true, 0, 8*time.Minute) // no change, not a cycle
+	switchAt(u, "Heater", false, 0, 10*time.Minute)
+	switchAt(u, "Heater", true, 0, 25*time.Minute)
+	usage := u.Get(usageStart.Add(30 * time.Minute))
+
+	if len(usage.Actors) != 2 || usage.Actors[0].Name != "Heater" {
+		t.Fatalf("got actors %+v", usage.Actors)
+	}
+	heater := usage.Actors[0]
+	if heater.Total.Cycles != 2 || !near(heater.Total.OnTime, 600) {
+		t.Errorf("cycles = %d, on-time = %.1fs; want 2 and 600s", heater.Total.Cycles, heater.Total.OnTime)
+	}
+	// 2 kW for 10 minutes
+	if !near(heater.Total.Energy, 2000.0/6/1000) || !near(heater.Total.Cost, heater.Total.Energy*0.25) {
+		t.Errorf("energy = %.4f kWh at cost %.4f", heater.Total.Energy, heater.Total.Cost)
+	}
+	if heater.Batch != heater.Total {
+		t.Errorf("batch %+v differs from total %+v", heater.Batch, heater.Total)
+	}
+
+	tests := []struct {
+		window string
+		want   float64
+	}{
+		{"10m", 50},        // 5 of the last 10 minutes
+		{"1h", 100.0 / 3},  // 10 of 30 minutes since start
+		{"24h", 100.0 / 3}, // same as 1h
+	}
+	for _, test := range tests {
+		if got := heater.Duty[test.window]; !near(got, test.want) {
+			t.Errorf("duty %s = %.2f%%, want %.2f%%", test.window, got, test.want)
+		}
+	}
+	if pump := usage.Actors[1]; pump.Total.Cycles != 0 || pump.Total.Energy != 0 || pump.Duty["1h"] != 0 {
+		t.Errorf("pump usage %+v, want none", pump)
+	}
+
+	u.NewBatch(usageStart.Add(30 * time.Minute))
+	usage = u.Get(usageStart.Add(36 * time.Minute))
+	heater = usage.Actors[0]
+	if heater.Batch.Cycles != 0 || !near(heater.Batch.OnTime, 360) || !near(heater.Total.OnTime, 960) {
+		t.Errorf("after new batch total %+v, batch %+v", heater.Total, heater.Batch)
+	}
+	if usage.BatchStart != usageStart.Add(30*time.Minute).UnixNano()/int64(time.Millisecond) {
+		t.Errorf("batch start not set")
+	}
+}
+
+func TestUsagePowerControl(t *testing.T) {
+	u, _ := NewUsage("", 0, usageStart)
+	u.AddActor("SSR", 1000, true)
+	switchAt(u, "SSR", true, 50, 0)
+	switchAt(u, "SSR", true, 100, time.Hour)
+	usage := u.Get(usageStart.Add(2 * time.Hour))
+
+	if ssr := usage.Actors[0]; ssr.Total.Cycles != 1 || !near(ssr.Total.Energy, 1.5) {
+		t.Errorf("cycles = %d, energy = %.3f kWh; want 1 and 1.5", ssr.Total.Cycles, ssr.Total.Energy)
+	}
+}
+
+func TestUsageFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "usage.json")
+	u, err := NewUsage(fileName, 0, usageStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.AddActor("Heater", 1000, false)
+	if err := u.Save(usageStart); err != nil {
+		t.Fatal(err)
+	}
+	switchAt(u, "Heater", true, 0, 0)
+	if err := u.Save(usageStart.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// counting continues after a restart
+	restart := usageStart.Add(2 * time.Hour)
+	u, err = NewUsage(fileName, 0.5, restart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.AddActor("Heater", 1000, false)
+	u.Update(ActorEvent{Name: "Heater", State: StateOn}, restart)
+	usage := u.Get(restart.Add(30 * time.Minute))
+
+	heater := usage.Actors[0]
+	if heater.Total.Cycles != 2 || !near(heater.Total.OnTime, 5400) || !near(heater.Total.Energy, 1.5) {
+		t.Errorf("after restart usage %+v, want 2 cycles, 5400s and 1.5 kWh", heater.Total)
+	}
+	if usage.Since != usageStart.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("since = %d, want time of first start", usage.Since)
+	}
+	// duty cycle starts again after restart
+	if !near(heater.Duty["24h"], 100) {
+		t.Errorf("duty 24h = %.2f%%, want 100%%", heater.Duty["24h"])
+	}
+
+	if err := u.Save(restart.Add(30 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadUsage(fileName, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.Actors[0].Total; !near(got.Energy, 1.5) || !near(got.Cost, 0.75) {
+		t.Errorf("ReadUsage() = %+v, want 1.5 kWh costing 0.75", got)
+	}
+}
@@ -4,20 +4,34 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
-	"./control"
+	"github.com/gigatropolis/brewbrat/controller/config"
+	"github.com/gigatropolis/brewbrat/controller/control"
+	"github.com/gigatropolis/brewbrat/controller/www/cmd/server"
 )
 
-// SET GO111MODULE=off
-
 const (
-	DefaultSensorCount = 3
 	DefaultRelayCount  = 3
 	DefaultSSRCount    = 1
 	DefaultBuzzerCount = 1
 )
 
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 
 	dummyMode := false
@@ -30,22 +44,39 @@ func main() {
 	runFlgDummy := runCmd.Bool("dummy", false, "Use dummy configuration")
 	runFlgDebug := runCmd.Bool("debug", false, "Run in debug mode")
 	runFlgConfig := runCmd.String("name", "configuration.xml", "XML configuration file to load")
+	runFlgAddr := runCmd.String("addr", "", "Address web server listens on. Overrides \"Web Address\" in configuration")
+	runFlgPort := runCmd.Int("port", 0, "Port web server listens on. Overrides \"Web Port\" in configuration")
+	runFlgAssets := runCmd.String("assets", "", "Serve web UI files from directory instead of files built into controller. Overrides \"Web Assets\" in configuration")
+	runFlgCert := runCmd.String("tls-cert", "", "TLS certificate file. Overrides \"Web TLS Cert\" in configuration")
+	runFlgKey := runCmd.String("tls-key", "", "TLS key file. Overrides \"Web TLS Key\" in configuration")
 
 	configCmd := flag.NewFlagSet("config", flag.ExitOnError)
 	configFlgDummy := configCmd.Bool("dummy", false, "Use dummy configuration")
 	configFlgDebug := configCmd.Bool("debug", false, "Run in debug mode")
 	configFlgName := configCmd.String("name", "configuration.xml", "XML configuration name to save configuration")
 	configFlgList := configCmd.Bool("list", false, "List 64 bit addreeses for 1-wire devices available then exit")
-	configFlgSens1 := configCmd.String("sens1", "unknown", "Set sensor 1. format \"<name[:<net address>\". Default \"Temp Sensor 1\"")
-	configFlgSens2 := configCmd.String("sens2", "unknown", "Set sensor 2. format \"<name[:<net address>\". Default \"Temp Sensor 2\"")
-	configFlgSens3 := configCmd.String("sens3", "unknown", "Set sensor 3. format \"<name[:<net address>\". Default \"Temp Sensor 3\"")
+	configFlgSensors := stringList{}
+	configCmd.Var(&configFlgSensors, "sensor", "Add temperature sensor \"<name>[:<1-wire address>]\". Repeat for more sensors. Default is a sensor for each 1-wire address found")
+
+	userCmd := flag.NewFlagSet("user", flag.ExitOnError)
+	userFlgName := userCmd.String("name", "configuration.xml", "XML configuration file to update")
+	userFlgUser := userCmd.String("user", "", "User name")
+	userFlgRole := userCmd.String("role", "viewer", "User role: viewer, operator or admin")
+	userFlgPassword := userCmd.String("password", "", "Set password used to log in to web server")
+	userFlgToken := userCmd.Bool("token", false, "Create new API token for user. Token is only shown once")
+	userFlgDelete := userCmd.Bool("delete", false, "Delete user")
+
+	typesCmd := flag.NewFlagSet("types", flag.ExitOnError)
+	typesFlgKind := typesCmd.String("kind", "", "Only list types of kind sensor, actor, equipment or buzzer")
+
+	usageCmd := flag.NewFlagSet("usage", flag.ExitOnError)
+	usageFlgName := usageCmd.String("name", "configuration.xml", "XML configuration file with \"Usage File\" and \"Energy Price\"")
 
 	if len(os.Args) < 2 {
-		fmt.Println("expected 'run' or 'config' subcommands")
+		fmt.Println("expected 'run', 'config', 'user', 'types' or 'usage' subcommands")
 		os.Exit(1)
 	}
 
-	sensors := []string{"Temp Sensor 1", "Temp Sensor 2", "Temp Sensor 3"}
 	mode := os.Args[1]
 
 	switch mode {
@@ -60,27 +91,29 @@ func main() {
 		configName = *configFlgName
 		debugMode = *configFlgDebug
 		cmdMode = control.ConfigCmdMode
-		tempSensors := []string{*configFlgSens1, *configFlgSens2, *configFlgSens3}
-		f := true
-		for i := 0; i < DefaultSensorCount; i++ {
-			if tempSensors[i] != "default" {
-				f = false
-				break
-			}
+		CmdInfo.Sensors = configFlgSensors
+	case "user":
+		userCmd.Parse(os.Args[2:])
+		err := editUser(*userFlgName, *userFlgUser, *userFlgRole, *userFlgPassword, *userFlgToken, *userFlgDelete)
+		if err != nil {
+			fmt.Printf("unable to update user: %s\n", err)
+			os.Exit(1)
 		}
-
-		for i := 0; i < DefaultSensorCount; i++ {
-			if !f {
-				if tempSensors[i] != "unknown" {
-					CmdInfo.Sensors = append(CmdInfo.Sensors, tempSensors[i])
-					continue
-				}
-				CmdInfo.Sensors = append(CmdInfo.Sensors, "")
-			} else {
-				CmdInfo.Sensors = append(CmdInfo.Sensors, fmt.Sprintf("Temp Sensor %d", i+1))
-			}
+		os.Exit(0)
+	case "types":
+		typesCmd.Parse(os.Args[2:])
+		if err := listTypes(control.DefaultRegistry, *typesFlgKind); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "usage":
+		usageCmd.Parse(os.Args[2:])
+		if err := listUsage(*usageFlgName); err != nil {
+			fmt.Printf("unable to read usage: %s\n", err)
+			os.Exit(1)
 		}
-		//os.Exit(1)
+		os.Exit(0)
 	}
 
 	// flag.Parse()
@@ -88,18 +121,6 @@ func main() {
 		fmt.Println("Dummy Configutation used")
 	}
 
-	regDevices := control.RegDevices{
-
-		"TempSensor":      reflect.TypeOf(control.TempSensor{}),
-		"DummyTempSensor": reflect.TypeOf(control.DummyTempSensor{}),
-		"DummyRelay":      reflect.TypeOf(control.DummyRelay{}),
-		"SimpleRelay":     reflect.TypeOf(control.SimpleRelay{}),
-		"SimpleSSR":       reflect.TypeOf(control.SimpleSSR{}),
-		"SimpleRIMM":      reflect.TypeOf(control.SimpleRIMM{}),
-		"ActiveBuzzer":    reflect.TypeOf(control.ActiveBuzzer{}),
-		"DummyBuzzer":     reflect.TypeOf(control.DummyBuzzer{}),
-	}
-
 	fmt.Println("Starting Controller...")
 
 	logger := control.Logger{}
@@ -107,12 +128,6 @@ func main() {
 	logger.SetDebug(debugMode)
 	logger.Add("default", control.LogLevelAll, os.Stdout)
 
-	if mode == "config" {
-		sensors[0] = *configFlgSens1
-		sensors[1] = *configFlgSens2
-		sensors[2] = *configFlgSens3
-	}
-
 	if *configFlgList == true {
 		netAddresses, errlist := control.GetActiveNetlinkAddresses(&logger)
 		if errlist != nil {
@@ -127,7 +142,26 @@ func main() {
 	}
 
 	controller := control.Control{}
-	controller.InitController(&regDevices, &logger, sensors, cmdMode, configName, dummyMode)
+	if err := controller.InitController(control.DefaultRegistry, &logger, CmdInfo.Sensors, cmdMode, configName, dummyMode); err != nil {
+		fmt.Printf("unable to create configuration: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *runFlgAddr != "" {
+		controller.SetProperty("Web Address", "string", *runFlgAddr, "Address web server listens on")
+	}
+	if *runFlgPort != 0 {
+		controller.SetProperty("Web Port", "int", int64(*runFlgPort), "Port web server listens on")
+	}
+	if *runFlgAssets != "" {
+		controller.SetProperty("Web Assets", "string", *runFlgAssets, "Directory of web UI files")
+	}
+	if *runFlgCert != "" {
+		controller.SetProperty("Web TLS Cert", "string", *runFlgCert, "TLS certificate file")
+	}
+	if *runFlgKey != "" {
+		controller.SetProperty("Web TLS Key", "string", *runFlgKey, "TLS private key file")
+	}
 
 	if cmdMode != control.ConfigCmdMode {
 		controller.OnStart()
@@ -135,3 +169,143 @@ func main() {
 	}
 
 }
+
+// editUser adds, updates or deletes a web server user in configuration file
+func editUser(fileName string, name string, role string, password string, newToken bool, remove bool) error {
+	if name == "" {
+		return fmt.Errorf("missing -user")
+	}
+	if server.ParseRole(role) == server.RoleNone {
+		return fmt.Errorf("unknown role '%s'", role)
+	}
+
+	brewController, err := config.LoadConfiguration(fileName)
+	if err != nil {
+		return err
+	}
+
+	users := []config.UserConfig{}
+	user := config.UserConfig{Name: name}
+	for _, u := range brewController.Users {
+		if u.Name == name {
+			user = u
+			continue
+		}
+		users = append(users, u)
+	}
+
+	if remove {
+		brewController.Users = users
+		fmt.Printf("user '%s' deleted\n", name)
+		return config.SaveConfiguration(fileName, brewController)
+	}
+
+	user.Role = role
+	if password != "" {
+		hash, err := server.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+	}
+	if newToken {
+		token, err := server.NewToken()
+		if err != nil {
+			return err
+		}
+		user.Token = server.HashToken(token)
+		fmt.Printf("API token for '%s': %s\n", name, token)
+	}
+	if user.Password == "" && user.Token == "" {
+		return fmt.Errorf("user needs -password or -token")
+	}
+
+	brewController.Users = append(users, user)
+	fmt.Printf("user '%s' saved with role %s\n", name, role)
+	return config.SaveConfiguration(fileName, brewController)
+}
+
+// listTypes prints all registered device types of kind with their properties. Empty kind lists all types
+func listTypes(reg *control.Registry, kind string) error {
+	switch kind {
+	case "", control.KindSensor, control.KindActor, control.KindEquipment, control.KindBuzzer:
+	default:
+		return fmt.Errorf("unknown kind '%s'. Use sensor, actor, equipment or buzzer", kind)
+	}
+
+	for _, t := range reg.Types() {
+		if kind != "" && t.Kind != kind {
+			continue
+		}
+		fmt.Printf("%s (%s)\n", t.Name, t.Kind)
+		if t.Description != "" {
+			fmt.Printf("    %s\n", t.Description)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, prop := range t.Properties {
+			if prop.Hidden || prop.Name == "Name" {
+				continue
+			}
+			comment := prop.Comment
+			if prop.Select != "" {
+				comment += " (" + strings.Replace(prop.Select, ",", ", ", -1) + ")"
+			}
+			fmt.Fprintf(w, "    %s\t%s\t%q\t%s\n", prop.Name, prop.Type, prop.Value, comment)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+	return nil
+}
+
+// listUsage prints switch cycles, on-time and energy of all actors from the usage file of configuration fileName
+func listUsage(fileName string) error {
+	brewController, err := config.LoadConfiguration(fileName)
+	if err != nil {
+		return err
+	}
+	usageFile, price := "usage.json", 0.0
+	for _, prop := range brewController.Properties {
+		switch prop.Name {
+		case "Usage File":
+			usageFile = prop.Value
+		case "Energy Price":
+			price, _ = strconv.ParseFloat(prop.Value, 64)
+		}
+	}
+	if usageFile == "" {
+		return fmt.Errorf("\"Usage File\" is empty, usage is only kept in memory")
+	}
+
+	usage, err := control.ReadUsage(usageFile, price)
+	if err != nil {
+		return err
+	}
+	ms := func(t int64) string { return time.Unix(0, t*int64(time.Millisecond)).Format("2006-01-02 15:04") }
+	fmt.Printf("Usage since %s, batch started %s\n\n", ms(usage.Since), ms(usage.BatchStart))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Actor\tCycles\tOn Time\tkWh\tBatch Cycles\tBatch On Time\tBatch kWh\n")
+	for _, actor := range usage.Actors {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.2f\t%d\t%s\t%.2f\n", actor.Name,
+			actor.Total.Cycles, seconds(actor.Total.OnTime), actor.Total.Energy,
+			actor.Batch.Cycles, seconds(actor.Batch.OnTime), actor.Batch.Energy)
+	}
+	w.Flush()
+
+	if price > 0 {
+		total, batch := 0.0, 0.0
+		for _, actor := range usage.Actors {
+			total += actor.Total.Cost
+			batch += actor.Batch.Cost
+		}
+		fmt.Printf("\nEnergy cost %.2f, this batch %.2f\n", total, batch)
+	}
+	return nil
+}
+
+// seconds formats on-time rounded to seconds
+func seconds(s float64) string {
+	return (time.Duration(s) * time.Second).String()
+}
@@ -0,0 +1,16 @@
+module github.com/gigatropolis/brewbrat/controller
+
+go 1.21
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	periph.io/x/periph v3.6.8+incompatible
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+)
@@ -0,0 +1,301 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+	"github.com/gigatropolis/brewbrat/controller/www/cmd/server"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	commandTimeout = 5 * time.Second
+)
+
+// Equipment modes published on <root>/equipment/<name>/mode
+const (
+	ModeOff  = "off"
+	ModeHeat = "heat"
+)
+
+// Logger is the subset of control.Logger used by the bridge
+type Logger interface {
+	LogMessage(msg string, args ...interface{})
+	LogError(errMsg string, args ...interface{})
+}
+
+// Options are the broker settings read from the configuration properties
+type Options struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	Topic    string
+	QoS      byte
+	Retain   bool
+}
+
+// Bridge publishes sensor, actor and setpoint values to an MQTT broker
+// and forwards commands from the broker to the controller.
+//
+// Topic tree (<root> is Options.Topic):
+//
+//	<root>/status                         online|offline
+//	<root>/sensor/<name>/value            sensor reading
+//	<root>/actor/<name>/state             ON|OFF
+//	<root>/actor/<name>/power             power level
+//	<root>/actor/<name>/mode              auto|manual
+//	<root>/equipment/<name>/setpoint      equipment setpoint
+//	<root>/equipment/<name>/mode          off|heat
+//
+// Command topics:
+//
+//	<root>/actor/<name>/set               ON|OFF|AUTO, ON:<minutes> for a timed manual override
+//	<root>/actor/<name>/power/set         power level
+//	<root>/equipment/<name>/setpoint/set  new setpoint
+//	<root>/equipment/<name>/mode/set      off|heat
+type Bridge struct {
+	opts       Options
+	client     paho.Client
+	out        server.SvrChanOut
+	logger     Logger
+	subscribed chan struct{}
+	once       sync.Once
+	newClient  func(*paho.ClientOptions) paho.Client
+
+	// names maps "<kind>/<topic level>" back to the device name the topic level was made of
+	namesMu sync.Mutex
+	names   map[string]string
+
+	discoveryMu     sync.Mutex
+	discoveryPrefix string
+	inventory       Inventory
+}
+
+// NewBridge creates a bridge that sends commands received from the broker to out.
+// out is read by the controller the same way as web server requests.
+func NewBridge(opts Options, out server.SvrChanOut, logger Logger) *Bridge {
+	if opts.Topic == "" {
+		opts.Topic = "brewbrat"
+	}
+	opts.Topic = strings.TrimSuffix(opts.Topic, "/")
+	if opts.ClientID == "" {
+		opts.ClientID = "brewbrat"
+	}
+	return &Bridge{
+		opts:       opts,
+		out:        out,
+		logger:     logger,
+		subscribed: make(chan struct{}),
+		newClient:  paho.NewClient,
+		names:      make(map[string]string),
+	}
+}
+
+// Connect opens connection to broker and subscribes to command topics.
+// Returns once subscriptions are in place. Subscriptions are renewed
+// each time the client reconnects.
+func (b *Bridge) Connect() error {
+	co := paho.NewClientOptions()
+	co.AddBroker(b.opts.Broker)
+	co.SetClientID(b.opts.ClientID)
+	co.SetUsername(b.opts.Username)
+	co.SetPassword(b.opts.Password)
+	co.SetAutoReconnect(true)
+	co.SetOrderMatters(false)
+	co.SetConnectTimeout(connectTimeout)
+	co.SetWill(b.Topic("status"), "offline", b.opts.QoS, true)
+	co.SetOnConnectHandler(func(c paho.Client) {
+		b.logger.LogMessage("MQTT connected to %s", b.opts.Broker)
+		b.publish(b.Topic("status"), "online", true)
+		b.subscribe(c)
+		b.subscribeDiscovery(c)
+		b.once.Do(func() { close(b.subscribed) })
+	})
+	co.SetConnectionLostHandler(func(c paho.Client, err error) {
+		b.logger.LogError("MQTT connection lost: %s", err)
+	})
+
+	b.client = b.newClient(co)
+	token := b.client.Connect()
+	if !token.WaitTimeout(connectTimeout) {
+		return fmt.Errorf("timeout connecting to MQTT broker %s", b.opts.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+
+	select {
+	case <-b.subscribed:
+	case <-time.After(connectTimeout):
+		return fmt.Errorf("timeout subscribing to MQTT command topics")
+	}
+	return nil
+}
+
+// Close publishes offline status and disconnects from broker
+func (b *Bridge) Close() {
+	if b == nil || b.client == nil {
+		return
+	}
+	if b.client.IsConnected() {
+		b.publish(b.Topic("status"), "offline", true)
+	}
+	b.client.Disconnect(250)
+}
+
+// IsConnected returns true when bridge has an active broker connection
+func (b *Bridge) IsConnected() bool {
+	return b != nil && b.client != nil && b.client.IsConnected()
+}
+
+// Topic joins the levels under the root topic. Characters that have
+// special meaning in MQTT topics are replaced in each level.
+func (b *Bridge) Topic(levels ...string) string {
+	parts := []string{b.opts.Topic}
+	for _, level := range levels {
+		parts = append(parts, TopicLevel(level))
+	}
+	return strings.Join(parts, "/")
+}
+
+// TopicLevel replaces '/', '+' and '#' so a device name can be used as a single topic level
+func TopicLevel(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+// PublishSensor publishes the latest sensor reading
+func (b *Bridge) PublishSensor(name string, value float64) {
+	b.publish(b.Topic("sensor", name, "value"), fmt.Sprintf("%.2f", value), b.opts.Retain)
+}
+
+// PublishActor publishes the actor state, power level and auto or manual mode
+func (b *Bridge) PublishActor(name string, on bool, power int, manual bool) {
+	state := "OFF"
+	if on {
+		state = "ON"
+	}
+	mode := api.ActorAuto
+	if manual {
+		mode = api.ActorManual
+	}
+	b.addName("actor", name)
+	b.publish(b.Topic("actor", name, "state"), state, b.opts.Retain)
+	b.publish(b.Topic("actor", name, "power"), fmt.Sprintf("%d", power), b.opts.Retain)
+	b.publish(b.Topic("actor", name, "mode"), mode, b.opts.Retain)
+}
+
+// PublishSetpoint publishes the equipment setpoint
+func (b *Bridge) PublishSetpoint(name string, setpoint float64) {
+	b.addName("equipment", name)
+	b.publish(b.Topic("equipment", name, "setpoint"), fmt.Sprintf("%.2f", setpoint), b.opts.Retain)
+}
+
+// PublishMode publishes heat when equipment is active and off when idle
+func (b *Bridge) PublishMode(name string, active bool) {
+	mode := ModeOff
+	if active {
+		mode = ModeHeat
+	}
+	b.addName("equipment", name)
+	b.publish(b.Topic("equipment", name, "mode"), mode, b.opts.Retain)
+}
+
+// PublishAlarm publishes a raised, cleared or acknowledged alarm as JSON on "alarm/<source>/<condition>"
+func (b *Bridge) PublishAlarm(alarm api.Alarm) {
+	buf, err := json.Marshal(alarm)
+	if err != nil {
+		return
+	}
+	b.publish(b.Topic("alarm", alarm.Source, alarm.Condition), string(buf), false)
+}
+
+func (b *Bridge) publish(topic string, payload string, retain bool) {
+	if !b.IsConnected() {
+		return
+	}
+	token := b.client.Publish(topic, b.opts.QoS, retain, payload)
+	go func() {
+		if token.WaitTimeout(commandTimeout) && token.Error() != nil {
+			b.logger.LogError("MQTT publish '%s' failed: %s", topic, token.Error())
+		}
+	}()
+}
+
+func (b *Bridge) subscribe(c paho.Client) {
+	subs := map[string]int{
+		b.opts.Topic + "/actor/+/set":              server.CmdSetRelay,
+		b.opts.Topic + "/actor/+/power/set":        server.CmdRelaySetPower,
+		b.opts.Topic + "/equipment/+/setpoint/set": server.CmdSetSetpointValue,
+		b.opts.Topic + "/equipment/+/mode/set":     server.CmdSetEquipmentState,
+	}
+	for topic, cmd := range subs {
+		cmd := cmd
+		token := c.Subscribe(topic, b.opts.QoS, func(c paho.Client, msg paho.Message) {
+			go b.handleCommand(cmd, msg.Topic(), msg.Payload())
+		})
+		if token.WaitTimeout(commandTimeout) && token.Error() != nil {
+			b.logger.LogError("MQTT subscribe '%s' failed: %s", topic, token.Error())
+		}
+	}
+}
+
+// addName remembers the device name of its topic level so commands reach the device
+// even when TopicLevel replaced characters of the name
+func (b *Bridge) addName(kind string, name string) {
+	b.namesMu.Lock()
+	b.names[kind+"/"+TopicLevel(name)] = name
+	b.namesMu.Unlock()
+}
+
+// deviceName returns the device name of the <name> level of a command topic
+func (b *Bridge) deviceName(topic string) string {
+	levels := strings.Split(strings.TrimPrefix(topic, b.opts.Topic+"/"), "/")
+	if len(levels) < 2 || levels[1] == "" {
+		return ""
+	}
+	b.namesMu.Lock()
+	defer b.namesMu.Unlock()
+	if name, ok := b.names[levels[0]+"/"+levels[1]]; ok {
+		return name
+	}
+	return levels[1]
+}
+
+// handleCommand sends command to controller and waits for the reply
+func (b *Bridge) handleCommand(cmd int, topic string, payload []byte) {
+	name := b.deviceName(topic)
+	if name == "" {
+		return
+	}
+	value := strings.TrimSpace(string(payload))
+	switch cmd {
+	case server.CmdSetRelay:
+		value = strings.ToUpper(value)
+	case server.CmdSetEquipmentState:
+		value = strings.ToLower(value)
+	}
+	b.logger.LogMessage("MQTT command '%s' = %s", topic, value)
+
+	ret := make(chan string, 1)
+	select {
+	case b.out <- server.ServerCommand{Cmd: cmd, DeviceName: name, Value: []byte(value), ChanReturn: ret}:
+	case <-time.After(commandTimeout):
+		b.logger.LogError("MQTT command '%s' not accepted by controller", topic)
+		return
+	}
+
+	select {
+	case reply := <-ret:
+		if reply == "bad" || reply == "Unknown" {
+			b.logger.LogError("MQTT command '%s' failed: %s", topic, reply)
+		}
+	case <-time.After(commandTimeout):
+		b.logger.LogError("MQTT command '%s' timed out", topic)
+	}
+}
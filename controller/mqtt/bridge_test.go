@@ -0,0 +1,356 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gigatropolis/brewbrat/controller/www/cmd/server"
+)
+
+type testLogger struct{}
+
+func (testLogger) LogMessage(msg string, args ...interface{})  {}
+func (testLogger) LogError(errMsg string, args ...interface{}) {}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+type fakeMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return m.retained }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMessage) Ack()              {}
+
+// fakeClient is an in-process paho client. It records published messages and delivers
+// messages to the handlers subscribed to matching topic filters
+type fakeClient struct {
+	opts      *paho.ClientOptions
+	mu        sync.Mutex
+	connected bool
+	published []fakeMessage
+	subs      map[string]paho.MessageHandler
+}
+
+func (c *fakeClient) IsConnected() bool      { c.mu.Lock(); defer c.mu.Unlock(); return c.connected }
+func (c *fakeClient) IsConnectionOpen() bool { return c.IsConnected() }
+
+func (c *fakeClient) Connect() paho.Token {
+	c.mu.Lock()
+	c.connected = true
+	c.mu.Unlock()
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
+	return doneToken{}
+}
+
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.mu.Lock()
+	c.published = append(c.published, fakeMessage{topic: topic, payload: payload.(string), retained: retained})
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	c.subs[topic] = callback
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback paho.MessageHandler) paho.Token {
+	for topic := range filters {
+		c.Subscribe(topic, 0, callback)
+	}
+	return doneToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) paho.Token {
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+func (c *fakeClient) AddRoute(topic string, callback paho.MessageHandler) {}
+
+func (c *fakeClient) OptionsReader() paho.ClientOptionsReader { return paho.ClientOptionsReader{} }
+
+// deliver sends a message to the handlers of matching filters. Returns false when nobody subscribed
+func (c *fakeClient) deliver(topic string, payload string) bool {
+	c.mu.Lock()
+	handlers := []paho.MessageHandler{}
+	for filter, handler := range c.subs {
+		if topicMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(c, fakeMessage{topic: topic, payload: payload})
+	}
+	return len(handlers) > 0
+}
+
+// last returns the latest message published on topic
+func (c *fakeClient) last(topic string) (fakeMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.published) - 1; i >= 0; i-- {
+		if c.published[i].topic == topic {
+			return c.published[i], true
+		}
+	}
+	return fakeMessage{}, false
+}
+
+func (c *fakeClient) count(topic string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, msg := range c.published {
+		if msg.topic == topic {
+			n++
+		}
+	}
+	return n
+}
+
+func topicMatches(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// newTestBridge returns a bridge connected to a fake client. Commands are read from out
+func newTestBridge(t *testing.T) (*Bridge, *fakeClient, server.SvrChanOut) {
+	out := make(server.SvrChanOut, 1)
+	b := NewBridge(Options{Broker: "tcp://broker:1883", Topic: "brew/", Retain: true}, out, testLogger{})
+	client := &fakeClient{subs: make(map[string]paho.MessageHandler)}
+	b.newClient = func(opts *paho.ClientOptions) paho.Client {
+		client.opts = opts
+		return client
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return b, client, out
+}
+
+func (c *fakeClient) wantMessage(t *testing.T, topic string, payload string, retained bool) {
+	t.Helper()
+	msg, ok := c.last(topic)
+	if !ok || msg.payload != payload || msg.retained != retained {
+		t.Errorf("last message on %s = %+v, %t; want %q retained %t", topic, msg, ok, payload, retained)
+	}
+}
+
+func TestBridgeStatus(t *testing.T) {
+	b, client, _ := newTestBridge(t)
+
+	// broker publishes the will when the controller disappears
+	if !client.opts.WillEnabled || client.opts.WillTopic != "brew/status" || string(client.opts.WillPayload) != "offline" || !client.opts.WillRetained {
+		t.Errorf("will %s = %q, retained %t", client.opts.WillTopic, client.opts.WillPayload, client.opts.WillRetained)
+	}
+	client.wantMessage(t, "brew/status", "online", true)
+	if !b.IsConnected() {
+		t.Error("bridge not connected")
+	}
+
+	// status and subscriptions are renewed on reconnect
+	client.opts.OnConnect(client)
+	if n := client.count("brew/status"); n != 2 {
+		t.Errorf("online published %d times, want 2", n)
+	}
+
+	b.Close()
+	client.wantMessage(t, "brew/status", "offline", true)
+	if b.IsConnected() {
+		t.Error("bridge connected after Close")
+	}
+	b.PublishSensor("Temp", 1)
+	if _, ok := client.last("brew/sensor/Temp/value"); ok {
+		t.Error("published while disconnected")
+	}
+}
+
+func TestBridgePublish(t *testing.T) {
+	b, client, _ := newTestBridge(t)
+
+	b.PublishSensor("Temp Sensor 1", 152.346)
+	b.PublishActor("Heater", true, 80, true)
+	b.PublishSetpoint("HLT/Boil", 168)
+	b.PublishMode("HLT/Boil", false)
+
+	client.wantMessage(t, "brew/sensor/Temp Sensor 1/value", "152.35", true)
+	client.wantMessage(t, "brew/actor/Heater/state", "ON", true)
+	client.wantMessage(t, "brew/actor/Heater/power", "80", true)
+	client.wantMessage(t, "brew/actor/Heater/mode", "manual", true)
+	client.wantMessage(t, "brew/equipment/HLT_Boil/setpoint", "168.00", true)
+	client.wantMessage(t, "brew/equipment/HLT_Boil/mode", ModeOff, true)
+}
+
+func TestBridgeCommands(t *testing.T) {
+	b, client, out := newTestBridge(t)
+	b.PublishSetpoint("HLT/Boil", 168)
+
+	tests := []struct {
+		topic   string
+		payload string
+		cmd     int
+		name    string
+		value   string
+	}{
+		{"brew/actor/Pump/set", " on ", server.CmdSetRelay, "Pump", "ON"},
+		{"brew/actor/Heater/power/set", "55", server.CmdRelaySetPower, "Heater", "55"},
+		{"brew/equipment/HLT_Boil/setpoint/set", "170", server.CmdSetSetpointValue, "HLT/Boil", "170"},
+		{"brew/equipment/HLT_Boil/mode/set", "HEAT", server.CmdSetEquipmentState, "HLT/Boil", ModeHeat},
+	}
+	for _, test := range tests {
+		if !client.deliver(test.topic, test.payload) {
+			t.Errorf("no subscription for %s", test.topic)
+			continue
+		}
+		select {
+		case cmd := <-out:
+			if cmd.Cmd != test.cmd || cmd.DeviceName != test.name || string(cmd.Value) != test.value {
+				t.Errorf("%s sent command %d to %q with %q, want %d to %q with %q",
+					test.topic, cmd.Cmd, cmd.DeviceName, cmd.Value, test.cmd, test.name, test.value)
+			}
+			cmd.ChanReturn <- "ok"
+		case <-time.After(time.Second):
+			t.Errorf("%s sent no command", test.topic)
+		}
+	}
+
+	// state topics are not commands
+	if client.deliver("brew/actor/Pump/state", "ON") {
+		t.Error("subscribed to state topic")
+	}
+}
+
+func TestBridgeDiscovery(t *testing.T) {
+	b, client, out := newTestBridge(t)
+	b.PublishDiscovery("", Inventory{
+		Controller: "Brewery",
+		Actors:     []ActorInfo{{Name: "Pump #1"}},
+		Equipment:  []EquipmentInfo{{Name: "HLT", Sensor: "Temp", Units: "F"}},
+	})
+
+	msg, ok := client.last("homeassistant/switch/brewery/pump_1/config")
+	if !ok || !msg.retained {
+		t.Fatalf("switch config %+v, %t", msg, ok)
+	}
+	var e haEntity
+	if err := json.Unmarshal([]byte(msg.payload), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.CommandTopic != "brew/actor/Pump _1/set" || e.AvailabilityTopic != "brew/status" {
+		t.Errorf("switch config %+v", e)
+	}
+
+	// commands on the discovered topic reach the actor
+	client.deliver(e.CommandTopic, "OFF")
+	select {
+	case cmd := <-out:
+		if cmd.DeviceName != "Pump #1" {
+			t.Errorf("command sent to %q", cmd.DeviceName)
+		}
+		cmd.ChanReturn <- "ok"
+	case <-time.After(time.Second):
+		t.Error("discovered command topic sent no command")
+	}
+
+	// discovery is published again when Home Assistant comes online
+	client.deliver("homeassistant/status", "online")
+	deadline := time.Now().Add(time.Second)
+	for client.count("homeassistant/climate/brewery/hlt/config") < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := client.count("homeassistant/climate/brewery/hlt/config"); n != 2 {
+		t.Errorf("climate config published %d times, want 2", n)
+	}
+}
+
+func TestDiscoveryUnits(t *testing.T) {
+	tests := []struct {
+		units    string
+		want     string
+		min, max float64
+	}{
+		{"F", "F", 32, 212},
+		{"°F", "F", 32, 212},
+		{"C", "C", 0, 100},
+		{"°C", "C", 0, 100},
+		{"c", "C", 0, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.units, func(t *testing.T) {
+			b, client, _ := newTestBridge(t)
+			b.PublishDiscovery("", Inventory{
+				Controller: "Brewery",
+				Sensors:    []SensorInfo{{Name: "Temp", Units: test.units}},
+				Equipment:  []EquipmentInfo{{Name: "HLT", Sensor: "Temp", Units: test.units}},
+			})
+
+			msg, ok := client.last("homeassistant/climate/brewery/hlt/config")
+			if !ok {
+				t.Fatal("no climate config")
+			}
+			var e haEntity
+			if err := json.Unmarshal([]byte(msg.payload), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.TemperatureUnit != test.want || e.MinTemp == nil || *e.MinTemp != test.min || e.MaxTemp == nil || *e.MaxTemp != test.max {
+				t.Errorf("climate unit %q from %v to %v, want %q from %v to %v", e.TemperatureUnit, e.MinTemp, e.MaxTemp, test.want, test.min, test.max)
+			}
+
+			msg, ok = client.last("homeassistant/sensor/brewery/temp/config")
+			if !ok {
+				t.Fatal("no sensor config")
+			}
+			e = haEntity{}
+			if err := json.Unmarshal([]byte(msg.payload), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.DeviceClass != "temperature" || e.UnitOfMeasurement != test.units {
+				t.Errorf("sensor class %q units %q", e.DeviceClass, e.UnitOfMeasurement)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// SensorInfo describes a sensor for Home Assistant discovery
+type SensorInfo struct {
+	Name  string
+	Units string
+}
+
+// ActorInfo describes an actor for Home Assistant discovery.
+// Power is true when actor accepts a power level.
+type ActorInfo struct {
+	Name  string
+	Power bool
+}
+
+// EquipmentInfo describes equipment for Home Assistant discovery.
+// Sensor is the name of the temperature sensor used by equipment.
+type EquipmentInfo struct {
+	Name   string
+	Sensor string
+	Units  string
+}
+
+// Inventory is all devices of the controller announced to Home Assistant
+type Inventory struct {
+	Controller string
+	Version    string
+	Sensors    []SensorInfo
+	Actors     []ActorInfo
+	Equipment  []EquipmentInfo
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+}
+
+type haEntity struct {
+	Name                    string    `json:"name"`
+	UniqueID                string    `json:"unique_id"`
+	ObjectID                string    `json:"object_id"`
+	Device                  *haDevice `json:"device"`
+	AvailabilityTopic       string    `json:"availability_topic"`
+	PayloadAvailable        string    `json:"payload_available,omitempty"`
+	PayloadNotAvailable     string    `json:"payload_not_available,omitempty"`
+	StateTopic              string    `json:"state_topic,omitempty"`
+	CommandTopic            string    `json:"command_topic,omitempty"`
+	DeviceClass             string    `json:"device_class,omitempty"`
+	StateClass              string    `json:"state_class,omitempty"`
+	UnitOfMeasurement       string    `json:"unit_of_measurement,omitempty"`
+	PayloadOn               string    `json:"payload_on,omitempty"`
+	PayloadOff              string    `json:"payload_off,omitempty"`
+	Min                     *float64  `json:"min,omitempty"`
+	Max                     *float64  `json:"max,omitempty"`
+	Step                    float64   `json:"step,omitempty"`
+	CurrentTemperatureTopic string    `json:"current_temperature_topic,omitempty"`
+	TemperatureStateTopic   string    `json:"temperature_state_topic,omitempty"`
+	TemperatureCommandTopic string    `json:"temperature_command_topic,omitempty"`
+	ModeStateTopic          string    `json:"mode_state_topic,omitempty"`
+	ModeCommandTopic        string    `json:"mode_command_topic,omitempty"`
+	Modes                   []string  `json:"modes,omitempty"`
+	TemperatureUnit         string    `json:"temperature_unit,omitempty"`
+	MinTemp                 *float64  `json:"min_temp,omitempty"`
+	MaxTemp                 *float64  `json:"max_temp,omitempty"`
+	TempStep                float64   `json:"temp_step,omitempty"`
+	Precision               float64   `json:"precision,omitempty"`
+}
+
+// PublishDiscovery publishes retained Home Assistant discovery payloads for all devices in inventory.
+// All entities are grouped under one Home Assistant device named after the controller.
+// Payloads are published again whenever Home Assistant announces it is online on <prefix>/status.
+func (b *Bridge) PublishDiscovery(prefix string, inv Inventory) {
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	b.discoveryMu.Lock()
+	first := b.discoveryPrefix == ""
+	b.discoveryPrefix = prefix
+	b.inventory = inv
+	b.discoveryMu.Unlock()
+
+	if first && b.IsConnected() {
+		b.subscribeDiscovery(b.client)
+	}
+	b.publishDiscovery(prefix, inv)
+}
+
+// subscribeDiscovery listens for Home Assistant birth message to publish discovery again
+func (b *Bridge) subscribeDiscovery(c paho.Client) {
+	b.discoveryMu.Lock()
+	prefix := b.discoveryPrefix
+	b.discoveryMu.Unlock()
+	if prefix == "" {
+		return
+	}
+
+	token := c.Subscribe(prefix+"/status", b.opts.QoS, func(c paho.Client, msg paho.Message) {
+		if string(msg.Payload()) != "online" {
+			return
+		}
+		b.discoveryMu.Lock()
+		inv := b.inventory
+		b.discoveryMu.Unlock()
+		go b.publishDiscovery(prefix, inv)
+	})
+	if token.WaitTimeout(commandTimeout) && token.Error() != nil {
+		b.logger.LogError("MQTT subscribe '%s/status' failed: %s", prefix, token.Error())
+	}
+}
+
+func (b *Bridge) publishDiscovery(prefix string, inv Inventory) {
+	if inv.Controller == "" {
+		inv.Controller = b.opts.ClientID
+	}
+	node := ObjectID(inv.Controller)
+	device := &haDevice{
+		Identifiers:  []string{node},
+		Name:         inv.Controller,
+		Manufacturer: "brewbrat",
+		Model:        "Brew Controller",
+		SwVersion:    inv.Version,
+	}
+
+	entity := func(name string) haEntity {
+		return haEntity{
+			Name:                name,
+			UniqueID:            node + "_" + ObjectID(name),
+			ObjectID:            node + "_" + ObjectID(name),
+			Device:              device,
+			AvailabilityTopic:   b.Topic("status"),
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+		}
+	}
+
+	for _, sensor := range inv.Sensors {
+		e := entity(sensor.Name)
+		e.StateTopic = b.Topic("sensor", sensor.Name, "value")
+		e.UnitOfMeasurement = sensor.Units
+		e.StateClass = "measurement"
+		if isTemperatureUnit(sensor.Units) {
+			e.DeviceClass = "temperature"
+		}
+		b.publishConfig(prefix, "sensor", node, sensor.Name, e)
+	}
+
+	for _, actor := range inv.Actors {
+		b.addName("actor", actor.Name)
+		e := entity(actor.Name)
+		e.StateTopic = b.Topic("actor", actor.Name, "state")
+		e.CommandTopic = b.Topic("actor", actor.Name, "set")
+		e.PayloadOn = "ON"
+		e.PayloadOff = "OFF"
+		b.publishConfig(prefix, "switch", node, actor.Name, e)
+
+		if actor.Power {
+			min, max := 0.0, 100.0
+			e := entity(actor.Name + " Power")
+			e.StateTopic = b.Topic("actor", actor.Name, "power")
+			e.CommandTopic = b.Topic("actor", actor.Name, "power", "set")
+			e.Min = &min
+			e.Max = &max
+			e.Step = 1
+			e.UnitOfMeasurement = "%"
+			b.publishConfig(prefix, "number", node, actor.Name+" Power", e)
+		}
+	}
+
+	for _, eq := range inv.Equipment {
+		b.addName("equipment", eq.Name)
+		e := entity(eq.Name)
+		if eq.Sensor != "" {
+			e.CurrentTemperatureTopic = b.Topic("sensor", eq.Sensor, "value")
+		}
+		e.TemperatureStateTopic = b.Topic("equipment", eq.Name, "setpoint")
+		e.TemperatureCommandTopic = b.Topic("equipment", eq.Name, "setpoint", "set")
+		e.ModeStateTopic = b.Topic("equipment", eq.Name, "mode")
+		e.ModeCommandTopic = b.Topic("equipment", eq.Name, "mode", "set")
+		e.Modes = []string{ModeOff, ModeHeat}
+		e.TempStep = 0.5
+		e.Precision = 0.1
+		min, max := 32.0, 212.0
+		e.TemperatureUnit = "F"
+		if units, _ := api.TemperatureUnits(eq.Units); units == api.UnitsCelsius {
+			min, max = 0.0, 100.0
+			e.TemperatureUnit = "C"
+		}
+		e.MinTemp = &min
+		e.MaxTemp = &max
+		b.publishConfig(prefix, "climate", node, eq.Name, e)
+	}
+}
+
+func (b *Bridge) publishConfig(prefix string, component string, node string, name string, e haEntity) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		b.logger.LogError("Unable to create discovery payload for '%s': %s", name, err)
+		return
+	}
+	topic := strings.Join([]string{prefix, component, node, ObjectID(name), "config"}, "/")
+	b.publish(topic, string(payload), true)
+}
+
+// ObjectID converts name to a Home Assistant object id. Only lower case letters,
+// digits and '_' are kept, i.e. "Temp Sensor 1" becomes "temp_sensor_1"
+func ObjectID(name string) string {
+	id := strings.Builder{}
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			id.WriteRune(r)
+		default:
+			if id.Len() > 0 && !strings.HasSuffix(id.String(), "_") {
+				id.WriteRune('_')
+			}
+		}
+	}
+	return strings.TrimSuffix(id.String(), "_")
+}
+
+func isTemperatureUnit(units string) bool {
+	_, ok := api.TemperatureUnits(units)
+	return ok
+}
@@ -0,0 +1,117 @@
+// dummyph is an example device plugin. It provides a simulated pH meter
+// and a relay that only logs when it is switched.
+//
+// Add it to the controller configuration:
+//
+//	<plugins>
+//	   <plugin>
+//	      <name>dummyph</name>
+//	      <path>/usr/local/bin/dummyph</path>
+//	   </plugin>
+//	</plugins>
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"github.com/gigatropolis/brewbrat/controller/plugin"
+)
+
+// PHMeter moves pH around the configured start value
+type PHMeter struct {
+	name  string
+	value float64
+}
+
+func (ph *PHMeter) Init(name string, properties map[string]string) error {
+	ph.name = name
+	value, err := strconv.ParseFloat(properties["Start Value"], 64)
+	if err != nil {
+		return fmt.Errorf("bad 'Start Value': %s", err)
+	}
+	ph.value = value
+	return nil
+}
+
+func (ph *PHMeter) OnStart() error {
+	log.Printf("%s started at pH %.2f", ph.name, ph.value)
+	return nil
+}
+
+func (ph *PHMeter) OnRead() (float64, error) {
+	ph.value += (rand.Float64() - 0.5) * 0.02
+	return ph.value, nil
+}
+
+func (ph *PHMeter) OnStop() error {
+	return nil
+}
+
+// LogRelay is an actor that logs its state
+type LogRelay struct {
+	name string
+}
+
+func (rel *LogRelay) Init(name string, properties map[string]string) error {
+	rel.name = name
+	return nil
+}
+
+func (rel *LogRelay) OnStart() error {
+	return rel.Off()
+}
+
+func (rel *LogRelay) On() error {
+	log.Printf("%s ON", rel.name)
+	return nil
+}
+
+func (rel *LogRelay) Off() error {
+	log.Printf("%s OFF", rel.name)
+	return nil
+}
+
+func (rel *LogRelay) SetPower(power int) error {
+	log.Printf("%s power %d%%", rel.name, power)
+	return nil
+}
+
+func (rel *LogRelay) OnStop() error {
+	return rel.Off()
+}
+
+func main() {
+	// stdout is used by the controller. Log to stderr without time as the controller adds it
+	log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+
+	err := plugin.Serve(
+		plugin.Type{
+			TypeInfo: plugin.TypeInfo{
+				Kind:        plugin.KindSensor,
+				Type:        "DummyPHMeter",
+				Description: "Simulated pH meter",
+				Properties: []plugin.Property{
+					{Name: "Units", Type: "string", Value: "pH", Comment: "Units for Sensor", Hidden: true},
+					{Name: "Start Value", Type: "float", Value: "5.4", Comment: "pH at start"},
+				},
+			},
+			New: func() interface{} { return new(PHMeter) },
+		},
+		plugin.Type{
+			TypeInfo: plugin.TypeInfo{
+				Kind:        plugin.KindActor,
+				Type:        "LogRelay",
+				Description: "Relay that logs when it is switched",
+			},
+			New: func() interface{} { return new(LogRelay) },
+		},
+	)
+	if err != nil {
+		os.Exit(1)
+	}
+}
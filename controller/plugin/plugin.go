@@ -0,0 +1,299 @@
+// Package plugin is used to write device plugins for the brewbrat controller.
+//
+// A plugin is an executable listed in the <plugins> section of the controller
+// configuration. The controller starts it and calls its devices with JSON-RPC
+// over the plugin's stdin and stdout. Plugins must not write anything else to
+// stdout; use stderr for logging, it is copied to the controller log.
+//
+//	func main() {
+//		plugin.Serve(plugin.Type{
+//			TypeInfo: plugin.TypeInfo{Kind: plugin.KindSensor, Type: "PHMeter", Description: "Serial pH meter"},
+//			New:      func() interface{} { return new(PHMeter) },
+//		})
+//	}
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync"
+)
+
+// ServiceName is the name of the RPC service of a plugin. Methods are called as "Plugin.<Method>"
+const ServiceName = "Plugin"
+
+// Kinds of devices a plugin can provide
+const (
+	KindSensor = "sensor"
+	KindActor  = "actor"
+)
+
+// Property is a configuration property of a device type.
+// Type is one of string, int, uint, float or bool. Select is a comma separated list of choices
+type Property struct {
+	Name    string
+	Type    string
+	Value   string
+	Comment string
+	Select  string
+	Hidden  bool
+}
+
+// TypeInfo describes a device type provided by a plugin
+type TypeInfo struct {
+	Kind        string
+	Type        string
+	Description string
+	Properties  []Property
+}
+
+// Sensor is implemented by sensor devices of a plugin.
+// properties holds the configured values of the device by property name
+type Sensor interface {
+	Init(name string, properties map[string]string) error
+	OnStart() error
+	OnRead() (float64, error)
+	OnStop() error
+}
+
+// Actor is implemented by actor devices of a plugin
+type Actor interface {
+	Init(name string, properties map[string]string) error
+	OnStart() error
+	On() error
+	Off() error
+	SetPower(power int) error
+	OnStop() error
+}
+
+// Type is a device type served by a plugin. New returns a new Sensor or Actor matching Kind
+type Type struct {
+	TypeInfo
+	New func() interface{}
+}
+
+// Empty is used for RPC calls without arguments or reply
+type Empty struct{}
+
+// DescribeReply lists the device types of a plugin
+type DescribeReply struct {
+	Types []TypeInfo
+}
+
+// InitArgs creates device Name of Type
+type InitArgs struct {
+	Type       string
+	Name       string
+	Properties map[string]string
+}
+
+// DeviceArgs selects a device created with Init
+type DeviceArgs struct {
+	Name string
+}
+
+// ReadReply is the value read from a sensor
+type ReadReply struct {
+	Value float64
+}
+
+// PowerArgs sets power level 0-100 of an actor
+type PowerArgs struct {
+	Name  string
+	Power int
+}
+
+// HealthReply is returned by the health check of the controller
+type HealthReply struct {
+	Devices int
+}
+
+// Service is the RPC service of a plugin. Use Serve() to run it
+type Service struct {
+	mu      sync.Mutex
+	types   map[string]Type
+	order   []string
+	devices map[string]interface{}
+}
+
+// NewService returns a service for types
+func NewService(types ...Type) (*Service, error) {
+	svc := &Service{types: make(map[string]Type), devices: make(map[string]interface{})}
+	for _, t := range types {
+		if t.Kind != KindSensor && t.Kind != KindActor {
+			return nil, fmt.Errorf("device type '%s' has unknown kind '%s'", t.Type, t.Kind)
+		}
+		if t.Type == "" || t.New == nil {
+			return nil, fmt.Errorf("device type of kind '%s' needs a name and New()", t.Kind)
+		}
+		if _, ok := svc.types[t.Type]; ok {
+			return nil, fmt.Errorf("device type '%s' is defined more than once", t.Type)
+		}
+		svc.types[t.Type] = t
+		svc.order = append(svc.order, t.Type)
+	}
+	return svc, nil
+}
+
+// Describe returns the device types of plugin
+func (svc *Service) Describe(args Empty, reply *DescribeReply) error {
+	for _, name := range svc.order {
+		reply.Types = append(reply.Types, svc.types[name].TypeInfo)
+	}
+	return nil
+}
+
+// Init creates a device. A device already created with the same name is replaced
+func (svc *Service) Init(args InitArgs, reply *Empty) error {
+	t, ok := svc.types[args.Type]
+	if !ok {
+		return fmt.Errorf("unknown device type '%s'", args.Type)
+	}
+	dev := t.New()
+	var err error
+	switch d := dev.(type) {
+	case Sensor:
+		err = d.Init(args.Name, args.Properties)
+	case Actor:
+		err = d.Init(args.Name, args.Properties)
+	default:
+		return fmt.Errorf("device type '%s' is not a sensor or actor", args.Type)
+	}
+	if err != nil {
+		return err
+	}
+	svc.mu.Lock()
+	svc.devices[args.Name] = dev
+	svc.mu.Unlock()
+	return nil
+}
+
+func (svc *Service) device(name string) (interface{}, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	dev, ok := svc.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown device '%s'", name)
+	}
+	return dev, nil
+}
+
+func (svc *Service) sensor(name string) (Sensor, error) {
+	dev, err := svc.device(name)
+	if err != nil {
+		return nil, err
+	}
+	sen, ok := dev.(Sensor)
+	if !ok {
+		return nil, fmt.Errorf("device '%s' is not a sensor", name)
+	}
+	return sen, nil
+}
+
+func (svc *Service) actor(name string) (Actor, error) {
+	dev, err := svc.device(name)
+	if err != nil {
+		return nil, err
+	}
+	act, ok := dev.(Actor)
+	if !ok {
+		return nil, fmt.Errorf("device '%s' is not an actor", name)
+	}
+	return act, nil
+}
+
+// OnStart starts a device
+func (svc *Service) OnStart(args DeviceArgs, reply *Empty) error {
+	dev, err := svc.device(args.Name)
+	if err != nil {
+		return err
+	}
+	return dev.(interface{ OnStart() error }).OnStart()
+}
+
+// OnStop stops a device
+func (svc *Service) OnStop(args DeviceArgs, reply *Empty) error {
+	dev, err := svc.device(args.Name)
+	if err != nil {
+		return err
+	}
+	return dev.(interface{ OnStop() error }).OnStop()
+}
+
+// OnRead reads the value of a sensor
+func (svc *Service) OnRead(args DeviceArgs, reply *ReadReply) error {
+	sen, err := svc.sensor(args.Name)
+	if err != nil {
+		return err
+	}
+	reply.Value, err = sen.OnRead()
+	return err
+}
+
+// On turns an actor on
+func (svc *Service) On(args DeviceArgs, reply *Empty) error {
+	act, err := svc.actor(args.Name)
+	if err != nil {
+		return err
+	}
+	return act.On()
+}
+
+// Off turns an actor off
+func (svc *Service) Off(args DeviceArgs, reply *Empty) error {
+	act, err := svc.actor(args.Name)
+	if err != nil {
+		return err
+	}
+	return act.Off()
+}
+
+// SetPower sets power level of an actor
+func (svc *Service) SetPower(args PowerArgs, reply *Empty) error {
+	act, err := svc.actor(args.Name)
+	if err != nil {
+		return err
+	}
+	return act.SetPower(args.Power)
+}
+
+// Health is called periodically by the controller. A plugin not answering is restarted
+func (svc *Service) Health(args Empty, reply *HealthReply) error {
+	svc.mu.Lock()
+	reply.Devices = len(svc.devices)
+	svc.mu.Unlock()
+	return nil
+}
+
+// stdio joins stdin and stdout of the plugin process
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error {
+	return os.Stdin.Close()
+}
+
+// Serve answers calls of the controller on stdin and stdout until the controller closes stdin
+func Serve(types ...Type) error {
+	svc, err := NewService(types...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	return ServeConn(svc, stdio{os.Stdin, os.Stdout})
+}
+
+// ServeConn answers calls to svc on conn until it is closed
+func ServeConn(svc *Service, conn io.ReadWriteCloser) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(ServiceName, svc); err != nil {
+		return err
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
@@ -0,0 +1,375 @@
+// Package api defines JSON messages shared by the web server and the WASM client
+package api
+
+import "strings"
+
+// Actor states
+const (
+	StateOn  = "ON"
+	StateOff = "OFF"
+)
+
+// Actor modes. Manual actors are not switched by equipment
+const (
+	ActorAuto   = "auto"
+	ActorManual = "manual"
+)
+
+// Equipment states
+const (
+	EquipmentIdle   = "Idle"
+	EquipmentActive = "Active"
+)
+
+// Temperature units of sensors
+const (
+	UnitsFahrenheit = "°F"
+	UnitsCelsius    = "°C"
+)
+
+// TemperatureUnits returns UnitsFahrenheit or UnitsCelsius for units written as "°F", "F" or "f",
+// or "°C", "C" or "c". Returns false for other units
+func TemperatureUnits(units string) (string, bool) {
+	switch strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(units), "°")) {
+	case "F":
+		return UnitsFahrenheit, true
+	case "C":
+		return UnitsCelsius, true
+	}
+	return units, false
+}
+
+// Sensor is a sensor and its latest reading
+type Sensor struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type"`
+	Units string  `json:"units"`
+	Value float64 `json:"value"`
+	Valid bool    `json:"valid"`
+}
+
+// Actor is a relay, SSR or any on/off device
+type Actor struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	State        string `json:"state"`
+	Power        int    `json:"power"`
+	PowerControl bool   `json:"powerControl"`
+	Mode         string `json:"mode"`
+	// Until is the time in ms a manual override ends, 0 if it does not expire
+	Until int64 `json:"until,omitempty"`
+}
+
+// Equipment is a kettle, mash tun, etc. with names of the devices it uses
+type Equipment struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Sensor   string  `json:"sensor"`
+	Heater   string  `json:"heater"`
+	Pump     string  `json:"pump"`
+	Agitator string  `json:"agitator"`
+	Setpoint float64 `json:"setpoint"`
+	State    string  `json:"state"`
+	Mode     string  `json:"mode"`
+	// Autotune is the state of the last auto-tune, "idle" if it never ran
+	Autotune string `json:"autotune"`
+	// HeatUp is the estimated time to reach the setpoint, nil when it can not be estimated
+	HeatUp *HeatUp `json:"heatUp,omitempty"`
+}
+
+// Heat-up rate sources. Observed rates are measured from history while the heater was on;
+// model rates come from heater watts and equipment volume
+const (
+	HeatRateObserved = "observed"
+	HeatRateModel    = "model"
+)
+
+// HeatUp is the estimated time for equipment to heat from Temperature to Setpoint at full heater power.
+// Rate is degrees per minute. Ready is Unix time in ms the setpoint is reached and Text reads like
+// "ready in 23 min" or "at setpoint"
+type HeatUp struct {
+	Temperature float64 `json:"temperature"`
+	Setpoint    float64 `json:"setpoint"`
+	Rate        float64 `json:"rate"`
+	Source      string  `json:"source"`
+	Seconds     float64 `json:"seconds"`
+	Ready       int64   `json:"ready"`
+	Text        string  `json:"text"`
+}
+
+// ScheduleStep is a rest at Temperature for Minutes. HeatSeconds is the estimated time to heat
+// to the step; Start and End are Unix time in ms of the rest
+type ScheduleStep struct {
+	Temperature float64 `json:"temperature"`
+	Minutes     float64 `json:"minutes"`
+	HeatSeconds float64 `json:"heatSeconds"`
+	Start       int64   `json:"start"`
+	End         int64   `json:"end"`
+}
+
+// ScheduleETA is the estimated time of a mash schedule started now at Temperature, heating at Rate
+// degrees per minute. Done is Unix time in ms the last step ends
+type ScheduleETA struct {
+	Temperature float64        `json:"temperature"`
+	Rate        float64        `json:"rate"`
+	Source      string         `json:"source"`
+	Steps       []ScheduleStep `json:"steps"`
+	Seconds     float64        `json:"seconds"`
+	Done        int64          `json:"done"`
+	Text        string         `json:"text"`
+}
+
+// States of a timed action
+const (
+	TimerPending = "pending"
+	TimerDone    = "done"
+	TimerMissed  = "missed"
+	TimerFailed  = "failed"
+)
+
+// Timer is an action run on equipment at a time, such as setting the HLT to 168 and activating it at 06:00.
+// At is Unix time in ms the action runs. With ReadyBy instead, the action runs early enough for the
+// equipment to reach Setpoint by then; Start is the estimated start, updated while pending, and Rate
+// the degrees per minute used when the heating rate is not known at the time. Setpoint is left
+// unchanged when nil. Run is Unix time in ms the action ran
+type Timer struct {
+	ID        int      `json:"id"`
+	Equipment string   `json:"equipment"`
+	Setpoint  *float64 `json:"setpoint,omitempty"`
+	State     string   `json:"state"`
+	At        int64    `json:"at,omitempty"`
+	ReadyBy   int64    `json:"readyBy,omitempty"`
+	Start     int64    `json:"start"`
+	Rate      float64  `json:"rate,omitempty"`
+	Status    string   `json:"status"`
+	Run       int64    `json:"run,omitempty"`
+	Message   string   `json:"message,omitempty"`
+}
+
+// TimerRequest adds a Timer. At or ReadyBy is a time of day "06:00", meaning its next occurrence,
+// or a date and time in RFC 3339. State is "Active" or "Idle" and defaults to "Active"
+type TimerRequest struct {
+	Equipment string   `json:"equipment"`
+	Setpoint  *float64 `json:"setpoint,omitempty"`
+	State     string   `json:"state,omitempty"`
+	At        string   `json:"at,omitempty"`
+	ReadyBy   string   `json:"readyBy,omitempty"`
+}
+
+// Alarm conditions
+const (
+	AlarmOutOfBand    = "out-of-band"   // equipment temperature left the "Alarm Band" around its setpoint
+	AlarmSensorFault  = "sensor-fault"  // sensor sent no reading for "Alarm Sensor Timeout" seconds
+	AlarmStepComplete = "step-complete" // equipment reached its setpoint
+	AlarmBoilOver     = "boil-over"     // heater is on above "Boil Over Temperature"
+	AlarmInterlock    = "interlock"     // heater is blocked because the pump is off while its policy wants it on
+)
+
+// Alarm severities. Each has its own buzzer sound; warning and critical alarms repeat until acknowledged
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alarm is an alarm Condition of device Source. Raised, Cleared and Acknowledged are Unix time in ms,
+// 0 until it happens. Active is false once the condition is cleared. Sounded counts the times the
+// alarm was sent to the buzzer
+type Alarm struct {
+	ID           int    `json:"id"`
+	Source       string `json:"source"`
+	Condition    string `json:"condition"`
+	Severity     string `json:"severity"`
+	Message      string `json:"message"`
+	Active       bool   `json:"active"`
+	Raised       int64  `json:"raised"`
+	Cleared      int64  `json:"cleared,omitempty"`
+	Acknowledged int64  `json:"acknowledged,omitempty"`
+	Sounded      int    `json:"sounded"`
+}
+
+// Alarms are the current alarms, kept until they are cleared and acknowledged, and the history of
+// alarms that ended, newest first
+type Alarms struct {
+	Current []Alarm `json:"current"`
+	History []Alarm `json:"history"`
+}
+
+// Status is the inventory of all devices and their current values.
+// Devices are listed in configuration order. Alarms are the current alarms
+type Status struct {
+	Name      string      `json:"name"`
+	Sensors   []Sensor    `json:"sensors"`
+	Actors    []Actor     `json:"actors"`
+	Equipment []Equipment `json:"equipment"`
+	Alarms    []Alarm     `json:"alarms"`
+}
+
+// HistoryPoint is one sample of equipment temperature, setpoint and heater power.
+// Time is Unix time in milliseconds. Heater is 0 when off and 100 when on unless
+// the heater accepts a power level.
+type HistoryPoint struct {
+	Time        int64   `json:"time"`
+	Temperature float64 `json:"temperature"`
+	Valid       bool    `json:"valid"`
+	Setpoint    float64 `json:"setpoint"`
+	Heater      int     `json:"heater"`
+	Active      bool    `json:"active"`
+}
+
+// History is the recorded samples of one equipment between From and To (Unix time in milliseconds).
+// PowerOn and PowerOff are the hysteresis bands below the setpoint when equipment uses them.
+type History struct {
+	Name     string         `json:"name"`
+	Units    string         `json:"units"`
+	From     int64          `json:"from"`
+	To       int64          `json:"to"`
+	Interval int            `json:"interval"`
+	PowerOn  float64        `json:"powerOn,omitempty"`
+	PowerOff float64        `json:"powerOff,omitempty"`
+	Points   []HistoryPoint `json:"points"`
+}
+
+// LogEntry is a controller log message. Time is Unix time in milliseconds.
+// Level is debug, message, warning, pass, fail or error. Device is empty for controller messages.
+// Kind is the kind of the source: sensor, actor, equipment, buzzer, plugin or controller
+type LogEntry struct {
+	ID      uint64 `json:"id"`
+	Time    int64  `json:"time"`
+	Level   string `json:"level"`
+	Device  string `json:"device,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message"`
+}
+
+// Log is a page of log entries, oldest first. Last is the ID of the newest message
+// in the log, also when it is filtered out; pass it as "after" to read only newer entries.
+type Log struct {
+	Entries []LogEntry `json:"entries"`
+	Last    uint64     `json:"last"`
+}
+
+// LogLevels is the minimum level (debug, message, warning or error) of log messages.
+// Devices and Kinds override Default for a device or for all devices of a kind;
+// a device level takes precedence over the level of its kind.
+type LogLevels struct {
+	Default string            `json:"default"`
+	Devices map[string]string `json:"devices"`
+	Kinds   map[string]string `json:"kinds"`
+}
+
+// UsageCounters are switch cycles, seconds on and energy in kWh of an actor.
+// Cost is energy times the "Energy Price" of the controller and 0 without a price
+type UsageCounters struct {
+	Cycles int64   `json:"cycles"`
+	OnTime float64 `json:"onTime"`
+	Energy float64 `json:"energy"`
+	Cost   float64 `json:"cost,omitempty"`
+}
+
+// ActorUsage is the usage of an actor since tracking started and in the current batch.
+// Duty is percent of time on in the last "10m", "1h" and "24h" while the controller was running
+type ActorUsage struct {
+	Name  string             `json:"name"`
+	Watts float64            `json:"watts"`
+	Total UsageCounters      `json:"total"`
+	Batch UsageCounters      `json:"batch"`
+	Duty  map[string]float64 `json:"duty,omitempty"`
+}
+
+// Usage is the wear and energy use of all actors. Since and BatchStart are Unix time in milliseconds
+type Usage struct {
+	Since      int64        `json:"since"`
+	BatchStart int64        `json:"batchStart"`
+	Price      float64      `json:"price,omitempty"`
+	Actors     []ActorUsage `json:"actors"`
+}
+
+// Auto-tune states of equipment
+const (
+	AutotuneIdle    = "idle"
+	AutotuneRunning = "running"
+	AutotuneDone    = "done"
+	AutotuneFailed  = "failed"
+	AutotuneStopped = "stopped"
+)
+
+// Autotune is the relay auto-tune experiment of equipment. Started is Unix time in ms.
+// Amplitude is half the peak to peak temperature swing and Period is seconds of one oscillation.
+// Kp, Ki and Kd are the suggested PID gains once State is "done"; Saved is true when they were
+// written to the configuration file
+type Autotune struct {
+	Equipment string  `json:"equipment"`
+	State     string  `json:"state"`
+	Setpoint  float64 `json:"setpoint"`
+	Band      float64 `json:"band"`
+	Started   int64   `json:"started,omitempty"`
+	Cycles    int     `json:"cycles"`
+	Wanted    int     `json:"wanted"`
+	Amplitude float64 `json:"amplitude,omitempty"`
+	Period    float64 `json:"period,omitempty"`
+	Kp        float64 `json:"kp,omitempty"`
+	Ki        float64 `json:"ki,omitempty"`
+	Kd        float64 `json:"kd,omitempty"`
+	Save      bool    `json:"save"`
+	Saved     bool    `json:"saved"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Device classes of the configuration editor
+const (
+	ClassSensor    = "sensor"
+	ClassActor     = "actor"
+	ClassEquipment = "equipment"
+	ClassBuzzer    = "buzzer"
+)
+
+// Select lists that are replaced by the names of configured sensors or actors
+const (
+	SelectSensors = "$sensors"
+	SelectActors  = "$actors"
+)
+
+// Property is a device property with the metadata used to build editor forms.
+// When Select is not empty Value must be one of the listed values.
+type Property struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Hidden  bool     `json:"hidden"`
+	Comment string   `json:"comment"`
+	Select  []string `json:"select,omitempty"`
+	Value   string   `json:"value"`
+}
+
+// DeviceConfig is a configured device
+type DeviceConfig struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Properties []Property `json:"properties"`
+}
+
+// DeviceType is a registered device type and its default properties
+type DeviceType struct {
+	Class       string     `json:"class"`
+	Type        string     `json:"type"`
+	Description string     `json:"description"`
+	Properties  []Property `json:"properties"`
+}
+
+// Configuration is the devices of the configuration file edited in the web UI.
+// Types is only sent by the server.
+type Configuration struct {
+	Sensors   []DeviceConfig `json:"sensors"`
+	Actors    []DeviceConfig `json:"actors"`
+	Equipment []DeviceConfig `json:"equipment"`
+	Buzzers   []DeviceConfig `json:"buzzers"`
+	Types     []DeviceType   `json:"types,omitempty"`
+}
+
+// ConfigResult is the reply to a saved configuration.
+// Restart is true when the controller restarts to apply the configuration.
+type ConfigResult struct {
+	Errors  []string `json:"errors,omitempty"`
+	Saved   bool     `json:"saved"`
+	Restart bool     `json:"restart"`
+}
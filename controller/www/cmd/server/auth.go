@@ -0,0 +1,380 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is the access level of a user. Each role includes the rights of the roles below it.
+type Role int
+
+// Roles checked by the web server
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleOperator
+	RoleAdmin
+)
+
+const (
+	sessionCookie = "brewbrat_session"
+	sessionLength = 12 * time.Hour
+	// a user name or client address is refused after loginMaxFailures failed logins
+	// until loginLockout after the first of them
+	loginMaxFailures = 5
+	loginLockout     = 15 * time.Minute
+)
+
+// User is allowed to access web server.
+// PasswordHash is bcrypt hash of password and TokenHash is sha256 hash of API token.
+type User struct {
+	Name         string
+	Role         Role
+	PasswordHash string
+	TokenHash    string
+}
+
+// ParseRole converts "viewer", "operator" or "admin" to Role
+func ParseRole(name string) Role {
+	switch strings.ToLower(name) {
+	case "viewer":
+		return RoleViewer
+	case "operator":
+		return RoleOperator
+	case "admin":
+		return RoleAdmin
+	}
+	return RoleNone
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// HashPassword returns bcrypt hash of password to be stored in configuration
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// HashToken returns sha256 hash of API token to be stored in configuration
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken returns a random API token
+func NewToken() (string, error) {
+	return randomString(32)
+}
+
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+type session struct {
+	user    User
+	expires time.Time
+}
+
+// loginFailures counts failed logins of a user name or client address since first
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+// authenticator checks requests against configured users and login sessions
+type authenticator struct {
+	enabled  bool
+	origins  map[string]bool
+	users    map[string]User
+	mu       sync.Mutex
+	sessions map[string]session
+	failures map[string]loginFailures
+}
+
+func newAuthenticator(opts Options) *authenticator {
+	auth := authenticator{
+		enabled:  opts.AuthEnabled,
+		origins:  make(map[string]bool),
+		users:    make(map[string]User),
+		sessions: make(map[string]session),
+		failures: make(map[string]loginFailures),
+	}
+	for _, origin := range opts.Origins {
+		auth.origins[strings.TrimSuffix(strings.TrimSpace(origin), "/")] = true
+	}
+	for _, user := range opts.Users {
+		auth.users[user.Name] = user
+	}
+	return &auth
+}
+
+// cors allows cross origin requests only from configured origins.
+// Origin "*" allows any site but without cookies or basic authentication, so other sites cannot
+// use the session of a logged in user
+func (auth *authenticator) cors(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	switch {
+	case auth.origins[origin]:
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	case auth.origins["*"]:
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	default:
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+}
+
+// authenticate returns user sending request from API token, session cookie or basic authentication
+func (auth *authenticator) authenticate(r *http.Request) (User, bool) {
+	if !auth.enabled {
+		return User{Name: "anonymous", Role: RoleAdmin}, true
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		hash := HashToken(strings.TrimPrefix(header, "Bearer "))
+		for _, user := range auth.users {
+			if user.TokenHash != "" && subtle.ConstantTimeCompare([]byte(user.TokenHash), []byte(hash)) == 1 {
+				return user, true
+			}
+		}
+		return User{}, false
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		auth.mu.Lock()
+		defer auth.mu.Unlock()
+		if s, ok := auth.sessions[cookie.Value]; ok {
+			if time.Now().Before(s.expires) {
+				return s.user, true
+			}
+			delete(auth.sessions, cookie.Value)
+		}
+		return User{}, false
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		return auth.checkPassword(name, password)
+	}
+	return User{}, false
+}
+
+func (auth *authenticator) checkPassword(name string, password string) (User, bool) {
+	user, ok := auth.users[name]
+	if !ok || user.PasswordHash == "" {
+		return User{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+// sameSite returns false for requests changing state that a browser sends from another site,
+// e.g. a form or image of a web page. Browsers send cookies and cached basic authentication
+// with them, so they are refused unless the site is a configured origin. API token requests
+// are not sent by browsers on their own and are always allowed.
+func (auth *authenticator) sameSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return origin == "" && r.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return auth.origins[origin] || (!auth.enabled && auth.origins["*"])
+}
+
+// require wraps handler so it is only called for users with at least role
+func (auth *authenticator) require(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth.cors(w, r)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !auth.sameSite(r) {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+
+		user, ok := auth.authenticate(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user.Role < role {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// clientAddress returns IP address of client sending request
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sweep removes expired sessions and failed logins older than loginLockout. Call with mu locked
+func (auth *authenticator) sweep(now time.Time) {
+	for id, s := range auth.sessions {
+		if !now.Before(s.expires) {
+			delete(auth.sessions, id)
+		}
+	}
+	for key, f := range auth.failures {
+		if !now.Before(f.first.Add(loginLockout)) {
+			delete(auth.failures, key)
+		}
+	}
+}
+
+// lockedOut returns how long logins with keys are refused after too many failures. Call with mu locked
+func (auth *authenticator) lockedOut(now time.Time, keys ...string) time.Duration {
+	wait := time.Duration(0)
+	for _, key := range keys {
+		if f := auth.failures[key]; f.count >= loginMaxFailures {
+			if left := f.first.Add(loginLockout).Sub(now); left > wait {
+				wait = left
+			}
+		}
+	}
+	return wait
+}
+
+// login handles route /login. Expects form values "name" and "password".
+// Failed logins are counted for the user name and the client address, see loginMaxFailures
+func (auth *authenticator) login(w http.ResponseWriter, r *http.Request) {
+	auth.cors(w, r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !auth.sameSite(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+
+	name := r.FormValue("name")
+	keys := []string{"user:" + name, "address:" + clientAddress(r)}
+	now := time.Now()
+	auth.mu.Lock()
+	auth.sweep(now)
+	wait := auth.lockedOut(now, keys...)
+	auth.mu.Unlock()
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+0.5)))
+		http.Error(w, "too many failed logins", http.StatusTooManyRequests)
+		return
+	}
+
+	user, ok := auth.checkPassword(name, r.FormValue("password"))
+	if !ok {
+		auth.mu.Lock()
+		for _, key := range keys {
+			f := auth.failures[key]
+			if f.count == 0 {
+				f.first = now
+			}
+			f.count++
+			auth.failures[key] = f
+		}
+		auth.mu.Unlock()
+		http.Error(w, "invalid name or password", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := randomString(32)
+	if err != nil {
+		http.Error(w, "unable to create session", http.StatusInternalServerError)
+		return
+	}
+	expires := now.Add(sessionLength)
+	auth.mu.Lock()
+	for _, key := range keys {
+		delete(auth.failures, key)
+	}
+	auth.sessions[id] = session{user: user, expires: expires}
+	auth.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	auth.writeUser(w, user)
+}
+
+// logout handles route /logout
+func (auth *authenticator) logout(w http.ResponseWriter, r *http.Request) {
+	auth.cors(w, r)
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		auth.mu.Lock()
+		delete(auth.sessions, cookie.Value)
+		auth.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusOK)
+}
+
+// whoami handles route /whoami and returns name and role of logged in user
+func (auth *authenticator) whoami(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.authenticate(r)
+	auth.writeUser(w, user)
+}
+
+func (auth *authenticator) writeUser(w http.ResponseWriter, user User) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}{user.Name, user.Role.String()})
+}
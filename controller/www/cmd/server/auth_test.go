@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		origin      string
+		allow       string
+		credentials string
+	}{
+		{[]string{"https://brew.example"}, "https://brew.example", "https://brew.example", "true"},
+		{[]string{"https://brew.example"}, "https://evil.example", "", ""},
+		{[]string{"*"}, "https://evil.example", "*", ""},
+		{[]string{"*", "https://brew.example"}, "https://brew.example", "https://brew.example", "true"},
+	}
+	for _, test := range tests {
+		auth := newAuthenticator(Options{AuthEnabled: true, Origins: test.origins})
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		r.Header.Set("Origin", test.origin)
+		w := httptest.NewRecorder()
+		auth.cors(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("origins %v allow %s = %q, want %q", test.origins, test.origin, got, test.allow)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != test.credentials {
+			t.Errorf("origins %v credentials for %s = %q, want %q", test.origins, test.origin, got, test.credentials)
+		}
+	}
+}
+
+func TestCrossSiteRequests(t *testing.T) {
+	hash, err := HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newAuthenticator(Options{
+		AuthEnabled: true,
+		Users:       []User{{Name: "brewer", Role: RoleOperator, PasswordHash: hash, TokenHash: HashToken("token")}},
+		Origins:     []string{"*", "https://brew.example"},
+	})
+	handler := auth.require(RoleOperator, func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		method string
+		header map[string]string
+		bearer bool
+		want   int
+	}{
+		{http.MethodPost, nil, false, http.StatusOK},
+		{http.MethodPost, map[string]string{"Origin": "http://brewbrat.local"}, false, http.StatusOK},
+		{http.MethodPost, map[string]string{"Origin": "https://brew.example"}, false, http.StatusOK},
+		{http.MethodPost, map[string]string{"Origin": "https://evil.example"}, false, http.StatusForbidden},
+		{http.MethodPost, map[string]string{"Origin": "null"}, false, http.StatusForbidden},
+		{http.MethodPost, map[string]string{"Sec-Fetch-Site": "cross-site"}, false, http.StatusForbidden},
+		{http.MethodPost, map[string]string{"Origin": "https://evil.example"}, true, http.StatusOK},
+		{http.MethodGet, map[string]string{"Origin": "https://evil.example"}, false, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "http://brewbrat.local/setactor/Pump/ON", nil)
+		if test.bearer {
+			r.Header.Set("Authorization", "Bearer token")
+		} else {
+			r.SetBasicAuth("brewer", "pw")
+		}
+		for name, value := range test.header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s with %v, bearer %t = %d, want %d", test.method, test.header, test.bearer, w.Code, test.want)
+		}
+	}
+}
+
+// loginRequest returns a login form post of name and password from client address
+func loginRequest(name string, password string, address string) *http.Request {
+	form := url.Values{"name": {name}, "password": {password}}
+	r := httptest.NewRequest(http.MethodPost, "http://brewbrat.local/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = address + ":40000"
+	return r
+}
+
+func TestLogin(t *testing.T) {
+	hash, err := HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newAuthenticator(Options{
+		AuthEnabled: true,
+		Users:       []User{{Name: "brewer", Role: RoleOperator, PasswordHash: hash}, {Name: "viewer", Role: RoleViewer, PasswordHash: hash}},
+	})
+	login := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		auth.login(w, r)
+		return w
+	}
+
+	// a login form of another site is refused
+	r := loginRequest("brewer", "pw", "10.0.0.2")
+	r.Header.Set("Origin", "https://evil.example")
+	if w := login(r); w.Code != http.StatusForbidden {
+		t.Errorf("cross-site login = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// expired sessions are removed at the next login
+	auth.sessions["old"] = session{user: User{Name: "brewer"}, expires: time.Now().Add(-time.Minute)}
+	w := login(loginRequest("brewer", "pw", "10.0.0.2"))
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("login = %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	if _, ok := auth.sessions["old"]; ok || len(auth.sessions) != 1 {
+		t.Errorf("sessions %v, want only the new one", auth.sessions)
+	}
+
+	// failed logins lock out the user name and the client address
+	for i := 0; i < loginMaxFailures; i++ {
+		if w := login(loginRequest("brewer", "wrong", "10.0.0.3")); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d = %d", i+1, w.Code)
+		}
+	}
+	w = login(loginRequest("brewer", "pw", "10.0.0.4"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("login of locked out user = %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := login(loginRequest("viewer", "pw", "10.0.0.3")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("login from locked out address = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := login(loginRequest("viewer", "pw", "10.0.0.4")); w.Code != http.StatusOK {
+		t.Errorf("login of other user from other address = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// the lockout ends loginLockout after the first failure
+	for key, f := range auth.failures {
+		f.first = f.first.Add(-loginLockout)
+		auth.failures[key] = f
+	}
+	if w := login(loginRequest("brewer", "pw", "10.0.0.3")); w.Code != http.StatusOK {
+		t.Errorf("login after lockout = %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(auth.failures) != 0 {
+		t.Errorf("failures %v kept after lockout", auth.failures)
+	}
+}
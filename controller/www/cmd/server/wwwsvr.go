@@ -1,11 +1,18 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gigatropolis/brewbrat/controller/www/api"
 	"github.com/gorilla/mux"
 )
 
@@ -19,6 +26,25 @@ const (
 	CmdGetActorValue
 	CmdGetSetpointValue
 	CmdSetSetpointValue
+	CmdSetEquipmentState
+	CmdGetStatus
+	CmdGetHistory
+	CmdGetConfig
+	CmdSetConfig
+	CmdGetLog
+	CmdGetLogLevels
+	CmdSetLogLevel
+	CmdGetUsage
+	CmdNewBatch
+	CmdGetAutotune
+	CmdStartAutotune
+	CmdStopAutotune
+	CmdGetHeatUp
+	CmdGetTimers
+	CmdAddTimer
+	CmdCancelTimer
+	CmdGetAlarms
+	CmdAckAlarm
 )
 
 type ServerCommand struct {
@@ -29,29 +55,49 @@ type ServerCommand struct {
 	ChanReturn    chan string
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+// Options used to setup web server
+type Options struct {
+	// Address to listen on. Empty or "0.0.0.0" listens on all interfaces
+	Address string
+	Port    int
+	// Assets are the web UI files embedded in the binary
+	Assets fs.FS
+	// AssetDir overrides Assets with files from a directory. Used for UI development
+	AssetDir string
+	// TLSCert and TLSKey are certificate and key files. Serves https when both are set
+	TLSCert string
+	TLSKey  string
+	// AuthEnabled requires users to log in or send an API token
+	AuthEnabled bool
+	Users       []User
+	// Origins allowed for cross origin requests. "*" allows any origin without credentials
+	Origins []string
 }
 
-// setActor handles route /setactor/{name}/{cmd}
+// setActor handles route /setactor/{name}/{cmd}. cmd ON or OFF puts the actor in manual mode,
+// for ?minutes=<n> minutes if given. AUTO returns it to its equipment
 func setActor(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	vars := mux.Vars(r)
 	fmt.Printf("setActor('%s')=%s", vars["name"], vars["cmd"])
-	w.WriteHeader(http.StatusOK)
 
+	value := vars["cmd"]
+	if minutes := r.URL.Query().Get("minutes"); minutes != "" {
+		value += ":" + minutes
+	}
 	ret := make(chan string)
-	svrChanOut <- ServerCommand{Cmd: CmdSetRelay, DeviceName: vars["name"], Value: []byte(vars["cmd"]), ChanReturn: ret}
+	svrChanOut <- ServerCommand{Cmd: CmdSetRelay, DeviceName: vars["name"], Value: []byte(value), ChanReturn: ret}
 	retValue := <-ret
+	if retValue == "bad" {
+		http.Error(w, "unknown actor command or minutes", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 
 	fmt.Printf("setActor '%s' received: %s\n", vars["name"], retValue)
 	fmt.Fprintf(w, "%s", retValue) // vars["name"], vars["cmd"])
 }
 
 func getSensorValue(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	//fmt.Println("getSensorValue()")
 	vars := mux.Vars(r)
 	w.WriteHeader(http.StatusOK)
@@ -65,7 +111,6 @@ func getSensorValue(w http.ResponseWriter, r *http.Request) {
 }
 
 func getActorValue(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	//fmt.Println("getActorValue()")
 	vars := mux.Vars(r)
 	w.WriteHeader(http.StatusOK)
@@ -80,7 +125,6 @@ func getActorValue(w http.ResponseWriter, r *http.Request) {
 
 // setActor handles route /setactor/{name}/{cmd}
 func setSetpoint(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	vars := mux.Vars(r)
 	fmt.Printf("setSetpoint('%s')=%s", vars["name"], vars["setpoint"])
 	w.WriteHeader(http.StatusOK)
@@ -95,7 +139,6 @@ func setSetpoint(w http.ResponseWriter, r *http.Request) {
 
 // setActor handles route /setactor/{name}/{cmd}
 func getSetpointValue(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	vars := mux.Vars(r)
 	w.WriteHeader(http.StatusOK)
 
@@ -107,13 +150,326 @@ func getSetpointValue(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", retValue)
 }
 
+// getStatus handles route /status and returns api.Status as JSON
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	ret := make(chan string)
+	svrChanOut <- ServerCommand{Cmd: CmdGetStatus, ChanReturn: ret}
+	retValue := <-ret
+
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// usage handles routes /usage and /usage/batch. POST to /usage/batch starts a new batch.
+// Both return api.Usage
+func usage(w http.ResponseWriter, r *http.Request) {
+	cmd := ServerCommand{Cmd: CmdGetUsage, ChanReturn: make(chan string)}
+	if r.Method == http.MethodPost {
+		cmd.Cmd = CmdNewBatch
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		http.Error(w, "unable to read usage", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// autotune handles routes /autotune/{name}, /autotune/{name}/start and /autotune/{name}/stop.
+// POST to start with query "save=true" writes the suggested PID gains to the configuration when done.
+// All return api.Autotune
+func autotune(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cmd := ServerCommand{Cmd: CmdGetAutotune, DeviceName: vars["name"], ChanReturn: make(chan string)}
+	switch vars["cmd"] {
+	case "start":
+		cmd.Cmd = CmdStartAutotune
+		if save, _ := strconv.ParseBool(r.URL.Query().Get("save")); save {
+			cmd.Value = []byte("save")
+		}
+	case "stop":
+		cmd.Cmd = CmdStopAutotune
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		http.Error(w, "unknown equipment", http.StatusNotFound)
+		return
+	}
+	if strings.HasPrefix(retValue, "error: ") {
+		http.Error(w, strings.TrimPrefix(retValue, "error: "), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// heatUp handles routes /heatup/{name}, returning api.HeatUp to the setpoint of equipment, and
+// /heatup/{name}/schedule?steps=152:60,168:10 returning api.ScheduleETA of a mash schedule of
+// <temperature>:<minutes> steps started now
+func heatUp(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cmd := ServerCommand{Cmd: CmdGetHeatUp, DeviceName: vars["name"], ChanReturn: make(chan string)}
+	if vars["schedule"] != "" {
+		steps := r.URL.Query().Get("steps")
+		if steps == "" {
+			http.Error(w, "steps of schedule are missing", http.StatusBadRequest)
+			return
+		}
+		cmd.Value = []byte(steps)
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		http.Error(w, "unknown equipment", http.StatusNotFound)
+		return
+	}
+	if strings.HasPrefix(retValue, "error: ") {
+		http.Error(w, strings.TrimPrefix(retValue, "error: "), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// setEquipmentState handles route /setstate/{name}/{state}. state is "active" or "idle"
+func setEquipmentState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	w.WriteHeader(http.StatusOK)
+
+	ret := make(chan string)
+	svrChanOut <- ServerCommand{Cmd: CmdSetEquipmentState, DeviceName: vars["name"], Value: []byte(vars["state"]), ChanReturn: ret}
+	retValue := <-ret
+
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// getHistory handles route /history/{name} and returns api.History as JSON.
+// Query is "minutes=<n>" for the last n minutes or "from=<ms>&to=<ms>" with Unix time in milliseconds
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	ret := make(chan string)
+	svrChanOut <- ServerCommand{Cmd: CmdGetHistory, DeviceName: vars["name"], Value: []byte(r.URL.RawQuery), ChanReturn: ret}
+	retValue := <-ret
+
+	if retValue == "bad" {
+		http.Error(w, "unknown equipment", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// getLog handles route /log and returns api.Log as JSON.
+// Query is "level=<debug|message|warning|error>", "device=<name>", "kind=<kind>", "after=<id>" and "max=<n>"
+func getLog(w http.ResponseWriter, r *http.Request) {
+	ret := make(chan string)
+	svrChanOut <- ServerCommand{Cmd: CmdGetLog, Value: []byte(r.URL.RawQuery), ChanReturn: ret}
+	retValue := <-ret
+
+	if retValue == "bad" {
+		http.Error(w, "log buffer is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// timers handles route /timers. GET returns the list of api.Timer, POST adds api.TimerRequest sent
+// as JSON and returns the new api.Timer. DELETE to /timers/{id} cancels a timer
+func timers(w http.ResponseWriter, r *http.Request) {
+	cmd := ServerCommand{Cmd: CmdGetTimers, ChanReturn: make(chan string)}
+	switch r.Method {
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, "unable to read timer", http.StatusBadRequest)
+			return
+		}
+		cmd.Cmd = CmdAddTimer
+		cmd.Value = body
+	case http.MethodDelete:
+		cmd.Cmd = CmdCancelTimer
+		cmd.DeviceName = mux.Vars(r)["id"]
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		if cmd.Cmd == CmdCancelTimer {
+			http.Error(w, "unknown timer", http.StatusNotFound)
+		} else {
+			http.Error(w, "unable to read timers", http.StatusInternalServerError)
+		}
+		return
+	}
+	if strings.HasPrefix(retValue, "error: ") {
+		http.Error(w, strings.TrimPrefix(retValue, "error: "), http.StatusBadRequest)
+		return
+	}
+	if cmd.Cmd == CmdCancelTimer {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// alarms handles routes /alarms, returning api.Alarms, and /alarms/{id}/ack and /alarms/ack
+// acknowledging one or all current alarms, then returning api.Alarms
+func alarms(w http.ResponseWriter, r *http.Request) {
+	cmd := ServerCommand{Cmd: CmdGetAlarms, ChanReturn: make(chan string)}
+	if r.Method == http.MethodPost {
+		cmd.Cmd = CmdAckAlarm
+		cmd.DeviceName = "0"
+		if id := mux.Vars(r)["id"]; id != "" {
+			cmd.DeviceName = id
+		}
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		http.Error(w, "unknown alarm", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// logLevel handles route /loglevel. GET returns api.LogLevels and POST sets a level with query
+// "level=<debug|message|warning|error|default>" and "device=<name>" or "kind=<kind>", then returns api.LogLevels
+func logLevel(w http.ResponseWriter, r *http.Request) {
+	cmd := ServerCommand{Cmd: CmdGetLogLevels, ChanReturn: make(chan string)}
+	if r.Method == http.MethodPost {
+		cmd.Cmd = CmdSetLogLevel
+		cmd.Value = []byte(r.URL.RawQuery)
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		http.Error(w, "unknown device, kind or level", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
+// streamLog handles route /log/stream. New entries matching the query of /log are sent as
+// server-sent events with the entry ID as event id and api.LogEntry as data.
+// The stream ends before the server write timeout; EventSource reconnects and sends
+// Last-Event-ID so the stream continues after the last entry received.
+func streamLog(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		query.Set("after", last)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", logStreamRetry.Milliseconds())
+	flusher.Flush()
+
+	ticker := time.NewTicker(logStreamPoll)
+	defer ticker.Stop()
+	end := time.After(logStreamLength)
+	for {
+		ret := make(chan string)
+		svrChanOut <- ServerCommand{Cmd: CmdGetLog, Value: []byte(query.Encode()), ChanReturn: ret}
+		retValue := <-ret
+		if retValue == "bad" {
+			return
+		}
+		page := api.Log{}
+		if err := json.Unmarshal([]byte(retValue), &page); err != nil {
+			return
+		}
+		for _, entry := range page.Entries {
+			data, _ := json.Marshal(entry)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", entry.ID, data)
+		}
+		query.Set("after", strconv.FormatUint(page.Last, 10))
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// configuration handles route /config. GET returns api.Configuration and
+// POST saves api.Configuration sent as JSON and returns api.ConfigResult
+func configuration(w http.ResponseWriter, r *http.Request) {
+	cmd := ServerCommand{Cmd: CmdGetConfig, ChanReturn: make(chan string)}
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "unable to read configuration", http.StatusBadRequest)
+			return
+		}
+		cmd.Cmd = CmdSetConfig
+		cmd.Value = body
+	}
+
+	svrChanOut <- cmd
+	retValue := <-cmd.ChanReturn
+
+	if retValue == "bad" {
+		http.Error(w, "unable to read configuration", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if cmd.Cmd == CmdSetConfig {
+		result := api.ConfigResult{}
+		if err := json.Unmarshal([]byte(retValue), &result); err != nil || len(result.Errors) > 0 {
+			status = http.StatusBadRequest
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", retValue)
+}
+
 type WebServer struct {
 	//control.Device
+	auth *authenticator
 }
 
 // setActor handles route /setactor/{name}/{cmd}
 func (wb *WebServer) setSetpoint(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
 	vars := mux.Vars(r)
 	fmt.Printf("setSetpoint('%s')=%s", vars["name"], vars["setpoint"])
 	w.WriteHeader(http.StatusOK)
@@ -126,37 +482,94 @@ func (wb *WebServer) setSetpoint(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", retValue) // vars["name"], vars["setpoint"])
 }
 
+// Server-sent log stream timing. logStreamLength must be shorter than the server WriteTimeout
+const (
+	logStreamPoll   = time.Second
+	logStreamLength = 10 * time.Second
+	logStreamRetry  = time.Second
+)
+
 type SvrChanIn chan ServerCommand
 type SvrChanOut chan ServerCommand
 
 var svrChanIn SvrChanIn
 var svrChanOut SvrChanOut
 
-func RunWebServer(in SvrChanIn, out SvrChanOut) {
+// Addr returns host:port the server listens on
+func (opts Options) Addr() string {
+	return net.JoinHostPort(opts.Address, strconv.Itoa(opts.Port))
+}
+
+// UseTLS is true when certificate and key are configured
+func (opts Options) UseTLS() bool {
+	return opts.TLSCert != "" && opts.TLSKey != ""
+}
+
+// URL returns base URL of web server
+func (opts Options) URL() string {
+	if opts.UseTLS() {
+		return "https://" + opts.Addr() + "/"
+	}
+	return "http://" + opts.Addr() + "/"
+}
+
+func RunWebServer(in SvrChanIn, out SvrChanOut, opts Options) {
 
 	svrChanIn = in
 	svrChanOut = out
-	wb := WebServer{}
+	wb := WebServer{auth: newAuthenticator(opts)}
+	auth := wb.auth
 
 	r := mux.NewRouter()
 
-	r.HandleFunc("/setactor/{name}/{cmd}", setActor)
-	r.HandleFunc("/getactor/{name}", getActorValue)
-	r.HandleFunc("/getsensor/{name}", getSensorValue)
-	r.HandleFunc("/setsetpoint/{name}/{setpoint}", wb.setSetpoint)
-	r.HandleFunc("/getsetpoint/{name}", getSetpointValue)
+	r.HandleFunc("/login", auth.login)
+	r.HandleFunc("/logout", auth.logout)
+	r.HandleFunc("/whoami", auth.require(RoleNone, auth.whoami))
+
+	r.HandleFunc("/setactor/{name}/{cmd}", auth.require(RoleOperator, setActor)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/getactor/{name}", auth.require(RoleViewer, getActorValue))
+	r.HandleFunc("/getsensor/{name}", auth.require(RoleViewer, getSensorValue))
+	r.HandleFunc("/setsetpoint/{name}/{setpoint}", auth.require(RoleOperator, wb.setSetpoint)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/getsetpoint/{name}", auth.require(RoleViewer, getSetpointValue))
+	r.HandleFunc("/setstate/{name}/{state}", auth.require(RoleOperator, setEquipmentState)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/status", auth.require(RoleViewer, getStatus))
+	r.HandleFunc("/history/{name}", auth.require(RoleViewer, getHistory))
+	r.HandleFunc("/usage", auth.require(RoleViewer, usage)).Methods(http.MethodGet)
+	r.HandleFunc("/usage/batch", auth.require(RoleOperator, usage)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/autotune/{name}", auth.require(RoleViewer, autotune)).Methods(http.MethodGet)
+	r.HandleFunc("/autotune/{name}/{cmd:start|stop}", auth.require(RoleOperator, autotune)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/heatup/{name}", auth.require(RoleViewer, heatUp))
+	r.HandleFunc("/heatup/{name}/{schedule:schedule}", auth.require(RoleViewer, heatUp))
+	r.HandleFunc("/timers", auth.require(RoleViewer, timers)).Methods(http.MethodGet)
+	r.HandleFunc("/timers", auth.require(RoleOperator, timers)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/timers/{id:[0-9]+}", auth.require(RoleOperator, timers)).Methods(http.MethodDelete, http.MethodOptions)
+	r.HandleFunc("/alarms", auth.require(RoleViewer, alarms)).Methods(http.MethodGet)
+	r.HandleFunc("/alarms/{id:[0-9]+}/ack", auth.require(RoleOperator, alarms)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/alarms/ack", auth.require(RoleOperator, alarms)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/log", auth.require(RoleViewer, getLog))
+	r.HandleFunc("/log/stream", auth.require(RoleViewer, streamLog))
+	r.HandleFunc("/loglevel", auth.require(RoleViewer, logLevel)).Methods(http.MethodGet)
+	r.HandleFunc("/loglevel", auth.require(RoleOperator, logLevel)).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/config", auth.require(RoleAdmin, configuration)).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	// This will serve files under http://localhost:8000/static/<filename>
-	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("www/assets"))))
+	assets := http.FS(opts.Assets)
+	if opts.AssetDir != "" {
+		assets = http.Dir(opts.AssetDir)
+	}
+	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(assets)))
 
 	srv := &http.Server{
 		Handler: r,
-		Addr:    "127.0.0.1:8090",
+		Addr:    opts.Addr(),
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
+	if opts.UseTLS() {
+		log.Fatal(srv.ListenAndServeTLS(opts.TLSCert, opts.TLSKey))
+	}
 	log.Fatal(srv.ListenAndServe())
 
 	/*err := http.ListenAndServe(":9090", http.FileServer(http.Dir("../../assets")))
@@ -1,8 +1,4 @@
 
-set GOOS=js
-set GOARCH=wasm
-
-go build -o ..\..\assets\json.wasm
-
-set GOOS=windows
-set GOARCH=amd64
+cd ..\..
+go generate
+cd cmd\wasm
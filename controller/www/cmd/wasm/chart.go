@@ -0,0 +1,285 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+const svgNS = "http://www.w3.org/2000/svg"
+
+// Size of chart in SVG user units. Chart is scaled to panel width by css
+const (
+	chartWidth  = 600
+	chartHeight = 240
+	chartLeft   = 45
+	chartRight  = 10
+	chartTop    = 10
+	chartBottom = 25
+)
+
+// chart plots temperature of one equipment against its setpoint and hysteresis bands
+// with heater power shaded underneath. Shows the last minutes live or a past range.
+type chart struct {
+	d       *dashboard
+	name    string
+	minutes int
+	window  js.Value
+	from    js.Value
+	to      js.Value
+	svg     js.Value
+	info    js.Value
+}
+
+func newChart(d *dashboard, panel js.Value, name string) *chart {
+	c := chart{d: d, name: name, minutes: 30}
+
+	row := d.element(panel, "div", "row chart-controls", "")
+	c.window = d.element(row, "select", "", "")
+	for _, minutes := range []int{10, 30, 60, 120, 240} {
+		option := d.element(c.window, "option", "", fmt.Sprintf("Last %d min", minutes))
+		option.Set("value", strconv.Itoa(minutes))
+		option.Set("selected", minutes == c.minutes)
+	}
+	d.onEvent(c.window, "change", func() {
+		c.minutes, _ = strconv.Atoi(c.window.Get("value").String())
+		go c.load()
+	})
+
+	row = d.element(panel, "div", "row chart-controls", "")
+	c.from = d.element(row, "input", "", "")
+	c.from.Set("type", "datetime-local")
+	c.to = d.element(row, "input", "", "")
+	c.to.Set("type", "datetime-local")
+	load := d.element(row, "div", "button", "Load")
+	d.onClick(load, func() {
+		c.minutes = 0
+		go c.load()
+	})
+	live := d.element(row, "div", "button", "Live")
+	d.onClick(live, func() {
+		c.minutes, _ = strconv.Atoi(c.window.Get("value").String())
+		go c.load()
+	})
+
+	c.svg = d.doc.Call("createElementNS", svgNS, "svg")
+	c.svg.Call("setAttribute", "viewBox", fmt.Sprintf("0 0 %d %d", chartWidth, chartHeight))
+	c.svg.Call("setAttribute", "class", "chart")
+	panel.Call("appendChild", c.svg)
+	c.info = d.element(panel, "div", "chart-info", "")
+	return &c
+}
+
+// isLive is true when chart follows the last minutes
+func (c *chart) isLive() bool {
+	return c.minutes > 0
+}
+
+// query returns history range requested by user
+func (c *chart) query() (string, error) {
+	if c.isLive() {
+		return fmt.Sprintf("minutes=%d", c.minutes), nil
+	}
+	from := inputTime(c.from)
+	to := inputTime(c.to)
+	if from == 0 {
+		return "", WebError{"Select start of time range"}
+	}
+	if to == 0 {
+		to = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	if to <= from {
+		return "", WebError{"End of time range is before start"}
+	}
+	return fmt.Sprintf("from=%d&to=%d", from, to), nil
+}
+
+// inputTime returns value of a datetime-local input as Unix time in milliseconds or 0 when empty
+func inputTime(input js.Value) int64 {
+	value := input.Get("value").String()
+	if value == "" {
+		return 0
+	}
+	ms := js.Global().Get("Date").New(value).Call("getTime").Float()
+	if math.IsNaN(ms) {
+		return 0
+	}
+	return int64(ms)
+}
+
+// load reads history from server and draws chart
+func (c *chart) load() {
+	query, err := c.query()
+	if err != nil {
+		c.info.Set("innerText", err.Error())
+		return
+	}
+	body, err := getValueFromServer(apiBase()+"history/"+url.PathEscape(c.name)+"?"+query, c.name)
+	if err != nil {
+		c.info.Set("innerText", err.Error())
+		return
+	}
+	hist := api.History{}
+	if err := json.Unmarshal([]byte(body), &hist); err != nil {
+		c.info.Set("innerText", "Unable to read history: "+err.Error())
+		return
+	}
+	c.draw(hist)
+}
+
+func (c *chart) add(tag string, class string, attrs map[string]string) js.Value {
+	el := c.d.doc.Call("createElementNS", svgNS, tag)
+	if class != "" {
+		el.Call("setAttribute", "class", class)
+	}
+	for name, value := range attrs {
+		el.Call("setAttribute", name, value)
+	}
+	c.svg.Call("appendChild", el)
+	return el
+}
+
+func (c *chart) text(x float64, y float64, anchor string, text string) {
+	el := c.add("text", "axis", map[string]string{
+		"x":           fmt.Sprintf("%.1f", x),
+		"y":           fmt.Sprintf("%.1f", y),
+		"text-anchor": anchor,
+	})
+	el.Set("textContent", text)
+}
+
+// draw replaces chart with history
+func (c *chart) draw(hist api.History) {
+	c.svg.Set("innerHTML", "")
+	bands := hist.PowerOn != 0 || hist.PowerOff != 0
+
+	// temperature range of all lines in chart
+	low, high := math.Inf(1), math.Inf(-1)
+	extend := func(value float64) {
+		low = math.Min(low, value)
+		high = math.Max(high, value)
+	}
+	for _, p := range hist.Points {
+		if p.Valid {
+			extend(p.Temperature)
+		}
+		extend(p.Setpoint)
+		if bands {
+			extend(p.Setpoint - hist.PowerOn)
+			extend(p.Setpoint - hist.PowerOff)
+		}
+	}
+	if len(hist.Points) == 0 || hist.To <= hist.From {
+		c.text(chartWidth/2, chartHeight/2, "middle", "No history for selected time")
+		c.info.Set("innerText", "")
+		return
+	}
+	pad := math.Max(1, (high-low)*0.05)
+	low, high = math.Floor(low-pad), math.Ceil(high+pad)
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	x := func(ms int64) float64 {
+		return chartLeft + float64(ms-hist.From)/float64(hist.To-hist.From)*plotWidth
+	}
+	y := func(value float64) float64 {
+		return chartTop + (high-value)/(high-low)*plotHeight
+	}
+
+	// heater power shaded from bottom of chart. Height is power level
+	for i := 0; i < len(hist.Points); {
+		power := hist.Points[i].Heater
+		j := i + 1
+		for j < len(hist.Points) && hist.Points[j].Heater == power {
+			j++
+		}
+		end := hist.Points[len(hist.Points)-1].Time
+		if j < len(hist.Points) {
+			end = hist.Points[j].Time
+		}
+		if power > 0 {
+			height := plotHeight * float64(power) / 100
+			c.add("rect", "heater", map[string]string{
+				"x":      fmt.Sprintf("%.1f", x(hist.Points[i].Time)),
+				"y":      fmt.Sprintf("%.1f", chartTop+plotHeight-height),
+				"width":  fmt.Sprintf("%.1f", math.Max(1, x(end)-x(hist.Points[i].Time))),
+				"height": fmt.Sprintf("%.1f", height),
+			})
+		}
+		i = j
+	}
+
+	// grid and axis labels
+	for i := 0; i <= 4; i++ {
+		value := low + (high-low)*float64(i)/4
+		c.add("line", "grid", map[string]string{
+			"x1": strconv.Itoa(chartLeft), "x2": strconv.Itoa(chartWidth - chartRight),
+			"y1": fmt.Sprintf("%.1f", y(value)), "y2": fmt.Sprintf("%.1f", y(value)),
+		})
+		c.text(chartLeft-4, y(value)+4, "end", fmt.Sprintf("%.0f", value))
+
+		ms := hist.From + (hist.To-hist.From)*int64(i)/4
+		c.text(x(ms), chartHeight-8, "middle", time.Unix(0, ms*int64(time.Millisecond)).Format("15:04"))
+	}
+
+	line := func(class string, value func(p api.HistoryPoint) (float64, bool)) {
+		points := strings.Builder{}
+		flush := func() {
+			if points.Len() > 0 {
+				c.add("polyline", class, map[string]string{"points": points.String()})
+				points.Reset()
+			}
+		}
+		for _, p := range hist.Points {
+			v, ok := value(p)
+			if !ok {
+				flush()
+				continue
+			}
+			fmt.Fprintf(&points, "%.1f,%.1f ", x(p.Time), y(v))
+		}
+		flush()
+	}
+
+	if bands {
+		line("band", func(p api.HistoryPoint) (float64, bool) { return p.Setpoint - hist.PowerOn, p.Active })
+		line("band", func(p api.HistoryPoint) (float64, bool) { return p.Setpoint - hist.PowerOff, p.Active })
+	}
+	line("setpoint", func(p api.HistoryPoint) (float64, bool) { return p.Setpoint, true })
+	line("temperature", func(p api.HistoryPoint) (float64, bool) { return p.Temperature, p.Valid })
+
+	c.info.Set("innerText", historySummary(hist))
+}
+
+// historySummary returns latest temperature and the largest overshoot above setpoint while equipment was active
+func historySummary(hist api.History) string {
+	last := hist.Points[len(hist.Points)-1]
+	summary := []string{}
+	if last.Valid {
+		summary = append(summary, fmt.Sprintf("Temperature %.1f%s", last.Temperature, hist.Units))
+	}
+	summary = append(summary, fmt.Sprintf("Setpoint %.1f%s", last.Setpoint, hist.Units))
+	if hist.PowerOn != 0 || hist.PowerOff != 0 {
+		summary = append(summary, fmt.Sprintf("Power On -%.1f Off -%.1f", hist.PowerOn, hist.PowerOff))
+	}
+
+	overshoot := math.Inf(-1)
+	for _, p := range hist.Points {
+		if p.Valid && p.Active {
+			overshoot = math.Max(overshoot, p.Temperature-p.Setpoint)
+		}
+	}
+	if overshoot > 0 {
+		summary = append(summary, fmt.Sprintf("Overshoot %.1f%s", overshoot, hist.Units))
+	}
+	return strings.Join(summary, "   ")
+}
@@ -0,0 +1,345 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"syscall/js"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// section is one class of devices shown by the editor
+type section struct {
+	class string
+	title string
+}
+
+var sections = []section{
+	{api.ClassSensor, "Sensors"},
+	{api.ClassActor, "Actors"},
+	{api.ClassEquipment, "Equipment"},
+	{api.ClassBuzzer, "Buzzers"},
+}
+
+// editor builds forms for all configured devices from the property metadata sent by the server
+type editor struct {
+	doc      js.Value
+	root     js.Value
+	errorBox js.Value
+	funcs    []js.Func
+	cfg      api.Configuration
+	types    map[string][]api.DeviceType
+}
+
+func newEditor(root js.Value) *editor {
+	return &editor{doc: js.Global().Get("document"), root: root}
+}
+
+// devices returns configured devices of class
+func (e *editor) devices(class string) *[]api.DeviceConfig {
+	switch class {
+	case api.ClassSensor:
+		return &e.cfg.Sensors
+	case api.ClassActor:
+		return &e.cfg.Actors
+	case api.ClassEquipment:
+		return &e.cfg.Equipment
+	}
+	return &e.cfg.Buzzers
+}
+
+// load reads configuration and device types from server
+func (e *editor) load() {
+	body, err := getValueFromServer(apiBase()+"config", "config")
+	if err != nil {
+		e.root.Set("innerText", err.Error())
+		return
+	}
+	cfg := api.Configuration{}
+	if err := json.Unmarshal([]byte(body), &cfg); err != nil {
+		e.root.Set("innerText", "Unable to read configuration: "+err.Error())
+		return
+	}
+	e.types = make(map[string][]api.DeviceType)
+	for _, t := range cfg.Types {
+		e.types[t.Class] = append(e.types[t.Class], t)
+	}
+	cfg.Types = nil
+	e.cfg = cfg
+	e.render()
+}
+
+// save sends configuration to server and shows validation errors
+func (e *editor) save() {
+	buf, err := json.Marshal(e.cfg)
+	if err != nil {
+		e.showErrors([]string{err.Error()})
+		return
+	}
+	resp, err := http.Post(apiBase()+"config", "application/json", bytes.NewReader(buf))
+	if err != nil {
+		e.showErrors([]string{"Unable to send configuration"})
+		return
+	}
+	defer resp.Body.Close()
+	if err := checkLogin(resp); err != nil {
+		e.showErrors([]string{err.Error()})
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	result := api.ConfigResult{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		e.showErrors([]string{"Unable to read reply: " + string(body)})
+		return
+	}
+	if len(result.Errors) > 0 {
+		e.showErrors(result.Errors)
+		return
+	}
+	if !result.Restart {
+		e.errorBox.Set("innerText", "Configuration saved. Restart controller to use it")
+		return
+	}
+	e.errorBox.Set("innerText", "Configuration saved. Controller is restarting...")
+	time.Sleep(5 * time.Second)
+	js.Global().Get("location").Set("href", "index.html")
+}
+
+func (e *editor) showErrors(errs []string) {
+	e.errorBox.Set("innerHTML", "")
+	for _, msg := range errs {
+		e.element(e.errorBox, "div", "", msg)
+	}
+}
+
+func (e *editor) element(parent js.Value, tag string, class string, text string) js.Value {
+	el := e.doc.Call("createElement", tag)
+	if class != "" {
+		el.Set("className", class)
+	}
+	if text != "" {
+		el.Set("innerText", text)
+	}
+	parent.Call("appendChild", el)
+	return el
+}
+
+func (e *editor) on(el js.Value, event string, handler func(value string)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		value := ""
+		if v := el.Get("value"); v.Type() == js.TypeString {
+			value = v.String()
+		}
+		if el.Get("type").String() == "checkbox" {
+			value = fmt.Sprintf("%t", el.Get("checked").Bool())
+		}
+		handler(value)
+		return nil
+	})
+	e.funcs = append(e.funcs, f)
+	el.Call("addEventListener", event, f)
+}
+
+// selectInput creates a dropdown with choices and selects value
+func (e *editor) selectInput(parent js.Value, choices []string, value string) js.Value {
+	input := e.element(parent, "select", "", "")
+	found := false
+	for _, choice := range choices {
+		text := choice
+		if text == "" {
+			text = "(none)"
+		}
+		option := e.element(input, "option", "", text)
+		option.Set("value", choice)
+		if choice == value {
+			option.Set("selected", true)
+			found = true
+		}
+	}
+	if !found {
+		option := e.element(input, "option", "", value+" (not available)")
+		option.Set("value", value)
+		option.Set("selected", true)
+	}
+	return input
+}
+
+// choices expands names of configured sensors and actors in select list
+func (e *editor) choices(selects []string) []string {
+	choices := []string{}
+	for _, choice := range selects {
+		switch choice {
+		case api.SelectSensors:
+			for _, dev := range e.cfg.Sensors {
+				choices = append(choices, dev.Name)
+			}
+		case api.SelectActors:
+			choices = append(choices, "")
+			for _, dev := range e.cfg.Actors {
+				choices = append(choices, dev.Name)
+			}
+		default:
+			choices = append(choices, choice)
+		}
+	}
+	return choices
+}
+
+// newDevice returns a device of type with default properties and a name not used by class
+func (e *editor) newDevice(class string, t api.DeviceType) api.DeviceConfig {
+	dev := api.DeviceConfig{Type: t.Type, Properties: append([]api.Property(nil), t.Properties...)}
+	for i := len(*e.devices(class)) + 1; ; i++ {
+		dev.Name = fmt.Sprintf("%s %d", t.Type, i)
+		used := false
+		for _, d := range *e.devices(class) {
+			used = used || d.Name == dev.Name
+		}
+		if !used {
+			return dev
+		}
+	}
+}
+
+// changeType replaces properties with defaults of new type keeping values of properties with the same name
+func (e *editor) changeType(class string, dev *api.DeviceConfig, devType string) {
+	for _, t := range e.types[class] {
+		if t.Type != devType {
+			continue
+		}
+		values := make(map[string]string)
+		for _, prop := range dev.Properties {
+			values[prop.Name] = prop.Value
+		}
+		dev.Type = devType
+		dev.Properties = append([]api.Property(nil), t.Properties...)
+		for i, prop := range dev.Properties {
+			if value, ok := values[prop.Name]; ok {
+				dev.Properties[i].Value = value
+			}
+		}
+	}
+}
+
+// render rebuilds all forms from configuration
+func (e *editor) render() {
+	for _, f := range e.funcs {
+		f.Release()
+	}
+	e.funcs = nil
+	e.root.Set("innerHTML", "")
+
+	bar := e.element(e.root, "div", "row", "")
+	save := e.element(bar, "div", "button", "Save and Apply")
+	e.on(save, "click", func(string) { go e.save() })
+	reload := e.element(bar, "div", "button", "Discard Changes")
+	e.on(reload, "click", func(string) { go e.load() })
+	back := e.element(bar, "a", "button", "Dashboard")
+	back.Set("href", "index.html")
+	e.errorBox = e.element(e.root, "div", "error", "")
+
+	for _, sec := range sections {
+		e.renderSection(sec)
+	}
+}
+
+func (e *editor) renderSection(sec section) {
+	e.element(e.root, "h2", "", sec.title)
+	devices := e.devices(sec.class)
+
+	for i := range *devices {
+		i := i
+		dev := &(*devices)[i]
+		panel := e.element(e.root, "div", "panel", "")
+
+		row := e.element(panel, "div", "row", "")
+		e.element(row, "div", "label", "Name")
+		name := e.element(row, "input", "", "")
+		name.Set("value", dev.Name)
+		e.on(name, "change", func(value string) {
+			dev.Name = value
+			e.render()
+		})
+		remove := e.element(row, "div", "button", "Remove")
+		e.on(remove, "click", func(string) {
+			*devices = append((*devices)[:i], (*devices)[i+1:]...)
+			e.render()
+		})
+
+		row = e.element(panel, "div", "row", "")
+		e.element(row, "div", "label", "Type")
+		typeNames := []string{}
+		for _, t := range e.types[sec.class] {
+			typeNames = append(typeNames, t.Type)
+		}
+		devType := e.selectInput(row, typeNames, dev.Type)
+		for _, t := range e.types[sec.class] {
+			if t.Type == dev.Type {
+				e.element(row, "div", "comment", t.Description)
+			}
+		}
+		e.on(devType, "change", func(value string) {
+			e.changeType(sec.class, dev, value)
+			e.render()
+		})
+
+		for j := range dev.Properties {
+			prop := &dev.Properties[j]
+			if prop.Hidden {
+				continue
+			}
+			e.renderProperty(panel, prop)
+		}
+	}
+
+	if len(e.types[sec.class]) == 0 {
+		return
+	}
+	row := e.element(e.root, "div", "row", "")
+	typeNames := []string{}
+	for _, t := range e.types[sec.class] {
+		typeNames = append(typeNames, t.Type)
+	}
+	newType := e.selectInput(row, typeNames, typeNames[0])
+	add := e.element(row, "div", "button", "Add "+sec.class)
+	e.on(add, "click", func(string) {
+		for _, t := range e.types[sec.class] {
+			if t.Type == newType.Get("value").String() {
+				*devices = append(*devices, e.newDevice(sec.class, t))
+			}
+		}
+		e.render()
+	})
+}
+
+// renderProperty creates input for property from its type and select list
+func (e *editor) renderProperty(panel js.Value, prop *api.Property) {
+	row := e.element(panel, "div", "row", "")
+	label := e.element(row, "div", "label", prop.Name)
+	label.Set("title", prop.Comment)
+
+	var input js.Value
+	switch {
+	case len(prop.Select) > 0:
+		input = e.selectInput(row, e.choices(prop.Select), prop.Value)
+	case prop.Type == "bool":
+		input = e.element(row, "input", "", "")
+		input.Set("type", "checkbox")
+		input.Set("checked", prop.Value == "true" || prop.Value == "1")
+	default:
+		input = e.element(row, "input", "", "")
+		if prop.Type == "int" || prop.Type == "uint" || prop.Type == "float" {
+			input.Set("inputMode", "decimal")
+		}
+		input.Set("value", prop.Value)
+	}
+	input.Set("title", prop.Comment)
+	e.on(input, "change", func(value string) {
+		prop.Value = value
+	})
+}
@@ -0,0 +1,422 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"syscall/js"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// dashboard shows one panel per equipment built from the server status.
+// Panels are rebuilt when devices are added or removed in the configuration.
+type dashboard struct {
+	doc       js.Value
+	root      js.Value
+	errorBox  js.Value
+	inventory string
+	funcs     []js.Func
+
+	sensors    map[string][]js.Value
+	actors     map[string][]js.Value
+	overrides  map[string][]js.Value
+	hold       js.Value
+	setpoints  map[string]js.Value
+	heatUps    map[string]js.Value
+	inputs     map[string]js.Value
+	states     map[string]js.Value
+	modes      map[string]js.Value
+	actorState map[string]string
+	actorMode  map[string]string
+	eqState    map[string]string
+	charts     []*chart
+
+	// alarmBox lists current alarms. It is rebuilt when alarmKey changes
+	alarmBox   js.Value
+	alarmKey   string
+	alarmFuncs []js.Func
+}
+
+func newDashboard(id string) *dashboard {
+	doc := js.Global().Get("document")
+	d := dashboard{doc: doc, root: doc.Call("getElementById", id)}
+	if !d.root.Truthy() {
+		d.root = doc.Get("body")
+	}
+	return &d
+}
+
+// refresh reads status from server and updates panels
+func (d *dashboard) refresh() {
+	status, err := getStatus()
+	if err != nil {
+		d.showError(err.Error())
+		return
+	}
+	d.showError("")
+	if key := inventoryKey(status); key != d.inventory {
+		d.build(status)
+		d.inventory = key
+	}
+	d.update(status)
+	for _, c := range d.charts {
+		if c.isLive() {
+			c.load()
+		}
+	}
+}
+
+func (d *dashboard) showError(msg string) {
+	if d.errorBox.Truthy() {
+		d.errorBox.Set("innerText", msg)
+	}
+}
+
+// inventoryKey changes when devices or the devices used by equipment change
+func inventoryKey(status api.Status) string {
+	key := []string{status.Name}
+	for _, sensor := range status.Sensors {
+		key = append(key, "s:"+sensor.Name+sensor.Units)
+	}
+	for _, actor := range status.Actors {
+		key = append(key, "a:"+actor.Name)
+	}
+	for _, eq := range status.Equipment {
+		key = append(key, "e:"+eq.Name, eq.Sensor, eq.Heater, eq.Pump, eq.Agitator, eq.Mode)
+	}
+	return strings.Join(key, "|")
+}
+
+func (d *dashboard) element(parent js.Value, tag string, class string, text string) js.Value {
+	el := d.doc.Call("createElement", tag)
+	if class != "" {
+		el.Set("className", class)
+	}
+	if text != "" {
+		el.Set("innerText", text)
+	}
+	parent.Call("appendChild", el)
+	return el
+}
+
+func (d *dashboard) onClick(el js.Value, handler func()) {
+	d.onEvent(el, "click", handler)
+}
+
+func (d *dashboard) onEvent(el js.Value, event string, handler func()) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		handler()
+		return nil
+	})
+	d.funcs = append(d.funcs, f)
+	el.Call("addEventListener", event, f)
+}
+
+// build creates panels for all equipment and a panel for devices not used by equipment
+func (d *dashboard) build(status api.Status) {
+	for _, f := range d.funcs {
+		f.Release()
+	}
+	d.funcs = nil
+	d.sensors = make(map[string][]js.Value)
+	d.actors = make(map[string][]js.Value)
+	d.overrides = make(map[string][]js.Value)
+	d.setpoints = make(map[string]js.Value)
+	d.heatUps = make(map[string]js.Value)
+	d.inputs = make(map[string]js.Value)
+	d.states = make(map[string]js.Value)
+	d.modes = make(map[string]js.Value)
+	d.actorState = make(map[string]string)
+	d.actorMode = make(map[string]string)
+	d.eqState = make(map[string]string)
+	d.charts = nil
+
+	d.root.Set("innerHTML", "")
+	if status.Name != "" {
+		d.element(d.root, "h1", "title", status.Name)
+	}
+	d.errorBox = d.element(d.root, "div", "error", "")
+	d.alarmBox = d.element(d.root, "div", "alarms", "")
+	d.alarmKey = ""
+	if len(status.Actors) > 0 {
+		d.buildHold()
+	}
+
+	sensors := make(map[string]api.Sensor)
+	for _, sensor := range status.Sensors {
+		sensors[sensor.Name] = sensor
+	}
+	actors := make(map[string]api.Actor)
+	for _, actor := range status.Actors {
+		actors[actor.Name] = actor
+	}
+	used := make(map[string]bool)
+
+	for _, eq := range status.Equipment {
+		panel := d.element(d.root, "div", "panel", "")
+		d.element(panel, "div", "panel-title", eq.Name)
+
+		if _, ok := sensors[eq.Sensor]; ok {
+			row := d.element(panel, "div", "row", "")
+			d.element(row, "div", "label", "Temperature")
+			d.sensors[eq.Sensor] = append(d.sensors[eq.Sensor], d.element(row, "div", "value", "--"))
+			used["s:"+eq.Sensor] = true
+		}
+
+		d.buildSetpoint(panel, eq.Name)
+
+		row := d.element(panel, "div", "row", "")
+		d.element(row, "div", "label", "Heat-up")
+		d.heatUps[eq.Name] = d.element(row, "div", "value", "--")
+
+		row = d.element(panel, "div", "row", "")
+		for _, act := range []struct{ label, name string }{{"Heater", eq.Heater}, {"Pump", eq.Pump}, {"Agitator", eq.Agitator}} {
+			if _, ok := actors[act.name]; ok {
+				d.buildActor(row, act.label, act.name)
+				used["a:"+act.name] = true
+			}
+		}
+
+		row = d.element(panel, "div", "row", "")
+		d.element(row, "div", "label", "Mode")
+		d.modes[eq.Name] = d.element(row, "div", "value", eq.Mode)
+
+		row = d.element(panel, "div", "row", "")
+		d.element(row, "div", "label", "State")
+		name := eq.Name
+		state := d.element(row, "div", "button", "--")
+		d.states[name] = state
+		d.onClick(state, func() {
+			next := "active"
+			if d.eqState[name] == api.EquipmentActive {
+				next = "idle"
+			}
+			sendCommand(d, "setstate/"+url.PathEscape(name)+"/"+next)
+		})
+
+		d.charts = append(d.charts, newChart(d, panel, eq.Name))
+	}
+
+	var other js.Value
+	otherPanel := func() js.Value {
+		if !other.Truthy() {
+			other = d.element(d.root, "div", "panel", "")
+			d.element(other, "div", "panel-title", "Other Devices")
+		}
+		return other
+	}
+	for _, sensor := range status.Sensors {
+		if !used["s:"+sensor.Name] {
+			row := d.element(otherPanel(), "div", "row", "")
+			d.element(row, "div", "label", sensor.Name)
+			d.sensors[sensor.Name] = append(d.sensors[sensor.Name], d.element(row, "div", "value", "--"))
+		}
+	}
+	var row js.Value
+	for _, actor := range status.Actors {
+		if !used["a:"+actor.Name] {
+			if !row.Truthy() {
+				row = d.element(otherPanel(), "div", "row", "")
+			}
+			d.buildActor(row, actor.Name, actor.Name)
+		}
+	}
+}
+
+func (d *dashboard) buildSetpoint(panel js.Value, name string) {
+	row := d.element(panel, "div", "row", "")
+	d.element(row, "div", "label", "Setpoint")
+	d.setpoints[name] = d.element(row, "div", "value", "--")
+
+	input := d.element(row, "input", "setpoint", "")
+	input.Set("type", "number")
+	input.Set("step", "0.5")
+	d.inputs[name] = input
+
+	set := d.element(row, "div", "button", "Set")
+	d.onClick(set, func() {
+		value := input.Get("value").String()
+		if value == "" {
+			return
+		}
+		input.Call("blur")
+		sendCommand(d, "setsetpoint/"+url.PathEscape(name)+"/"+url.PathEscape(value))
+	})
+}
+
+// buildHold creates the select of how long actors switched on the dashboard stay manual
+func (d *dashboard) buildHold() {
+	row := d.element(d.root, "div", "row", "")
+	d.element(row, "div", "label", "Manual hold")
+	d.hold = d.element(row, "select", "hold", "")
+	for _, minutes := range []string{"0", "5", "10", "30", "60"} {
+		text := minutes + " min"
+		if minutes == "0" {
+			text = "until auto"
+		}
+		option := d.element(d.hold, "option", "", text)
+		option.Set("value", minutes)
+	}
+}
+
+// buildActor creates a button switching actor and its mode. Switching an actor puts it in manual mode,
+// clicking the mode of a manual actor returns it to its equipment
+func (d *dashboard) buildActor(parent js.Value, label string, name string) {
+	button := d.element(parent, "div", "actor", label)
+	button.Set("title", name)
+	d.actors[name] = append(d.actors[name], button)
+	d.onClick(button, func() {
+		next := api.StateOn
+		if d.actorState[name] == api.StateOn {
+			next = api.StateOff
+		}
+		path := "setactor/" + url.PathEscape(name) + "/" + next
+		if d.hold.Truthy() {
+			if minutes := d.hold.Get("value").String(); minutes != "0" {
+				path += "?minutes=" + minutes
+			}
+		}
+		sendCommand(d, path)
+	})
+
+	mode := d.element(parent, "div", "override", api.ActorAuto)
+	mode.Set("title", "Click to return manual actor to automatic")
+	d.overrides[name] = append(d.overrides[name], mode)
+	d.onClick(mode, func() {
+		if d.actorMode[name] == api.ActorManual {
+			sendCommand(d, "setactor/"+url.PathEscape(name)+"/AUTO")
+		}
+	})
+}
+
+// overrideText shows mode of actor and minutes left of a timed manual override
+func overrideText(actor api.Actor) string {
+	if actor.Mode != api.ActorManual || actor.Until == 0 {
+		return actor.Mode
+	}
+	left := time.Until(time.Unix(0, actor.Until*int64(time.Millisecond)))
+	return fmt.Sprintf("%s %.0fm", actor.Mode, math.Max(1, math.Ceil(left.Minutes())))
+}
+
+// heatUpText shows time to setpoint and the clock time it is reached, "--" when it is not known
+func heatUpText(heat *api.HeatUp) string {
+	if heat == nil {
+		return "--"
+	}
+	if heat.Seconds == 0 {
+		return heat.Text
+	}
+	return fmt.Sprintf("%s (%s)", heat.Text, time.Unix(0, heat.Ready*int64(time.Millisecond)).Format("15:04"))
+}
+
+// alarmsKey changes when alarms are raised, cleared or acknowledged
+func alarmsKey(alarms []api.Alarm) string {
+	key := []string{}
+	for _, al := range alarms {
+		key = append(key, fmt.Sprintf("%d:%t:%d", al.ID, al.Active, al.Acknowledged))
+	}
+	return strings.Join(key, "|")
+}
+
+// updateAlarms lists current alarms with buttons acknowledging one or all of them
+func (d *dashboard) updateAlarms(alarms []api.Alarm) {
+	key := alarmsKey(alarms)
+	if key == d.alarmKey {
+		return
+	}
+	d.alarmKey = key
+	for _, f := range d.alarmFuncs {
+		f.Release()
+	}
+	d.alarmFuncs = nil
+	d.alarmBox.Set("innerHTML", "")
+
+	ack := func(parent js.Value, text string, path string) {
+		button := d.element(parent, "span", "button", text)
+		f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			sendCommand(d, path)
+			return nil
+		})
+		d.alarmFuncs = append(d.alarmFuncs, f)
+		button.Call("addEventListener", "click", f)
+	}
+	unacknowledged := 0
+	for _, al := range alarms {
+		class := "alarm " + al.Severity
+		if al.Acknowledged != 0 {
+			class += " acknowledged"
+		}
+		row := d.element(d.alarmBox, "div", class, "")
+		d.element(row, "span", "alarm-time", time.Unix(0, al.Raised*int64(time.Millisecond)).Format("15:04"))
+		d.element(row, "span", "alarm-source", al.Source)
+		message := al.Message
+		if !al.Active {
+			message += " (cleared)"
+		}
+		d.element(row, "span", "alarm-message", message)
+		if al.Acknowledged == 0 {
+			unacknowledged++
+			ack(row, "Ack", fmt.Sprintf("alarms/%d/ack", al.ID))
+		}
+	}
+	if unacknowledged > 1 {
+		ack(d.alarmBox, "Ack all", "alarms/ack")
+	}
+}
+
+// update shows current values in existing panels
+func (d *dashboard) update(status api.Status) {
+	d.updateAlarms(status.Alarms)
+
+	for _, sensor := range status.Sensors {
+		text := "--"
+		if sensor.Valid {
+			text = fmt.Sprintf("%.1f%s", sensor.Value, sensor.Units)
+		}
+		for _, el := range d.sensors[sensor.Name] {
+			el.Set("innerText", text)
+		}
+	}
+
+	for _, actor := range status.Actors {
+		d.actorState[actor.Name] = actor.State
+		d.actorMode[actor.Name] = actor.Mode
+		class := "actor off"
+		if actor.State == api.StateOn {
+			class = "actor on"
+		}
+		for _, el := range d.actors[actor.Name] {
+			el.Set("className", class)
+		}
+		for _, el := range d.overrides[actor.Name] {
+			el.Set("innerText", overrideText(actor))
+			el.Set("className", "override "+actor.Mode)
+		}
+	}
+
+	active := d.doc.Get("activeElement")
+	for _, eq := range status.Equipment {
+		d.eqState[eq.Name] = eq.State
+		if el, ok := d.setpoints[eq.Name]; ok {
+			el.Set("innerText", fmt.Sprintf("%.1f", eq.Setpoint))
+		}
+		if input, ok := d.inputs[eq.Name]; ok && !input.Equal(active) {
+			input.Set("value", fmt.Sprintf("%.1f", eq.Setpoint))
+		}
+		if el, ok := d.heatUps[eq.Name]; ok {
+			el.Set("innerText", heatUpText(eq.HeatUp))
+		}
+		if el, ok := d.modes[eq.Name]; ok {
+			el.Set("innerText", eq.Mode)
+		}
+		if el, ok := d.states[eq.Name]; ok {
+			el.Set("innerText", eq.State)
+			el.Set("className", "button "+strings.ToLower(eq.State))
+		}
+	}
+}
@@ -0,0 +1,166 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"syscall/js"
+	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
+)
+
+// maxLogRows is the number of log entries shown before the oldest are removed
+const maxLogRows = 500
+
+// logPanel shows the controller log kept in memory by the server and follows
+// new entries over the /log/stream server-sent events
+type logPanel struct {
+	doc      js.Value
+	root     js.Value
+	list     js.Value
+	level    js.Value
+	device   js.Value
+	errorBox js.Value
+	source   js.Value
+	funcs    []js.Func
+}
+
+func newLogPanel(root js.Value) *logPanel {
+	return &logPanel{doc: js.Global().Get("document"), root: root}
+}
+
+func (p *logPanel) element(parent js.Value, tag string, class string, text string) js.Value {
+	el := p.doc.Call("createElement", tag)
+	if class != "" {
+		el.Set("className", class)
+	}
+	if text != "" {
+		el.Set("innerText", text)
+	}
+	parent.Call("appendChild", el)
+	return el
+}
+
+func (p *logPanel) option(sel js.Value, value string, text string) {
+	opt := p.element(sel, "option", "", text)
+	opt.Set("value", value)
+}
+
+func (p *logPanel) onEvent(el js.Value, event string, handler func(args []js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		handler(args)
+		return nil
+	})
+	p.funcs = append(p.funcs, f)
+	el.Call("addEventListener", event, f)
+}
+
+// build creates the panel with level and device filters. Devices are read from the server status
+func (p *logPanel) build() {
+	panel := p.element(p.root, "div", "panel log-panel", "")
+	p.element(panel, "div", "panel-title", "Log")
+
+	controls := p.element(panel, "div", "row log-controls", "")
+	p.level = p.element(controls, "select", "", "")
+	for _, level := range []string{"debug", "message", "warning", "error"} {
+		p.option(p.level, level, level)
+	}
+	p.level.Set("value", "message")
+
+	p.device = p.element(controls, "select", "", "")
+	p.option(p.device, "", "All devices")
+	if status, err := getStatus(); err == nil {
+		for _, sensor := range status.Sensors {
+			p.option(p.device, sensor.Name, sensor.Name)
+		}
+		for _, actor := range status.Actors {
+			p.option(p.device, actor.Name, actor.Name)
+		}
+		for _, eq := range status.Equipment {
+			p.option(p.device, eq.Name, eq.Name)
+		}
+	}
+
+	clear := p.element(controls, "span", "button", "Clear")
+	p.onEvent(clear, "click", func([]js.Value) { p.list.Set("innerHTML", "") })
+	p.onEvent(p.level, "change", func([]js.Value) { go p.load() })
+	p.onEvent(p.device, "change", func([]js.Value) { go p.load() })
+
+	p.errorBox = p.element(panel, "div", "error", "")
+	p.list = p.element(panel, "div", "log-list", "")
+}
+
+// query returns the filter of /log and /log/stream
+func (p *logPanel) query() url.Values {
+	values := url.Values{}
+	values.Set("level", p.level.Get("value").String())
+	if device := p.device.Get("value").String(); device != "" {
+		values.Set("device", device)
+	}
+	return values
+}
+
+// load shows the last entries matching the filters and starts following new entries
+func (p *logPanel) load() {
+	if !p.list.Truthy() {
+		p.build()
+	}
+	query := p.query()
+	query.Set("max", strconv.Itoa(maxLogRows))
+	body, err := getValueFromServer(apiBase()+"log?"+query.Encode(), "log")
+	if err != nil {
+		p.errorBox.Set("innerText", err.Error())
+		return
+	}
+	page := api.Log{}
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		p.errorBox.Set("innerText", "Log is not available")
+		return
+	}
+	p.errorBox.Set("innerText", "")
+	p.list.Set("innerHTML", "")
+	for _, entry := range page.Entries {
+		p.add(entry)
+	}
+	p.follow(page.Last)
+}
+
+// follow opens the event stream of entries after ID last. The browser reconnects
+// when the server ends the stream and continues after the last event received
+func (p *logPanel) follow(last uint64) {
+	if p.source.Truthy() {
+		p.source.Call("close")
+	}
+	query := p.query()
+	query.Set("after", strconv.FormatUint(last, 10))
+	p.source = js.Global().Get("EventSource").New(apiBase() + "log/stream?" + query.Encode())
+	p.onEvent(p.source, "message", func(args []js.Value) {
+		entry := api.LogEntry{}
+		if err := json.Unmarshal([]byte(args[0].Get("data").String()), &entry); err == nil {
+			p.add(entry)
+		}
+	})
+}
+
+// add appends entry to the list, scrolling down when the newest entry was visible
+func (p *logPanel) add(entry api.LogEntry) {
+	atEnd := p.list.Get("scrollTop").Int()+p.list.Get("clientHeight").Int() >= p.list.Get("scrollHeight").Int()-4
+
+	row := p.element(p.list, "div", "log-entry "+entry.Level, "")
+	p.element(row, "span", "log-time", time.Unix(0, entry.Time*int64(time.Millisecond)).Format("15:04:05"))
+	p.element(row, "span", "log-level", entry.Level)
+	if entry.Device != "" {
+		p.element(row, "span", "log-device", entry.Device)
+	}
+	p.element(row, "span", "log-message", entry.Message)
+
+	for p.list.Get("childElementCount").Int() > maxLogRows {
+		p.list.Call("removeChild", p.list.Get("firstChild"))
+	}
+	if atEnd {
+		p.list.Set("scrollTop", p.list.Get("scrollHeight"))
+	}
+}
@@ -1,3 +1,5 @@
+//go:build js && wasm
+
 package main
 
 import (
@@ -5,12 +7,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"strings"
 	"syscall/js"
 	"time"
+
+	"github.com/gigatropolis/brewbrat/controller/www/api"
 )
 
-// GOOS=js GOARCH=wasm go build -o ../../assets/json.wasm
+// Built to ../../assets/json.wasm by running "go generate" in the www directory
 
 type WebError struct {
 	err string
@@ -20,12 +24,36 @@ func (w WebError) Error() string {
 	return w.err
 }
 
+// apiBase returns URL of the server that served the page, i.e. "https://brewpi.local:8090/"
+func apiBase() string {
+	location := js.Global().Get("location")
+	path := location.Get("pathname").String()
+	path = path[:strings.LastIndex(path, "/")+1]
+	return location.Get("origin").String() + path
+}
+
+// checkLogin sends browser to login page when server requires authentication
+func checkLogin(resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		js.Global().Get("location").Set("href", "login.html")
+		return WebError{"Login required"}
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return WebError{"Not allowed for user"}
+	}
+	return nil
+}
+
 func getValueFromServer(request string, name string) (string, error) {
 	resp, err := http.Get(request)
 	if err != nil {
 		fmt.Printf("Sensor:%s GET error:%s\n", name, err.Error())
 		return "", WebError{"Unable send GET request"}
 	}
+	if err := checkLogin(resp); err != nil {
+		resp.Body.Close()
+		return "", err
+	}
 
 	body, err2 := ioutil.ReadAll(resp.Body)
 	if err2 != nil {
@@ -79,221 +107,55 @@ func jsonWrapper() js.Func {
 	return jsonfunc
 }
 
-func postActor(name string, action string) error {
-	vals := url.Values{"Name": {name}, "Action": {action}}
-	s := fmt.Sprintf("http://127.0.0.1:8090/setactor/%s/%s", vals["Name"][0], vals["Action"][0])
-
-	jsDoc := js.Global().Get("document")
-	if !jsDoc.Truthy() {
-		return WebError{"Unable to get document object"}
-	}
-
-	actor := jsDoc.Call("getElementById", name)
-	if !actor.Truthy() {
-		return WebError{"Unable to find relay id " + name}
-	}
-
+// sendCommand sends request to server and refreshes dashboard with reply
+func sendCommand(d *dashboard, path string) {
 	go func() {
-		resp, err := http.PostForm(s, vals)
+		resp, err := http.Post(apiBase()+path, "text/plain", nil)
 		if err != nil {
-			fmt.Printf("Relay:%s POST error:%s\n", vals["Name"][0], err.Error())
+			fmt.Printf("%s POST error:%s\n", path, err.Error())
 			return
 		}
-
-		body, err2 := ioutil.ReadAll(resp.Body)
-		if err2 != nil {
-			fmt.Printf("Relay:%s Read error:%s\n", vals["Name"][0], err2.Error())
-		}
-
 		defer resp.Body.Close()
-
-		sBody := string(body)
-		if sBody == "ON" {
-			fmt.Printf("Status=%s\n", sBody)
-			actor.Call("setAttribute", "style", "background:red;")
-			if !actor.Truthy() {
-				fmt.Printf("unable to set style background-color %s\n", name)
-			}
-		} else if sBody == "OFF" {
-			fmt.Printf("Status=%s\n", sBody)
-			actor.Call("setAttribute", "style", "background:black;")
-			if !actor.Truthy() {
-				fmt.Printf("unable to set style background-color %s\n", name)
-			}
-		} else {
-			fmt.Printf("Unknown response = %s\n", sBody)
-		}
-
-	}()
-
-	return nil
-
-}
-func postActorWapper() js.Func {
-	actorFunc := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		if len(args) != 2 {
-			return "Invalid no of arguments passed"
-		}
-		inputActorName := args[0].String()
-		inputActorAction := args[1].String()
-		fmt.Printf("input %s\n", inputActorName)
-		err := postActor(inputActorName, inputActorAction)
-		if err != nil {
-			errStr := fmt.Sprintf("unable to Post  Actor Value. Error %s occurred\n", err)
-			return errStr
-		}
-		return nil
-	})
-
-	return actorFunc
-}
-
-func onSetpointUpdate(name string) error {
-
-	//fmt.Printf("onSetpointUpdate %s\n", name)
-	request := fmt.Sprintf("http://127.0.0.1:8090/getsetpoint/%s", name)
-
-	jsDoc := js.Global().Get("document")
-	if !jsDoc.Truthy() {
-		return WebError{"Unable to get document object"}
-	}
-
-	sensor := jsDoc.Call("getElementById", name)
-	if !sensor.Truthy() {
-		return WebError{"Unable to find sensor id " + name}
-	}
-
-	go func() {
-		value, err := getValueFromServer(request, name)
-		if err != nil {
-			fmt.Printf("Unable to get document object")
+		if err := checkLogin(resp); err != nil {
+			d.showError(err.Error())
 			return
 		}
-		sensor.Set("innerText", value)
-
+		d.refresh()
 	}()
-
-	return nil
-
 }
 
-func onSensorUpdate(name string) error {
-
-	//fmt.Printf("onSensorUpdate %s\n", name)
-	request := fmt.Sprintf("http://127.0.0.1:8090/getsensor/%s", name)
-
-	jsDoc := js.Global().Get("document")
-	if !jsDoc.Truthy() {
-		return WebError{"Unable to get document object"}
+// getStatus reads inventory and current values of all devices from server
+func getStatus() (api.Status, error) {
+	status := api.Status{}
+	body, err := getValueFromServer(apiBase()+"status", "status")
+	if err != nil {
+		return status, err
 	}
-
-	sensor := jsDoc.Call("getElementById", name)
-	if !sensor.Truthy() {
-		return WebError{"Unable to find sensor id " + name}
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		return status, WebError{"Unable to read status: " + err.Error()}
 	}
-
-	go func() {
-		value, err := getValueFromServer(request, name)
-		if err != nil {
-			fmt.Printf("Unable to get document object")
-			return
-		}
-		sensor.Set("innerText", value)
-	}()
-
-	return nil
-
+	return status, nil
 }
 
-func onActorUpdate(name string) error {
-
-	//fmt.Printf("onActorUpdate %s\n", name)
-	s := fmt.Sprintf("http://127.0.0.1:8090/getactor/%s", name)
+func main() {
+	fmt.Println("Go Web Assembly")
+	js.Global().Set("formatJSON", jsonWrapper())
 
-	jsDoc := js.Global().Get("document")
-	if !jsDoc.Truthy() {
-		return WebError{"Unable to get document object"}
+	if root := js.Global().Get("document").Call("getElementById", "config"); root.Truthy() {
+		newEditor(root).load()
+		select {}
 	}
 
-	actor := jsDoc.Call("getElementById", name)
-	if !actor.Truthy() {
-		fmt.Printf("getElementById::%s ERROR \n", name)
-		return WebError{"relay:" + name + " getElementById error\n"}
-	}
+	d := newDashboard("dashboard")
+	d.refresh()
 
-	go func() {
-		resp, err := http.Get(s)
-		if err != nil {
-			fmt.Printf("relay:%s GET error:%s\n", name, err.Error())
-			return
-		}
-
-		body, err2 := ioutil.ReadAll(resp.Body)
-		if err2 != nil {
-			fmt.Printf("Relay:%s Read error:%s\n", name, err2.Error())
-			return
-		}
-
-		defer resp.Body.Close()
-
-		sBody := string(body)
-		actor.Set("innerText", sBody)
-
-		if sBody == "ON" {
-			//fmt.Printf("Status=%s\n", sBody)
-			actor.Call("setAttribute", "style", "background:red;")
-			if !actor.Truthy() {
-				fmt.Printf("unable to set style background-color %s\n", name)
-			}
-		} else if sBody == "OFF" {
-			//fmt.Printf("Status=%s\n", sBody)
-			actor.Call("setAttribute", "style", "background:black;")
-			if !actor.Truthy() {
-				fmt.Printf("unable to set style background-color %s\n", name)
-			}
-		} else {
-			fmt.Printf("'%s' Can't determine Actor status. Recieved: %s\n", name, sBody)
-			actor.Call("setAttribute", "style", "background:grey;")
-		}
-
-	}()
-
-	return nil
-
-}
-
-func main() {
-	fmt.Println("Go Web Assembly")
-	js.Global().Set("formatJSON", jsonWrapper())
-	js.Global().Set("UpdateRelayValue", postActorWapper())
-	//js.Global().Set("postSensorUpdate", postSensorUpdateWapper())
-	sensors := []string{"Temp Sensor 1", "Temp Sensor 2", "Temp Sensor 3"}
-	setpoints := []string{"Dummy Equipment 1"}
-	actors := []string{"Relay 1", "Relay 2", "SSR 1"}
+	if root := js.Global().Get("document").Call("getElementById", "log"); root.Truthy() {
+		go newLogPanel(root).load()
+	}
 
-	//<-make(chan bool)
 	t := time.NewTicker(5000 * time.Millisecond)
-
 	for true {
 		<-t.C
-		for _, sensor := range sensors {
-			err := onSensorUpdate(sensor)
-			if err != nil {
-				fmt.Printf("sensor read error: %s\n", err.Error())
-			}
-		}
-		for _, setpoint := range setpoints {
-			err := onSetpointUpdate(setpoint)
-			if err != nil {
-				fmt.Printf("Setpoint read error: %s\n", err.Error())
-			}
-		}
-		for _, actor := range actors {
-			err := onActorUpdate(actor)
-			if err != nil {
-				fmt.Printf("actor read error: %s\n", err.Error())
-			}
-			time.Sleep(200 * time.Millisecond)
-		}
+		d.refresh()
 	}
 }
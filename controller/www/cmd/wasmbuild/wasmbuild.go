@@ -0,0 +1,50 @@
+package main
+
+// wasmbuild compiles the web UI client to assets/json.wasm and copies the matching
+// wasm_exec.js from the Go installation. Run from the www directory by "go generate".
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const assetDir = "assets"
+
+func main() {
+	if err := copyWasmExec(); err != nil {
+		fmt.Printf("unable to copy wasm_exec.js: %s\n", err)
+		os.Exit(1)
+	}
+
+	cmd := exec.Command("go", "build", "-o", filepath.Join(assetDir, "json.wasm"), "./cmd/wasm")
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("unable to build json.wasm: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("built", filepath.Join(assetDir, "json.wasm"))
+}
+
+// copyWasmExec copies wasm_exec.js of the Go version used to build json.wasm
+func copyWasmExec() error {
+	out, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		return err
+	}
+	goRoot := strings.TrimSpace(string(out))
+
+	// moved from misc/wasm to lib/wasm in Go 1.24
+	for _, dir := range []string{"lib", "misc"} {
+		buf, err := ioutil.ReadFile(filepath.Join(goRoot, dir, "wasm", "wasm_exec.js"))
+		if err == nil {
+			return ioutil.WriteFile(filepath.Join(assetDir, "wasm_exec.js"), buf, 0644)
+		}
+	}
+	return fmt.Errorf("wasm_exec.js not found in %s", goRoot)
+}
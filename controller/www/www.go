@@ -0,0 +1,26 @@
+// Package www holds the web UI served by the controller.
+// Files in assets are embedded into the controller binary.
+// Run "go generate" in this directory to rebuild json.wasm and wasm_exec.js before building the controller.
+// json.wasm is not committed; the build fails until it was generated.
+package www
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:generate go run ./cmd/wasmbuild
+
+// json.wasm is named so a build without it fails instead of serving a dashboard without its client
+//
+//go:embed assets assets/json.wasm
+var assets embed.FS
+
+// Assets returns embedded web UI files. Paths are relative to the assets directory, i.e. "index.html"
+func Assets() fs.FS {
+	sub, err := fs.Sub(assets, "assets")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -0,0 +1,69 @@
+// Package beerxml reads the parts of a BeerXML 2.0 database the slackbot answers questions about.
+// It replaces github.com/gigatropolis/beercnv, which was never published as a module
+package beerxml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// BeerXML2 holds the recipes and ingredients of a BeerXML 2.0 document
+type BeerXML2 struct {
+	XMLName      xml.Name      `xml:"beer_xml"`
+	Version      string        `xml:"version"`
+	Recipes      []Recipe      `xml:"recipes>recipe"`
+	HopVarieties []Hop         `xml:"hop_varieties>hop"`
+	Fermentables []Fermentable `xml:"fermentables>fermentable"`
+	Miscs        []Misc        `xml:"miscellaneous_ingredients>misc"`
+	Cultures     []Culture     `xml:"cultures>culture"`
+	Styles       []Style       `xml:"styles>style"`
+}
+
+// Recipe is a beer recipe
+type Recipe struct {
+	Name   string `xml:"name"`
+	Type   string `xml:"type"`
+	Author string `xml:"author"`
+}
+
+// Hop is a hop variety. AlphaAcidUnits is the alpha acid in percent
+type Hop struct {
+	Name           string  `xml:"name"`
+	Origin         string  `xml:"origin"`
+	AlphaAcidUnits float64 `xml:"alpha_acid_units"`
+}
+
+// Fermentable is a grain, extract or sugar
+type Fermentable struct {
+	Name   string `xml:"name"`
+	Type   string `xml:"type"`
+	Origin string `xml:"origin"`
+}
+
+// Misc is a miscellaneous ingredient such as a spice or fining
+type Misc struct {
+	Name string `xml:"name"`
+	Type string `xml:"type"`
+}
+
+// Culture is a yeast or bacteria strain. Attenuation is in percent
+type Culture struct {
+	Name        string  `xml:"name"`
+	Type        string  `xml:"type"`
+	Attenuation float64 `xml:"attenuation"`
+}
+
+// Style is a beer style
+type Style struct {
+	Name     string `xml:"name"`
+	Category string `xml:"category"`
+}
+
+// NewBeerXML2 reads a BeerXML 2.0 document
+func NewBeerXML2(r io.Reader) (*BeerXML2, error) {
+	data := &BeerXML2{}
+	if err := xml.NewDecoder(r).Decode(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -8,9 +8,9 @@ import (
 	"os"
 	"strings"
 
-	"./ingredients"
+	"github.com/gigatropolis/brewbrat/slackbot/ingredients"
 
-	"./calc"
+	"github.com/gigatropolis/brewbrat/slackbot/calc"
 	"github.com/nlopes/slack"
 )
 
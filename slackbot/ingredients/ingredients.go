@@ -1,7 +1,7 @@
 package ingredients
 
 import (
-	"github.com/gigatropolis/beercnv"
+	"github.com/gigatropolis/brewbrat/slackbot/beerxml"
 
 	"fmt"
 	"os"
@@ -14,18 +14,18 @@ import (
 )
 
 var (
-	data *beercnv.BeerXML2
+	data *beerxml.BeerXML2
 )
 
 // $.map($('.recipe-link'), m=>m.href).forEach(recipe=>{window.open(`${recipe}.xml`, '_blank')})
 
 // Init inits
 func Init() {
-	data = &beercnv.BeerXML2{}
+	data = &beerxml.BeerXML2{}
 }
 
 // GetBeerXMLFromFile takes a filename as string that has all beer related data in BeerXML 2.0 format
-func GetBeerXMLFromFile(fileName string) (*beercnv.BeerXML2, error) {
+func GetBeerXMLFromFile(fileName string) (*beerxml.BeerXML2, error) {
 	//allXML := beercnv.BeerXML{}
 	//beer2 := beercnv.BeerXml2{}
 	//path := "../recipes/public"
@@ -50,7 +50,7 @@ func GetBeerXMLFromFile(fileName string) (*beercnv.BeerXML2, error) {
 
 	fmt.Printf("Reading in recipe database...\n\n")
 
-	data, err = beercnv.NewBeerXML2(xmlFile)
+	data, err = beerxml.NewBeerXML2(xmlFile)
 
 	if err != nil {
 		fmt.Printf("no xml object from %s", outName2)